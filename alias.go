@@ -0,0 +1,71 @@
+package rtmp
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// playAlias 预先编译的PlayAlias正则规则
+type playAlias struct {
+	re     *regexp.Regexp
+	target string
+}
+
+// playAliases 加载配置时按key排序编译好的PlayAlias
+var playAliases atomic.Pointer[[]playAlias]
+
+// loadPlayAliases 加载配置时编译PlayAlias，无效的正则表达式只告警并忽略（仍可精确匹配）
+func (c *RTMPConfig) loadPlayAliases() {
+	patterns := make([]string, 0, len(c.PlayAlias))
+	for pattern := range c.PlayAlias {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	aliases := make([]playAlias, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			RTMPPlugin.Warn("invalid play alias", zap.String("pattern", pattern), zap.Error(err))
+			continue
+		}
+		aliases = append(aliases, playAlias{re, c.PlayAlias[pattern]})
+	}
+	playAliases.Store(&aliases)
+}
+
+// resolveAlias 按照PlayAlias将播放的streamPath（不含参数）转换成实际的streamPath，没有匹配时原样返回。
+// 精确匹配优先，其次按key的顺序以正则表达式完整匹配，value中可以用$1等引用分组
+func resolveAlias(streamPath string) string {
+	if target, ok := conf.PlayAlias[streamPath]; ok {
+		return target
+	}
+	if aliases := playAliases.Load(); aliases != nil {
+		for _, alias := range *aliases {
+			if alias.re.MatchString(streamPath) {
+				return alias.re.ReplaceAllString(streamPath, alias.target)
+			}
+		}
+	}
+	return streamPath
+}
+
+// aliasStreamPath 转换带参数的播放streamPath，订阅者直接订阅实际的流，不会产生新的流
+func aliasStreamPath(streamPath string) string {
+	if len(conf.PlayAlias) == 0 {
+		return streamPath
+	}
+	name, query, hasQuery := strings.Cut(streamPath, "?")
+	target := resolveAlias(name)
+	if target == name {
+		return streamPath
+	}
+	RTMPPlugin.Debug("play alias", zap.String("alias", name), zap.String("streamPath", target))
+	if hasQuery {
+		target += "?" + query
+	}
+	return target
+}
@@ -0,0 +1,64 @@
+package rtmp
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// AuditEntry 审计日志中的一条命令记录
+type AuditEntry struct {
+	Time     time.Time
+	Session  string // 客户端远端地址
+	AppName  string `json:",omitempty"`
+	Command  string
+	StreamID uint32 `json:",omitempty"`
+	Args     any    `json:",omitempty"` // 解码后的命令
+	Outcome  string // 回复的状态码或者错误信息
+}
+
+var auditLog struct {
+	sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// openAuditLog 以追加方式打开审计日志文件，每行一条JSON记录，便于接入SIEM等系统
+func openAuditLog(path string) {
+	if path == "" {
+		return
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		RTMPPlugin.Error("open audit log", zap.String("path", path), zap.Error(err))
+		return
+	}
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	auditLog.file = file
+	auditLog.encoder = json.NewEncoder(file)
+}
+
+// audit 记录connect、publish、play、deleteStream等命令及其结果
+func (nc *NetConnection) audit(command string, streamID uint32, args any, outcome string) {
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	if auditLog.encoder == nil {
+		return
+	}
+	entry := AuditEntry{
+		Time:     time.Now(),
+		Session:  nc.RemoteAddr().String(),
+		AppName:  nc.appName,
+		Command:  command,
+		StreamID: streamID,
+		Args:     args,
+		Outcome:  outcome,
+	}
+	if err := auditLog.encoder.Encode(entry); err != nil {
+		RTMPPlugin.Error("write audit log", zap.Error(err))
+	}
+}
@@ -0,0 +1,153 @@
+package rtmp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 签名地址鉴权：推流（以及开启播放鉴权时的播放）地址需要带上exp（过期时间，unix秒）、nonce（随机字符串）和sign参数，
+// sign为以应用的AppAuthSecret（没有时为AuthSecret）为密钥对"streamPath|exp|nonce"计算的HMAC-SHA256（十六进制），streamPath不含参数。
+// 同一个nonce在有效期内只能使用一次，防止截获的地址被重放
+var seenNonces struct {
+	sync.Mutex
+	m map[string]time.Time // nonce -> 过期时间
+}
+
+// authSecret 应用使用的签名密钥，为空时不校验
+func authSecret(appName string) string {
+	if secret, ok := conf.AppAuthSecret[appName]; ok {
+		return secret
+	}
+	return conf.AuthSecret
+}
+
+// authPlay 应用的播放地址是否需要签名
+func authPlay(appName string) bool {
+	if play, ok := conf.AppAuthPlay[appName]; ok {
+		return play
+	}
+	return conf.AuthPlay
+}
+
+// Sign 以streamPath所属应用的密钥计算签名
+func Sign(streamPath string, exp int64, nonce string) string {
+	appName, _, _ := strings.Cut(streamPath, "/")
+	mac := hmac.New(sha256.New, []byte(authSecret(appName)))
+	mac.Write([]byte(streamPath + "|" + strconv.FormatInt(exp, 10) + "|" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkAuth 校验推拉流地址中的签名，应用没有签名密钥时不校验，推流时先校验推流密钥再校验一次性令牌，令牌在发布成功之后才作废
+func checkAuth(fullPath string, publish bool) error {
+	if publish {
+		// 推流密钥不对时不触碰令牌，避免没有密钥的请求作废合法的令牌
+		if err := checkPublishKey(fullPath); err != nil {
+			return err
+		}
+		if err := checkPublishToken(fullPath); err != nil {
+			return err
+		}
+	}
+	streamPath, rawQuery, _ := strings.Cut(fullPath, "?")
+	appName, _, _ := strings.Cut(streamPath, "/")
+	if !publish && !authPlay(appName) || authSecret(appName) == "" {
+		return nil
+	}
+	args, _ := url.ParseQuery(rawQuery)
+	exp, err := strconv.ParseInt(args.Get("exp"), 10, 64)
+	if err != nil {
+		return errors.New("missing exp")
+	}
+	expire := time.Unix(exp, 0)
+	if time.Now().After(expire) {
+		return errors.New("url expired")
+	}
+	nonce := args.Get("nonce")
+	if nonce == "" {
+		return errors.New("missing nonce")
+	}
+	if !hmac.Equal([]byte(args.Get("sign")), []byte(Sign(streamPath, exp, nonce))) {
+		return errors.New("invalid sign")
+	}
+	seenNonces.Lock()
+	defer seenNonces.Unlock()
+	if _, ok := seenNonces.m[nonce]; ok {
+		return errors.New("nonce replayed")
+	}
+	return nil
+}
+
+// consumeNonce 推拉流成功之后记录签名地址中的nonce，同时进行的请求已经使用该nonce时返回错误
+func consumeNonce(fullPath string, publish bool) error {
+	streamPath, rawQuery, _ := strings.Cut(fullPath, "?")
+	appName, _, _ := strings.Cut(streamPath, "/")
+	if !publish && !authPlay(appName) || authSecret(appName) == "" {
+		return nil
+	}
+	args, _ := url.ParseQuery(rawQuery)
+	exp, _ := strconv.ParseInt(args.Get("exp"), 10, 64)
+	nonce := args.Get("nonce")
+	seenNonces.Lock()
+	defer seenNonces.Unlock()
+	if seenNonces.m == nil {
+		seenNonces.m = make(map[string]time.Time)
+	}
+	if _, ok := seenNonces.m[nonce]; ok {
+		return errors.New("nonce replayed")
+	}
+	seenNonces.m[nonce] = time.Unix(exp, 0)
+	return nil
+}
+
+// runNonceSweep 定时清理已经过期的nonce，过期的地址本身会被拒绝，不需要再记录
+func runNonceSweep() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		seenNonces.Lock()
+		for n, e := range seenNonces.m {
+			if now.After(e) {
+				delete(seenNonces.m, n)
+			}
+		}
+		seenNonces.Unlock()
+	}
+}
+
+// maxSignTTL 签名地址的最长有效期，nonce在有效期内一直保存
+const maxSignTTL = time.Hour * 24
+
+// API_sign 生成签名参数，用于测试或者由业务服务器代理调用
+func (*RTMPConfig) API_sign(rw http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	streamPath := q.Get("streamPath")
+	appName, _, _ := strings.Cut(streamPath, "/")
+	if streamPath == "" || authSecret(appName) == "" {
+		http.Error(rw, "streamPath required and authsecret must be configured", http.StatusBadRequest)
+		return
+	}
+	ttl, err := time.ParseDuration(q.Get("ttl"))
+	if err != nil || ttl <= 0 {
+		ttl = time.Minute * 5
+	} else if ttl > maxSignTTL {
+		ttl = maxSignTTL
+	}
+	exp := time.Now().Add(ttl).Unix()
+	b := make([]byte, 8)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+	args := url.Values{}
+	args.Set("exp", strconv.FormatInt(exp, 10))
+	args.Set("nonce", nonce)
+	args.Set("sign", Sign(streamPath, exp, nonce))
+	rw.Write([]byte(args.Encode()))
+}
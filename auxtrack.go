@@ -0,0 +1,68 @@
+package rtmp
+
+import (
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// parseAuxVideo 从onMetaData的videoTrackIdInfoMap中找出透明通道等辅助视频层的trackId，
+// 以trackId为key，轨道信息中alpha或auxiliary为true的轨道是辅助视频层，例如 "videoTrackIdInfoMap": {"1": {"alpha": true}}
+func parseAuxVideo(values []any) (aux map[byte]bool) {
+	for _, v := range values {
+		m, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+		infoMap, ok := m["videoTrackIdInfoMap"].(map[string]any)
+		if !ok {
+			continue
+		}
+		for id, v := range infoMap {
+			info, ok := v.(map[string]any)
+			if !ok {
+				continue
+			}
+			trackID, err := strconv.ParseUint(id, 10, 8)
+			if err != nil || trackID == 0 {
+				continue
+			}
+			alpha, _ := info["alpha"].(bool)
+			auxiliary, _ := info["auxiliary"].(bool)
+			if alpha || auxiliary {
+				if aux == nil {
+					aux = make(map[byte]bool)
+				}
+				aux[byte(trackID)] = true
+			}
+		}
+	}
+	return
+}
+
+// receiveAuxVideo 根据onMetaData更新辅助视频层，之后的序列头和帧转发给支持多轨道的播放者
+func (r *RTMPReceiver) receiveAuxVideo(values []any) {
+	aux := parseAuxVideo(values)
+	r.mtLock.Lock()
+	defer r.mtLock.Unlock()
+	if len(aux) == len(r.auxVideo) {
+		same := true
+		for id := range aux {
+			same = same && r.auxVideo[id]
+		}
+		if same {
+			return
+		}
+	}
+	r.auxVideo = aux
+	ids := make([]int, 0, len(aux))
+	for id := range aux {
+		ids = append(ids, int(id))
+	}
+	r.Info("auxiliary video tracks", zap.Ints("trackIds", ids))
+}
+
+// acceptTrack sink是否接收trackId为id的视频，调用时持有mtLock
+func (r *RTMPReceiver) acceptTrack(sink *multitrackSink, id byte) bool {
+	return id == 0 || sink.extra || sink.aux && r.auxVideo[id]
+}
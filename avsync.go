@@ -0,0 +1,103 @@
+package rtmp
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"m7s.live/engine/v4/util"
+)
+
+// syncState 读取协程更新的音视频同步状态，rtmp/api/sync和播放者在其他协程中读取
+type syncState struct {
+	lastAudioTimestamp atomic.Uint32
+	lastVideoTimestamp atomic.Uint32
+	audioOffset        atomic.Uint32
+	syncSkew           atomic.Int64 // 音频时间戳减去视频时间戳（毫秒），音视频都收到之后才更新
+	lastKeyFrameNano   atomic.Int64 // 收到最近一个关键帧时的墙上时间，0代表还没有收到
+	hasAudioSeqHead    atomic.Bool
+	hasVideoSeqHead    atomic.Bool
+
+	monitorStats atomic.Pointer[PublisherStats] // rtmp/api/stats读取的监控状态快照，不包括StreamPath
+}
+
+// storeSync 在读取协程中把AVMonitor的状态同步到syncState，同时保存码率和GOP监控的快照
+func (r *RTMPReceiver) storeSync() {
+	m := &r.AVMonitor
+	r.lastAudioTimestamp.Store(m.LastAudioTimestamp)
+	r.lastVideoTimestamp.Store(m.LastVideoTimestamp)
+	r.audioOffset.Store(m.AudioOffset)
+	if m.hasAudio && m.hasVideo {
+		r.syncSkew.Store(int64(m.LastAudioTimestamp) - int64(m.LastVideoTimestamp))
+	}
+	r.hasAudioSeqHead.Store(m.AudioSeqHead)
+	r.hasVideoSeqHead.Store(m.VideoSeqHead)
+	r.monitorStats.Store(&PublisherStats{AVMonitor: *m, BitrateMonitor: r.BitrateMonitor, GOPMonitor: r.GOPMonitor})
+}
+
+// PlayerSync 播放会话发送的进度
+type PlayerSync struct {
+	ID            string
+	LastTimestamp uint32        // 最后发送的时间戳
+	Behind        time.Duration // 落后于发布者最新时间戳的时长
+}
+
+// SyncReport 发布者的音视频同步情况，用于判断同步问题出在推流端还是播放端
+type SyncReport struct {
+	StreamPath         string
+	LastAudioTimestamp uint32
+	LastVideoTimestamp uint32
+	Skew               time.Duration // 音频时间戳减去视频时间戳
+	AudioOffset        uint32        // 已修正的音频时间戳偏移量
+	KeyFrameAge        time.Duration // 距离收到最近一个关键帧的时长，-1代表还没有收到
+	AudioSeqHead       bool          // 已经收到音频序列头，不需要序列头的编码收到音频即为true
+	VideoSeqHead       bool          // 已经收到视频序列头，不需要序列头的编码收到视频即为true
+	Players            []PlayerSync
+}
+
+func syncReports(streamPath string) (list []SyncReport) {
+	for _, s := range filterStreams() {
+		if streamPath != "" && s.Path != streamPath {
+			continue
+		}
+		p, ok := s.Publisher.(IRTMPReceiver)
+		if !ok {
+			continue
+		}
+		receiver := p.GetReceiver()
+		report := SyncReport{
+			StreamPath:         s.Path,
+			LastAudioTimestamp: receiver.lastAudioTimestamp.Load(),
+			LastVideoTimestamp: receiver.lastVideoTimestamp.Load(),
+			Skew:               time.Duration(receiver.syncSkew.Load()) * time.Millisecond,
+			AudioOffset:        receiver.audioOffset.Load(),
+			KeyFrameAge:        -1,
+			AudioSeqHead:       receiver.hasAudioSeqHead.Load(),
+			VideoSeqHead:       receiver.hasVideoSeqHead.Load(),
+		}
+		if nano := receiver.lastKeyFrameNano.Load(); nano != 0 {
+			report.KeyFrameAge = time.Since(time.Unix(0, nano))
+		}
+		subscribers.Range(func(key, value any) bool {
+			if sub := value.(*RTMPSubscriber); sub.Stream == s {
+				lastAbsTime := atomic.LoadUint32(&sub.lastAbsTime)
+				report.Players = append(report.Players, PlayerSync{
+					ID:            sub.ID,
+					LastTimestamp: lastAbsTime,
+					Behind:        time.Duration(int64(receiver.StreamTime())-int64(lastAbsTime-atomic.LoadUint32(&sub.timestampOffset))) * time.Millisecond,
+				})
+			}
+			return true
+		})
+		list = append(list, report)
+	}
+	return
+}
+
+// API_sync 获取rtmp发布者的音视频时间戳偏差、关键帧间隔时长、序列头以及各播放会话的进度
+func (*RTMPConfig) API_sync(w http.ResponseWriter, r *http.Request) {
+	streamPath := r.URL.Query().Get("streamPath")
+	util.ReturnJson(func() []SyncReport {
+		return syncReports(streamPath)
+	}, time.Second, w, r)
+}
@@ -0,0 +1,79 @@
+package rtmp
+
+import (
+	"m7s.live/engine/v4"
+	"m7s.live/engine/v4/codec"
+)
+
+// backfillState 推流在流的中途开始时，保证远端先收到onMetaData、序列头和关键帧，再收到其他音视频数据，避免被远端拒绝
+type backfillState struct {
+	backfillEnabled bool
+	metaSent        bool
+	audioHeadSent   bool
+	videoHeadSent   bool
+	keyFrameSent    bool
+}
+
+func (b *backfillState) resetBackfill() {
+	*b = backfillState{backfillEnabled: conf.PushBackfill}
+}
+
+// cacheAudioHead 缓存音频序列头，用于中途开始的推流补发
+func (c *keyFrameCache) cacheAudioHead(msg *Chunk) {
+	r := msg.AVData.NewReader()
+	b0, _ := r.ReadByte()
+	if b1, _ := r.ReadByte(); hasAudioPacketType(codec.AudioCodecID(b0>>4)) && b1 == 0 {
+		seqHead := msg.AVData.ToBytes()
+		c.audioSeqHead.Store(&seqHead)
+	}
+}
+
+// backfill 在发送音视频数据之前补发缺少的onMetaData和序列头，返回false代表该帧不发送
+func (rtmp *RTMPSender) backfill(isVideo bool, iframe bool) bool {
+	if !rtmp.backfillEnabled {
+		return true
+	}
+	var receiver *RTMPReceiver
+	if p, ok := rtmp.Stream.Publisher.(IRTMPReceiver); ok {
+		receiver = p.GetReceiver()
+	}
+	if receiver != nil {
+		if !rtmp.videoHeadSent {
+			if snapshot := receiver.snapshot.Load(); snapshot != nil && snapshot.SequenceHead != nil {
+				rtmp.video.sendSequenceHead(snapshot.SequenceHead)
+				rtmp.videoHeadSent = true
+			}
+		}
+		if !rtmp.audioHeadSent {
+			if seqHead := receiver.audioSeqHead.Load(); seqHead != nil {
+				rtmp.audio.sendSequenceHead(*seqHead)
+				rtmp.audioHeadSent = true
+			}
+		}
+	}
+	// 已经转发了发布者的onMetaData则不需要补发
+	if !rtmp.metaSent && rtmp.sentMetaVersion.Load() == 0 {
+		rtmp.metaSent = true
+		meta := map[string]any{"encoder": "monibuca/" + engine.Engine.Version}
+		if receiver != nil {
+			if snapshot := receiver.snapshot.Load(); snapshot != nil && len(snapshot.SequenceHead) > 0 {
+				meta["videocodecid"] = snapshot.SequenceHead[0] & 0x0f
+			}
+			if seqHead := receiver.audioSeqHead.Load(); seqHead != nil && len(*seqHead) > 0 {
+				meta["audiocodecid"] = (*seqHead)[0] >> 4
+			}
+		}
+		rtmp.sendDataMessage("@setDataFrame", "onMetaData", meta)
+	}
+	hasVideo := rtmp.videoHeadSent || receiver != nil && receiver.hasVideoSeqHead.Load()
+	if isVideo {
+		// 非rtmp发布者没有缓存的序列头，只能依赖引擎发送
+		if !rtmp.videoHeadSent && receiver != nil || !rtmp.keyFrameSent && !iframe {
+			return false
+		}
+		rtmp.keyFrameSent = true
+		return true
+	}
+	// 有视频的流在第一个关键帧之前不发送音频
+	return !hasVideo || rtmp.keyFrameSent
+}
@@ -0,0 +1,66 @@
+package rtmp
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// InsufficientBWEvent 播放端持续落后，带宽不足以正常速度播放
+type InsufficientBWEvent struct {
+	ID         string // 播放会话ID
+	StreamPath string
+	Lag        time.Duration
+	Labels     map[string]string `json:",omitempty"`
+}
+
+// insufficientBW 播放端发送进度持续落后于实际时间时发送NetStream.Play.InsufficientBW，供播放器切换码率或提示用户
+type insufficientBW struct {
+	InsufficientBWCount int32
+	bwStartTime         time.Time
+	bwStartAbsTime      uint32
+	lagSince            time.Time // 开始落后的时间
+	bwNotified          bool
+}
+
+// lag 计算发送进度落后于实际时间的时长，以第一次计算时为起点；降级和跳过GOP也使用同样的落后时长
+func (b *insufficientBW) lag(absTime uint32) time.Duration {
+	if b.bwStartTime.IsZero() {
+		b.bwStartTime = time.Now()
+		b.bwStartAbsTime = absTime
+		return 0
+	}
+	return time.Since(b.bwStartTime) - time.Duration(absTime-b.bwStartAbsTime)*time.Millisecond
+}
+
+func (rtmp *RTMPSender) checkBandwidth(absTime uint32) {
+	if conf.InsufficientBWLag <= 0 {
+		return
+	}
+	b := &rtmp.insufficientBW
+	lag := b.lag(absTime)
+	if lag < conf.InsufficientBWLag {
+		// 追上一半之后才允许再次通知，避免在阈值附近反复通知
+		if lag < conf.InsufficientBWLag/2 {
+			b.lagSince = time.Time{}
+			b.bwNotified = false
+		}
+		return
+	}
+	if b.lagSince.IsZero() {
+		b.lagSince = time.Now()
+	}
+	if b.bwNotified || time.Since(b.lagSince) < conf.InsufficientBWTime {
+		return
+	}
+	b.bwNotified = true
+	count := atomic.AddInt32(&b.InsufficientBWCount, 1)
+	rtmp.Warn("insufficient bandwidth", zap.Duration("lag", lag), zap.Int32("count", count))
+	rtmp.Response(0, NetStream_Play_InsufficientBW, Level_Warning)
+	event := InsufficientBWEvent{ID: rtmp.ID, Lag: lag, Labels: rtmp.Labels()}
+	if rtmp.Stream != nil {
+		event.StreamPath = rtmp.Stream.Path
+	}
+	emitEvent(event)
+}
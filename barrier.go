@@ -0,0 +1,82 @@
+package rtmp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	barrierMaxMessages = 1024     // 音视频屏障最多暂存的消息数，超过时立即释放
+	barrierMaxBytes    = 16 << 20 // 音视频屏障最多暂存的字节数，超过时立即释放
+)
+
+// avBarrier 发布开始时暂存音视频消息，等音视频序列头都到达（或者超时）后才写入引擎，避免播放者加入时前几秒只有音频
+type avBarrier struct {
+	barrierStart time.Time
+	barrierDone  atomic.Bool
+	hasAudioHead bool
+	hasVideoHead bool
+	held         []*Chunk
+
+	barrierMu    sync.Mutex  // 超时由定时器在其他协程中释放
+	barrierTimer *time.Timer // 超时后即使没有收到新的消息也释放
+	heldBytes    int
+}
+
+// barrier 返回true代表消息被暂存
+func (r *RTMPReceiver) barrier(msg *Chunk) bool {
+	if r.barrierDone.Load() || conf.AVBarrierTimeout <= 0 {
+		return false
+	}
+	r.barrierMu.Lock()
+	defer r.barrierMu.Unlock()
+	// 等待锁的时候可能已经超时释放
+	if r.barrierDone.Load() {
+		return false
+	}
+	if r.barrierStart.IsZero() {
+		r.barrierStart = time.Now()
+		r.barrierTimer = time.AfterFunc(conf.AVBarrierTimeout, r.barrierTimeout)
+	}
+	// 不需要序列头的编码收到音频或视频即可
+	if msg.MessageTypeID == RTMP_MSG_AUDIO {
+		r.hasAudioHead = r.hasAudioHead || audioSeqHeadReady(msg)
+	} else {
+		r.hasVideoHead = r.hasVideoHead || videoSeqHeadReady(msg)
+	}
+	// 超过连接的内存上限时立即释放，当前消息不再暂存
+	held := r.holdMessage(msg, "av barrier")
+	if held {
+		r.held = append(r.held, msg)
+		r.heldBytes += msg.AVData.ByteLength
+	}
+	// 纯音频或者纯视频的发布收到其中一种即可
+	if !held || (r.hasAudioHead || r.VideoOnlyPublish) && (r.hasVideoHead || r.AudioOnlyPublish) || len(r.held) >= barrierMaxMessages || r.heldBytes >= barrierMaxBytes {
+		r.releaseBarrier()
+	}
+	return held
+}
+
+// barrierTimeout 超时后释放暂存的消息，发布者不再发送数据时也不会一直暂存
+func (r *RTMPReceiver) barrierTimeout() {
+	r.barrierMu.Lock()
+	defer r.barrierMu.Unlock()
+	if !r.barrierDone.Load() {
+		r.releaseBarrier()
+	}
+}
+
+// releaseBarrier 持有barrierMu时调用，写完暂存的消息后才标记完成，之后的消息不会插到暂存的消息之前
+func (r *RTMPReceiver) releaseBarrier() {
+	r.barrierTimer.Stop()
+	r.Info("av barrier released", zap.Bool("audio", r.hasAudioHead), zap.Bool("video", r.hasVideoHead), zap.Int("held", len(r.held)), zap.Int("bytes", r.heldBytes))
+	for _, m := range r.held {
+		r.releaseMessage(m)
+		r.receive(m)
+	}
+	r.held, r.heldBytes = nil, 0
+	r.barrierDone.Store(true)
+}
@@ -0,0 +1,146 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"m7s.live/engine/v4/util"
+)
+
+// 基准测试使用的默认参数，与常见的推流配置相近
+const (
+	benchPayloadSize = 64 << 10 // 一个视频帧的大小
+	benchChunkSize   = 4096
+)
+
+// benchConn 只用于写入的连接，写入的数据交给w
+type benchConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c benchConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (benchConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// loopReader 循环读取同一段数据，用于反复解码同一个消息
+type loopReader struct {
+	data []byte
+	off  int
+}
+
+func (l *loopReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		c := copy(p[n:], l.data[l.off:])
+		n += c
+		l.off = (l.off + c) % len(l.data)
+	}
+	return
+}
+
+// newBenchSender 创建写入w的视频发送者
+func newBenchSender(w io.Writer, chunkSize int) *AVSender {
+	nc := NewNetConnection(benchConn{w: w})
+	nc.writeChunkSize = chunkSize
+	sender := &RTMPSender{}
+	sender.NetStream = NetStream{NetConnection: nc, StreamID: 1}
+	return &AVSender{
+		RTMPSender:  sender,
+		ChunkHeader: ChunkHeader{ChunkStreamID: RTMP_CSID_VIDEO, MessageTypeID: RTMP_MSG_VIDEO, MessageStreamID: 1},
+	}
+}
+
+func benchPayload(size int) []byte {
+	payload := make([]byte, size)
+	payload[0], payload[1] = 0x17, 1 // AVC关键帧
+	return payload
+}
+
+// benchMetaData 典型的onMetaData
+func benchMetaData() *DataMessage {
+	return &DataMessage{Name: "onMetaData", Values: []any{map[string]any{
+		"duration": 0.0, "width": 1920.0, "height": 1080.0, "videodatarate": 4000.0, "framerate": 30.0, "videocodecid": 7.0,
+		"audiodatarate": 128.0, "audiosamplerate": 48000.0, "audiosamplesize": 16.0, "stereo": true, "audiocodecid": 10.0,
+		"encoder": "obs-output module (libobs version 29.1.3)", "filesize": 0.0,
+	}}}
+}
+
+func benchChunkEncode(size, chunkSize int) func(b *testing.B) {
+	return func(b *testing.B) {
+		av := newBenchSender(io.Discard, chunkSize)
+		payload := benchPayload(size)
+		b.SetBytes(int64(size))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			av.sendData(payload, uint32(i))
+		}
+	}
+}
+
+func benchChunkDecode(size, chunkSize int) func(b *testing.B) {
+	return func(b *testing.B) {
+		var encoded bytes.Buffer
+		newBenchSender(&encoded, chunkSize).sendData(benchPayload(size), 0)
+		nc := NewNetConnection(benchConn{w: io.Discard})
+		nc.Reader = bufio.NewReader(&loopReader{data: encoded.Bytes()})
+		nc.readChunkSize = chunkSize
+		b.SetBytes(int64(size))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for {
+				msg, err := nc.readChunk()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if msg != nil {
+					msg.AVData.Recycle()
+					break
+				}
+			}
+		}
+	}
+}
+
+// BenchmarkChunkEncode 将64KB的视频帧按4096字节的块大小分块发送
+func BenchmarkChunkEncode(b *testing.B) {
+	benchChunkEncode(benchPayloadSize, benchChunkSize)(b)
+}
+
+// BenchmarkChunkDecode 读取并重组按4096字节分块的64KB视频帧
+func BenchmarkChunkDecode(b *testing.B) {
+	benchChunkDecode(benchPayloadSize, benchChunkSize)(b)
+}
+
+// BenchmarkAMFEncode 编码典型的onMetaData
+func BenchmarkAMFEncode(b *testing.B) {
+	m := benchMetaData()
+	var buf util.Buffer
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		m.Encode(&buf)
+	}
+	b.SetBytes(int64(buf.Len()))
+}
+
+// BenchmarkAMFDecode 解码典型的onMetaData
+func BenchmarkAMFDecode(b *testing.B) {
+	var buf util.Buffer
+	benchMetaData().Encode(&buf)
+	var chunk Chunk
+	b.SetBytes(int64(buf.Len()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		decodeDataAMF0(&chunk, buf)
+	}
+}
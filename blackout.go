@@ -0,0 +1,113 @@
+package rtmp
+
+import (
+	"net/http"
+	"time"
+
+	"m7s.live/engine/v4"
+)
+
+// Blackout 对rtmp订阅者屏蔽某个流的画面，用于合规下架而不断开播放者
+type Blackout struct {
+	Since time.Time
+	Slate bool // 屏蔽期间在原关键帧位置重复发送屏蔽时刻缓存的关键帧
+	Mute  bool // 屏蔽期间同时停止发送音频
+	slate *KeyFrameSnapshot
+}
+
+// blackoutState 记录订阅者自身的屏蔽状态，视频恢复时等待关键帧，音频立即恢复
+type blackoutState struct {
+	blackedOut      bool
+	audioBlackedOut bool
+}
+
+// blackoutPassthrough 屏蔽期间绕过引擎转发的音视频同样不发送给rtmp订阅者，返回true代表该帧不发送。
+// 序列头仍然缓存和转发，视频恢复时等待关键帧，数据轨道不受影响
+func (r *RTMPReceiver) blackoutPassthrough(isAudio, seqHead, keyFrame bool) bool {
+	if seqHead || r.Stream == nil {
+		return false
+	}
+	var blackout *Blackout
+	if v, ok := paths.Load(r.Stream.Path); ok {
+		blackout = v.(*pathEntry).blackout.Load()
+	}
+	if isAudio {
+		return blackout != nil && blackout.Mute
+	}
+	if blackout != nil {
+		r.exBlackedOut = true
+		return true
+	}
+	if r.exBlackedOut && !keyFrame {
+		return true
+	}
+	r.exBlackedOut = false
+	return false
+}
+
+// filterBlackout 返回true代表该帧不发送
+func (rtmp *RTMPSender) filterBlackout(isVideo bool, v *engine.VideoFrame, absTime uint32) bool {
+	if rtmp.Stream == nil {
+		return false
+	}
+	var blackout *Blackout
+	if v, ok := paths.Load(rtmp.Stream.Path); ok {
+		blackout = v.(*pathEntry).blackout.Load()
+	}
+	if blackout == nil {
+		if !isVideo {
+			if rtmp.audioBlackedOut {
+				rtmp.audioBlackedOut = false
+				rtmp.audio.firstSent.Store(false)
+			}
+			return false
+		}
+		if !rtmp.blackedOut {
+			return false
+		}
+		if !v.IFrame {
+			rtmp.waitKeyFrame()
+			return true
+		}
+		rtmp.blackedOut = false
+		rtmp.video.firstSent.Store(false)
+		return false
+	}
+	if !isVideo {
+		rtmp.audioBlackedOut = rtmp.audioBlackedOut || blackout.Mute
+		return blackout.Mute
+	}
+	rtmp.blackedOut = true
+	if blackout.slate != nil && v.IFrame {
+		rtmp.video.sendData(blackout.slate.Payload, absTime)
+	}
+	return true
+}
+
+func (*RTMPConfig) API_blackout(rw http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	streamPath := q.Get("streamPath")
+	if q.Get("enable") == "0" {
+		pathEntryOf(streamPath).blackout.Store(nil)
+		rw.Write([]byte("ok"))
+		return
+	}
+	blackout := &Blackout{
+		Since: time.Now(),
+		Slate: q.Get("slate") == "1",
+		Mute:  q.Get("mute") == "1",
+	}
+	if blackout.Slate {
+		if s := engine.Streams.Get(streamPath); s != nil {
+			if p, ok := s.Publisher.(IRTMPReceiver); ok {
+				blackout.slate = p.GetReceiver().snapshot.Load()
+			}
+		}
+		if blackout.slate == nil {
+			http.Error(rw, "no keyframe for slate", http.StatusBadRequest)
+			return
+		}
+	}
+	pathEntryOf(streamPath).blackout.Store(blackout)
+	rw.Write([]byte("ok"))
+}
@@ -0,0 +1,66 @@
+package rtmp
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// broadcastData 向streamPath（或者appName下所有流）的rtmp播放者发送一次AMF0数据消息，返回发送的播放者数量。
+// 播放地址带?data=0的播放者不接收
+func broadcastData(streamPath, appName, name string, value map[string]any) (n int) {
+	subscribers.Range(func(_, v any) bool {
+		sub := v.(*RTMPSubscriber)
+		if sub.Stream == nil || sub.NoData {
+			return true
+		}
+		if streamPath != "" && sub.Stream.Path != streamPath || appName != "" && sub.Stream.AppName != appName {
+			return true
+		}
+		if err := sub.sendDataMessage(name, value); err != nil {
+			sub.Warn("broadcast data", zap.String("name", name), zap.Error(err))
+			return true
+		}
+		n++
+		return true
+	})
+	return
+}
+
+// API_broadcast 向播放者发送通知，例如 rtmp/api/broadcast?appName=live&text=服务将在10分钟后维护，
+// 以POST发送JSON对象时以该对象作为数据消息的内容，name为数据消息的名称，默认为onAnnouncement
+func (*RTMPConfig) API_broadcast(rw http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	streamPath, appName := q.Get("streamPath"), q.Get("appName")
+	if streamPath == "" && appName == "" {
+		http.Error(rw, "streamPath or appName required", http.StatusBadRequest)
+		return
+	}
+	name := q.Get("name")
+	if name == "" {
+		name = "onAnnouncement"
+	}
+	value := make(map[string]any)
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&value); err != nil {
+			http.Error(rw, "invalid json object: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if text := q.Get("text"); text != "" {
+		value["text"] = text
+	}
+	if len(value) == 0 {
+		http.Error(rw, "text or json body required", http.StatusBadRequest)
+		return
+	}
+	if _, ok := value["time"]; !ok {
+		value["time"] = float64(time.Now().UnixMilli())
+	}
+	n := broadcastData(streamPath, appName, name, value)
+	RTMPPlugin.Info("broadcast data", zap.String("streamPath", streamPath), zap.String("appName", appName), zap.String("name", name), zap.Int("players", n))
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]int{"players": n})
+}
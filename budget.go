@@ -0,0 +1,74 @@
+package rtmp
+
+import (
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+// ConnectionBudget 服务端连接数和协程数的预算使用情况
+type ConnectionBudget struct {
+	Connections    int64
+	MaxConnections int64 // 0为不限制
+	Goroutines     int
+	MaxGoroutines  int    // 0为不限制
+	Refused        uint64 // 超过预算而拒绝的连接数
+}
+
+var (
+	activeConns  atomic.Int64
+	refusedConns atomic.Uint64
+	lastRefusal  atomic.Int64 // 上次记录拒绝日志的时间（UnixNano）
+	fdLimitOnce  sync.Once
+	fdBudget     int64
+)
+
+// maxConnections 连接数上限，未配置时使用文件描述符上限的90%，给日志、录像等其他文件留出余量
+func maxConnections() int64 {
+	if conf.MaxConnections > 0 {
+		return int64(conf.MaxConnections)
+	}
+	fdLimitOnce.Do(func() {
+		if limit := fdLimit(); limit > 0 {
+			fdBudget = int64(limit) * 9 / 10
+		}
+	})
+	return fdBudget
+}
+
+// admit 判断是否接受新的连接，接近预算时主动拒绝，避免文件描述符耗尽（EMFILE）导致进行中的握手失败
+func admit() bool {
+	reason := ""
+	if max := maxConnections(); max > 0 && activeConns.Load() >= max {
+		reason = "connection budget exceeded"
+	} else if conf.MaxGoroutines > 0 && runtime.NumGoroutine() >= conf.MaxGoroutines {
+		reason = "goroutine budget exceeded"
+	}
+	if reason == "" {
+		return true
+	}
+	refused := refusedConns.Add(1)
+	// 每秒最多记录一次，避免拒绝时刷屏
+	if now := time.Now().UnixNano(); now-lastRefusal.Load() > int64(time.Second) {
+		lastRefusal.Store(now)
+		RTMPPlugin.Warn("refuse connection", zap.String("reason", reason), zap.Int64("connections", activeConns.Load()), zap.Int("goroutines", runtime.NumGoroutine()), zap.Uint64("refused", refused))
+	}
+	return false
+}
+
+func (*RTMPConfig) API_budget(w http.ResponseWriter, r *http.Request) {
+	util.ReturnJson(func() ConnectionBudget {
+		return ConnectionBudget{
+			Connections:    activeConns.Load(),
+			MaxConnections: maxConnections(),
+			Goroutines:     runtime.NumGoroutine(),
+			MaxGoroutines:  conf.MaxGoroutines,
+			Refused:        refusedConns.Load(),
+		}
+	}, time.Second, w, r)
+}
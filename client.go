@@ -12,6 +12,12 @@ import (
 )
 
 func NewRTMPClient(addr string) (client *NetConnection, err error) {
+	return newRTMPClient(addr, nil)
+}
+
+// newRTMPClient 连接远端并完成connect，props为connect命令对象中附加的属性。
+// 地址中带有user:password时按远端要求的authmod（adobe或llnw）认证，每次质询需要重新连接
+func newRTMPClient(addr string, props map[string]any) (client *NetConnection, err error) {
 	u, err := url.Parse(addr)
 	if err != nil {
 		RTMPPlugin.Error("connect url parse", zap.Error(err))
@@ -19,19 +25,52 @@ func NewRTMPClient(addr string) (client *NetConnection, err error) {
 	}
 	ps := strings.Split(u.Path, "/")
 	if len(ps) < 3 {
-		RTMPPlugin.Error("illegal rtmp url", zap.String("url", addr))
+		RTMPPlugin.Error("illegal rtmp url", zap.String("url", redactURL(addr)))
 		return nil, errors.New("illegal rtmp url")
 	}
-	isRtmps := u.Scheme == "rtmps"
+	var auth *clientAuth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &clientAuth{user: u.User.Username(), password: password}
+		// 用户名和密码不出现在tcUrl和swfUrl中
+		clean := *u
+		clean.User = nil
+		addr = clean.String()
+	}
 	if strings.Count(u.Host, ":") == 0 {
-		if isRtmps {
+		if u.Scheme == "rtmps" {
 			u.Host += ":443"
 		} else {
 			u.Host += ":1935"
 		}
 	}
+	// 最多尝试三次：不带认证、带用户名获取质询、带质询的应答
+	for attempt := 1; ; attempt++ {
+		var authQuery string
+		if auth != nil {
+			authQuery = auth.query(ps[1])
+		}
+		client, err = connectRTMP(u, addr, ps[1], authQuery, props)
+		rejected, ok := err.(*connectRejected)
+		if !ok || auth == nil {
+			return
+		}
+		retry, authErr := auth.retry(rejected)
+		if authErr != nil {
+			RTMPPlugin.Error("connect auth", zap.String("host", u.Host), zap.Error(authErr))
+			return nil, authErr
+		}
+		if !retry || attempt == 3 {
+			return
+		}
+		RTMPPlugin.Debug("connect auth challenge", zap.String("host", u.Host), zap.String("authmod", auth.authmod))
+	}
+}
+
+// connectRTMP 建立连接、握手并以appName加上认证参数connect
+func connectRTMP(u *url.URL, addr string, appName string, authQuery string, props map[string]any) (client *NetConnection, err error) {
 	var conn net.Conn
-	if isRtmps {
+	if u.Scheme == "rtmps" {
 		var tlsconn *tls.Conn
 		tlsconn, err = tls.Dial("tcp", u.Host, &tls.Config{})
 		conn = tlsconn
@@ -53,24 +92,27 @@ func NewRTMPClient(addr string) (client *NetConnection, err error) {
 		RTMPPlugin.Error("handshake", zap.Error(err))
 		return nil, err
 	}
-	client.appName = ps[1]
-	err = client.SendMessage(RTMP_MSG_CHUNK_SIZE, Uint32Message(conf.ChunkSize))
+	client.appName = appName
+	err = client.SetChunkSize(conf.ChunkSize)
 	if err != nil {
 		return
 	}
-	client.writeChunkSize = conf.ChunkSize
 	path := u.Path
 	if len(u.Query()) != 0 {
 		path += "?" + u.RawQuery
 	}
+	object := map[string]any{
+		"app":      client.appName + authQuery,
+		"flashVer": "monibuca/" + engine.Engine.Version,
+		"swfUrl":   addr,
+		"tcUrl":    strings.TrimSuffix(addr, path) + "/" + client.appName + authQuery,
+	}
+	for k, v := range props {
+		object[k] = v
+	}
 	err = client.SendMessage(RTMP_MSG_AMF0_COMMAND, &CallMessage{
 		CommandMessage{"connect", 1},
-		map[string]any{
-			"app":      client.appName,
-			"flashVer": "monibuca/" + engine.Engine.Version,
-			"swfUrl":   addr,
-			"tcUrl":    strings.TrimSuffix(addr, path) + "/" + client.appName,
-		},
+		object,
 		nil,
 	})
 	if err != nil {
@@ -85,13 +127,18 @@ func NewRTMPClient(addr string) (client *NetConnection, err error) {
 		case RTMP_MSG_AMF0_COMMAND:
 			cmd := msg.MsgData.(Commander).GetCommand()
 			switch cmd.CommandName {
-			case "_result":
-				response := msg.MsgData.(*ResponseMessage)
-				if response.Infomation["code"] == NetConnection_Connect_Success {
+			case Response_Result, Response_Error:
+				response, ok := msg.MsgData.(*ResponseMessage)
+				if !ok {
+					break
+				}
+				code, _ := response.Infomation["code"].(string)
+				if code == NetConnection_Connect_Success {
+					client.caps = parseCapabilities(response.Properties)
 					return client, nil
-				} else {
-					return nil, err
 				}
+				description, _ := response.Infomation["description"].(string)
+				return nil, &connectRejected{code, description}
 			}
 		}
 	}
@@ -100,22 +147,92 @@ func NewRTMPClient(addr string) (client *NetConnection, err error) {
 type RTMPPusher struct {
 	RTMPSender
 	engine.Pusher
+	originURL string // 转换前的远端地址
+	taskRetry
+}
+
+// newRTMPPusher 创建推流，开启PushLatestGOP时订阅模式改为首屏之后不追赶，先完整发送最近的一个GOP
+func newRTMPPusher() *RTMPPusher {
+	pusher := new(RTMPPusher)
+	if conf.PushLatestGOP {
+		// 复制插件共享的订阅配置再修改
+		config := conf.Subscribe
+		config.SubMode = 1
+		pusher.Subscriber.Config = &config
+	}
+	return pusher
 }
 
 func (pusher *RTMPPusher) Connect() (err error) {
-	if pusher.NetConnection, err = NewRTMPClient(pusher.RemoteURL); err == nil {
+	if drainRejects(false) {
+		return errors.New("server draining")
+	}
+	if !inPushWindow(pusher.StreamPath) {
+		return errors.New("outside push window")
+	}
+	if pushSuspended(pusher.StreamPath) {
+		return errPushSuspended
+	}
+	if pusher.originURL == "" {
+		pusher.originURL = pusher.RemoteURL
+	}
+	if pusher.RemoteURL, err = transformPushURL(pusher.StreamPath, pusher.originURL); err != nil {
+		RTMPPlugin.Error("transform push url", zap.String("url", redactURL(pusher.originURL)), zap.Error(err))
+		return
+	}
+	pusher.attempt()
+	// 增强rtmp：通告本地流携带的视频编码和扩展能力，部分远端只在协商后才接受HEVC等编码的推流
+	if pusher.NetConnection, err = newRTMPClient(pusher.RemoteURL, clientCapabilityProps(pusher.localFourCcList())); err == nil {
 		pusher.SetIO(pusher.NetConnection.Conn)
-		RTMPPlugin.Info("connect", zap.String("remoteURL", pusher.RemoteURL))
+		RTMPPlugin.Info("connect", zap.String("remoteURL", redactURL(pusher.RemoteURL)))
+	} else {
+		pusher.failed("push", pusher.StreamPath, pusher.RemoteURL, pusher.exhausted(), err)
 	}
 	return
 }
 
-func (pusher *RTMPPusher) Push() error {
+func (pusher *RTMPPusher) exhausted() bool {
+	return pusher.Pusher.Config.RePush >= 0 && pusher.ReConnectCount > pusher.Pusher.Config.RePush
+}
+
+func (pusher *RTMPPusher) Push() (err error) {
+	pusher.connected()
+	defer func() {
+		// 暂停导致的断开不算失败
+		pusher.failed("push", pusher.StreamPath, pusher.RemoteURL, pusher.exhausted() && !pushSuspended(pusher.StreamPath), err)
+		pusher.saveSuspended()
+		// 保存暂停的统计之后再删除，恢复时以此判断推流已经退出
+		pathEntryOf(pusher.StreamPath).pusher.CompareAndSwap(pusher, nil)
+	}()
+	pusher.SetContext(pusher.Context)
+	defer pusher.releaseContext()
+	pathEntryOf(pusher.StreamPath).pusher.Store(pusher)
+	// 重连后需要重新发送完整的消息头，并在音视频之前补发onMetaData和序列头
+	pusher.audio.firstSent.Store(false)
+	pusher.video.firstSent.Store(false)
+	pusher.resetBackfill()
+	pusher.setDataFrame = true
+	// 根据远端在connect响应中通告的能力决定打包格式
+	pusher.exVideo = conf.PushEnhancedRTMP || pusher.caps.Supports(FourCC_HEVC)
+	if legacyHEVCTarget(pusher.RemoteURL) {
+		pusher.exVideo = false
+	}
+	pusher.sentMetaVersion.Store(0)
+	switch conf.PushTimestamp {
+	case PushTimestampContinue:
+		pusher.resyncing = true
+	case PushTimestampZero:
+		pusher.resyncing = true
+		pusher.resyncZero = true
+	}
 	pusher.SendMessage(RTMP_MSG_AMF0_COMMAND, &CommandMessage{"createStream", 2})
 	defer pusher.Stop()
 	for {
 		msg, err := pusher.RecvMessage()
 		if err != nil {
+			if pusher.handoverRead() {
+				continue
+			}
 			return err
 		}
 		switch msg.MessageTypeID {
@@ -128,12 +245,7 @@ func (pusher *RTMPPusher) Push() error {
 					pusher.audio.MessageStreamID = pusher.StreamID
 					pusher.video.MessageStreamID = pusher.StreamID
 					URL, _ := url.Parse(pusher.RemoteURL)
-					_, streamPath, _ := strings.Cut(URL.Path, "/")
-					_, streamPath, _ = strings.Cut(streamPath, "/")
 					pusher.Args = URL.Query()
-					if len(pusher.Args) > 0 {
-						streamPath += "?" + pusher.Args.Encode()
-					}
 					pusher.SendMessage(RTMP_MSG_AMF0_COMMAND, &PublishMessage{
 						CURDStreamMessage{
 							CommandMessage{
@@ -142,15 +254,23 @@ func (pusher *RTMPPusher) Push() error {
 							},
 							response.StreamId,
 						},
-						streamPath,
+						publishName(pusher.RemoteURL),
 						"live",
 					})
 				} else if response, ok := msg.MsgData.(*ResponsePublishMessage); ok {
 					if response.Infomation["code"] == NetStream_Publish_Start {
+						if _, ok := conf.Encryption[pusher.StreamPath]; ok {
+							if err = pusher.startEncryption(); err != nil {
+								return err
+							}
+						}
 						go pusher.PlayRaw()
+						pusher.startMultitrack(conf.PushMultitrack || pusher.caps.Multitrack())
 					} else {
 						return errors.New(response.Infomation["code"].(string))
 					}
+				} else if response, ok := msg.MsgData.(*ResponseMessage); ok && response.Infomation["code"] == NetConnection_Connect_ReconnectRequest {
+					go pusher.handover(response.Infomation)
 				}
 			}
 		}
@@ -160,56 +280,104 @@ func (pusher *RTMPPusher) Push() error {
 type RTMPPuller struct {
 	RTMPReceiver
 	engine.Puller
+	taskRetry
+	playState
+}
+
+func (puller *RTMPPuller) exhausted() bool {
+	return puller.Puller.Config.RePull >= 0 && puller.ReConnectCount > puller.Puller.Config.RePull
 }
 
 func (puller *RTMPPuller) Connect() (err error) {
-	if puller.NetConnection, err = NewRTMPClient(puller.RemoteURL); err == nil {
+	if drainRejects(true) {
+		return errors.New("server draining")
+	}
+	puller.attempt()
+	if nc := takeStandby(puller.RemoteURL); nc != nil {
+		puller.NetConnection = nc
+		puller.SetIO(nc.Conn)
+		RTMPPlugin.Info("connect from warm standby", zap.String("remoteURL", redactURL(puller.RemoteURL)))
+		return
+	}
+	// 增强rtmp：通告可以接收的编码，源站据此决定是否发送HEVC、AV1等编码
+	if puller.NetConnection, err = newRTMPClient(puller.RemoteURL, clientCapabilityProps(conf.FourCcList)); err == nil {
 		puller.SetIO(puller.NetConnection.Conn)
-		RTMPPlugin.Info("connect", zap.String("remoteURL", puller.RemoteURL))
+		RTMPPlugin.Info("connect", zap.String("remoteURL", redactURL(puller.RemoteURL)))
+	} else {
+		puller.failed("pull", puller.StreamPath, puller.RemoteURL, puller.exhausted(), err)
 	}
 	return
 }
 
 func (puller *RTMPPuller) Pull() (err error) {
+	puller.connected()
+	defer func() {
+		puller.failed("pull", puller.StreamPath, puller.RemoteURL, puller.exhausted(), err)
+	}()
 	defer puller.Stop()
+	puller.SetContext(puller.Context)
+	defer puller.releaseContext()
+	puller.Delay = conf.PublishDelay
+	puller.NormalizeTimestamp = conf.PullNormalizeTimestamp
+	puller.startShadow()
+	puller.resetGap(conf.PullGapFill > 0)
+	if conf.PullGapFill > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go puller.fillGaps(done)
+	}
+	if URL, err := url.Parse(puller.RemoteURL); err == nil {
+		puller.Args = URL.Query()
+	}
 	err = puller.SendMessage(RTMP_MSG_AMF0_COMMAND, &CommandMessage{"createStream", 2})
+	timer := puller.playAfter(createStreamTimeout)
+	defer timer.Stop()
 	for err == nil {
 		msg, err := puller.RecvMessage()
 		if err != nil {
 			return err
 		}
 		switch msg.MessageTypeID {
-		case RTMP_MSG_AUDIO:
-			puller.ReceiveAudio(msg)
-		case RTMP_MSG_VIDEO:
-			puller.ReceiveVideo(msg)
+		case RTMP_MSG_AUDIO, RTMP_MSG_VIDEO:
+			if msg.MessageStreamID != puller.StreamID && (conf.StreamIDCheck == StreamIDCheckLog || conf.StreamIDCheck == StreamIDCheckReject) {
+				if !puller.badStreamID(msg, puller.StreamID) {
+					return errors.New("unexpected message stream id")
+				}
+			}
+			// 与补发静音帧的协程互斥
+			puller.gapMu.Lock()
+			if msg.MessageTypeID == RTMP_MSG_AUDIO {
+				puller.ReceiveAudio(msg)
+			} else {
+				puller.ReceiveVideo(msg)
+			}
+			puller.gapMu.Unlock()
+		case RTMP_MSG_AMF0_METADATA:
+			puller.receiveMetaData(msg)
 		case RTMP_MSG_AMF0_COMMAND:
+			if m, ok := msg.MsgData.(*EncryptionMessage); ok {
+				puller.setDecryption(m)
+				break
+			}
 			cmd := msg.MsgData.(Commander).GetCommand()
 			switch cmd.CommandName {
+			case Response_OnStatus:
+				switch response := msg.MsgData.(type) {
+				case *ResponsePlayMessage:
+					if err = puller.playStatus(response); err != nil {
+						return err
+					}
+				case *ResponseMessage:
+					if response.Infomation["code"] == NetConnection_Connect_ReconnectRequest {
+						if err = puller.handover(response.Infomation); err != nil {
+							return err
+						}
+					}
+				}
 			case "_result":
-				if response, ok := msg.MsgData.(*ResponseCreateStreamMessage); ok {
+				if response, ok := msg.MsgData.(*ResponseCreateStreamMessage); ok && !puller.playSent.Load() {
 					puller.StreamID = response.StreamId
-					m := &PlayMessage{}
-					m.StreamId = response.StreamId
-					m.TransactionId = 1
-					m.CommandMessage.CommandName = "play"
-					URL, _ := url.Parse(puller.RemoteURL)
-					ps := strings.Split(URL.Path, "/")
-					puller.Args = URL.Query()
-					m.StreamName = ps[len(ps)-1]
-					if len(puller.Args) > 0 {
-						m.StreamName += "?" + puller.Args.Encode()
-					}
-					puller.SendMessage(RTMP_MSG_AMF0_COMMAND, m)
-					// if response, ok := msg.MsgData.(*ResponsePlayMessage); ok {
-					// 	if response.Object["code"] == "NetStream.Play.Start" {
-
-					// 	} else if response.Object["level"] == Level_Error {
-					// 		return errors.New(response.Object["code"].(string))
-					// 	}
-					// } else {
-					// 	return errors.New("pull faild")
-					// }
+					puller.sendPlay(response.StreamId)
 				}
 			}
 		}
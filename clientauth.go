@@ -0,0 +1,154 @@
+package rtmp
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// connect时支持的认证方式
+const (
+	AuthModAdobe = "adobe" // Adobe Media Server、Wowza
+	AuthModLLNW  = "llnw"  // Limelight
+)
+
+// connectRejected 远端以_error拒绝connect，description中可能带有认证的质询
+type connectRejected struct {
+	code        string
+	description string
+}
+
+func (e *connectRejected) Error() string {
+	return "connect rejected: " + e.code + " " + e.description
+}
+
+// clientAuth connect的质询应答认证，用户名和密码来自远端地址中的user:password，认证方式由远端拒绝connect时指定
+type clientAuth struct {
+	user, password          string
+	authmod                 string
+	salt, challenge, opaque string // adobe
+	nonce                   string // llnw
+}
+
+// redactedParams 远端地址中需要隐藏的查询参数，包括认证的响应和令牌
+var redactedParams = []string{"response", "password", "token"}
+
+// redactURL 隐藏远端地址中user:password的密码以及认证参数，所有日志、事件和接口输出都使用隐藏后的地址
+func redactURL(remoteURL string) string {
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		return remoteURL
+	}
+	q, redacted := u.Query(), false
+	for _, key := range redactedParams {
+		if q.Has(key) {
+			q.Set(key, "xxxxx")
+			redacted = true
+		}
+	}
+	if u.User == nil && !redacted {
+		return remoteURL
+	}
+	if redacted {
+		u.RawQuery = q.Encode()
+	}
+	return u.Redacted()
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func md5Hex(s string) string {
+	h := md5.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// query 附加在app和tcUrl之后的认证参数：远端还没有要求认证时为空，还没有收到质询时只带用户名
+func (a *clientAuth) query(appName string) string {
+	if a.authmod == "" {
+		return ""
+	}
+	q := "?authmod=" + a.authmod + "&user=" + url.QueryEscape(a.user)
+	switch {
+	case a.authmod == AuthModAdobe && a.salt != "":
+		// 以opaque（没有时以challenge）计算应答
+		key := a.challenge
+		if a.opaque != "" {
+			key = a.opaque
+		}
+		challenge := randomHex(4)
+		q += "&challenge=" + challenge + "&response=" + adobeAuthResponse(a.user, a.salt, a.password, key, challenge)
+		if a.opaque != "" {
+			q += "&opaque=" + a.opaque
+		}
+	case a.authmod == AuthModLLNW && a.nonce != "":
+		// HTTP摘要认证：realm为live，method为publish，uri为/app，app不带实例名时加上默认的/_definst_
+		const nc, qop = "00000001", "auth"
+		cnonce := randomHex(4)
+		uri := "/" + appName
+		if !strings.Contains(appName, "/") {
+			uri += "/_definst_"
+		}
+		ha1 := md5Hex(a.user + ":live:" + a.password)
+		ha2 := md5Hex("publish:" + uri)
+		response := md5Hex(ha1 + ":" + a.nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
+		q += "&nonce=" + url.QueryEscape(a.nonce) + "&cnonce=" + cnonce + "&nc=" + nc + "&response=" + response
+	}
+	return q
+}
+
+// retry 根据拒绝connect的description决定是否带上新的认证参数重新connect，例如
+// [ AccessManager.Reject ] : [ code=403 need auth; authmod=adobe ] 或者
+// [ AccessManager.Reject ] : [ authmod=adobe ] : ?reason=needauth&user=test&salt=xxx&challenge=xxx&opaque=xxx
+func (a *clientAuth) retry(rejected *connectRejected) (bool, error) {
+	desc := rejected.description
+	_, query, found := strings.Cut(desc, "?reason=")
+	if !found {
+		if !strings.Contains(desc, "code=403 need auth") || a.authmod != "" {
+			return false, nil
+		}
+		switch {
+		case strings.Contains(desc, "authmod="+AuthModAdobe):
+			a.authmod = AuthModAdobe
+		case strings.Contains(desc, "authmod="+AuthModLLNW):
+			a.authmod = AuthModLLNW
+		default:
+			return false, errors.New("unsupported authmod: " + desc)
+		}
+		// 带上用户名重新connect，获取质询
+		return true, nil
+	}
+	args, err := url.ParseQuery("reason=" + query)
+	if err != nil {
+		return false, err
+	}
+	if reason := args.Get("reason"); reason != "needauth" || a.salt != "" || a.nonce != "" {
+		return false, errors.New(a.authmod + " auth failed: " + reason)
+	}
+	if a.authmod == "" {
+		// 远端直接给出质询
+		if strings.Contains(desc, "authmod="+AuthModLLNW) {
+			a.authmod = AuthModLLNW
+		} else {
+			a.authmod = AuthModAdobe
+		}
+	}
+	switch a.authmod {
+	case AuthModAdobe:
+		a.salt, a.challenge, a.opaque = args.Get("salt"), args.Get("challenge"), args.Get("opaque")
+		if a.salt == "" {
+			return false, errors.New("adobe auth: missing salt")
+		}
+	case AuthModLLNW:
+		if a.nonce = args.Get("nonce"); a.nonce == "" {
+			return false, errors.New("llnw auth: missing nonce")
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,132 @@
+package rtmp
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/track"
+)
+
+// 发布者使用引擎不支持的编码时的处理方式
+const (
+	CodecActionAllow  = "allow"  // 记录日志并产生事件，仍然交给引擎处理（默认，与没有检查时一致）
+	CodecActionLog    = "log"    // 记录日志并产生事件，丢弃该轨道的数据
+	CodecActionReject = "reject" // 回复NetStream.Publish.Rejected并断开发布者
+)
+
+// UnsupportedCodecEvent 发布者使用了引擎不支持的编码
+type UnsupportedCodecEvent struct {
+	StreamPath string
+	Kind       string // audio 或 video
+	CodecID    byte
+	FourCC     string            `json:",omitempty"` // 增强rtmp扩展头中的编码
+	Labels     map[string]string `json:",omitempty"`
+}
+
+// codecChecker 在创建轨道之前检查编码，避免不支持的编码静默地产生空轨道
+type codecChecker struct {
+	audioUnsupported bool
+	videoUnsupported bool
+	legacyHEVC       bool // 最近的视频消息是传统FLV CodecID 12的HEVC
+}
+
+// parseCodec 解析音视频消息的编码，isExt为增强rtmp的扩展头
+func parseCodec(msg *Chunk) (codecID byte, fourCc string, isExt bool) {
+	data := msg.AVData.ToBytes()
+	if len(data) == 0 {
+		return
+	}
+	if msg.MessageTypeID == RTMP_MSG_AUDIO {
+		codecID = data[0] >> 4
+		isExt = codecID == 9
+	} else {
+		codecID = data[0] & 0x0f
+		isExt = data[0]&0x80 != 0
+	}
+	if isExt && len(data) >= 5 {
+		fourCc = string(data[1:5])
+	}
+	return
+}
+
+// codecSupported 引擎可以创建轨道或者绕过引擎转发的编码：传统格式以FLV的CodecID判断，增强rtmp的扩展头以FourCC判断
+func codecSupported(isAudio bool, codecID byte, fourCc string, isExt bool) bool {
+	if isExt {
+		if isAudio {
+			return isAudioFourCc(fourCc)
+		}
+		_, ok := exVideoCodecID(fourCc)
+		return ok
+	}
+	if isAudio {
+		switch codec.AudioCodecID(codecID) {
+		case codec.CodecID_AAC, codec.CodecID_PCMA, codec.CodecID_PCMU, CodecID_MP3, CodecID_MP3_8K:
+			return true
+		}
+		return false
+	}
+	switch codec.VideoCodecID(codecID) {
+	case codec.CodecID_H264, codec.CodecID_H265:
+		return true
+	}
+	return false
+}
+
+// checkCodec 检查还没有创建轨道的音视频消息的编码，返回false代表该消息不写入引擎
+func (r *RTMPReceiver) checkCodec(msg *Chunk) bool {
+	isAudio := msg.MessageTypeID == RTMP_MSG_AUDIO
+	unsupported := &r.videoUnsupported
+	if isAudio {
+		unsupported = &r.audioUnsupported
+	}
+	if *unsupported {
+		return conf.UnsupportedCodec == CodecActionAllow
+	}
+	codecID, fourCc, isExt := parseCodec(msg)
+	if codecSupported(isAudio, codecID, fourCc, isExt) && (isAudio || !r.legacyHEVC || conf.LegacyHEVC) {
+		return true
+	}
+	*unsupported = true
+	kind := "video"
+	if isAudio {
+		kind = "audio"
+	}
+	r.Warn("unsupported codec", zap.String("kind", kind), zap.Uint8("codecID", codecID), zap.String("fourCC", fourCc), zap.String("action", conf.UnsupportedCodec))
+	event := UnsupportedCodecEvent{Kind: kind, CodecID: codecID, FourCC: fourCc, Labels: r.Labels()}
+	if r.Stream != nil {
+		event.StreamPath = r.Stream.Path
+	}
+	emitEvent(event)
+	switch conf.UnsupportedCodec {
+	case CodecActionAllow:
+		return true
+	case CodecActionReject:
+		name := fmt.Sprint(codecID)
+		if fourCc != "" {
+			name = fourCc
+		}
+		r.ResponseReason(0, NetStream_Publish_Rejected, Level_Error, event.StreamPath, fmt.Sprintf("unsupported %s codec %s", kind, name))
+		r.Stop()
+	}
+	return false
+}
+
+func isG711(codecID codec.AudioCodecID) bool {
+	return codecID == codec.CodecID_PCMA || codecID == codec.CodecID_PCMU
+}
+
+// createG711Track 创建G711（SoundFormat 7、8）轨道，IP摄像头转rtmp时常用。FLV的SoundRate无法表示8kHz，采样率固定为8000，返回false代表不是G711
+func (r *RTMPReceiver) createG711Track(msg *Chunk) bool {
+	b0, err := msg.AVData.NewReader().ReadByte()
+	if err != nil || r.Stream == nil || !isG711(codec.AudioCodecID(b0>>4)) {
+		return false
+	}
+	alaw := codec.AudioCodecID(b0>>4) == codec.CodecID_PCMA
+	at := track.NewG711(r.Stream, alaw, uint32(8000))
+	at.Channels = b0&0x01 + 1
+	at.SetStuff(r.bytePool)
+	r.AudioTrack = at
+	r.Info("g711 audio", zap.Bool("alaw", alaw), zap.Uint8("channels", at.Channels))
+	return true
+}
@@ -0,0 +1,204 @@
+package rtmp
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/util"
+)
+
+// ColorConfig colorInfo中的色彩配置，取值与ISO/IEC 23091-2（H.273）相同
+type ColorConfig struct {
+	BitDepth                int
+	ColorPrimaries          int
+	TransferCharacteristics int
+	MatrixCoefficients      int
+}
+
+// HdrCll 内容亮度级别（cd/m²）
+type HdrCll struct {
+	MaxFall float64
+	MaxCLL  float64
+}
+
+// HdrMdcv 母版显示器的色度坐标和亮度
+type HdrMdcv struct {
+	RedX, RedY, GreenX, GreenY, BlueX, BlueY float64
+	WhitePointX, WhitePointY                 float64
+	MaxLuminance, MinLuminance               float64
+}
+
+// ColorInfo 增强rtmp PacketTypeMetadata中的colorInfo，用于HDR10、HLG
+type ColorInfo struct {
+	FourCC      string
+	Track       string         `json:",omitempty"` // 附加的引擎视频轨道
+	HDR         string         `json:",omitempty"` // HDR10、HLG，根据transferCharacteristics判断
+	ColorConfig *ColorConfig   `json:",omitempty"`
+	HdrCll      *HdrCll        `json:",omitempty"`
+	HdrMdcv     *HdrMdcv       `json:",omitempty"`
+	raw         map[string]any // 原始对象，转发时原样发送
+}
+
+// colorInfoCache 缓存发布者最新的colorInfo，附加在引擎视频轨道上，视频轨道重新创建后失效，版本号用于让订阅者发现更新
+type colorInfoCache struct {
+	colorInfo        atomic.Pointer[ColorInfo]
+	colorInfoVersion atomic.Uint32
+	colorPending     *ColorInfo        // 视频轨道创建之前收到的colorInfo，只在接收协程中访问
+	colorTrack       common.VideoTrack // colorInfo附加的视频轨道，只在接收协程中访问
+}
+
+// colorInfoSender 已经转发的发布者colorInfo版本
+type colorInfoSender struct {
+	sentColorInfoVersion uint32
+}
+
+func amfNumber(obj map[string]any, key string) float64 {
+	f, _ := obj[key].(float64)
+	return f
+}
+
+// parseColorInfo 解析PacketTypeMetadata的负载：AMF编码的名称和对象，目前只定义了colorInfo
+func parseColorInfo(fourCc string, payload []byte) (*ColorInfo, bool) {
+	amf := util.AMF{payload}
+	if amf.ReadShortString() != "colorInfo" {
+		return nil, false
+	}
+	v, err := amf.Unmarshal()
+	if err != nil {
+		return nil, false
+	}
+	raw, ok := v.(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	info := &ColorInfo{FourCC: fourCc, raw: raw}
+	if c, ok := raw["colorConfig"].(map[string]any); ok {
+		info.ColorConfig = &ColorConfig{
+			BitDepth:                int(amfNumber(c, "bitDepth")),
+			ColorPrimaries:          int(amfNumber(c, "colorPrimaries")),
+			TransferCharacteristics: int(amfNumber(c, "transferCharacteristics")),
+			MatrixCoefficients:      int(amfNumber(c, "matrixCoefficients")),
+		}
+		switch info.ColorConfig.TransferCharacteristics {
+		case 16: // SMPTE ST 2084（PQ）
+			info.HDR = "HDR10"
+		case 18: // ARIB STD-B67
+			info.HDR = "HLG"
+		}
+	}
+	if c, ok := raw["hdrCll"].(map[string]any); ok {
+		info.HdrCll = &HdrCll{amfNumber(c, "maxFall"), amfNumber(c, "maxCLL")}
+	}
+	if c, ok := raw["hdrMdcv"].(map[string]any); ok {
+		info.HdrMdcv = &HdrMdcv{
+			amfNumber(c, "redX"), amfNumber(c, "redY"), amfNumber(c, "greenX"), amfNumber(c, "greenY"), amfNumber(c, "blueX"), amfNumber(c, "blueY"),
+			amfNumber(c, "whitePointX"), amfNumber(c, "whitePointY"),
+			amfNumber(c, "maxLuminance"), amfNumber(c, "minLuminance"),
+		}
+	}
+	return info, true
+}
+
+// encode 生成以fourCc发送的PacketTypeMetadata扩展视频消息
+func (info *ColorInfo) encode(fourCc string) []byte {
+	var buf util.Buffer
+	// FrameType为5（视频信息/命令帧）
+	buf.WriteByte(0x80 | 0x50 | PacketTypeMetadata)
+	buf.Write([]byte(fourCc))
+	buf.MarshalAMFs("colorInfo", info.raw)
+	return buf
+}
+
+// receiveColorInfo 记录发布者发送的colorInfo，HDR信息变化时同样转发给所有rtmp订阅者和推流目标
+func (r *RTMPReceiver) receiveColorInfo(fourCc string, payload []byte) {
+	info, ok := parseColorInfo(fourCc, payload)
+	if !ok {
+		r.Warn("invalid video metadata", zap.String("fourCC", fourCc))
+		return
+	}
+	if r.VideoTrack == nil {
+		r.colorPending = info
+		return
+	}
+	r.attachColorInfo(info)
+}
+
+// attachColorInfo 将colorInfo附加到当前的引擎视频轨道
+func (r *RTMPReceiver) attachColorInfo(info *ColorInfo) {
+	info.Track, r.colorTrack = r.VideoTrack.GetName(), r.VideoTrack
+	if r.colorInfo.Swap(info) == nil {
+		r.Info("color info", zap.String("hdr", info.HDR), zap.String("track", info.Track))
+	}
+	r.colorInfoVersion.Add(1)
+}
+
+// syncColorInfo 视频轨道创建后附加之前收到的colorInfo，轨道重新创建时丢弃旧轨道的colorInfo
+func (r *RTMPReceiver) syncColorInfo() {
+	if r.VideoTrack == nil || r.VideoTrack == r.colorTrack {
+		return
+	}
+	if info := r.colorPending; info != nil {
+		r.colorPending = nil
+		r.attachColorInfo(info)
+	} else if r.colorInfo.Swap(nil) != nil {
+		r.colorTrack = nil
+		r.colorInfoVersion.Add(1)
+	}
+}
+
+// ColorInfo 发布者最新的colorInfo，没有收到时返回nil
+func (r *RTMPReceiver) ColorInfo() *ColorInfo {
+	return r.colorInfo.Load()
+}
+
+// forwardColorInfo 发布者的colorInfo有更新时在下一个视频帧之前发送，之后加入的订阅者在第一个视频帧之前发送；
+// 视频以传统格式发送时，只发送给在connect中通告支持该编码的对端
+func (rtmp *RTMPSender) forwardColorInfo() {
+	if rtmp.Stream == nil {
+		return
+	}
+	p, ok := rtmp.Stream.Publisher.(IRTMPReceiver)
+	if !ok {
+		return
+	}
+	receiver := p.GetReceiver()
+	version := receiver.colorInfoVersion.Load()
+	if version == rtmp.sentColorInfoVersion {
+		return
+	}
+	info := receiver.colorInfo.Load()
+	if info == nil {
+		rtmp.sentColorInfoVersion = version
+		return
+	}
+	fourCc := rtmp.video.currentFourCc()
+	if fourCc == "" {
+		if !rtmp.caps.Supports(info.FourCC) {
+			return
+		}
+		fourCc = info.FourCC
+	}
+	rtmp.sentColorInfoVersion = version
+	rtmp.video.sendData(info.encode(fourCc), rtmp.lastAbsTime)
+}
+
+func (*RTMPConfig) API_colorinfo(w http.ResponseWriter, r *http.Request) {
+	streamPath := r.URL.Query().Get("streamPath")
+	util.ReturnJson(func() map[string]*ColorInfo {
+		m := make(map[string]*ColorInfo)
+		for _, s := range filterStreams() {
+			if streamPath != "" && s.Path != streamPath {
+				continue
+			}
+			if p, ok := s.Publisher.(IRTMPReceiver); ok {
+				if info := p.GetReceiver().ColorInfo(); info != nil {
+					m[s.Path] = info
+				}
+			}
+		}
+		return m
+	}, time.Second, w, r)
+}
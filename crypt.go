@@ -0,0 +1,117 @@
+package rtmp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+// 自有节点之间的音视频负载加密
+// 发送端在发送音视频之前发送@setEncryption命令（事务ID为0，命令对象为null，信息对象包含cipher:"aes-ctr"和十六进制的iv），
+// 之后该消息流上所有音视频消息的消息体按发送顺序使用同一个AES-CTR密钥流加密，密钥为双方在Encryption中为各自的streamPath配置的预共享密钥
+const (
+	CommandSetEncryption = "@setEncryption"
+	CipherAESCTR         = "aes-ctr"
+)
+
+type EncryptionMessage struct {
+	CommandMessage
+	Infomation map[string]any
+	StreamID   uint32
+}
+
+func (msg *EncryptionMessage) GetStreamID() uint32 {
+	return msg.StreamID
+}
+
+func (msg *EncryptionMessage) Encode(buf *util.Buffer) {
+	buf.MarshalAMFs(msg.CommandName, msg.TransactionId, nil, msg.Infomation)
+}
+
+// newCTR 使用streamPath对应的预共享密钥创建AES-CTR密钥流
+func newCTR(streamPath string, iv []byte) (cipher.Stream, error) {
+	key, err := hex.DecodeString(conf.Encryption[streamPath])
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, errors.New("invalid iv")
+	}
+	return cipher.NewCTR(block, iv), nil
+}
+
+// startEncryption 发送@setEncryption命令，之后发送的音视频消息体都会被加密
+func (rtmp *RTMPSender) startEncryption() error {
+	if rtmp.Stream == nil {
+		return errors.New("no stream")
+	}
+	if _, ok := conf.Encryption[rtmp.Stream.Path]; !ok {
+		return errors.New("no encryption key")
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return err
+	}
+	stream, err := newCTR(rtmp.Stream.Path, iv)
+	if err != nil {
+		return err
+	}
+	err = rtmp.SendMessage(RTMP_MSG_AMF0_COMMAND, &EncryptionMessage{
+		CommandMessage{CommandSetEncryption, 0},
+		map[string]any{"cipher": CipherAESCTR, "iv": hex.EncodeToString(iv)},
+		rtmp.StreamID,
+	})
+	if err == nil {
+		rtmp.encrypter = stream
+		rtmp.Info("payload encryption enabled")
+	}
+	return err
+}
+
+// encrypt 加密消息体的拷贝，不修改引擎中共享的数据
+func (rtmp *RTMPSender) encrypt(data []byte) []byte {
+	data = append([]byte(nil), data...)
+	rtmp.encrypter.XORKeyStream(data, data)
+	return data
+}
+
+// setDecryption 收到@setEncryption命令后开始解密之后的音视频消息体，密钥或参数不对时断开
+func (r *RTMPReceiver) setDecryption(msg *EncryptionMessage) {
+	if r.Stream == nil {
+		return
+	}
+	ivHex, _ := msg.Infomation["iv"].(string)
+	iv, err := hex.DecodeString(ivHex)
+	if err == nil {
+		if msg.Infomation["cipher"] != CipherAESCTR {
+			err = errors.New("unsupported cipher")
+		} else {
+			r.decrypter, err = newCTR(r.Stream.Path, iv)
+		}
+	}
+	if err != nil {
+		r.Error("set encryption", zap.Error(err))
+		r.Stop()
+		return
+	}
+	r.Info("payload decryption enabled")
+}
+
+// decrypt 就地解密收到的消息体
+func (r *RTMPReceiver) decrypt(msg *Chunk) {
+	if r.decrypter == nil {
+		return
+	}
+	for _, b := range msg.AVData.ToBuffers() {
+		r.decrypter.XORKeyStream(b, b)
+	}
+}
@@ -0,0 +1,76 @@
+package rtmp
+
+import (
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/codec"
+)
+
+// compositionTime 读取AVC/HEVC视频消息头中24位有符号的CompositionTime
+func compositionTime(b []byte) int32 {
+	return int32(uint32(b[0])<<24|uint32(b[1])<<16|uint32(b[2])<<8) >> 8
+}
+
+func putCompositionTime(b []byte, cts int32) {
+	b[0], b[1], b[2] = byte(cts>>16), byte(cts>>8), byte(cts)
+}
+
+// ctsMonitor 部分编码器在有B帧时发送负的CompositionTime，引擎按照无符号数解析会使PTS跳到约4.6小时之后。
+// 收到负值后将之后的视频DTS提前负值的最大幅度，同时增大CompositionTime，PTS保持不变
+type ctsMonitor struct {
+	NegativeCTS int    // 负CompositionTime的帧数
+	CTSShift    uint32 // 视频DTS提前的毫秒数
+	lastDTS     uint32 // 上一个调整过的视频DTS，推流中途增大提前量时DTS不能倒退
+	hasLastDTS  bool
+}
+
+// fixCompositionTime 在写入引擎之前将负的CompositionTime转换为非负值
+func (r *RTMPReceiver) fixCompositionTime(msg *Chunk) {
+	if msg.AVData.ByteLength < 5 || r.CTSShift == 0 && !hasNegativeCTS(msg) {
+		return
+	}
+	data := msg.AVData.ToBytes()
+	if codecID := codec.VideoCodecID(data[0] & 0x0f); codecID != codec.CodecID_H264 && codecID != codec.CodecID_H265 || data[1] != 1 {
+		return
+	}
+	cts := compositionTime(data[2:5])
+	if cts < 0 {
+		r.NegativeCTS++
+		if shift := uint32(-cts); shift > r.CTSShift {
+			r.Info("negative composition time, shift video dts", zap.Int32("cts", cts), zap.Uint32("shift", shift))
+			r.CTSShift = shift
+		}
+	}
+	shift := r.CTSShift
+	if msg.ExtendTimestamp < shift {
+		shift = msg.ExtendTimestamp
+	}
+	if cts += int32(shift); cts < 0 {
+		// PTS本身为负，只能从0开始
+		cts = 0
+	}
+	dts := msg.ExtendTimestamp - shift
+	if r.hasLastDTS && dts < r.lastDTS {
+		// 提前量在推流中途增大，DTS保持不小于上一帧，减小CompositionTime使PTS不变
+		cts -= int32(r.lastDTS - dts)
+		if cts < 0 {
+			cts = 0
+		}
+		dts = r.lastDTS
+	}
+	r.lastDTS, r.hasLastDTS = dts, true
+	msg.ExtendTimestamp = dts
+	mem := r.bytePool.Get(len(data))
+	copy(mem.Value, data)
+	putCompositionTime(mem.Value[2:5], cts)
+	msg.AVData.Recycle()
+	msg.AVData.Push(mem)
+}
+
+// hasNegativeCTS 不复制负载判断CompositionTime是否为负
+func hasNegativeCTS(msg *Chunk) bool {
+	reader := msg.AVData.NewReader()
+	reader.ReadByte()
+	b1, _ := reader.ReadByte()
+	b2, _ := reader.ReadByte()
+	return b1 == 1 && b2&0x80 != 0
+}
@@ -0,0 +1,50 @@
+package rtmp
+
+import (
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4"
+)
+
+// AudioOnlyDegrade 持续拥塞时停止发送视频只发送音频，拥塞缓解后在下一个关键帧恢复视频
+type AudioOnlyDegrade struct {
+	DegradeEnabled atomic.Bool // 在API中修改，发送协程中读取
+	audioOnly      atomic.Bool // 当前是否处于纯音频状态
+	DegradeCount   int32
+}
+
+// skipVideo 判断当前视频帧是否因为降级而不发送
+func (rtmp *RTMPSender) skipVideo(v engine.VideoFrame) bool {
+	d := &rtmp.AudioOnlyDegrade
+	degradeLag := rtmp.degradeLag()
+	if !d.DegradeEnabled.Load() || degradeLag <= 0 {
+		if d.audioOnly.Load() {
+			d.audioOnly.Store(false)
+			rtmp.video.firstSent.Store(false)
+		}
+		return false
+	}
+	lag := rtmp.insufficientBW.lag(v.AbsTime)
+	if !d.audioOnly.Load() {
+		if lag > degradeLag {
+			d.audioOnly.Store(true)
+			atomic.AddInt32(&d.DegradeCount, 1)
+			rtmp.Info("degrade to audio only", zap.Duration("lag", lag))
+			return true
+		}
+		return false
+	}
+	if lag < degradeLag/2 {
+		if !v.IFrame {
+			rtmp.waitKeyFrame()
+			return true
+		}
+		d.audioOnly.Store(false)
+		// 跳过了中间的视频帧，需要重新发送绝对时间戳
+		rtmp.video.firstSent.Store(false)
+		rtmp.Info("resume video", zap.Duration("lag", lag))
+		return false
+	}
+	return true
+}
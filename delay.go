@@ -0,0 +1,144 @@
+package rtmp
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type delayedMessage struct {
+	*Chunk
+	release time.Time
+	ex      bool // 绕过引擎转发或者多轨道的扩展消息，释放时再转换
+}
+
+// DelayBuffer 发布延迟缓冲，收到的音视频消息在延迟时间之后才写入引擎
+type DelayBuffer struct {
+	Delay         time.Duration
+	BufferedBytes int64 // 当前缓冲的字节数
+	Dropped       int64 // 超过内存上限丢弃的消息数
+	queue         chan delayedMessage
+	waitKeyFrame  bool
+}
+
+// delay 将消息放入延迟队列，返回false代表未开启延迟
+func (r *RTMPReceiver) delay(msg *Chunk) bool {
+	if r.Delay <= 0 {
+		return false
+	}
+	r.enqueueDelay(msg, false)
+	return true
+}
+
+// delayEx 扩展消息中绕过引擎转发的音视频和多轨道在转换时就会转发，开启延迟时不转换直接放入延迟队列，返回false代表不需要延迟
+func (r *RTMPReceiver) delayEx(msg *Chunk) bool {
+	if r.Delay <= 0 || !exBypass(msg) {
+		return false
+	}
+	r.enqueueDelay(msg, true)
+	return true
+}
+
+// exBypass 判断是否为绕过引擎转发的编码或者多轨道的扩展音视频消息
+func exBypass(msg *Chunk) bool {
+	reader := msg.AVData.NewReader()
+	var head [5]byte
+	for i := range head {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return false
+		}
+		head[i] = b
+	}
+	fourCc := string(head[1:])
+	if msg.MessageTypeID == RTMP_MSG_AUDIO {
+		return head[0]>>4 == SoundFormatExHeader && (head[0]&0x0f == AudioPacketTypeMultitrack || exAudioPassthrough[fourCc])
+	}
+	return head[0]&0x80 != 0 && (head[0]&0x0f == PacketTypeMultitrack || exPassthrough[fourCc])
+}
+
+func (r *RTMPReceiver) enqueueDelay(msg *Chunk, ex bool) {
+	if r.queue == nil {
+		r.queue = make(chan delayedMessage, 4096)
+		go r.releaseDelayed()
+	}
+	size := int64(msg.AVData.ByteLength)
+	isVideo := msg.MessageTypeID == RTMP_MSG_VIDEO
+	if r.waitKeyFrame && isVideo {
+		// 扩展视频头的最高位为1，FrameType同样在高4位的低3位
+		if b0, err := msg.AVData.NewReader().ReadByte(); err == nil && b0>>4&0x07 == 1 {
+			r.waitKeyFrame = false
+		}
+	}
+	// 等待关键帧时只丢弃视频，音频照常缓冲，没有视频的发布不会一直静音
+	waiting := r.waitKeyFrame && isVideo
+	if waiting || (conf.DelayMaxBytes > 0 && atomic.LoadInt64(&r.BufferedBytes)+size > conf.DelayMaxBytes) || !r.holdMessage(msg, "delay") {
+		if !waiting {
+			r.Warn("delay buffer full", zap.Int64("bytes", atomic.LoadInt64(&r.BufferedBytes)))
+		}
+		// 丢弃了视频帧之后需要等到下一个关键帧才能继续，丢弃音频只影响当前消息
+		r.waitKeyFrame = r.waitKeyFrame || isVideo
+		atomic.AddInt64(&r.Dropped, 1)
+		msg.AVData.Recycle()
+		return
+	}
+	// 先计入再放入队列，释放协程减去时不会出现负数
+	atomic.AddInt64(&r.BufferedBytes, size)
+	select {
+	case r.queue <- delayedMessage{msg, time.Now().Add(r.Delay), ex}:
+	default:
+		atomic.AddInt64(&r.BufferedBytes, -size)
+		r.releaseMessage(msg)
+		r.waitKeyFrame = r.waitKeyFrame || isVideo
+		atomic.AddInt64(&r.Dropped, 1)
+		msg.AVData.Recycle()
+	}
+}
+
+// dropDelayed 丢弃延迟队列中的消息
+func (r *RTMPReceiver) dropDelayed(m delayedMessage) {
+	atomic.AddInt64(&r.BufferedBytes, -int64(m.AVData.ByteLength))
+	r.releaseMessage(m.Chunk)
+	m.AVData.Recycle()
+}
+
+func (r *RTMPReceiver) releaseDelayed() {
+	timer := time.NewTimer(r.Delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-r.Done():
+			for {
+				select {
+				case m := <-r.queue:
+					r.dropDelayed(m)
+				default:
+					return
+				}
+			}
+		case m := <-r.queue:
+			if wait := time.Until(m.release); wait > 0 {
+				timer.Reset(wait)
+				select {
+				case <-timer.C:
+				case <-r.Done():
+					r.dropDelayed(m)
+					continue
+				}
+			}
+			atomic.AddInt64(&r.BufferedBytes, -int64(m.AVData.ByteLength))
+			r.releaseMessage(m.Chunk)
+			// 与读取和补帧的协程互斥写入引擎
+			r.gapMu.Lock()
+			if m.MessageTypeID == RTMP_MSG_AUDIO {
+				if !m.ex || r.convertExAudio(m.Chunk) {
+					r.writeAudio(m.Chunk)
+				}
+			} else if !m.ex || r.convertExVideo(m.Chunk) {
+				r.writeVideo(m.Chunk)
+			}
+			r.gapMu.Unlock()
+		}
+	}
+}
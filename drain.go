@@ -0,0 +1,119 @@
+package rtmp
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+// DrainStatus 排空模式的状态和进度
+type DrainStatus struct {
+	Draining      bool
+	RejectPublish bool // 拒绝新的推流
+	RejectPlay    bool // 拒绝新的播放
+	Since         time.Time
+	Deadline      time.Time `json:",omitempty"` // 到达后断开剩余的连接
+	Connections   int
+	Publishers    int
+	Subscribers   int
+	Pullers       int // 拉流同样是发布者，排空时拒绝新的拉流
+	Pushers       int // 推流同样是订阅者，排空时拒绝新的推流
+}
+
+var drain struct {
+	sync.RWMutex
+	DrainStatus
+	timer *time.Timer
+}
+
+// drainRejects 判断排空模式下是否拒绝新的推流或播放
+func drainRejects(publish bool) bool {
+	drain.RLock()
+	defer drain.RUnlock()
+	if publish {
+		return drain.RejectPublish
+	}
+	return drain.RejectPlay
+}
+
+func drainStatus() (status DrainStatus) {
+	drain.RLock()
+	status = drain.DrainStatus
+	drain.RUnlock()
+	connections.Range(func(key, value any) bool {
+		status.Connections++
+		return true
+	})
+	subscribers.Range(func(key, value any) bool {
+		status.Subscribers++
+		return true
+	})
+	for _, s := range filterStreams() {
+		switch s.Publisher.(type) {
+		case *RTMPReceiver:
+			status.Publishers++
+		case *RTMPPuller:
+			status.Pullers++
+		}
+	}
+	rangePaths(func(_ string, e *pathEntry) bool {
+		if e.pusher.Load() != nil {
+			status.Pushers++
+		}
+		return true
+	})
+	return
+}
+
+// closeConnections 排空超时后断开剩余的连接，并停止拉流和推流
+func closeConnections() {
+	connections.Range(func(key, value any) bool {
+		RTMPPlugin.Info("drain timeout, close connection", zap.Any("remote", key))
+		value.(*NetConnection).Close()
+		return true
+	})
+	for _, s := range filterStreams() {
+		if puller, ok := s.Publisher.(*RTMPPuller); ok {
+			RTMPPlugin.Info("drain timeout, stop pull", zap.String("streamPath", s.Path))
+			puller.Stop()
+		}
+	}
+	rangePaths(func(streamPath string, e *pathEntry) bool {
+		if pusher := e.pusher.Load(); pusher != nil {
+			RTMPPlugin.Info("drain timeout, stop push", zap.String("streamPath", streamPath))
+			pusher.Stop()
+		}
+		return true
+	})
+}
+
+// API_drain 开启或关闭排空模式，用于滚动重启：不再接受新的推流/播放，等待已有会话结束
+func (*RTMPConfig) API_drain(rw http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Has("enable") {
+		drain.Lock()
+		if drain.timer != nil {
+			drain.timer.Stop()
+			drain.timer = nil
+		}
+		if q.Get("enable") == "0" {
+			drain.DrainStatus = DrainStatus{}
+		} else {
+			drain.Draining = true
+			drain.RejectPublish = q.Get("publish") != "0"
+			drain.RejectPlay = q.Get("play") != "0"
+			drain.Since = time.Now()
+			drain.Deadline = time.Time{}
+			if timeout, err := time.ParseDuration(q.Get("timeout")); err == nil && timeout > 0 {
+				drain.Deadline = drain.Since.Add(timeout)
+				drain.timer = time.AfterFunc(timeout, closeConnections)
+			}
+		}
+		drain.Unlock()
+		RTMPPlugin.Info("drain", zap.String("enable", q.Get("enable")), zap.String("publish", q.Get("publish")), zap.String("play", q.Get("play")), zap.String("timeout", q.Get("timeout")))
+	}
+	util.ReturnJson(drainStatus, time.Second, rw, r)
+}
@@ -0,0 +1,534 @@
+package rtmp
+
+import (
+	"errors"
+	"net/url"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/codec"
+)
+
+// 增强rtmp（Enhanced RTMP）的视频编码FourCC
+const (
+	FourCC_AVC  = "avc1"
+	FourCC_HEVC = "hvc1"
+	FourCC_AV1  = "av01"
+	FourCC_VP9  = "vp09"
+	FourCC_VVC  = "vvc1"
+)
+
+// 增强rtmp的音频编码FourCC
+const (
+	FourCC_AAC  = "mp4a"
+	FourCC_OPUS = "Opus"
+	FourCC_AC3  = "ac-3"
+	FourCC_EAC3 = "ec-3"
+	FourCC_FLAC = "fLaC"
+)
+
+// videoFourCcInfoMap 中每个编码的能力
+const (
+	FourCcInfoCanDecode  = 0x01
+	FourCcInfoCanEncode  = 0x02
+	FourCcInfoCanForward = 0x04
+)
+
+// 增强rtmp扩展视频头的PacketType
+const (
+	PacketTypeSequenceStart        = 0
+	PacketTypeCodedFrames          = 1
+	PacketTypeSequenceEnd          = 2
+	PacketTypeCodedFramesX         = 3
+	PacketTypeMetadata             = 4
+	PacketTypeMPEG2TSSequenceStart = 5
+	PacketTypeMultitrack           = 6
+)
+
+// 增强rtmp扩展音频头的AudioPacketType
+const (
+	AudioPacketTypeSequenceStart      = 0
+	AudioPacketTypeCodedFrames        = 1
+	AudioPacketTypeSequenceEnd        = 2
+	AudioPacketTypeMultichannelConfig = 4
+	AudioPacketTypeMultitrack         = 5
+)
+
+// SoundFormatExHeader 音频消息第一个字节的高4位为9时是增强rtmp的扩展音频头
+const SoundFormatExHeader = 9
+
+// exVideoCodecs 增强rtmp的FourCC与转换成传统格式时使用的CodecID，传统rtmp没有定义CodecID的编码（AV1、VP9、VVC）不转换，见exPassthrough
+var exVideoCodecs = map[string]codec.VideoCodecID{
+	FourCC_HEVC: codec.CodecID_H265,
+}
+
+// hasCompositionTime 只有avc1和hvc1的CodedFrames带有CompositionTime
+func hasCompositionTime(fourCc string) bool {
+	return fourCc == FourCC_AVC || fourCc == FourCC_HEVC
+}
+
+// convertExVideo 将增强rtmp的扩展视频消息（例如OBS 29+推HEVC）转换成传统格式，返回false代表该消息丢弃
+func (r *RTMPReceiver) convertExVideo(msg *Chunk) bool {
+	if b0, err := msg.AVData.NewReader().ReadByte(); err != nil || b0&0x80 == 0 {
+		// 传统FLV中以CodecID 12表示HEVC，交给checkCodec根据配置判断是否接受
+		r.legacyHEVC = err == nil && codec.VideoCodecID(b0&0x0f) == codec.CodecID_H265
+		return true
+	}
+	data := msg.AVData.ToBytes()
+	if len(data) < 5 {
+		return true
+	}
+	if data[0]&0x0f == PacketTypeMultitrack {
+		return r.convertMultitrack(msg, data)
+	}
+	fourCc := string(data[1:5])
+	if data[0]&0x0f == PacketTypeMetadata {
+		r.receiveColorInfo(fourCc, data[5:])
+		return false
+	}
+	if exPassthrough[fourCc] {
+		r.forwardExVideo(fourCc, data, msg.ExtendTimestamp)
+		return false
+	}
+	if _, ok := exVideoCodecID(fourCc); !ok {
+		// 交给checkCodec处理不支持的编码
+		return true
+	}
+	header, payload, ok := r.legacyVideo(data[0], data[0]&0x0f, fourCc, data[5:])
+	if !ok {
+		return false
+	}
+	mem := r.bytePool.Get(len(header) + len(payload))
+	copy(mem.Value, header[:])
+	copy(mem.Value[len(header):], payload)
+	msg.AVData.Recycle()
+	msg.AVData.Push(mem)
+	return true
+}
+
+// exVideoCodecID 扩展视频头的FourCC对应的CodecID，avc1在增强rtmp v2中用于多轨道
+func exVideoCodecID(fourCc string) (codec.VideoCodecID, bool) {
+	if fourCc == FourCC_AVC {
+		return codec.CodecID_H264, true
+	}
+	codecID, ok := exVideoCodecs[fourCc]
+	return codecID, ok
+}
+
+// legacyVideo 生成扩展视频头中一个轨道的数据对应的传统格式的消息头，b0为扩展视频头的第一个字节，返回false代表该数据丢弃
+func (r *RTMPReceiver) legacyVideo(b0, packetType byte, fourCc string, payload []byte) (header [5]byte, body []byte, ok bool) {
+	codecID, _ := exVideoCodecID(fourCc)
+	header[0] = b0&0x70 | byte(codecID) // 保留FrameType
+	switch packetType {
+	case PacketTypeSequenceStart:
+		if err := r.checkExSequenceStart(fourCc, payload); err != nil {
+			r.Warn("invalid sequence start", zap.String("fourCC", fourCc), zap.Error(err))
+			return
+		}
+		header[1] = 0
+	case PacketTypeCodedFrames:
+		header[1] = 1
+		if hasCompositionTime(fourCc) {
+			if len(payload) < 3 {
+				return
+			}
+			copy(header[2:], payload[:3])
+			payload = payload[3:]
+		}
+	case PacketTypeCodedFramesX:
+		header[1] = 1
+	case PacketTypeSequenceEnd:
+		header[1] = 2
+	default:
+		return
+	}
+	return header, payload, true
+}
+
+// convertExAudio 将增强rtmp的扩展音频消息转换成传统格式，Opus保留扩展音频头绕过引擎转发，返回false代表该消息丢弃
+func (r *RTMPReceiver) convertExAudio(msg *Chunk) bool {
+	if b0, err := msg.AVData.NewReader().ReadByte(); err != nil || b0>>4 != SoundFormatExHeader {
+		return true
+	}
+	data := msg.AVData.ToBytes()
+	if len(data) < 5 {
+		return true
+	}
+	if data[0]&0x0f == AudioPacketTypeMultitrack {
+		return r.convertAudioMultitrack(msg, data)
+	}
+	fourCc := string(data[1:5])
+	if exAudioPassthrough[fourCc] {
+		if data[0]&0x0f == AudioPacketTypeMultichannelConfig {
+			r.receiveMultichannel(fourCc, data[5:])
+		}
+		r.forwardExAudio(fourCc, data, msg.ExtendTimestamp)
+		return false
+	}
+	if _, ok := exAudioCodecID(fourCc); !ok {
+		// 交给checkCodec处理不支持的编码
+		return true
+	}
+	if data[0]&0x0f == AudioPacketTypeMultichannelConfig {
+		r.receiveMultichannel(fourCc, data[5:])
+		return false
+	}
+	header, ok := legacyAudio(data[0]&0x0f, fourCc, data[5:])
+	if !ok {
+		return false
+	}
+	payload := data[5:]
+	mem := r.bytePool.Get(len(header) + len(payload))
+	copy(mem.Value, header)
+	copy(mem.Value[len(header):], payload)
+	msg.AVData.Recycle()
+	msg.AVData.Push(mem)
+	return true
+}
+
+// exAudioCodecID 扩展音频头的FourCC对应的CodecID，mp4a在增强rtmp v2中用于多轨道，.mp3转换成传统格式后按传统格式转发
+func exAudioCodecID(fourCc string) (codec.AudioCodecID, bool) {
+	switch fourCc {
+	case FourCC_AAC:
+		return codec.CodecID_AAC, true
+	case FourCC_MP3:
+		return CodecID_MP3, true
+	}
+	return 0, false
+}
+
+// isAudioFourCc 是否为音频编码的FourCC，包括绕过引擎转发的编码
+func isAudioFourCc(fourCc string) bool {
+	_, ok := exAudioCodecID(fourCc)
+	return ok || exAudioPassthrough[fourCc]
+}
+
+// legacyAudio 生成扩展音频头中一个轨道的数据对应的传统格式的消息头，返回false代表该数据丢弃
+func legacyAudio(packetType byte, fourCc string, payload []byte) (header []byte, ok bool) {
+	codecID, _ := exAudioCodecID(fourCc)
+	if hasAudioPacketType(codecID) {
+		// 44kHz、16bit、立体声
+		b0 := byte(codecID)<<4 | 0x0f
+		switch packetType {
+		case AudioPacketTypeSequenceStart:
+			return []byte{b0, 0}, true
+		case AudioPacketTypeCodedFrames:
+			return []byte{b0, 1}, true
+		}
+		return nil, false
+	}
+	if packetType != AudioPacketTypeCodedFrames {
+		return nil, false
+	}
+	flags := byte(0x0e) // 44kHz、16bit
+	if len(payload) < 4 || payload[3]>>6 != 3 {
+		flags |= 0x01 // MP3帧头的声道模式不是单声道时为立体声
+	}
+	return []byte{byte(codecID)<<4 | flags}, true
+}
+
+// hasAudioPacketType 传统格式的AAC在SoundFormat之后有一个字节区分序列头和音频帧
+func hasAudioPacketType(codecID codec.AudioCodecID) bool {
+	return codecID == codec.CodecID_AAC
+}
+
+// checkExSequenceStart 校验扩展视频头的序列头中的解码配置
+func (r *RTMPReceiver) checkExSequenceStart(fourCc string, config []byte) error {
+	switch fourCc {
+	case FourCC_AV1:
+		c, err := parseAV1Config(config)
+		if err == nil {
+			r.Info("av1 config", zap.Uint8("profile", c.Profile), zap.Uint8("level", c.Level), zap.Int("bitDepth", c.BitDepth))
+		}
+		return err
+	case FourCC_VP9:
+		c, err := parseVP9Config(config)
+		if err == nil {
+			r.Info("vp9 config", zap.Uint8("profile", c.Profile), zap.Uint8("level", c.Level), zap.Int("bitDepth", c.BitDepth))
+		}
+		return err
+	}
+	return nil
+}
+
+// AV1Config AV1CodecConfigurationRecord中的主要字段
+type AV1Config struct {
+	Profile    byte
+	Level      byte
+	Tier       byte
+	BitDepth   int
+	Monochrome bool
+	ConfigOBUs []byte // 序列头OBU
+}
+
+func parseAV1Config(b []byte) (c AV1Config, err error) {
+	if len(b) < 4 {
+		return c, errors.New("av1 config too short")
+	}
+	// marker为1，version为1
+	if b[0] != 0x81 {
+		return c, errors.New("invalid av1 config marker or version")
+	}
+	c.Profile = b[1] >> 5
+	c.Level = b[1] & 0x1f
+	c.Tier = b[2] >> 7
+	c.BitDepth = 8
+	if b[2]&0x40 != 0 {
+		c.BitDepth = 10
+		if c.Profile == 2 && b[2]&0x20 != 0 {
+			c.BitDepth = 12
+		}
+	}
+	c.Monochrome = b[2]&0x10 != 0
+	c.ConfigOBUs = b[4:]
+	return
+}
+
+// VP9Config VPCodecConfigurationRecord（vpcC）中的主要字段
+type VP9Config struct {
+	Profile           byte
+	Level             byte
+	BitDepth          int
+	ChromaSubsampling byte
+	FullRange         bool
+}
+
+// parseVP9Config 解析VPCodecConfigurationRecord：profile(1) level(1) bitDepth|chromaSubsampling|fullRange(1) colourPrimaries(1)
+// transferCharacteristics(1) matrixCoefficients(1) codecInitializationDataSize(2)，FFmpeg等推流端会带上vpcC box的version(1) flags(3)
+func parseVP9Config(b []byte) (c VP9Config, err error) {
+	if len(b) >= 12 && b[0] == 1 && b[1] == 0 && b[2] == 0 && b[3] == 0 {
+		b = b[4:]
+	}
+	if len(b) < 8 {
+		return c, errors.New("vp9 config too short")
+	}
+	c.Profile = b[0]
+	c.Level = b[1]
+	c.BitDepth = int(b[2] >> 4)
+	c.ChromaSubsampling = (b[2] >> 1) & 0x07
+	c.FullRange = b[2]&0x01 != 0
+	if size := int(b[6])<<8 | int(b[7]); size > len(b)-8 {
+		return c, errors.New("vp9 config initialization data too short")
+	}
+	return
+}
+
+// exVideoFourCc 需要以扩展视频头发送的编码，HEVC在hevc为true时使用，AV1、VP9绕过引擎转发时保留扩展视频头
+func exVideoFourCc(b0 byte, hevc bool) string {
+	codecID := codec.VideoCodecID(b0 & 0x0f)
+	if codecID == codec.CodecID_H265 {
+		if hevc {
+			return FourCC_HEVC
+		}
+		return ""
+	}
+	for fourCc, id := range exVideoCodecs {
+		if id == codecID {
+			return fourCc
+		}
+	}
+	return ""
+}
+
+// exFourCcOf 引擎中的音频都以传统格式发送，Opus绕过引擎保留扩展音频头转发
+func (av *AVSender) exFourCcOf(b0 byte) string {
+	if av.MessageTypeID == RTMP_MSG_AUDIO {
+		return ""
+	}
+	return exVideoFourCc(b0, av.exVideo)
+}
+
+// toExVideo 将传统格式的视频消息转换成增强rtmp的扩展视频头
+func toExVideo(data []byte, fourCc string) []byte {
+	if len(data) < 5 || fourCc == "" {
+		return data
+	}
+	out := make([]byte, 5, len(data)+3)
+	out[0] = 0x80 | data[0]&0x70
+	copy(out[1:], fourCc)
+	switch data[1] {
+	case 0:
+		out[0] |= PacketTypeSequenceStart
+	case 1:
+		if !hasCompositionTime(fourCc) {
+			out[0] |= PacketTypeCodedFrames
+		} else if data[2] == 0 && data[3] == 0 && data[4] == 0 {
+			// CompositionTime为0时省略
+			out[0] |= PacketTypeCodedFramesX
+		} else {
+			out[0] |= PacketTypeCodedFrames
+			out = append(out, data[2:5]...)
+		}
+	case 2:
+		out[0] |= PacketTypeSequenceEnd
+		return out
+	default:
+		return data
+	}
+	return append(out, data[5:]...)
+}
+
+// fourCcList 转换成amf的严格数组
+func fourCcList(list []string) []any {
+	arr := make([]any, len(list))
+	for i, fourCc := range list {
+		arr[i] = fourCc
+	}
+	return arr
+}
+
+// fourCcInfoMap 服务端只转发不转码，所以通告的编码都只有CanForward能力，audio区分音频和视频编码
+func fourCcInfoMap(list []string, audio bool) map[string]any {
+	m := make(map[string]any, len(list))
+	for _, fourCc := range list {
+		if isAudioFourCc(fourCc) == audio {
+			m[fourCc] = FourCcInfoCanForward
+		}
+	}
+	return m
+}
+
+// videoFourCc 根据视频序列头得到编码的FourCC，兼容传统的CodecID和增强rtmp的扩展头
+func videoFourCc(seqHead []byte) string {
+	if len(seqHead) == 0 {
+		return ""
+	}
+	if seqHead[0]&0x80 != 0 {
+		if len(seqHead) < 5 {
+			return ""
+		}
+		return string(seqHead[1:5])
+	}
+	codecID := codec.VideoCodecID(seqHead[0] & 0x0f)
+	if codecID == codec.CodecID_H264 {
+		return FourCC_AVC
+	}
+	for fourCc, id := range exVideoCodecs {
+		if id == codecID {
+			return fourCc
+		}
+	}
+	return ""
+}
+
+// localFourCcList 推流的本地流实际携带的视频编码，用于在connect中和远端协商
+func (pusher *RTMPPusher) localFourCcList() []string {
+	if pusher.Stream == nil {
+		return nil
+	}
+	if p, ok := pusher.Stream.Publisher.(IRTMPReceiver); ok {
+		if snapshot := p.GetReceiver().snapshot.Load(); snapshot != nil {
+			if fourCc := videoFourCc(snapshot.SequenceHead); fourCc != "" && !(fourCc == FourCC_HEVC && legacyHEVCTarget(pusher.RemoteURL)) {
+				return []string{fourCc}
+			}
+		}
+		if fourCc := p.GetReceiver().passthroughFourCc(); fourCc != "" {
+			return []string{fourCc}
+		}
+	}
+	return nil
+}
+
+// legacyHEVCTarget 远端是否只接受传统FLV CodecID 12的HEVC（例如旧版SRS、部分CDN节点）
+func legacyHEVCTarget(remoteURL string) bool {
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		return false
+	}
+	for _, host := range conf.LegacyHEVCPush {
+		if host == u.Host || host == u.Hostname() {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFourCcList 解析connect命令中对端通告的fourCcList
+func parseFourCcList(v any) (list []string) {
+	if arr, ok := v.([]any); ok {
+		for _, item := range arr {
+			if fourCc, ok := item.(string); ok {
+				list = append(list, fourCc)
+			}
+		}
+	}
+	return
+}
+
+// 增强rtmp在connect中通告的capsEx扩展能力
+const (
+	CapsExReconnect           = 0x01
+	CapsExMultitrack          = 0x04
+	CapsExModEx               = 0x08
+	CapsExTimestampNanoOffset = 0x10
+)
+
+// localCapsEx 本端支持的扩展能力
+const localCapsEx = CapsExMultitrack
+
+// Capabilities 对端在connect中通告的增强rtmp能力
+type Capabilities struct {
+	FourCcList      []string       `json:",omitempty"`
+	VideoFourCcInfo map[string]int `json:",omitempty"` // 每个视频编码的能力（FourCcInfoCan*）
+	AudioFourCcInfo map[string]int `json:",omitempty"` // 每个音频编码的能力（FourCcInfoCan*）
+	CapsEx          int            `json:",omitempty"`
+}
+
+// parseCapabilities 解析connect命令对象或者_result的属性中的增强rtmp能力
+func parseCapabilities(obj map[string]any) (c Capabilities) {
+	c.FourCcList = parseFourCcList(obj["fourCcList"])
+	c.VideoFourCcInfo = parseFourCcInfoMap(obj["videoFourCcInfoMap"])
+	c.AudioFourCcInfo = parseFourCcInfoMap(obj["audioFourCcInfoMap"])
+	if capsEx, ok := obj["capsEx"].(float64); ok {
+		c.CapsEx = int(capsEx)
+	}
+	return
+}
+
+func parseFourCcInfoMap(v any) map[string]int {
+	m, ok := v.(map[string]any)
+	if !ok || len(m) == 0 {
+		return nil
+	}
+	info := make(map[string]int, len(m))
+	for fourCc, v := range m {
+		if can, ok := v.(float64); ok {
+			info[fourCc] = int(can)
+		}
+	}
+	return info
+}
+
+// Supports 对端是否可以接收该编码，通告了FourCcInfoMap时以其中的能力为准，"*"代表所有编码
+func (c *Capabilities) Supports(fourCc string) bool {
+	info := c.VideoFourCcInfo
+	if isAudioFourCc(fourCc) {
+		info = c.AudioFourCcInfo
+	}
+	if info != nil {
+		return (info[fourCc]|info["*"])&(FourCcInfoCanDecode|FourCcInfoCanForward) != 0
+	}
+	for _, f := range c.FourCcList {
+		if f == fourCc || f == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Multitrack 对端是否支持增强rtmp v2的多轨道
+func (c *Capabilities) Multitrack() bool {
+	return c.CapsEx&CapsExMultitrack != 0
+}
+
+// capabilityProps 本端在connect命令或者响应中通告的增强rtmp能力，list为可以接收或者转发的编码
+func capabilityProps(list []string) map[string]any {
+	props := map[string]any{"capsEx": localCapsEx}
+	if len(list) > 0 {
+		props["fourCcList"] = fourCcList(list)
+		props["videoFourCcInfoMap"] = fourCcInfoMap(list, false)
+		if audio := fourCcInfoMap(list, true); len(audio) > 0 {
+			props["audioFourCcInfoMap"] = audio
+		}
+	}
+	return props
+}
@@ -24,6 +24,8 @@ const (
 	NetStream_Play_Switch         = "NetStream.Play.Switch"
 	NetStream_Play_Complete       = "NetStream.Play.Complete"
 
+	NetStream_Play_InsufficientBW = "NetStream.Play.InsufficientBW" // "warning" 客户端没有足够的带宽以正常速度播放数据.
+
 	NetStream_Data_Start = "NetStream.Data.Start"
 
 	NetStream_Publish_Start     = "NetStream.Publish.Start"     // "status"	已经成功发布.
@@ -31,6 +33,11 @@ const (
 	NetStream_Publish_Idle      = "NetStream.Publish.Idle"      // "status"	流发布者空闲而没有在传输数据.
 	NetStream_Unpublish_Success = "NetStream.Unpublish.Success" // "status"	已成功执行取消发布操作.
 
+	NetStream_Publish_BitrateExceeded = "NetStream.Publish.BitrateExceeded" // "warning"或"error" 发布码率持续超过限制.
+	NetStream_Publish_GOPExceeded     = "NetStream.Publish.GOPExceeded"     // "error" 关键帧间隔超过限制.
+
+	NetStream_Publish_Rejected = "NetStream.Publish.Rejected" // "error" 发布被拒绝，例如使用了不支持的编码.
+
 	NetStream_Buffer_Empty   = "NetStream.Buffer.Empty"   // "status" 数据的接收速度不足以填充缓冲区.数据流将在缓冲区重新填充前中断,此时将发送 NetStream.Buffer.Full 消息,并且该流将重新开始播放
 	NetStream_Buffer_Full    = "NetStream.Buffer.Full"    // "status" 缓冲区已满并且流将开始播放
 	NetStream_Buffe_Flush    = "NetStream.Buffer.Flush"   // "status" 数据已完成流式处理,剩余的缓冲区将被清空
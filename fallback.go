@@ -0,0 +1,52 @@
+package rtmp
+
+import (
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// fallbackState 发布者断开时，订阅者切换到备用流，发布者恢复后切换回来
+type fallbackState struct {
+	fallback        *RTMPSender
+	isFallback      bool
+	lastAbsTime     uint32 // 最后一次发送的时间戳
+	timestampOffset uint32 // 备用流的时间戳从切换前的时间戳继续
+}
+
+func (rtmp *RTMPSender) startFallback() {
+	if rtmp.isFallback || rtmp.fallback != nil || rtmp.Stream == nil {
+		return
+	}
+	fallbackPath, ok := conf.Fallback[rtmp.Stream.Path]
+	if !ok {
+		return
+	}
+	fb := &RTMPSender{}
+	fb.NetStream = rtmp.NetStream
+	fb.isFallback = true
+	fb.timestampOffset = rtmp.lastAbsTime
+	fb.ID = rtmp.ID + "|fallback"
+	fb.SetParentCtx(rtmp.Context)
+	if err := RTMPPlugin.Subscribe(fallbackPath, fb); err != nil {
+		rtmp.Error("fallback", zap.String("streamPath", fallbackPath), zap.Error(err))
+		return
+	}
+	rtmp.Info("switch to fallback", zap.String("streamPath", fallbackPath))
+	rtmp.fallback = fb
+	go fb.PlayRaw()
+}
+
+func (rtmp *RTMPSender) stopFallback() {
+	if rtmp.fallback == nil {
+		return
+	}
+	rtmp.Info("switch back from fallback")
+	atomic.StoreUint32(&rtmp.lastAbsTime, atomic.LoadUint32(&rtmp.fallback.lastAbsTime))
+	rtmp.fallback.Stop()
+	rtmp.fallback = nil
+	// 主流的第一帧从备用流最后的时间戳继续，同时重新发送完整的消息头
+	rtmp.resyncing = true
+	rtmp.audio.firstSent.Store(false)
+	rtmp.video.firstSent.Store(false)
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package rtmp
+
+import "syscall"
+
+// fdLimit 进程的文件描述符上限
+func fdLimit() int {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0
+	}
+	return int(rlimit.Cur)
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+package rtmp
+
+// fdLimit windows没有文件描述符上限，只能通过MaxConnections配置
+func fdLimit() int {
+	return 0
+}
@@ -0,0 +1,216 @@
+package rtmp
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/util"
+)
+
+// gapCheckInterval 检查源站音频是否中断的间隔
+const gapCheckInterval = 20 * time.Millisecond
+
+// gapHoldInterval 视频中断期间重复最后一个关键帧的间隔，只用于保持视频时间戳推进
+const gapHoldInterval = time.Second
+
+// AAC-LC的静音帧（原始数据块），以声道数为下标
+var aacSilentFrames = [...][]byte{
+	1: {0x00, 0xc8, 0x00, 0x80, 0x23, 0x80},
+	2: {0x21, 0x00, 0x49, 0x90, 0x02, 0x19, 0x00, 0x23, 0x80},
+}
+
+// gapFiller 拉流时源站短暂中断（音频不再到达但连接仍在）期间按帧间隔补发静音帧，
+// 同时按gapHoldInterval重复最后一个关键帧保持视频时间戳推进，
+// 避免下游对时间戳连续性要求严格的CDN因为中断断开推流。静音帧只支持AAC-LC单声道、立体声和G.711
+type gapFiller struct {
+	gapMu        sync.Mutex // 读取、补帧和发布延迟的协程互斥写入引擎
+	gapEnabled   bool
+	gapHeader    byte      // 最近一个音频消息的第一个字节（编码、采样率、声道）
+	gapChannels  byte      // AAC序列头中的声道数
+	gapSize      int       // 最近一个音频消息的长度，G.711按此生成静音
+	gapDelta     uint32    // 源站连续两个音频帧的时间戳间隔
+	gapLastTs    uint32    // 最近写入的音频时间戳，包括静音帧
+	gapRealTs    uint32    // 最近一个源站音频帧的时间戳
+	gapRealWall  time.Time // 最近一个源站音频帧的到达时间
+	gapFilled    int       // 本次中断补发的静音帧数
+	GapCount     int       // 补过静音帧的中断次数
+	GapFrames    int       // 补发的静音帧总数
+	gapVideoTs   uint32    // 最近写入的视频时间戳，包括重复的关键帧
+	gapVideoReal uint32    // 最近一个源站视频帧的时间戳
+	gapVideoWall time.Time // 最近一个源站视频帧的到达时间
+	gapHeld      int       // 本次中断重复的关键帧数
+	HeldFrames   int       // 重复的关键帧总数
+}
+
+// resetGap 每次连接源站时重新开始统计帧间隔
+func (g *gapFiller) resetGap(enabled bool) {
+	g.gapMu.Lock()
+	defer g.gapMu.Unlock()
+	g.gapEnabled = enabled
+	g.gapHeader, g.gapChannels, g.gapSize, g.gapDelta, g.gapFilled = 0, 0, 0, 0, 0
+	g.gapRealWall, g.gapVideoWall, g.gapHeld = time.Time{}, time.Time{}, 0
+}
+
+// observeGap 记录源站的音频帧，返回false代表该帧与已经补发的静音重叠，丢弃以保证时间戳递增
+func (r *RTMPReceiver) observeGap(msg *Chunk) bool {
+	if !r.gapEnabled || msg.AVData.ByteLength < 2 {
+		return true
+	}
+	reader := msg.AVData.NewReader()
+	b0, _ := reader.ReadByte()
+	b1, _ := reader.ReadByte()
+	switch codec.AudioCodecID(b0 >> 4) {
+	case codec.CodecID_AAC:
+		if b1 == 0 {
+			// AudioSpecificConfig的channelConfiguration
+			reader.ReadByte()
+			if b3, err := reader.ReadByte(); err == nil {
+				r.gapChannels = b3 >> 3 & 0x0f
+			}
+			return true
+		}
+	case codec.CodecID_PCMA, codec.CodecID_PCMU:
+	default:
+		r.gapHeader = 0
+		return true
+	}
+	ts := msg.ExtendTimestamp
+	if r.gapFilled > 0 {
+		if ts <= r.gapLastTs {
+			msg.AVData.Recycle()
+			return false
+		}
+		r.Info("audio gap filled", zap.Int("frames", r.gapFilled), zap.Duration("gap", time.Since(r.gapRealWall)))
+		r.gapFilled = 0
+	} else if !r.gapRealWall.IsZero() && ts > r.gapRealTs && ts-r.gapRealTs < 500 {
+		r.gapDelta = ts - r.gapRealTs
+	}
+	r.gapHeader, r.gapSize = b0, msg.AVData.ByteLength
+	r.gapLastTs, r.gapRealTs, r.gapRealWall = ts, ts, time.Now()
+	return true
+}
+
+// observeVideoGap 记录源站的视频帧，重复过关键帧之后丢弃时间戳重叠的帧和下一个关键帧之前的帧
+func (r *RTMPReceiver) observeVideoGap(msg *Chunk) bool {
+	if !r.gapEnabled {
+		return true
+	}
+	keyFrame, seqHead := parseVideoHeader(msg)
+	if seqHead {
+		return true
+	}
+	ts := msg.ExtendTimestamp
+	if r.gapHeld > 0 {
+		// 解码器停在重复的关键帧上，之后的帧参考不到，等到下一个关键帧
+		if ts <= r.gapVideoTs || !keyFrame {
+			msg.AVData.Recycle()
+			return false
+		}
+		r.Info("video gap held", zap.Int("frames", r.gapHeld), zap.Duration("gap", time.Since(r.gapVideoWall)))
+		r.gapHeld = 0
+	}
+	r.gapVideoTs, r.gapVideoReal, r.gapVideoWall = ts, ts, time.Now()
+	return true
+}
+
+// holdVideo 源站视频中断超过gapHoldInterval并且不超过PullGapFill时，重复最后一个关键帧到墙上时间
+func (r *RTMPReceiver) holdVideo(now time.Time) {
+	if r.gapVideoWall.IsZero() {
+		return
+	}
+	since := now.Sub(r.gapVideoWall)
+	if since < gapHoldInterval || since > conf.PullGapFill {
+		return
+	}
+	snapshot := r.snapshot.Load()
+	if snapshot == nil {
+		return
+	}
+	step := uint32(gapHoldInterval / time.Millisecond)
+	target := r.gapVideoReal + uint32(since/time.Millisecond)
+	for r.gapVideoTs+step <= target {
+		if r.gapHeld == 0 {
+			r.Warn("video gap, hold last key frame", zap.Uint32("timestamp", r.gapVideoTs))
+		}
+		r.gapVideoTs += step
+		msg := &Chunk{}
+		msg.MessageTypeID = RTMP_MSG_VIDEO
+		msg.MessageStreamID = r.StreamID
+		msg.MessageLength = uint32(len(snapshot.Payload))
+		msg.ExtendTimestamp = r.gapVideoTs
+		msg.AVData.Push(&util.ListItem[util.Buffer]{Value: append(util.Buffer(nil), snapshot.Payload...)})
+		r.deliver(msg)
+		r.gapHeld++
+		r.HeldFrames++
+	}
+}
+
+// silentFrame 与源站格式相同的静音音频消息体
+func (r *RTMPReceiver) silentFrame() []byte {
+	switch codec.AudioCodecID(r.gapHeader >> 4) {
+	case codec.CodecID_AAC:
+		if int(r.gapChannels) >= len(aacSilentFrames) || aacSilentFrames[r.gapChannels] == nil {
+			return nil
+		}
+		return append([]byte{r.gapHeader, 1}, aacSilentFrames[r.gapChannels]...)
+	case codec.CodecID_PCMA:
+		return append([]byte{r.gapHeader}, bytes.Repeat([]byte{0xd5}, r.gapSize-1)...)
+	case codec.CodecID_PCMU:
+		return append([]byte{r.gapHeader}, bytes.Repeat([]byte{0xff}, r.gapSize-1)...)
+	}
+	return nil
+}
+
+// fillGap 源站音频落后于墙上时间超过两个帧间隔并且不超过PullGapFill时，补发静音帧到墙上时间
+func (r *RTMPReceiver) fillGap(now time.Time) {
+	if r.gapDelta == 0 || r.gapHeader == 0 || r.gapRealWall.IsZero() {
+		return
+	}
+	since := now.Sub(r.gapRealWall)
+	delta := time.Duration(r.gapDelta) * time.Millisecond
+	if since < 2*delta || since > conf.PullGapFill {
+		return
+	}
+	silent := r.silentFrame()
+	if silent == nil {
+		return
+	}
+	target := r.gapRealTs + uint32(since/time.Millisecond)
+	for r.gapLastTs+r.gapDelta <= target {
+		if r.gapFilled == 0 {
+			r.GapCount++
+			r.Warn("audio gap, fill silence", zap.Uint32("timestamp", r.gapLastTs))
+		}
+		r.gapLastTs += r.gapDelta
+		msg := &Chunk{}
+		msg.MessageTypeID = RTMP_MSG_AUDIO
+		msg.MessageStreamID = r.StreamID
+		msg.MessageLength = uint32(len(silent))
+		msg.ExtendTimestamp = r.gapLastTs
+		// 补帧的协程不使用连接的内存池
+		msg.AVData.Push(&util.ListItem[util.Buffer]{Value: append(util.Buffer(nil), silent...)})
+		r.deliver(msg)
+		r.gapFilled++
+		r.GapFrames++
+	}
+}
+
+// fillGaps 在拉流期间定时检查源站音频是否中断
+func (r *RTMPReceiver) fillGaps(done <-chan struct{}) {
+	ticker := time.NewTicker(gapCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			r.gapMu.Lock()
+			r.fillGap(now)
+			r.holdVideo(now)
+			r.gapMu.Unlock()
+		}
+	}
+}
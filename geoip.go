@@ -0,0 +1,120 @@
+package rtmp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/oschwald/maxminddb-golang"
+	"go.uber.org/zap"
+)
+
+// GeoInfo 客户端的地理位置，来自MaxMind数据库
+type GeoInfo struct {
+	Country string `json:",omitempty"` // ISO 3166-1国家代码
+	ASN     uint32 `json:",omitempty"`
+	ASOrg   string `json:",omitempty"`
+}
+
+// geoRecord 国家数据库（Country、City）和ASN数据库中用到的字段
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	ASN   uint32 `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// geoCountryDB、geoASNDB 整个文件读入内存，重新加载时旧的数据库由GC回收，不需要等待正在进行的查询
+var geoCountryDB, geoASNDB atomic.Pointer[maxminddb.Reader]
+
+// openGeoIP 加载配置的MaxMind数据库，加载失败时保留原来的数据库
+func openGeoIP() {
+	load := func(path string, db *atomic.Pointer[maxminddb.Reader]) {
+		if path == "" {
+			db.Store(nil)
+			return
+		}
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			RTMPPlugin.Error("open geoip database", zap.String("path", path), zap.Error(err))
+			return
+		}
+		d, err := maxminddb.FromBytes(buf)
+		if err != nil {
+			RTMPPlugin.Error("open geoip database", zap.String("path", path), zap.Error(err))
+			return
+		}
+		db.Store(d)
+	}
+	load(conf.GeoIPCountryDB, &geoCountryDB)
+	load(conf.GeoIPASNDB, &geoASNDB)
+}
+
+// lookupGeo 查询客户端的地理位置，没有配置数据库时返回nil
+func lookupGeo(addr net.Addr) *GeoInfo {
+	countryDB, asnDB := geoCountryDB.Load(), geoASNDB.Load()
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || countryDB == nil && asnDB == nil {
+		return nil
+	}
+	geo := &GeoInfo{}
+	if countryDB != nil {
+		var rec geoRecord
+		if err := countryDB.Lookup(tcpAddr.IP, &rec); err == nil {
+			geo.Country = rec.Country.ISOCode
+			if geo.Country == "" {
+				// City数据库中部分地址只有注册国家
+				geo.Country = rec.RegisteredCountry.ISOCode
+			}
+		}
+	}
+	if asnDB != nil {
+		var rec geoRecord
+		if err := asnDB.Lookup(tcpAddr.IP, &rec); err == nil {
+			geo.ASN, geo.ASOrg = rec.ASN, rec.ASOrg
+		}
+	}
+	return geo
+}
+
+// match 规则为国家代码（例如CN）或者AS加ASN（例如AS4134）
+func (g *GeoInfo) match(rule string) bool {
+	if g == nil {
+		return false
+	}
+	if len(rule) > 2 && strings.EqualFold(rule[:2], "AS") {
+		asn, err := strconv.ParseUint(rule[2:], 10, 32)
+		return err == nil && g.ASN != 0 && uint32(asn) == g.ASN
+	}
+	return g.Country != "" && strings.EqualFold(rule, g.Country)
+}
+
+// checkGeo 按照应用的地理位置访问策略检查客户端，先匹配拒绝列表，配置了允许列表时只允许列表中的客户端
+func checkGeo(geo *GeoInfo, appName string, publish bool) error {
+	allow, deny := conf.GeoPlayAllow[appName], conf.GeoPlayDeny[appName]
+	if publish {
+		allow, deny = conf.GeoPublishAllow[appName], conf.GeoPublishDeny[appName]
+	}
+	for _, rule := range strings.Split(deny, ",") {
+		if geo.match(strings.TrimSpace(rule)) {
+			return fmt.Errorf("geo denied by %s", rule)
+		}
+	}
+	if allow == "" {
+		return nil
+	}
+	for _, rule := range strings.Split(allow, ",") {
+		if geo.match(strings.TrimSpace(rule)) {
+			return nil
+		}
+	}
+	return errors.New("geo not allowed")
+}
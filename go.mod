@@ -3,7 +3,9 @@ module m7s.live/plugin/rtmp/v4
 go 1.19
 
 require (
+	github.com/oschwald/maxminddb-golang v1.10.0
 	go.uber.org/zap v1.23.0
+	golang.org/x/crypto v0.4.0
 	m7s.live/engine/v4 v4.11.4
 )
 
@@ -33,7 +35,6 @@ require (
 	github.com/yusufpapurcu/wmi v1.2.2 // indirect
 	go.uber.org/atomic v1.10.0 // indirect
 	go.uber.org/multierr v1.8.0 // indirect
-	golang.org/x/crypto v0.4.0 // indirect
 	golang.org/x/exp v0.0.0-20221205204356-47842c84f3db // indirect
 	golang.org/x/mod v0.7.0 // indirect
 	golang.org/x/net v0.7.0 // indirect
@@ -73,9 +73,15 @@ func ReadBuf(r io.Reader, length int) (buf []byte) {
 }
 
 func (nc *NetConnection) Handshake() error {
-	C0C1 := ReadBuf(nc.Reader, C1S1_SIZE+1)
-	if C0C1[0] != RTMP_HANDSHAKE_VERSION {
-		return errors.New("C0 Error")
+	// 先检查版本号，扫描器发送的其他协议的数据可能不足C0C1的长度
+	if C0, err := nc.Reader.Peek(1); err != nil {
+		return err
+	} else if C0[0] != RTMP_HANDSHAKE_VERSION {
+		return &handshakeError{HandshakeBadVersion, errors.New("C0 Error")}
+	}
+	C0C1 := make([]byte, C1S1_SIZE+1)
+	if _, err := io.ReadFull(nc.Reader, C0C1); err != nil {
+		return err
 	}
 	var C1 = C0C1[1:]
 	if len(C1) != C1S1_SIZE {
@@ -99,8 +105,11 @@ func (client *NetConnection) ClientHandshake() (err error) {
 		if _, err = io.ReadFull(client.Reader, C0C1); err == nil {
 			if C0C1[0] != RTMP_HANDSHAKE_VERSION {
 				err = errors.New("S1 C1 Error")
-				// C2
-			} else if _, err = client.Write(C0C1[1:]); err == nil {
+				return
+			}
+			client.serverSig = append([]byte(nil), C0C1[len(C0C1)-32:]...)
+			// C2
+			if _, err = client.Write(C0C1[1:]); err == nil {
 				_, err = io.ReadFull(client.Reader, C0C1[1:]) // S2
 			}
 		}
@@ -113,10 +122,15 @@ func (nc *NetConnection) simple_handshake(C1 []byte) error {
 	S0S1[0] = RTMP_HANDSHAKE_VERSION
 	util.PutBE(S0S1[1:5], time.Now().Unix()&0xFFFFFFFF)
 	copy(S0S1[5:], "Monibuca")
+	nc.serverSig = S0S1[len(S0S1)-32:]
 	nc.Write(S0S1)
 	nc.Write(C1) // S2
-	if C2 := ReadBuf(nc.Reader, C1S1_SIZE); bytes.Compare(C2[8:], S0S1[9:]) != 0 {
-		return errors.New("C2 Error")
+	C2 := make([]byte, C1S1_SIZE)
+	if _, err := io.ReadFull(nc.Reader, C2); err != nil {
+		return err
+	}
+	if bytes.Compare(C2[8:], S0S1[9:]) != 0 {
+		return &handshakeError{HandshakeDigest, errors.New("C2 Error")}
 	}
 	return nil
 }
@@ -125,12 +139,12 @@ func (nc *NetConnection) complex_handshake(C1 []byte) error {
 	// 验证客户端,digest偏移位置和scheme由客户端定.
 	scheme, challenge, digest, ok, err := validateClient(C1)
 	if err != nil {
-		return err
+		return &handshakeError{HandshakeDigest, err}
 	}
 
 	if !ok {
 		fmt.Printf("digested handshake, scheme : %v\nchallenge : %v\ndigest : %v\nok : %v\nerr : %v\n", scheme, challenge, digest, ok, err)
-		return errors.New("validateClient failed")
+		return &handshakeError{HandshakeDigest, errors.New("validateClient failed")}
 	}
 
 	// s1
@@ -168,11 +182,12 @@ func (nc *NetConnection) complex_handshake(C1 []byte) error {
 		return err
 	}
 
+	nc.serverSig = S1[len(S1)-32:]
 	buffer := net.Buffers{[]byte{RTMP_HANDSHAKE_VERSION}, S1, S2_Random, S2_Digest}
 	buffer.WriteTo(nc)
 
-	ReadBuf(nc.Reader, 1536)
-	return nil
+	_, err = io.ReadFull(nc.Reader, make([]byte, 1536))
+	return err
 }
 
 func validateClient(C1 []byte) (scheme int, challenge []byte, digest []byte, ok bool, err error) {
@@ -0,0 +1,25 @@
+package rtmp
+
+import (
+	"sync"
+)
+
+var eventHandlers struct {
+	sync.RWMutex
+	list []func(event any)
+}
+
+// OnRTMPEvent 注册rtmp插件事件的回调，用于对接告警、监控等外部系统
+func OnRTMPEvent(handler func(event any)) {
+	eventHandlers.Lock()
+	defer eventHandlers.Unlock()
+	eventHandlers.list = append(eventHandlers.list, handler)
+}
+
+func emitEvent(event any) {
+	eventHandlers.RLock()
+	defer eventHandlers.RUnlock()
+	for _, handler := range eventHandlers.list {
+		handler(event)
+	}
+}
@@ -0,0 +1,163 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 回调的动作
+const (
+	HookConnect = "connect"
+	HookPublish = "publish"
+	HookPlay    = "play"
+	HookDone    = "done"
+)
+
+// HookRequest 以POST（JSON）发送给OnConnect、OnPublish、OnPlay、OnDone地址的连接信息
+type HookRequest struct {
+	Action     string
+	App        string
+	Stream     string            `json:",omitempty"` // 不含参数的流名称，connect时为空
+	StreamPath string            `json:",omitempty"`
+	StreamID   uint32            `json:",omitempty"`
+	IP         string            // 客户端IP
+	Remote     string            // 客户端地址，即连接ID
+	Args       map[string]string `json:",omitempty"` // 地址中的参数，同名参数取第一个
+	Done       string            `json:",omitempty"` // OnDone时结束的动作：publish、play
+	Time       time.Time
+	Labels     map[string]string `json:",omitempty"` // 会话标签，包括connect回调返回的标签
+}
+
+// HookResponse 回调返回2xx时可以在JSON响应中给会话设置标签，优先于地址中的label参数
+type HookResponse struct {
+	Labels map[string]string
+}
+
+// hookHiddenArgs 附加在app之后的adobe、llnw认证参数，不发送给回调
+var hookHiddenArgs = map[string]bool{"authmod": true, "user": true, "challenge": true, "response": true, "opaque": true, "salt": true, "nonce": true, "cnonce": true, "nc": true}
+
+// hookSlots 限制同时进行的鉴权回调数，nil为不限制
+var hookSlots chan struct{}
+
+// initHookSlots 按照HookConcurrency创建回调的并发槽，修改后需要重启生效
+func (c *RTMPConfig) initHookSlots() {
+	if c.HookConcurrency > 0 {
+		hookSlots = make(chan struct{}, c.HookConcurrency)
+	}
+}
+
+func hookURL(action string) string {
+	switch action {
+	case HookConnect:
+		return conf.OnConnect
+	case HookPublish:
+		return conf.OnPublish
+	case HookPlay:
+		return conf.OnPlay
+	}
+	return conf.OnDone
+}
+
+// newHookRequest fullPath为app/stream?args，connect时为app?args
+func (nc *NetConnection) newHookRequest(action, fullPath string, streamID uint32) *HookRequest {
+	path, rawQuery, _ := strings.Cut(fullPath, "?")
+	req := &HookRequest{Action: action, App: nc.appName, StreamID: streamID, Remote: nc.RemoteAddr().String(), Time: time.Now()}
+	if action == HookConnect {
+		// 没有开启adobe认证时appName仍然带有参数
+		req.App = path
+	} else {
+		req.StreamPath = path
+		req.Stream = strings.TrimPrefix(path, nc.appName+"/")
+	}
+	req.IP, _, _ = net.SplitHostPort(req.Remote)
+	req.Labels = (&NetStream{nc, streamID}).Labels()
+	if args, _ := url.ParseQuery(rawQuery); len(args) > 0 {
+		req.Args = make(map[string]string, len(args))
+		for k := range args {
+			if !hookHiddenArgs[k] {
+				req.Args[k] = args.Get(k)
+			}
+		}
+	}
+	return req
+}
+
+// checkHook 调用connect、publish、play的回调，返回2xx时允许，否则拒绝，响应的内容作为拒绝的原因。
+// 回调地址无法访问或者超过HookTimeout时同样拒绝，没有配置回调地址时允许。
+// 在读取协程中调用且不持有写锁，其他协程的发送不受影响；连接关闭时立即放弃
+func (nc *NetConnection) checkHook(action, fullPath string, streamID uint32) error {
+	hook := hookURL(action)
+	if hook == "" {
+		return nil
+	}
+	ctx := nc.ConnContext()
+	if conf.HookTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conf.HookTimeout)
+		defer cancel()
+	}
+	if hookSlots != nil {
+		select {
+		case hookSlots <- struct{}{}:
+			defer func() { <-hookSlots }()
+		case <-ctx.Done():
+			RTMPPlugin.Error("hook", zap.String("action", action), zap.String("url", hook), zap.Error(ctx.Err()))
+			return errors.New(action + " hook busy")
+		}
+	}
+	body, _ := json.Marshal(nc.newHookRequest(action, fullPath, streamID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook, bytes.NewReader(body))
+	if err != nil {
+		RTMPPlugin.Error("hook", zap.String("action", action), zap.String("url", hook), zap.Error(err))
+		return errors.New(action + " hook unavailable")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		RTMPPlugin.Error("hook", zap.String("action", action), zap.String("url", hook), zap.Error(err))
+		return errors.New(action + " hook unavailable")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		var res HookResponse
+		if json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&res) == nil {
+			ns := NetStream{nc, streamID}
+			for k, v := range res.Labels {
+				ns.SetLabel(k, v)
+			}
+		}
+		return nil
+	}
+	reason, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if len(bytes.TrimSpace(reason)) == 0 {
+		reason = []byte(resp.Status)
+	}
+	RTMPPlugin.Info("hook denied", zap.String("action", action), zap.String("path", fullPath), zap.Int("status", resp.StatusCode))
+	return errors.New(action + " denied: " + string(bytes.TrimSpace(reason)))
+}
+
+// hookDone 发布或者播放结束后通知OnDone地址，只通知不影响结果
+func (nc *NetConnection) hookDone(action, fullPath string, streamID uint32, done <-chan struct{}) {
+	if conf.OnDone == "" {
+		return
+	}
+	// 结束时会话标签可能已经随deleteStream删除，先保存一份
+	labels := (&NetStream{nc, streamID}).Labels()
+	<-done
+	req := nc.newHookRequest(HookDone, fullPath, streamID)
+	req.Done = action
+	if req.Labels == nil {
+		req.Labels = labels
+	}
+	postWebhook(conf.OnDone, req)
+}
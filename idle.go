@@ -0,0 +1,49 @@
+package rtmp
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// playIdleWatcher 记录正在进行的写操作的开始时间，写操作长时间不返回说明播放端已经不再读取数据
+type playIdleWatcher struct {
+	writeStart atomic.Int64 // 当前写操作开始的时间（UnixNano），0代表没有写操作
+}
+
+func (w *playIdleWatcher) beginWrite() {
+	w.writeStart.Store(time.Now().UnixNano())
+}
+
+func (w *playIdleWatcher) endWrite() {
+	w.writeStart.Store(0)
+}
+
+// watchIdle 定时检查写操作是否阻塞超过PlayIdleTimeout，超过则关闭该播放会话，避免僵尸订阅者占用统计和内存
+func (rtmp *RTMPSender) watchIdle() {
+	timeout := rtmp.idleTimeout()
+	if timeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rtmp.Done():
+			return
+		case <-ticker.C:
+			start := rtmp.writeStart.Load()
+			if start == 0 {
+				continue
+			}
+			if blocked := time.Since(time.Unix(0, start)); blocked > timeout {
+				rtmp.Warn("play idle timeout", zap.Duration("blocked", blocked))
+				// 中断阻塞的写操作
+				rtmp.SetWriteDeadline(time.Now())
+				rtmp.Stop(zap.String("reason", "idle timeout"))
+				return
+			}
+		}
+	}
+}
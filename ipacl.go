@@ -0,0 +1,148 @@
+package rtmp
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// ipRules 解析后的一组允许、拒绝规则
+type ipRules struct {
+	allow, deny []netip.Prefix
+	restricted  bool // 配置了允许规则，即使其中没有有效的规则也只允许列表中的IP
+}
+
+// ipACL 加载配置时解析的IP访问策略，推流和播放的规则以appName为key
+type ipACL struct {
+	accept  ipRules
+	publish map[string]ipRules
+	play    map[string]ipRules
+}
+
+var ipACLs atomic.Pointer[ipACL]
+
+// remoteIP 客户端地址中的IP，IPv4映射的IPv6地址转换成IPv4
+func remoteIP(addr net.Addr) (netip.Addr, bool) {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr().Unmap(), true
+}
+
+// parsePrefixes 规则为CIDR（例如10.0.0.0/8）或者单个IP，无效的规则忽略
+func parsePrefixes(rules []string) (prefixes []netip.Prefix) {
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		if !strings.Contains(rule, "/") {
+			addr, err := netip.ParseAddr(rule)
+			if err != nil {
+				RTMPPlugin.Warn("invalid ip rule", zap.String("rule", rule), zap.Error(err))
+				continue
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(rule)
+		if err != nil {
+			RTMPPlugin.Warn("invalid ip rule", zap.String("rule", rule), zap.Error(err))
+			continue
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return
+}
+
+func parseIPRules(allow, deny []string) ipRules {
+	return ipRules{allow: parsePrefixes(allow), deny: parsePrefixes(deny), restricted: len(allow) > 0}
+}
+
+func (r ipRules) empty() bool {
+	return !r.restricted && len(r.deny) == 0
+}
+
+// check 先匹配拒绝列表，配置了允许列表时只允许列表中的IP
+func (r ipRules) check(ip netip.Addr) error {
+	for _, prefix := range r.deny {
+		if prefix.Contains(ip) {
+			return errors.New("ip " + ip.String() + " denied by " + prefix.String())
+		}
+	}
+	if !r.restricted {
+		return nil
+	}
+	for _, prefix := range r.allow {
+		if prefix.Contains(ip) {
+			return nil
+		}
+	}
+	return errors.New("ip " + ip.String() + " not allowed")
+}
+
+// loadIPRules 加载配置时解析所有IP规则
+func (c *RTMPConfig) loadIPRules() {
+	acl := &ipACL{
+		accept:  parseIPRules(c.IPAllow, c.IPDeny),
+		publish: make(map[string]ipRules),
+		play:    make(map[string]ipRules),
+	}
+	for _, rules := range []struct {
+		m           map[string]ipRules
+		allow, deny map[string][]string
+	}{{acl.publish, c.IPPublishAllow, c.IPPublishDeny}, {acl.play, c.IPPlayAllow, c.IPPlayDeny}} {
+		for appName := range rules.allow {
+			rules.m[appName] = parseIPRules(rules.allow[appName], rules.deny[appName])
+		}
+		for appName := range rules.deny {
+			if _, ok := rules.m[appName]; !ok {
+				rules.m[appName] = parseIPRules(nil, rules.deny[appName])
+			}
+		}
+	}
+	ipACLs.Store(acl)
+}
+
+// acceptIP 接受连接时按照IPAllow、IPDeny检查客户端，此时还不知道应用
+func acceptIP(addr net.Addr) bool {
+	acl := ipACLs.Load()
+	if acl == nil || acl.accept.empty() {
+		return true
+	}
+	ip, ok := remoteIP(addr)
+	if !ok {
+		return false
+	}
+	if err := acl.accept.check(ip); err != nil {
+		RTMPPlugin.Debug("refuse connection", zap.String("remote", addr.String()), zap.Error(err))
+		return false
+	}
+	return true
+}
+
+// checkIP 按照应用的IP访问策略检查推流或者播放的客户端
+func checkIP(addr net.Addr, appName string, publish bool) error {
+	acl := ipACLs.Load()
+	if acl == nil {
+		return nil
+	}
+	rules := acl.play[appName]
+	if publish {
+		rules = acl.publish[appName]
+	}
+	if rules.empty() {
+		return nil
+	}
+	ip, ok := remoteIP(addr)
+	if !ok {
+		return errors.New("unknown client ip")
+	}
+	return rules.check(ip)
+}
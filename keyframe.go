@@ -0,0 +1,51 @@
+package rtmp
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// keyFrameWaiter 订阅者跳过视频后（降级恢复、屏蔽解除）等待关键帧的状态
+type keyFrameWaiter struct {
+	waitingKeyFrame atomic.Bool
+}
+
+// waitKeyFrame 标记订阅者正在等待关键帧，如果该流所有rtmp订阅者都在等待，则请求发布者尽快发送关键帧
+func (rtmp *RTMPSender) waitKeyFrame() {
+	if rtmp.waitingKeyFrame.Swap(true) || conf.KeyFrameRequest == "" || rtmp.Stream == nil {
+		return
+	}
+	receiver, ok := rtmp.Stream.Publisher.(*RTMPReceiver)
+	if !ok {
+		return
+	}
+	all := true
+	subscribers.Range(func(_, v any) bool {
+		if s := v.(*RTMPSubscriber); s.Stream == rtmp.Stream && !s.waitingKeyFrame.Load() {
+			all = false
+		}
+		return all
+	})
+	if all {
+		receiver.requestKeyFrame()
+	}
+}
+
+// requestKeyFrame 向发布者发送KeyFrameRequest自定义命令，部分编码器收到后会立即编码一个关键帧
+func (r *RTMPReceiver) requestKeyFrame() {
+	now := time.Now().UnixNano()
+	last := r.lastKeyFrameRequest.Load()
+	if now-last < int64(conf.KeyFrameRequestInterval) || !r.lastKeyFrameRequest.CompareAndSwap(last, now) {
+		return
+	}
+	m := new(ResponsePublishMessage)
+	m.CommandName = conf.KeyFrameRequest
+	m.StreamID = r.StreamID
+	if err := r.SendMessage(RTMP_MSG_AMF0_COMMAND, m); err != nil {
+		r.Warn("request keyframe", zap.Error(err))
+		return
+	}
+	r.Debug("request keyframe", zap.String("command", conf.KeyFrameRequest))
+}
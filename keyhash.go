@@ -0,0 +1,130 @@
+package rtmp
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 推流密钥：配置中只保存密钥的哈希（PHC字符串格式，例如bcrypt的$2b$10$...、argon2id的$argon2id$v=19$m=65536,t=3,p=4$盐$哈希），
+// 推流地址带上key参数，校验时按照哈希的算法标识选择KeyVerifier，配置文件泄露也无法得到可以直接使用的密钥
+
+// KeyVerifier 校验密钥与哈希是否匹配，哈希格式不正确时返回错误
+type KeyVerifier func(hash string, key string) (bool, error)
+
+var keyVerifiers = struct {
+	sync.RWMutex
+	m map[string]KeyVerifier
+}{m: map[string]KeyVerifier{
+	"2a":       verifyBcrypt,
+	"2b":       verifyBcrypt,
+	"2y":       verifyBcrypt,
+	"argon2id": verifyArgon2,
+	"argon2i":  verifyArgon2,
+}}
+
+// RegisterKeyVerifier 注册哈希算法标识（PHC字符串中第一个$之后的部分，例如scrypt）的校验函数，可以覆盖内置的bcrypt、argon2
+func RegisterKeyVerifier(scheme string, verifier KeyVerifier) {
+	keyVerifiers.Lock()
+	defer keyVerifiers.Unlock()
+	keyVerifiers.m[scheme] = verifier
+}
+
+// keyScheme 哈希的算法标识，不是$开头的（明文）返回空
+func keyScheme(hash string) string {
+	if !strings.HasPrefix(hash, "$") {
+		return ""
+	}
+	scheme, _, _ := strings.Cut(hash[1:], "$")
+	return scheme
+}
+
+func keyVerifier(hash string) KeyVerifier {
+	keyVerifiers.RLock()
+	defer keyVerifiers.RUnlock()
+	return keyVerifiers.m[keyScheme(hash)]
+}
+
+func verifyBcrypt(hash string, key string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(key))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// verifyArgon2 校验$argon2id$v=19$m=内存(KiB),t=迭代次数,p=并行度$盐$哈希，盐和哈希为不带填充的base64
+func verifyArgon2(hash string, key string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, errors.New("invalid argon2 hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errors.New("unsupported argon2 version")
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, errors.New("invalid argon2 params")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, err
+	}
+	sum, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, err
+	}
+	var derived []byte
+	if parts[1] == "argon2id" {
+		derived = argon2.IDKey([]byte(key), salt, time, memory, threads, uint32(len(sum)))
+	} else {
+		derived = argon2.Key([]byte(key), salt, time, memory, threads, uint32(len(sum)))
+	}
+	return subtle.ConstantTimeCompare(derived, sum) == 1, nil
+}
+
+// checkPublishKey 校验推流地址中的key参数，该流没有配置PublishKeys时不校验
+func checkPublishKey(fullPath string) error {
+	streamPath, rawQuery, _ := strings.Cut(fullPath, "?")
+	hash, ok := conf.PublishKeys[streamPath]
+	if !ok {
+		return nil
+	}
+	args, _ := url.ParseQuery(rawQuery)
+	key := args.Get("key")
+	if key == "" {
+		return errors.New("missing key")
+	}
+	verify := keyVerifier(hash)
+	if verify == nil {
+		return errors.New("unsupported key hash")
+	}
+	match, err := verify(hash, key)
+	if err != nil {
+		RTMPPlugin.Error("publish key", zap.String("streamPath", streamPath), zap.Error(err))
+		return errors.New("invalid key hash")
+	}
+	if !match {
+		return errors.New("invalid key")
+	}
+	return nil
+}
+
+// checkPublishKeys 加载配置时检查PublishKeys，明文或者没有注册校验函数的哈希会拒绝所有推流
+func (c *RTMPConfig) checkPublishKeys() {
+	for streamPath, hash := range c.PublishKeys {
+		if keyVerifier(hash) == nil {
+			RTMPPlugin.Warn("publish key is not a supported hash, publish will be rejected", zap.String("streamPath", streamPath), zap.String("scheme", keyScheme(hash)))
+		}
+	}
+}
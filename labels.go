@@ -0,0 +1,97 @@
+package rtmp
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+// SetLabel 给会话设置标签（例如租户、任务ID），value为空时删除
+func (ns *NetStream) SetLabel(key, value string) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if value == "" {
+		delete(ns.labels[ns.StreamID], key)
+		return
+	}
+	if ns.labels == nil {
+		ns.labels = make(map[uint32]map[string]string)
+	}
+	if ns.labels[ns.StreamID] == nil {
+		ns.labels[ns.StreamID] = make(map[string]string)
+	}
+	ns.labels[ns.StreamID][key] = value
+}
+
+// Labels 返回会话标签的拷贝，配置了GeoIP数据库时带上客户端的地理位置（geo.country、geo.asn），
+// 包括connect回调返回的连接标签（消息流ID为0）
+func (ns *NetStream) Labels() map[string]string {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	labels := make(map[string]string, len(ns.labels[0])+len(ns.labels[ns.StreamID])+2)
+	if geo := ns.geo; geo != nil {
+		if geo.Country != "" {
+			labels["geo.country"] = geo.Country
+		}
+		if geo.ASN != 0 {
+			labels["geo.asn"] = "AS" + strconv.FormatUint(uint64(geo.ASN), 10)
+		}
+	}
+	for k, v := range ns.labels[0] {
+		labels[k] = v
+	}
+	for k, v := range ns.labels[ns.StreamID] {
+		labels[k] = v
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+// parseLabels 读取推拉流地址中的?label=key:value参数，可以有多个；不覆盖回调返回的标签
+func (ns *NetStream) parseLabels(args url.Values) {
+	current := ns.Labels()
+	for _, label := range args["label"] {
+		if k, v, ok := strings.Cut(label, ":"); ok && k != "" {
+			if _, exists := current[k]; !exists {
+				ns.SetLabel(k, v)
+			}
+		}
+	}
+}
+
+func (ns *NetStream) labelFields() (fields []zap.Field) {
+	for k, v := range ns.Labels() {
+		fields = append(fields, zap.String("label."+k, v))
+	}
+	return
+}
+
+// API_label 设置会话标签，id为rtmp/api/connections中的远端地址和消息流ID，用|连接
+func (*RTMPConfig) API_label(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	remote, id, _ := strings.Cut(query.Get("id"), "|")
+	streamID, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		http.Error(rw, "invalid id", http.StatusBadRequest)
+		return
+	}
+	v, ok := connections.Load(remote)
+	if !ok {
+		http.Error(rw, "connection not found", http.StatusNotFound)
+		return
+	}
+	ns := NetStream{v.(*NetConnection), uint32(streamID)}
+	if key := query.Get("key"); key != "" {
+		ns.SetLabel(key, query.Get("value"))
+		rw.Write([]byte("ok"))
+		return
+	}
+	util.ReturnJson(ns.Labels, time.Second, rw, r)
+}
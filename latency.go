@@ -0,0 +1,105 @@
+package rtmp
+
+import (
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+// Latency 调试用的人为延迟，用于在本地复现客户反馈的缓冲、卡顿
+type Latency struct {
+	Delay  time.Duration // 固定延迟
+	Jitter time.Duration // 每帧额外的随机延迟，范围为[0, Jitter)
+	Since  time.Time
+}
+
+// latencyInjector 在发送音视频之前按照Latency等待，不影响同一个流的其他订阅者
+type latencyInjector struct {
+	latency       atomic.Pointer[Latency]
+	latencyFor    *Latency  // latencyOrigin对应的设置，设置变化时重新计算
+	latencyOrigin time.Time // 时间戳0对应的最早的墙上时间
+	latencyLast   uint32    // 上一帧的时间戳，时间戳回退时重新计算
+}
+
+// injectLatency 每一帧在时间戳对应的墙上时间之后再等待Delay和随机的抖动才发送，
+// 以最早到达的帧为基准，延迟不会因为等待而累积，播放开始时的关键帧缓存仍然一起发送
+func (rtmp *RTMPSender) injectLatency(absTime uint32) {
+	l := rtmp.latency.Load()
+	if l == nil {
+		rtmp.latencyFor = nil
+		return
+	}
+	now := time.Now()
+	origin := now.Add(-time.Duration(absTime) * time.Millisecond)
+	if rtmp.latencyFor != l || absTime < rtmp.latencyLast || origin.Before(rtmp.latencyOrigin) {
+		rtmp.latencyFor, rtmp.latencyOrigin = l, origin
+	}
+	rtmp.latencyLast = absTime
+	deadline := rtmp.latencyOrigin.Add(time.Duration(absTime)*time.Millisecond + l.Delay)
+	if l.Jitter > 0 {
+		deadline = deadline.Add(time.Duration(rand.Int63n(int64(l.Jitter))))
+	}
+	if d := deadline.Sub(now); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-rtmp.Subscriber.Done():
+		}
+	}
+}
+
+// latencySender 按照id查找播放者，按照streamPath查找推流
+func latencySender(id, streamPath string) *RTMPSender {
+	if id != "" {
+		if v, ok := subscribers.Load(id); ok {
+			return &v.(*RTMPSubscriber).RTMPSender
+		}
+		return nil
+	}
+	if p := runningPusher(streamPath); p != nil {
+		return &p.RTMPSender
+	}
+	return nil
+}
+
+// API_latency 对一个播放者（id）或者推流（streamPath）注入延迟和抖动，delay和jitter都为0时取消，只传id或者streamPath时返回当前的设置
+func (*RTMPConfig) API_latency(rw http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	sender := latencySender(q.Get("id"), q.Get("streamPath"))
+	if sender == nil {
+		http.Error(rw, "session not found", http.StatusNotFound)
+		return
+	}
+	if q.Has("delay") || q.Has("jitter") {
+		var l Latency
+		var err error
+		if s := q.Get("delay"); s != "" {
+			if l.Delay, err = time.ParseDuration(s); err != nil || l.Delay < 0 {
+				http.Error(rw, "invalid delay", http.StatusBadRequest)
+				return
+			}
+		}
+		if s := q.Get("jitter"); s != "" {
+			if l.Jitter, err = time.ParseDuration(s); err != nil || l.Jitter < 0 {
+				http.Error(rw, "invalid jitter", http.StatusBadRequest)
+				return
+			}
+		}
+		if l.Delay == 0 && l.Jitter == 0 {
+			sender.latency.Store(nil)
+			sender.Info("latency injection disabled")
+		} else {
+			l.Since = time.Now()
+			sender.latency.Store(&l)
+			sender.Warn("latency injection enabled", zap.Duration("delay", l.Delay), zap.Duration("jitter", l.Jitter))
+		}
+	}
+	util.ReturnJson(func() *Latency {
+		return sender.latency.Load()
+	}, time.Second, rw, r)
+}
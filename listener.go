@@ -0,0 +1,75 @@
+package rtmp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// listener 当前的rtmp监听，配置热更新时先打开新的监听再关闭旧的，已经建立的连接不受影响
+var listener struct {
+	sync.Mutex
+	addr string
+	l    net.Listener
+}
+
+// rebind 监听地址变化时切换到新的监听
+func (config *RTMPConfig) rebind() {
+	listener.Lock()
+	defer listener.Unlock()
+	if config.ListenAddr == listener.addr {
+		return
+	}
+	var l net.Listener
+	if config.ListenAddr != "" {
+		var err error
+		if l, err = net.Listen("tcp", config.ListenAddr); err != nil {
+			// 保留旧的监听，避免服务中断
+			RTMPPlugin.Error("listen", zap.String("listen addr", config.ListenAddr), zap.Error(err))
+			return
+		}
+		RTMPPlugin.Info("server rtmp start at", zap.String("listen addr", config.ListenAddr))
+		for i := 0; i < config.ListenNum || i == 0; i++ {
+			go config.accept(l)
+		}
+	}
+	if listener.l != nil {
+		RTMPPlugin.Info("server rtmp stop at", zap.String("listen addr", listener.addr))
+		listener.l.Close()
+	}
+	listener.l, listener.addr = l, config.ListenAddr
+}
+
+func (config *RTMPConfig) accept(l net.Listener) {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// 临时错误（例如文件描述符耗尽）时退避重试
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			RTMPPlugin.Warn("accept", zap.Error(err), zap.Duration("retry", delay))
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		if !acceptIP(conn.RemoteAddr()) || !admit() {
+			conn.Close()
+			continue
+		}
+		activeConns.Add(1)
+		go func() {
+			defer activeConns.Add(-1)
+			config.ServeTCP(conn.(*net.TCPConn))
+		}()
+	}
+}
@@ -1,7 +1,6 @@
 package rtmp
 
 import (
-	"context"
 	"net/http"
 	"strconv"
 	"time"
@@ -18,34 +17,151 @@ type RTMPConfig struct {
 	config.TCP
 	config.Pull
 	config.Push
-	ChunkSize int
-	KeepAlive bool //保持rtmp连接，默认随着stream的close而主动断开
+	ChunkSize               int
+	KeepAlive               bool              //保持rtmp连接，默认随着stream的close而主动断开
+	WallClock               bool              //在关键帧前发送onWallClock数据消息，用于下游多路流对齐
+	AVDriftThreshold        time.Duration     //发布者音视频时间戳偏差告警阈值，0为不检测
+	AVDriftCorrect          bool              //偏差超过阈值时自动修正音频时间戳
+	DegradeLag              time.Duration     //开启降级的播放端落后超过该时长时只发送音频，追上后在关键帧恢复视频
+	RecordAPI               string            //录像插件的API地址，例如 http://localhost:8080/record/api
+	RecordRules             map[string]string //发布时自动录像的规则，以正则表达式匹配streamPath，值为录像类型
+	PublishDelay            time.Duration     //发布延迟，收到的音视频在该时间之后才分发给订阅者，推流地址可以用?delay=30s单独指定
+	DelayMaxBytes           int64             //发布延迟缓冲的内存上限，超过后丢弃数据直到下一个关键帧
+	Fallback                map[string]string //发布者断开时订阅者切换到的备用流，以streamPath为key，备用流的streamPath为value
+	PlayAlias               map[string]string //播放别名，以别名的streamPath（或者正则表达式）为key，实际播放的streamPath为value
+	StreamIDMode            string            //createStream分配消息流ID的方式：global、sequential、fixed、random
+	StreamIDFixed           uint32            //fixed模式下的消息流ID
+	StreamIDMin             uint32            //random模式下消息流ID的最小值
+	StreamIDMax             uint32            //random模式下消息流ID的最大值
+	PushSchedule            map[string]string //推流时间窗口，以streamPath为key，格式为"分 时 日 月 周|时长"
+	MaxVideoBitrate         map[string]int    //发布者视频码率上限(kbps)，以appName为key
+	MaxAudioBitrate         map[string]int    //发布者音频码率上限(kbps)，以appName为key
+	BitrateViolation        time.Duration     //码率持续超过上限该时长后执行BitrateAction
+	BitrateAction           string            //码率超限的处理方式：log、warn、close
+	MaxGOPDuration          time.Duration     //发布者关键帧间隔上限，0为不限制
+	GOPAction               string            //关键帧间隔超限的处理方式：warn、close
+	Shadow                  map[string]string //将发布者的音视频消息镜像到另一个streamPath（影子流），以streamPath为key
+	TCPInfoInterval         time.Duration     //读取连接TCP_INFO（rtt、重传、拥塞窗口）的间隔，仅支持linux，0为不读取
+	NormalizeTimestamp      bool              //推流到本服务器的时间戳从0开始，用于首帧时间戳很大的推流端
+	PullNormalizeTimestamp  bool              //拉流的时间戳从0开始
+	PullGapFill             time.Duration     //拉流时源站音频中断不超过该时长时补发静音帧，用于对时间戳连续性要求严格的CDN，0为不补发
+	StreamIDCheck           string            //音视频消息的消息流ID与publish/play的不一致时的处理方式：off、log、reject
+	SWFVerify               bool              //connect后向客户端发送SWF校验请求，校验失败断开连接，需要配置有效的SWFHash
+	SWFHash                 string            //SWF校验使用的SWF哈希（十六进制），拉流推流时远端发送SWF校验请求则用它回复
+	SWFSize                 uint32            //SWF解压后的大小
+	InsufficientBWLag       time.Duration     //播放端落后超过该时长并持续InsufficientBWTime后发送NetStream.Play.InsufficientBW，0为不检测
+	InsufficientBWTime      time.Duration     //播放端持续落后的时长
+	KeyFrameRequest         string            //所有rtmp订阅者都在等待关键帧时向rtmp发布者发送的自定义命令名，例如requestKeyframe，为空则不发送
+	KeyFrameRequestInterval time.Duration     //发送KeyFrameRequest的最小间隔
+	AuthSecret              string            //签名地址鉴权的密钥，配置后推流地址需要带exp、nonce、sign参数
+	AuthPlay                bool              //播放地址也需要签名
+	AppAuthSecret           map[string]string //按应用配置的签名密钥，以appName为key，签名方式与AuthSecret相同，优先于AuthSecret
+	AppAuthPlay             map[string]bool   //按应用配置播放地址是否需要签名，以appName为key，优先于AuthPlay
+	AdobeAuth               map[string]string //connect的adobe认证（authmod=adobe）的用户名和密码，以用户名为key，配置后所有connect都需要认证
+	PublishToken            bool              //推流地址需要带通过rtmp/api/token生成的一次性令牌（token参数），使用一次后作废
+	PublishKeys             map[string]string //推流密钥的哈希（bcrypt或者argon2id），以streamPath为key，配置后该流的推流地址需要带key参数
+	Encryption              map[string]string //自有节点之间音视频负载加密的预共享密钥（十六进制的AES密钥），以streamPath为key
+	WarmStandby             map[string]string //按需拉流的预备连接，以streamPath为key，远端地址为value，有人订阅时使用已经完成握手和connect的连接立即play
+	WarmStandbyRefresh      time.Duration     //预备连接发送ping的间隔，连接断开后重建，建立失败时的重试间隔
+	AVBarrierTimeout        time.Duration     //发布开始时等待音视频序列头都到达后才写入引擎的最长等待时间，0为不等待
+	FourCcList              []string          //connect响应中通告可以接收的增强rtmp音视频编码（FourCC），例如hvc1、av01、Opus，为空则不通告
+	UnsupportedCodec        string            //发布者使用引擎不支持的编码时的处理方式：allow（交给引擎处理）、log（丢弃该轨道）、reject（拒绝发布）
+	HandshakeTimeout        time.Duration     //服务端握手（包括rtmps的TLS握手）的超时时间，0为不限制
+	MaxLifetime             time.Duration     //rtmp连接的最长存活时间，超过后关闭连接上的发布和播放，迫使客户端重新鉴权，0为不限制
+	MaxAppPublishers        map[string]int    //每个应用的发布者数量上限（包括其他协议），超过后拒绝rtmp推流，以appName为key
+	MaxAppPlayers           map[string]int    //每个应用的播放者数量上限（包括其他协议），超过后拒绝rtmp播放，以appName为key
+	MaxAppEgress            map[string]int    //每个应用的rtmp播放出口带宽上限(kbps)，超过后拒绝新的播放并断开最新的播放者，以appName为key
+	AuditLog                string            //命令审计日志文件（JSON Lines），记录connect、publish、play、deleteStream命令及结果，为空则不记录
+	TaskFailWebhook         string            //拉流推流任务重试次数用尽最终失败时，以POST方式发送TaskFailedEvent（JSON）的地址
+	OnConnect               string            //connect时以POST方式发送HookRequest（JSON）的地址，返回2xx允许，否则拒绝，为空则不调用
+	OnPublish               string            //推流时调用的地址，规则同OnConnect
+	OnPlay                  string            //播放时调用的地址，规则同OnConnect
+	OnDone                  string            //推流或播放结束时通知的地址
+	HookTimeout             time.Duration     //connect、publish、play回调的超时，超时按不可访问处理（拒绝）
+	HookConcurrency         int               //同时进行的鉴权回调数上限，超过时等待，等待同样计入超时，0为不限制
+	MetricLabels            []string          //rtmp/api/metrics中作为指标标签输出的会话标签，只输出列出的，避免标签的取值过多
+	PushEnhancedRTMP        bool              //推流时HEVC使用增强rtmp的扩展视频头（hvc1）发送，远端在connect响应中通告支持时自动使用
+	ReadCheck               bool              //检查读取的消息的连续性（声明长度与实际长度、块头类型的转换、消息类型），统计每个连接的异常次数
+	MaxConnections          int               //rtmp服务端连接数上限（文件描述符预算），达到后拒绝新的连接，0为使用文件描述符上限的90%（windows不限制）
+	MaxGoroutines           int               //协程数上限，达到后拒绝新的连接，0为不限制
+	LegacyHEVC              bool              //接收传统FLV CodecID 12的HEVC（国内编码器和播放器常用），关闭后只接收增强rtmp的HEVC
+	LegacyHEVCPush          []string          //推流时HEVC总是以传统FLV CodecID 12发送的远端地址（host或host:port），用于旧版SRS、CDN节点
+	PushMultitrack          bool              //推流时以增强rtmp v2多轨道视频发送发布者的其他视频轨道（trackId不为0），需要远端支持
+	PushPriority            map[string]int    //推流的优先级，以streamPath为key，数值越大越重要，默认为0
+	MaxPushEgress           int               //所有推流的出口带宽上限(kbps)，超过后从优先级最低的推流开始限流或暂停，0为不限制
+	PushPressureAction      string            //超过推流出口带宽上限时对低优先级推流的处理方式：throttle（只发送音频）、suspend（暂停推流）
+	GeoIPCountryDB          string            //MaxMind国家数据库（GeoIP2/GeoLite2的Country或City，mmdb格式）的路径
+	GeoIPASNDB              string            //MaxMind ASN数据库（GeoLite2-ASN，mmdb格式）的路径
+	GeoPublishAllow         map[string]string //按照地理位置允许推流的规则，以appName为key，多个规则以逗号分隔，规则为国家代码（例如CN）或者AS加ASN（例如AS4134）
+	GeoPublishDeny          map[string]string //按照地理位置拒绝推流的规则，优先于允许规则
+	GeoPlayAllow            map[string]string //按照地理位置允许播放的规则
+	GeoPlayDeny             map[string]string //按照地理位置拒绝播放的规则，优先于允许规则
+	PullBufferLength        time.Duration     //拉流play之后发送SetBufferLength用户控制消息的缓冲长度，0为不发送
+	PushBackfill            bool              //推流时在音视频数据之前补发onMetaData和序列头，并从关键帧开始发送
+	PushLatestGOP           bool              //推流在流的中途开始时先完整发送最近的一个GOP，不跳到下一个关键帧追赶
+	PushTimestamp           string            //推流重连后发送的时间戳：absolute（流的时间戳）、continue（从上一次连接最后的时间戳继续）、zero（从0开始）
+	Resync                  bool              //发布者重新发布后订阅者的时间戳从之前的时间戳继续
+	TLSCertFile             string            //证书文件，配置后rtmp端口同时接受rtmps连接
+	TLSKeyFile              string            //私钥文件
+	PlayIdleTimeout         time.Duration     //播放会话的写操作阻塞超过该时长（播放端不再读取数据）时关闭该会话，0为不检测
+	PlayProfile             map[string]string //播放的默认调优方案（low-latency、reliable、bulk），以appName为key，播放地址可以用?profile=单独指定
+	StatusDescription       map[string]string //onStatus的description模板，以code为key，例如 NetStream.Play.Failed: "{{.StreamName}}播放失败：{{.Reason}}"
+	MaxConnMemory           int64             //每个连接缓冲的字节数上限（未完成的块消息、音视频同步暂存和发布延迟队列），0为不限制
+	MemoryAction            string            //连接缓冲超过上限的处理方式：close（断开连接）、drop（丢弃新的暂存数据）
+	FlushInterval           time.Duration     //播放和推流的音视频帧合并发送的间隔，0为每帧立即发送，播放的调优方案优先
+	AudioFlushInterval      time.Duration     //纯音频发布的合并发送间隔上限，音频帧小而密，合并过久只会增加延迟
+
+	IPAllow        []string            //接受连接时允许的客户端IP（CIDR或者IP），为空则不限制
+	IPDeny         []string            //接受连接时拒绝的客户端IP，优先于允许规则
+	IPPublishAllow map[string][]string //按照客户端IP允许推流的规则，以appName为key，值为CIDR或者IP的列表
+	IPPublishDeny  map[string][]string //按照客户端IP拒绝推流的规则，优先于允许规则
+	IPPlayAllow    map[string][]string //按照客户端IP允许播放的规则
+	IPPlayDeny     map[string][]string //按照客户端IP拒绝播放的规则，优先于允许规则
 }
 
 func (c *RTMPConfig) OnEvent(event any) {
 	switch v := event.(type) {
 	case FirstConfig:
-		if c.ListenAddr != "" {
-			RTMPPlugin.Info("server rtmp start at", zap.String("listen addr", c.ListenAddr))
-			go c.Listen(RTMPPlugin, c)
-		}
+		c.enableTLS()
+		openAuditLog(c.AuditLog)
+		openGeoIP()
+		c.checkPublishKeys()
+		c.checkSWFHash()
+		c.loadIPRules()
+		c.loadRecordRules()
+		c.loadStatusTemplates()
+		c.loadPlayAliases()
+		c.initHookSlots()
+		guardRelayStreams()
+		c.rebind()
+		c.loadPushSchedules()
+		go c.runPushSchedule()
+		go runQuotaMeter()
+		go runPushPressure()
+		go runNonceSweep()
+		go runAdobeChallengeSweep()
+		c.runWarmStandby()
 		for streamPath, url := range c.PullOnStart {
 			if err := RTMPPlugin.Pull(streamPath, url, new(RTMPPuller), 0); err != nil {
-				RTMPPlugin.Error("pull", zap.String("streamPath", streamPath), zap.String("url", url), zap.Error(err))
+				RTMPPlugin.Error("pull", zap.String("streamPath", streamPath), zap.String("url", redactURL(url)), zap.Error(err))
 			}
 		}
 	case config.Config:
-		RTMPPlugin.CancelFunc()
-		if c.ListenAddr != "" {
-			RTMPPlugin.Context, RTMPPlugin.CancelFunc = context.WithCancel(Engine)
-			RTMPPlugin.Info("server rtmp start at", zap.String("listen addr", c.ListenAddr))
-			go c.Listen(RTMPPlugin, c)
-		}
+		c.loadIPRules()
+		c.loadRecordRules()
+		c.loadStatusTemplates()
+		c.loadPlayAliases()
+		// 先打开新的监听再关闭旧的，已经建立的连接不受影响
+		c.rebind()
+		c.enableTLS()
+		openGeoIP()
+		c.checkPublishKeys()
+		c.checkSWFHash()
 	case SEpublish:
 		for streamPath, url := range c.PushList {
-			if streamPath == v.Stream.Path {
-				if err := RTMPPlugin.Push(streamPath, url, new(RTMPPusher), false); err != nil {
-					RTMPPlugin.Error("push", zap.String("streamPath", streamPath), zap.String("url", url), zap.Error(err))
+			if streamPath == v.Stream.Path && inPushWindow(streamPath) && !pushSuspended(streamPath) {
+				if err := RTMPPlugin.Push(streamPath, url, newRTMPPusher(), false); err != nil {
+					RTMPPlugin.Error("push", zap.String("streamPath", streamPath), zap.String("url", redactURL(url)), zap.Error(err))
 				}
 			}
 		}
@@ -53,17 +169,49 @@ func (c *RTMPConfig) OnEvent(event any) {
 		for streamPath, url := range c.PullOnSub {
 			if streamPath == v.Path {
 				if err := RTMPPlugin.Pull(streamPath, url, new(RTMPPuller), 0); err != nil {
-					RTMPPlugin.Error("pull", zap.String("streamPath", streamPath), zap.String("url", url), zap.Error(err))
+					RTMPPlugin.Error("pull", zap.String("streamPath", streamPath), zap.String("url", redactURL(url)), zap.Error(err))
 				}
 				break
 			}
 		}
+		if url, ok := c.WarmStandby[v.Path]; ok {
+			if _, ok = c.PullOnSub[v.Path]; !ok {
+				if err := RTMPPlugin.Pull(v.Path, url, new(RTMPPuller), 0); err != nil {
+					RTMPPlugin.Error("pull", zap.String("streamPath", v.Path), zap.String("url", redactURL(url)), zap.Error(err))
+				}
+			}
+		}
 	}
 }
 
 var conf = &RTMPConfig{
-	ChunkSize: 65536,
-	TCP:       config.TCP{ListenAddr: ":1935"},
+	ChunkSize:               65536,
+	HookTimeout:             time.Second * 5,
+	DegradeLag:              time.Second * 3,
+	DelayMaxBytes:           64 << 20,
+	MemoryAction:            MemoryActionClose,
+	AudioFlushInterval:      time.Millisecond * 10,
+	StreamIDMode:            StreamIDGlobal,
+	StreamIDFixed:           1,
+	StreamIDMin:             1,
+	StreamIDMax:             1000,
+	BitrateViolation:        time.Second * 10,
+	BitrateAction:           BitrateActionLog,
+	GOPAction:               GOPActionWarn,
+	StreamIDCheck:           StreamIDCheckOff,
+	Resync:                  true,
+	WarmStandbyRefresh:      time.Second * 30,
+	PushTimestamp:           PushTimestampAbsolute,
+	PushBackfill:            true,
+	FourCcList:              []string{FourCC_HEVC, FourCC_AV1, FourCC_VP9, FourCC_OPUS, FourCC_AC3, FourCC_EAC3, FourCC_FLAC},
+	UnsupportedCodec:        CodecActionAllow,
+	LegacyHEVC:              true,
+	PushPressureAction:      PushPressureThrottle,
+	InsufficientBWTime:      time.Second * 5,
+	KeyFrameRequestInterval: time.Second * 2,
+	TCPInfoInterval:         time.Second * 5,
+	HandshakeTimeout:        time.Second * 10,
+	TCP:                     config.TCP{ListenAddr: ":1935"},
 }
 var RTMPPlugin = InstallPlugin(conf)
 
@@ -83,6 +231,92 @@ func (*RTMPConfig) API_list(w http.ResponseWriter, r *http.Request) {
 	util.ReturnJson(filterStreams, time.Second, w, r)
 }
 
+type ClockInfo struct {
+	StreamPath     string
+	FirstFrameTime time.Time
+	FirstTimestamp uint32
+	StreamTime     uint32
+	WallClock      time.Time
+	Timecode       *Timecode `json:",omitempty"` // 发布者最新的时间码
+}
+
+func (*RTMPConfig) API_clock(w http.ResponseWriter, r *http.Request) {
+	util.ReturnJson(func() (list []ClockInfo) {
+		for _, s := range filterStreams() {
+			if p, ok := s.Publisher.(IRTMPReceiver); ok {
+				receiver := p.GetReceiver()
+				list = append(list, ClockInfo{
+					StreamPath:     s.Path,
+					FirstFrameTime: receiver.FirstFrameTime(),
+					FirstTimestamp: receiver.FirstTimestamp(),
+					StreamTime:     receiver.StreamTime(),
+					WallClock:      receiver.WallClock(),
+					Timecode:       receiver.Timecode(),
+				})
+			}
+		}
+		return
+	}, time.Second, w, r)
+}
+
+func (*RTMPConfig) API_connections(w http.ResponseWriter, r *http.Request) {
+	util.ReturnJson(func() (list []ConnectionInfo) {
+		connections.Range(func(key, value any) bool {
+			list = append(list, value.(*NetConnection).GetInfo())
+			return true
+		})
+		return
+	}, time.Second, w, r)
+}
+
+func (*RTMPConfig) API_chunksize(rw http.ResponseWriter, r *http.Request) {
+	v, ok := connections.Load(r.URL.Query().Get("id"))
+	if !ok {
+		http.Error(rw, "connection not found", http.StatusNotFound)
+		return
+	}
+	size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+	if err := v.(*NetConnection).SetChunkSize(size); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rw.Write([]byte("ok"))
+}
+
+func (*RTMPConfig) API_degrade(rw http.ResponseWriter, r *http.Request) {
+	v, ok := subscribers.Load(r.URL.Query().Get("id"))
+	if !ok {
+		http.Error(rw, "subscriber not found", http.StatusNotFound)
+		return
+	}
+	v.(*RTMPSubscriber).DegradeEnabled.Store(r.URL.Query().Get("enable") != "0")
+	rw.Write([]byte("ok"))
+}
+
+type PublisherStats struct {
+	StreamPath string
+	AVMonitor
+	BitrateMonitor
+	GOPMonitor
+}
+
+func (*RTMPConfig) API_stats(w http.ResponseWriter, r *http.Request) {
+	util.ReturnJson(func() (list []PublisherStats) {
+		for _, s := range filterStreams() {
+			if p, ok := s.Publisher.(IRTMPReceiver); ok {
+				// 监控状态由读取协程更新，只读取快照
+				stats := PublisherStats{StreamPath: s.Path}
+				if snapshot := p.GetReceiver().monitorStats.Load(); snapshot != nil {
+					stats = *snapshot
+					stats.StreamPath = s.Path
+				}
+				list = append(list, stats)
+			}
+		}
+		return
+	}, time.Second, w, r)
+}
+
 func (*RTMPConfig) API_Pull(rw http.ResponseWriter, r *http.Request) {
 	save, _ := strconv.Atoi(r.URL.Query().Get("save"))
 	err := RTMPPlugin.Pull(r.URL.Query().Get("streamPath"), r.URL.Query().Get("target"), new(RTMPPuller), save)
@@ -94,7 +328,15 @@ func (*RTMPConfig) API_Pull(rw http.ResponseWriter, r *http.Request) {
 }
 
 func (*RTMPConfig) API_Push(rw http.ResponseWriter, r *http.Request) {
-	err := RTMPPlugin.Push(r.URL.Query().Get("streamPath"), r.URL.Query().Get("target"), new(RTMPPusher), r.URL.Query().Has("save"))
+	if priority := r.URL.Query().Get("priority"); priority != "" {
+		n, err := strconv.Atoi(priority)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pathEntryOf(r.URL.Query().Get("streamPath")).priority.Store(&n)
+	}
+	err := RTMPPlugin.Push(r.URL.Query().Get("streamPath"), r.URL.Query().Get("target"), newRTMPPusher(), r.URL.Query().Has("save"))
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusBadRequest)
 	} else {
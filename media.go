@@ -1,31 +1,83 @@
 package rtmp
 
 import (
+	"crypto/cipher"
 	"errors"
 	"runtime"
+	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/codec"
 	"m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/util"
 )
 
 type AVSender struct {
 	*RTMPSender
 	ChunkHeader
-	firstSent bool
+	firstSent atomic.Bool // 已经以完整的消息头发送过，转发绕过引擎的音视频和切换状态的协程也会重置
+	exFourCc  string      // 以增强rtmp扩展头发送时的FourCC，在写锁内读写
+	exChecked bool        // 是否已经根据编码确定了exFourCc
+	seqHead   []byte      // 最近发送的序列头（转换前），切换连接后补发
+}
+
+// currentFourCc 在写锁内读取exFourCc
+func (av *AVSender) currentFourCc() string {
+	for !av.writing.CompareAndSwap(false, true) {
+		runtime.Gosched()
+	}
+	defer av.writing.Store(false)
+	return av.exFourCc
 }
 
 func (av *AVSender) sendSequenceHead(seqHead []byte) {
-	av.SetTimestamp(0)
-	av.MessageLength = uint32(len(seqHead))
+	av.seqHead = seqHead
 	for !av.writing.CompareAndSwap(false, true) {
 		runtime.Gosched()
 	}
 	defer av.writing.Store(false)
+	if len(seqHead) > 0 {
+		av.exFourCc, av.exChecked = av.exFourCcOf(seqHead[0]), true
+		seqHead = toExVideo(seqHead, av.exFourCc)
+	}
+	// 密钥流的顺序必须和发送顺序一致，在写锁内加密
+	if av.encrypter != nil {
+		seqHead = av.encrypt(seqHead)
+	}
+	av.MessageLength = uint32(len(seqHead))
+	if av.firstSent.Swap(false) {
+		// 推流中途的新序列头（分辨率等参数变化）使用当前的时间戳，之后的帧重新发送完整的消息头，否则时间戳增量会以0为基准
+		av.SetTimestamp(av.lastAbsTime)
+	} else {
+		av.SetTimestamp(0)
+	}
 	av.WriteTo(RTMP_CHUNK_HEAD_12, &av.chunkHeader)
 	av.sendChunk(seqHead)
 }
 
+// sendData 以完整的消息头发送一个消息体，之后的帧也需要重新发送完整的消息头
+func (av *AVSender) sendData(data []byte, absTime uint32) {
+	for !av.writing.CompareAndSwap(false, true) {
+		runtime.Gosched()
+	}
+	defer av.writing.Store(false)
+	if av.encrypter != nil {
+		data = av.encrypt(data)
+	}
+	av.MessageLength = uint32(len(data))
+	av.firstSent.Store(false)
+	av.SetTimestamp(absTime)
+	av.WriteTo(RTMP_CHUNK_HEAD_12, &av.chunkHeader)
+	for i, chunk := range util.Buffer(data).Split(av.writeChunkSize) {
+		if i == 1 {
+			av.WriteTo(RTMP_CHUNK_HEAD_1, &av.chunkHeader)
+		}
+		av.sendChunk(chunk)
+	}
+}
+
 func (av *AVSender) sendFrame(frame *common.AVFrame, absTime uint32) (err error) {
 	payloadLen := frame.AVCC.ByteLength
 	if payloadLen == 0 {
@@ -33,28 +85,61 @@ func (av *AVSender) sendFrame(frame *common.AVFrame, absTime uint32) (err error)
 		av.Error("payload is empty", zap.Error(err))
 		return err
 	}
-	if av.writeSeqNum > av.bandwidth {
-		av.totalWrite += av.writeSeqNum
-		av.writeSeqNum = 0
-		av.SendMessage(RTMP_MSG_ACK, Uint32Message(av.totalWrite))
-		av.SendStreamID(RTMP_USER_PING_REQUEST, 0)
-	}
-	av.MessageLength = uint32(payloadLen)
 	for !av.writing.CompareAndSwap(false, true) {
 		runtime.Gosched()
 	}
 	defer av.writing.Store(false)
+	// 需要转换的负载，发送转换后的副本
+	var data []byte
+	if !av.exChecked {
+		// 没有发送过序列头时根据第一帧确定
+		if b0, err := frame.AVCC.NewReader().ReadByte(); err == nil {
+			av.exFourCc, av.exChecked = av.exFourCcOf(b0), true
+		}
+	}
+	if av.exFourCc != "" {
+		data = toExVideo(frame.AVCC.ToBytes(), av.exFourCc)
+	}
+	if data != nil {
+		payloadLen = len(data)
+	}
+	if av.quota != nil {
+		av.quota.egressBytes.Add(int64(payloadLen))
+	}
+	av.egressBytes.Add(int64(payloadLen))
+	if interval := av.flushInterval(); interval > 0 {
+		av.coalesce = true
+		defer av.endCoalesce(interval)
+	}
+	av.sendAck()
+	// 加密不改变长度，在写锁内进行，保证密钥流的顺序和发送顺序一致
+	if av.encrypter != nil {
+		if data == nil {
+			data = frame.AVCC.ToBytes()
+		}
+		data = av.encrypt(data)
+	}
+	// 块大小和消息头在写锁内读取，与SetChunkSize和切换连接不会交错
+	av.MessageLength = uint32(payloadLen)
 	// 第一次是发送关键帧,需要完整的消息头(Chunk Basic Header(1) + Chunk Message Header(11) + Extended Timestamp(4)(可能会要包括))
 	// 后面开始,就是直接发送音视频数据,那么直接发送,不需要完整的块(Chunk Basic Header(1) + Chunk Message Header(7))
 	// 当Chunk Type为0时(即Chunk12),
-	if !av.firstSent {
-		av.firstSent = true
+	if !av.firstSent.Swap(true) {
 		av.SetTimestamp(absTime)
 		av.WriteTo(RTMP_CHUNK_HEAD_12, &av.chunkHeader)
 	} else {
 		av.SetTimestamp(frame.DeltaTime)
 		av.WriteTo(RTMP_CHUNK_HEAD_8, &av.chunkHeader)
 	}
+	if data != nil {
+		for i, chunk := range util.Buffer(data).Split(av.writeChunkSize) {
+			if i > 0 {
+				av.WriteTo(RTMP_CHUNK_HEAD_1, &av.chunkHeader)
+			}
+			av.sendChunk(chunk)
+		}
+		return nil
+	}
 	r := frame.AVCC.NewReader()
 	chunk := r.ReadN(av.writeChunkSize)
 	// payloadLen -= util.SizeOfBuffers(chunk)
@@ -73,13 +158,43 @@ type RTMPSender struct {
 	Subscriber
 	NetStream
 	audio, video AVSender
+	AudioOnlyDegrade
+	blackoutState
+	fallbackState
+	insufficientBW
+	keyFrameWaiter
+	playIdleWatcher
+	resyncState
+	encrypter cipher.Stream // 负载加密
+	quota     *appQuota     // 所属应用的配额，用于统计出口带宽
+	profile   *PlayProfile  // 播放的调优方案，没有时使用全局配置
+	backfillState
+	multitrackSender
+	pushThrottle
+	timecodeSender
+	colorInfoSender
+	handoverState
+	latencyInjector
+	gopSkipper
+	metaSender
+	setDataFrame bool // 转发onMetaData时加上@setDataFrame，用于推流
+	exVideo      bool // HEVC使用增强rtmp的扩展视频头发送
+	NoData       bool // 不发送数据消息，播放地址中?data=0
+	DataOnly     bool // 只发送数据消息不发送音视频，播放地址中?data=only
 }
 
 func (rtmp *RTMPSender) OnEvent(event any) {
 	switch v := event.(type) {
 	case SEwaitPublish:
 		rtmp.Response(1, NetStream_Play_UnpublishNotify, Response_OnStatus)
+		rtmp.resyncing = conf.Resync
+		rtmp.startFallback()
 	case SEpublish:
+		rtmp.stopFallback()
+		// 新的发布者的onMetaData、时间码和colorInfo版本重新计数
+		rtmp.sentMetaVersion.Store(0)
+		rtmp.sentTimecodeVersion = 0
+		rtmp.sentColorInfoVersion = 0
 		rtmp.Response(1, NetStream_Play_PublishNotify, Response_OnStatus)
 	case ISubscriber:
 		rtmp.audio.RTMPSender = rtmp
@@ -91,34 +206,220 @@ func (rtmp *RTMPSender) OnEvent(event any) {
 		rtmp.audio.MessageStreamID = rtmp.StreamID
 		rtmp.video.MessageStreamID = rtmp.StreamID
 	case AudioDeConf:
-		rtmp.audio.sendSequenceHead(v)
+		if !rtmp.DataOnly {
+			// G711没有序列头，只有消息头的音频消息会被部分播放器当作空的音频帧
+			if len(v) == 0 || !isG711(codec.AudioCodecID(v[0]>>4)) {
+				rtmp.audio.sendSequenceHead(v)
+			}
+			rtmp.audioHeadSent = true
+		}
 	case VideoDeConf:
-		rtmp.video.sendSequenceHead(v)
+		if !rtmp.DataOnly {
+			rtmp.video.sendSequenceHead(v)
+			rtmp.videoHeadSent = true
+		}
 	case AudioFrame:
-		rtmp.audio.sendFrame(v.AVFrame, v.AbsTime)
+		rtmp.resumeHandover()
+		rtmp.forwardMetaData()
+		rtmp.forwardTimecode()
+		if rtmp.DataOnly || rtmp.filterBlackout(false, nil, v.AbsTime) || !rtmp.backfill(false, false) {
+			return
+		}
+		rtmp.resync(v.AbsTime)
+		atomic.StoreUint32(&rtmp.lastAbsTime, v.AbsTime+rtmp.timestampOffset)
+		rtmp.checkBandwidth(rtmp.lastAbsTime)
+		rtmp.injectLatency(rtmp.lastAbsTime)
+		rtmp.beginWrite()
+		rtmp.audio.sendFrame(v.AVFrame, rtmp.lastAbsTime)
+		rtmp.endWrite()
+		rtmp.audioTime.Store(rtmp.lastAbsTime)
+		rtmp.audioSent.Store(true)
 	case VideoFrame:
-		rtmp.video.sendFrame(v.AVFrame, v.AbsTime)
+		rtmp.resumeHandover()
+		rtmp.forwardMetaData()
+		rtmp.forwardTimecode()
+		if conf.WallClock && v.IFrame {
+			rtmp.sendWallClock(v.AbsTime)
+		}
+		if rtmp.DataOnly || rtmp.filterBlackout(true, &v, v.AbsTime) || rtmp.throttleVideo(v) || rtmp.skipVideo(v) || rtmp.skipGOP(v) || rtmp.skipUntilKeyFrame(v.IFrame) || !rtmp.backfill(true, v.IFrame) {
+			return
+		}
+		if v.IFrame {
+			rtmp.waitingKeyFrame.Store(false)
+		}
+		rtmp.resync(v.AbsTime)
+		atomic.StoreUint32(&rtmp.lastAbsTime, v.AbsTime+rtmp.timestampOffset)
+		rtmp.checkBandwidth(rtmp.lastAbsTime)
+		rtmp.forwardColorInfo()
+		rtmp.injectLatency(rtmp.lastAbsTime)
+		rtmp.beginWrite()
+		rtmp.video.sendFrame(v.AVFrame, rtmp.lastAbsTime)
+		rtmp.endWrite()
+		rtmp.videoTime.Store(rtmp.lastAbsTime)
+		rtmp.videoSent.Store(true)
 	default:
 		rtmp.Subscriber.OnEvent(event)
 	}
 }
 
 func (r *RTMPSender) Response(tid uint64, code, level string) error {
+	var streamPath string
+	if r.Stream != nil {
+		streamPath = r.Stream.Path
+	}
+	return r.ResponseReason(tid, code, level, streamPath, "")
+}
+
+// ResponseReason 发送onStatus，streamPath和reason用于生成description
+func (r *RTMPSender) ResponseReason(tid uint64, code, level, streamPath, reason string) error {
 	m := new(ResponsePlayMessage)
 	m.CommandName = Response_OnStatus
 	m.TransactionId = tid
 	m.Infomation = map[string]any{
 		"code":        code,
 		"level":       level,
-		"description": "",
+		"description": statusDescription(code, level, streamPath, reason),
 	}
 	m.StreamID = r.StreamID
 	return r.SendMessage(RTMP_MSG_AMF0_COMMAND, m)
 }
 
+// sendWallClock 发送onWallClock数据消息，将当前时间戳与发布端的墙上时间对应起来
+func (rtmp *RTMPSender) sendWallClock(absTime uint32) error {
+	wallClock := time.Now()
+	if rtmp.Stream != nil {
+		if p, ok := rtmp.Stream.Publisher.(IRTMPReceiver); ok {
+			if t := p.GetReceiver().WallClock(); !t.IsZero() {
+				wallClock = t
+			}
+		}
+	}
+	return rtmp.sendDataMessage("onWallClock", map[string]any{
+		"wallClock": float64(wallClock.UnixMilli()),
+		"timestamp": absTime,
+	})
+}
+
+// sendDataMessage 发送AMF0数据消息，播放地址带?data=0的订阅者不接收数据消息
+func (rtmp *RTMPSender) sendDataMessage(name string, values ...any) error {
+	if rtmp.NoData {
+		return nil
+	}
+	return rtmp.SendMessage(RTMP_MSG_AMF0_METADATA, &DataMessage{name, values, rtmp.StreamID})
+}
+
+// parseVideoHeader 解析视频消息头，判断是否为关键帧或者序列头，增强rtmp的扩展视频头以PacketType判断
+func parseVideoHeader(msg *Chunk) (keyFrame bool, seqHead bool) {
+	r := msg.AVData.NewReader()
+	b0, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+	if b0&0x80 != 0 {
+		packetType := b0 & 0x0f
+		seqHead = packetType == PacketTypeSequenceStart
+		return (b0>>4)&0x07 == 1 && !seqHead && packetType != PacketTypeMetadata, seqHead
+	}
+	b1, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+	return b0>>4 == 1 && b1 != 0, b1 == 0
+}
+
 type RTMPReceiver struct {
 	Publisher
 	NetStream
+	streamClock
+	AVMonitor
+	BitrateMonitor
+	GOPMonitor
+	RecordID string `json:",omitempty"` // 发布时自动开启的录像ID
+	keyFrameCache
+	DelayBuffer
+	avBarrier
+	codecChecker
+	metaDataCache
+	timecodeCache
+	colorInfoCache
+	multichannelCache
+	seqHeadMonitor
+	ctsMonitor
+	singleTrackPublish
+	mp3Clock
+	multitrackState
+	gapFiller
+	handoverRebase
+	decrypter           cipher.Stream // 负载解密
+	shadow              *RTMPReceiver // 镜像发布者
+	NormalizeTimestamp  bool          // 时间戳从0开始
+	TimestampBase       uint32        // 归一化时减去的时间戳
+	hasTimestampBase    bool
+	lastKeyFrameRequest atomic.Int64 // 上次请求关键帧的时间（UnixNano）
+
+	recordStop chan struct{} // 关闭后停止自动开启的录制
+	syncState
+}
+
+// IRTMPReceiver rtmp的发布者，包括推流的RTMPReceiver和拉流的RTMPPuller
+type IRTMPReceiver interface {
+	GetReceiver() *RTMPReceiver
+}
+
+func (r *RTMPReceiver) GetReceiver() *RTMPReceiver {
+	return r
+}
+
+// streamClock 发布者的时钟，写入数据的协程更新，API和播放者的协程读取
+type streamClock struct {
+	firstFrameTime atomic.Int64 // 收到第一帧时的墙上时间（UnixNano）
+	firstTimestamp atomic.Int64 // 第一帧的时间戳
+	streamTime     atomic.Int64 // 最新一帧的时间戳，32位回绕后继续累加
+}
+
+func (c *streamClock) updateClock(ts uint32) {
+	if c.firstFrameTime.Load() == 0 {
+		c.firstTimestamp.Store(int64(ts))
+		c.streamTime.Store(int64(ts))
+		c.firstFrameTime.Store(time.Now().UnixNano())
+		return
+	}
+	last := c.streamTime.Load()
+	t := last&^0xffffffff | int64(ts)
+	// 时间戳相差超过半个周期视为回绕
+	if t < last-1<<31 {
+		t += 1 << 32
+	} else if t > last+1<<31 && t >= 1<<32 {
+		t -= 1 << 32
+	}
+	c.streamTime.Store(t)
+}
+
+// FirstFrameTime 收到第一帧时的墙上时间
+func (c *streamClock) FirstFrameTime() time.Time {
+	if nano := c.firstFrameTime.Load(); nano != 0 {
+		return time.Unix(0, nano)
+	}
+	return time.Time{}
+}
+
+// FirstTimestamp 第一帧的时间戳
+func (c *streamClock) FirstTimestamp() uint32 {
+	return uint32(c.firstTimestamp.Load())
+}
+
+// StreamTime 最新一帧的时间戳
+func (c *streamClock) StreamTime() uint32 {
+	return uint32(c.streamTime.Load())
+}
+
+// WallClock 将最新一帧的时间戳映射为墙上时间
+func (c *streamClock) WallClock() time.Time {
+	nano := c.firstFrameTime.Load()
+	if nano == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nano).Add(time.Duration(c.streamTime.Load()-c.firstTimestamp.Load()) * time.Millisecond)
 }
 
 func (r *RTMPReceiver) OnEvent(event any) {
@@ -136,32 +437,135 @@ func (r *RTMPReceiver) OnEvent(event any) {
 }
 
 func (r *RTMPReceiver) Response(tid uint64, code, level string) error {
+	var streamPath string
+	if r.Stream != nil {
+		streamPath = r.Stream.Path
+	}
+	return r.ResponseReason(tid, code, level, streamPath, "")
+}
+
+// ResponseReason 发送onStatus，streamPath和reason用于生成description
+func (r *RTMPReceiver) ResponseReason(tid uint64, code, level, streamPath, reason string) error {
 	m := new(ResponsePublishMessage)
 	m.CommandName = Response_OnStatus
 	m.TransactionId = tid
 	m.Infomation = map[string]any{
 		"code":        code,
 		"level":       level,
-		"description": "",
+		"description": statusDescription(code, level, streamPath, reason),
 	}
 	m.StreamID = r.StreamID
 	return r.SendMessage(RTMP_MSG_AMF0_COMMAND, m)
 }
 
+// normalizeTimestamp 以第一个音视频消息的时间戳为基准，使时间戳从0开始并保持间隔不变
+func (r *RTMPReceiver) normalizeTimestamp(msg *Chunk) {
+	if !r.NormalizeTimestamp {
+		return
+	}
+	if !r.hasTimestampBase {
+		r.hasTimestampBase = true
+		atomic.StoreUint32(&r.TimestampBase, msg.ExtendTimestamp)
+	}
+	if msg.ExtendTimestamp < r.TimestampBase {
+		msg.ExtendTimestamp = 0
+	} else {
+		msg.ExtendTimestamp -= r.TimestampBase
+	}
+}
+
 func (r *RTMPReceiver) ReceiveAudio(msg *Chunk) {
+	r.decrypt(msg)
+	r.normalizeTimestamp(msg)
+	r.rebaseTimestamp(msg)
+	if r.delayEx(msg) || !r.convertExAudio(msg) {
+		return
+	}
+	r.retimeMP3(msg)
+	if !r.observeGap(msg) {
+		return
+	}
+	r.deliver(msg)
+}
+
+func (r *RTMPReceiver) ReceiveVideo(msg *Chunk) {
+	r.decrypt(msg)
+	r.normalizeTimestamp(msg)
+	r.rebaseTimestamp(msg)
+	if r.delayEx(msg) || !r.convertExVideo(msg) {
+		return
+	}
+	r.fixCompositionTime(msg)
+	if !r.observeVideoGap(msg) {
+		return
+	}
+	r.deliver(msg)
+}
+
+// deliver 源站的消息和补发的帧都经过音视频屏障后写入引擎
+func (r *RTMPReceiver) deliver(msg *Chunk) {
+	if !r.barrier(msg) {
+		r.receive(msg)
+	}
+}
+
+// receive 经过发布延迟后写入引擎
+func (r *RTMPReceiver) receive(msg *Chunk) {
+	if r.delay(msg) {
+		return
+	}
+	if msg.MessageTypeID == RTMP_MSG_AUDIO {
+		r.writeAudio(msg)
+	} else {
+		r.writeVideo(msg)
+	}
+}
+
+func (r *RTMPReceiver) writeAudio(msg *Chunk) {
+	r.monitorAudio(msg)
+	r.updateClock(msg.ExtendTimestamp)
+	r.cacheAudioHead(msg)
+	r.mirror(msg)
+	r.writeAudioTrack(msg)
+}
+
+func (r *RTMPReceiver) writeVideo(msg *Chunk) {
+	r.monitorVideo(msg)
+	r.updateClock(msg.ExtendTimestamp)
+	if !r.checkSeqHead(msg) {
+		return
+	}
+	r.cacheKeyFrame(msg)
+	r.mirror(msg)
+	r.writeVideoTrack(msg)
+}
+
+func (r *RTMPReceiver) writeAudioTrack(msg *Chunk) {
+	if r.forwardMP3(msg) {
+		return
+	}
 	if r.AudioTrack == nil {
-		if r.WriteAVCCAudio(0, &msg.AVData); r.AudioTrack != nil {
-			r.AudioTrack.SetStuff(r.bytePool)
+		if !r.checkCodec(msg) {
+			return
+		}
+		if !r.createG711Track(msg) {
+			if r.WriteAVCCAudio(0, &msg.AVData); r.AudioTrack != nil {
+				r.AudioTrack.SetStuff(r.bytePool)
+			}
+			return
 		}
-		return
 	}
 	r.AudioTrack.WriteAVCC(msg.ExtendTimestamp, &msg.AVData)
 }
 
-func (r *RTMPReceiver) ReceiveVideo(msg *Chunk) {
+func (r *RTMPReceiver) writeVideoTrack(msg *Chunk) {
 	if r.VideoTrack == nil {
+		if !r.checkCodec(msg) {
+			return
+		}
 		if r.WriteAVCCVideo(0, &msg.AVData); r.VideoTrack != nil {
 			r.VideoTrack.SetStuff(r.bytePool)
+			r.syncColorInfo()
 		}
 		return
 	}
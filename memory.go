@@ -0,0 +1,77 @@
+package rtmp
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// 连接缓冲超过MaxConnMemory的处理方式
+const (
+	MemoryActionClose = "close" // 断开连接
+	MemoryActionDrop  = "drop"  // 丢弃新的数据：音视频同步暂存立即释放，发布延迟队列丢弃到下一个关键帧；未完成的块消息超过上限时仍然断开连接
+)
+
+var errMemoryLimit = errors.New("connection memory limit exceeded")
+
+// memoryAccount 统计连接缓冲中的字节数：未完成的块消息、音视频同步暂存和发布延迟队列
+type memoryAccount struct {
+	memBytes    atomic.Int64
+	memPeak     atomic.Int64
+	memExceeded atomic.Uint32 // 超过上限的次数
+}
+
+// holdMemory 记录新缓冲的n字节，超过MaxConnMemory时不记录并返回errMemoryLimit
+func (m *memoryAccount) holdMemory(n int) error {
+	v := m.memBytes.Add(int64(n))
+	if conf.MaxConnMemory > 0 && v > conf.MaxConnMemory {
+		m.memBytes.Add(-int64(n))
+		m.memExceeded.Add(1)
+		return errMemoryLimit
+	}
+	for peak := m.memPeak.Load(); v > peak && !m.memPeak.CompareAndSwap(peak, v); peak = m.memPeak.Load() {
+	}
+	return nil
+}
+
+func (m *memoryAccount) releaseMemory(n int) {
+	m.memBytes.Add(-int64(n))
+}
+
+// exceedMemory 连接缓冲超过上限，按MemoryAction断开连接
+func (nc *NetConnection) exceedMemory(where string) {
+	RTMPPlugin.Warn("connection memory limit exceeded", zap.String("remote", nc.RemoteAddr().String()), zap.String("where", where), zap.Int64("bytes", nc.memBytes.Load()), zap.String("action", conf.MemoryAction))
+	if conf.MemoryAction != MemoryActionDrop {
+		nc.Close()
+	}
+}
+
+// holdMessage 记录发布者暂存的音视频消息，没有服务端连接的发布者不统计，返回false代表超过上限
+func (r *RTMPReceiver) holdMessage(msg *Chunk, where string) bool {
+	if r.NetConnection == nil {
+		return true
+	}
+	if err := r.NetConnection.holdMemory(msg.AVData.ByteLength); err != nil {
+		r.exceedMemory(where)
+		return false
+	}
+	return true
+}
+
+func (r *RTMPReceiver) releaseMessage(msg *Chunk) {
+	if r.NetConnection != nil {
+		r.NetConnection.releaseMemory(msg.AVData.ByteLength)
+	}
+}
+
+// MemoryStats 连接缓冲的统计
+type MemoryStats struct {
+	Bytes    int64  // 当前缓冲的字节数
+	Peak     int64  // 缓冲字节数的峰值
+	Exceeded uint32 // 超过上限的次数
+}
+
+func (m *memoryAccount) memoryStats() *MemoryStats {
+	return &MemoryStats{m.memBytes.Load(), m.memPeak.Load(), m.memExceeded.Load()}
+}
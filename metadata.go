@@ -0,0 +1,82 @@
+package rtmp
+
+import (
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// metaDataCache 缓存发布者最新的onMetaData，版本号用于让订阅者发现更新
+type metaDataCache struct {
+	metaData    atomic.Pointer[[]any]
+	metaVersion atomic.Uint32
+}
+
+// metaSender 已经转发的发布者onMetaData版本，发送帧和发布者更新时都会读写
+type metaSender struct {
+	sentMetaVersion atomic.Uint32
+}
+
+// receiveMetaData 缓存发布者发送的onMetaData，之后的更新（例如码率、分辨率变化）同样会转发给所有rtmp订阅者和推流目标
+func (r *RTMPReceiver) receiveMetaData(msg *Chunk) {
+	m, ok := msg.MsgData.(*DataMessage)
+	if !ok {
+		return
+	}
+	r.receiveTimecode(m, msg.ExtendTimestamp)
+	if m.Name != "onMetaData" {
+		return
+	}
+	values := m.Values
+	r.checkSingleTrack(values)
+	r.receiveAuxVideo(values)
+	r.metaData.Store(&values)
+	if version := r.metaVersion.Add(1); version > 1 {
+		r.Info("metadata updated", zap.Uint32("version", version))
+		r.pushMetaData()
+	}
+}
+
+// pushMetaData onMetaData更新时立即转发给已经收到过onMetaData的rtmp订阅者和推流目标，不等待下一帧
+func (r *RTMPReceiver) pushMetaData() {
+	if r.Stream == nil {
+		return
+	}
+	subscribers.Range(func(_, v any) bool {
+		if sub := v.(*RTMPSubscriber); sub.Stream == r.Stream && sub.sentMetaVersion.Load() > 0 {
+			sub.forwardMetaData()
+		}
+		return true
+	})
+	if v, ok := paths.Load(r.Stream.Path); ok {
+		if p := v.(*pathEntry).pusher.Load(); p != nil && p.sentMetaVersion.Load() > 0 {
+			p.forwardMetaData()
+		}
+	}
+}
+
+// forwardMetaData 发布者的onMetaData有更新时转发，推流目标需要@setDataFrame前缀。
+// 发送帧之前和发布者更新时都会调用，通过版本号的CAS保证每个版本只发送一次
+func (rtmp *RTMPSender) forwardMetaData() {
+	if rtmp.Stream == nil {
+		return
+	}
+	p, ok := rtmp.Stream.Publisher.(IRTMPReceiver)
+	if !ok {
+		return
+	}
+	receiver := p.GetReceiver()
+	version, sent := receiver.metaVersion.Load(), rtmp.sentMetaVersion.Load()
+	if version == sent {
+		return
+	}
+	values := receiver.metaData.Load()
+	if values == nil || !rtmp.sentMetaVersion.CompareAndSwap(sent, version) {
+		return
+	}
+	if rtmp.setDataFrame {
+		rtmp.sendDataMessage("@setDataFrame", append([]any{"onMetaData"}, *values...)...)
+	} else {
+		rtmp.sendDataMessage("onMetaData", *values...)
+	}
+}
@@ -0,0 +1,98 @@
+package rtmp
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// metricLabels 按照MetricLabels过滤会话标签，输出为Prometheus的标签，标签名加上label_前缀
+func metricLabels(streamPath string, labels map[string]string) string {
+	var sb strings.Builder
+	sb.WriteString(`streamPath="` + escapeLabelValue(streamPath) + `"`)
+	for _, key := range conf.MetricLabels {
+		if v, ok := labels[key]; ok {
+			sb.WriteString(`,label_` + sanitizeLabelName(key) + `="` + escapeLabelValue(v) + `"`)
+		}
+	}
+	return sb.String()
+}
+
+func sanitizeLabelName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+type metricSample struct {
+	labels string
+	value  int64
+}
+
+func writeMetric(w io.Writer, name, typ, help string, samples []metricSample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	sort.Slice(samples, func(i, j int) bool { return samples[i].labels < samples[j].labels })
+	for _, s := range samples {
+		if s.labels == "" {
+			fmt.Fprintf(w, "%s %d\n", name, s.value)
+		} else {
+			fmt.Fprintf(w, "%s{%s} %d\n", name, s.labels, s.value)
+		}
+	}
+}
+
+// API_metrics 以Prometheus文本格式输出连接、发布和播放的指标，会话标签按照MetricLabels输出
+func (*RTMPConfig) API_metrics(rw http.ResponseWriter, r *http.Request) {
+	var connCount int64
+	connections.Range(func(_, _ any) bool {
+		connCount++
+		return true
+	})
+	var audioBitrate, videoBitrate, buffered, dropped []metricSample
+	for _, stream := range filterStreams() {
+		p, ok := stream.Publisher.(IRTMPReceiver)
+		if !ok {
+			continue
+		}
+		receiver := p.GetReceiver()
+		labels := metricLabels(stream.Path, receiver.Labels())
+		if stats := receiver.monitorStats.Load(); stats != nil {
+			audioBitrate = append(audioBitrate, metricSample{labels, int64(stats.AudioBitrate)})
+			videoBitrate = append(videoBitrate, metricSample{labels, int64(stats.VideoBitrate)})
+		}
+		buffered = append(buffered, metricSample{labels, atomic.LoadInt64(&receiver.BufferedBytes)})
+		dropped = append(dropped, metricSample{labels, atomic.LoadInt64(&receiver.Dropped)})
+	}
+	var degrade, insufficientBW []metricSample
+	subscribers.Range(func(_, v any) bool {
+		sub := v.(*RTMPSubscriber)
+		streamPath := ""
+		if sub.Stream != nil {
+			streamPath = sub.Stream.Path
+		}
+		labels := `id="` + escapeLabelValue(sub.ID) + `",` + metricLabels(streamPath, sub.Labels())
+		degrade = append(degrade, metricSample{labels, int64(atomic.LoadInt32(&sub.DegradeCount))})
+		insufficientBW = append(insufficientBW, metricSample{labels, int64(atomic.LoadInt32(&sub.InsufficientBWCount))})
+		return true
+	})
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(rw, "rtmp_connections", "gauge", "Current RTMP connections.", []metricSample{{"", connCount}})
+	writeMetric(rw, "rtmp_publisher_audio_bitrate_kbps", "gauge", "Publisher audio bitrate.", audioBitrate)
+	writeMetric(rw, "rtmp_publisher_video_bitrate_kbps", "gauge", "Publisher video bitrate.", videoBitrate)
+	writeMetric(rw, "rtmp_publisher_buffered_bytes", "gauge", "Bytes buffered by the publish delay queue.", buffered)
+	writeMetric(rw, "rtmp_publisher_dropped_total", "counter", "Messages dropped because the publish delay buffer was full.", dropped)
+	writeMetric(rw, "rtmp_player_degrade_total", "counter", "Times the player degraded to audio only.", degrade)
+	writeMetric(rw, "rtmp_player_insufficient_bw_total", "counter", "Times NetStream.Play.InsufficientBW was sent.", insufficientBW)
+}
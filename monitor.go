@@ -0,0 +1,285 @@
+package rtmp
+
+import (
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/codec"
+)
+
+// AVDriftEvent 发布者音视频时间戳偏差超过阈值
+type AVDriftEvent struct {
+	StreamPath string
+	Drift      time.Duration // 音频时间戳减去视频时间戳
+	Corrected  bool
+	Labels     map[string]string `json:",omitempty"` // 会话标签
+}
+
+// AVMonitor 记录发布者音视频时间戳的交织情况
+type AVMonitor struct {
+	LastAudioTimestamp uint32
+	LastVideoTimestamp uint32
+	Drift              time.Duration
+	DriftCount         int    // 偏差超过阈值的次数
+	AudioOffset        uint32 // 修正音频时间戳时减去的偏移量
+	AudioSeqHead       bool   // 是否收到过音频序列头，不需要序列头的编码收到音频即为true
+	VideoSeqHead       bool   // 是否收到过视频序列头，不需要序列头的编码收到视频即为true
+	hasAudio, hasVideo bool
+	drifting           bool
+}
+
+func (r *RTMPReceiver) checkDrift() {
+	m := &r.AVMonitor
+	if !m.hasAudio || !m.hasVideo || conf.AVDriftThreshold <= 0 {
+		return
+	}
+	m.Drift = time.Duration(int64(m.LastAudioTimestamp)-int64(m.LastVideoTimestamp)) * time.Millisecond
+	if m.Drift < conf.AVDriftThreshold && m.Drift > -conf.AVDriftThreshold {
+		m.drifting = false
+		return
+	}
+	if m.drifting {
+		return
+	}
+	m.drifting = true
+	m.DriftCount++
+	r.Warn("av drift", zap.Duration("drift", m.Drift), zap.Int("count", m.DriftCount))
+	event := AVDriftEvent{Drift: m.Drift, Labels: r.Labels()}
+	if r.Stream != nil {
+		event.StreamPath = r.Stream.Path
+	}
+	if conf.AVDriftCorrect {
+		// 音频落后时偏移量减小，但不小于0：只能撤销之前的修正，不会把音频时间戳往后推
+		offset := int64(m.AudioOffset) + int64(m.Drift/time.Millisecond)
+		if offset < 0 {
+			offset = 0
+		}
+		if applied := offset - int64(m.AudioOffset); applied != 0 {
+			m.LastAudioTimestamp -= uint32(applied)
+			m.AudioOffset = uint32(offset)
+			// 修正后重新计算偏差，仍然超过阈值时保持告警状态，避免每个音频帧都告警
+			m.Drift -= time.Duration(applied) * time.Millisecond
+			m.drifting = m.Drift >= conf.AVDriftThreshold || m.Drift <= -conf.AVDriftThreshold
+			event.Corrected = true
+		}
+	}
+	emitEvent(event)
+}
+
+func (r *RTMPReceiver) monitorAudio(msg *Chunk) {
+	r.checkBitrate(msg)
+	if msg.ExtendTimestamp >= r.AudioOffset {
+		msg.ExtendTimestamp -= r.AudioOffset
+	} else {
+		msg.ExtendTimestamp = 0
+	}
+	r.LastAudioTimestamp = msg.ExtendTimestamp
+	if !r.AudioSeqHead {
+		r.AudioSeqHead = audioSeqHeadReady(msg)
+	}
+	r.hasAudio = true
+	r.checkDrift()
+	r.storeSync()
+}
+
+func (r *RTMPReceiver) monitorVideo(msg *Chunk) {
+	r.checkBitrate(msg)
+	r.checkGOP(msg)
+	r.LastVideoTimestamp = msg.ExtendTimestamp
+	if !r.VideoSeqHead {
+		r.VideoSeqHead = videoSeqHeadReady(msg)
+	}
+	r.hasVideo = true
+	r.checkDrift()
+	r.storeSync()
+}
+
+// audioSeqHeadReady 判断收到这个音频消息之后是否具备解码需要的序列头：
+// 只有AAC（包括扩展音频头中的AAC）、Opus和FLAC需要序列头，其他编码收到音频即可
+func audioSeqHeadReady(msg *Chunk) bool {
+	reader := msg.AVData.NewReader()
+	b0, _ := reader.ReadByte()
+	b1, _ := reader.ReadByte()
+	switch b0 >> 4 {
+	case 10:
+		return b1 == 0
+	case SoundFormatExHeader:
+		packetType, fourCc := b0&0x0f, make([]byte, 4)
+		if packetType == AudioPacketTypeMultitrack {
+			// 多音轨时第二个字节的低4位是实际的AudioPacketType
+			packetType = b1 & 0x0f
+			fourCc[0], _ = reader.ReadByte()
+		} else {
+			fourCc[0] = b1
+		}
+		for i := 1; i < 4; i++ {
+			fourCc[i], _ = reader.ReadByte()
+		}
+		switch string(fourCc) {
+		case FourCC_AAC, FourCC_OPUS, FourCC_FLAC:
+			return packetType == AudioPacketTypeSequenceStart
+		}
+	}
+	return true
+}
+
+// videoSeqHeadReady 判断收到这个视频消息之后是否具备解码需要的序列头：
+// H264、H265以及扩展视频头中的编码需要序列头，H263、VP6等传统编码收到视频即可
+func videoSeqHeadReady(msg *Chunk) bool {
+	reader := msg.AVData.NewReader()
+	b0, _ := reader.ReadByte()
+	b1, _ := reader.ReadByte()
+	if b0&0x80 != 0 {
+		packetType := b0 & 0x0f
+		if packetType == PacketTypeMultitrack {
+			packetType = b1 & 0x0f
+		}
+		return packetType == PacketTypeSequenceStart
+	}
+	switch codec.VideoCodecID(b0 & 0x0f) {
+	case codec.CodecID_H264, codec.CodecID_H265:
+		return b1 == 0
+	}
+	return true
+}
+
+// 码率超限的处理方式
+const (
+	BitrateActionLog   = "log"   // 记录日志并产生事件
+	BitrateActionWarn  = "warn"  // 同时向发布者发送onStatus警告
+	BitrateActionClose = "close" // 断开发布者
+)
+
+// BitrateViolationEvent 发布者码率持续超过限制
+type BitrateViolationEvent struct {
+	StreamPath   string
+	AudioBitrate int // kbps
+	VideoBitrate int // kbps
+	Action       string
+	Labels       map[string]string `json:",omitempty"`
+}
+
+// BitrateMonitor 每秒统计一次发布者的音视频码率
+type BitrateMonitor struct {
+	AudioBitrate     int // kbps
+	VideoBitrate     int // kbps
+	ViolationSeconds int // 连续超过码率限制的秒数
+	audioBytes       int
+	videoBytes       int
+	bitrateTime      time.Time
+}
+
+func appOf(streamPath string) string {
+	app, _, _ := strings.Cut(streamPath, "/")
+	return app
+}
+
+func (r *RTMPReceiver) checkBitrate(msg *Chunk) {
+	m := &r.BitrateMonitor
+	if msg.MessageTypeID == RTMP_MSG_AUDIO {
+		m.audioBytes += int(msg.MessageLength)
+	} else {
+		m.videoBytes += int(msg.MessageLength)
+	}
+	if m.bitrateTime.IsZero() {
+		m.bitrateTime = time.Now()
+		return
+	}
+	elapsed := time.Since(m.bitrateTime)
+	if elapsed < time.Second {
+		return
+	}
+	m.AudioBitrate = int(int64(m.audioBytes) * 8 * int64(time.Millisecond) / int64(elapsed))
+	m.VideoBitrate = int(int64(m.videoBytes) * 8 * int64(time.Millisecond) / int64(elapsed))
+	m.audioBytes, m.videoBytes, m.bitrateTime = 0, 0, time.Now()
+	if r.Stream == nil {
+		return
+	}
+	app := appOf(r.Stream.Path)
+	maxAudio, maxVideo := conf.MaxAudioBitrate[app], conf.MaxVideoBitrate[app]
+	if (maxAudio <= 0 || m.AudioBitrate <= maxAudio) && (maxVideo <= 0 || m.VideoBitrate <= maxVideo) {
+		m.ViolationSeconds = 0
+		return
+	}
+	if m.ViolationSeconds++; time.Duration(m.ViolationSeconds)*time.Second < conf.BitrateViolation {
+		return
+	}
+	m.ViolationSeconds = 0
+	r.Warn("bitrate exceeded", zap.Int("audio", m.AudioBitrate), zap.Int("video", m.VideoBitrate), zap.String("action", conf.BitrateAction))
+	emitEvent(BitrateViolationEvent{r.Stream.Path, m.AudioBitrate, m.VideoBitrate, conf.BitrateAction, r.Labels()})
+	switch conf.BitrateAction {
+	case BitrateActionWarn:
+		r.Response(0, NetStream_Publish_BitrateExceeded, Level_Warning)
+	case BitrateActionClose:
+		r.Response(0, NetStream_Publish_BitrateExceeded, Level_Error)
+		r.Stop()
+	}
+}
+
+// GOP超限的处理方式
+const (
+	GOPActionWarn  = "warn"  // 记录日志并产生事件
+	GOPActionClose = "close" // 断开发布者
+)
+
+// GOPExceededEvent 发布者关键帧间隔超过限制
+type GOPExceededEvent struct {
+	StreamPath       string
+	KeyFrameInterval time.Duration
+	GOPSize          int
+	Labels           map[string]string `json:",omitempty"`
+}
+
+// GOPMonitor 统计发布者的关键帧间隔和GOP帧数
+type GOPMonitor struct {
+	KeyFrameInterval    time.Duration // 最近两个关键帧的间隔
+	MaxKeyFrameInterval time.Duration
+	GOPSize             int // 最近一个GOP的帧数
+	frames              int
+	lastKeyFrame        uint32
+	lastKeyFrameTime    time.Time // 收到最近一个关键帧时的墙上时间
+	hasKeyFrame         bool
+	exceeded            bool
+}
+
+func (r *RTMPReceiver) checkGOP(msg *Chunk) {
+	m := &r.GOPMonitor
+	keyFrame, seqHead := parseVideoHeader(msg)
+	if seqHead {
+		return
+	}
+	if !keyFrame {
+		m.frames++
+		// 超过上限仍未收到关键帧时立即处理，无需等到下一个关键帧
+		if interval := time.Duration(msg.ExtendTimestamp-m.lastKeyFrame) * time.Millisecond; m.hasKeyFrame && !m.exceeded && conf.MaxGOPDuration > 0 && interval > conf.MaxGOPDuration {
+			m.exceeded = true
+			r.gopExceeded(interval, m.frames)
+		}
+		return
+	}
+	if m.hasKeyFrame {
+		m.KeyFrameInterval = time.Duration(msg.ExtendTimestamp-m.lastKeyFrame) * time.Millisecond
+		if m.KeyFrameInterval > m.MaxKeyFrameInterval {
+			m.MaxKeyFrameInterval = m.KeyFrameInterval
+		}
+		m.GOPSize = m.frames + 1
+	}
+	m.hasKeyFrame = true
+	m.exceeded = false
+	m.lastKeyFrame = msg.ExtendTimestamp
+	m.lastKeyFrameTime = time.Now()
+	r.lastKeyFrameNano.Store(m.lastKeyFrameTime.UnixNano())
+	m.frames = 0
+}
+
+func (r *RTMPReceiver) gopExceeded(interval time.Duration, frames int) {
+	r.Warn("gop exceeded", zap.Duration("interval", interval), zap.Int("frames", frames), zap.String("action", conf.GOPAction))
+	if r.Stream != nil {
+		emitEvent(GOPExceededEvent{r.Stream.Path, interval, frames, r.Labels()})
+	}
+	if conf.GOPAction == GOPActionClose {
+		r.Response(0, NetStream_Publish_GOPExceeded, Level_Error)
+		r.Stop()
+	}
+}
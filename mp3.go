@@ -0,0 +1,142 @@
+package rtmp
+
+import (
+	"m7s.live/engine/v4/codec"
+)
+
+// CodecID_MP3 传统rtmp的MP3（SoundFormat 2），引擎没有MP3轨道，按传统格式写入数据轨道并绕过引擎转发
+const CodecID_MP3 codec.AudioCodecID = 2
+
+// CodecID_MP3_8K 传统rtmp的MP3 8kHz（SoundFormat 14）
+const CodecID_MP3_8K codec.AudioCodecID = 14
+
+// FourCC_MP3 增强rtmp v2中MP3的FourCC，转换成传统的SoundFormat 2
+const FourCC_MP3 = ".mp3"
+
+func isMP3(codecID codec.AudioCodecID) bool {
+	return codecID == CodecID_MP3 || codecID == CodecID_MP3_8K
+}
+
+// MP3FrameHeader MP3帧头的主要字段
+type MP3FrameHeader struct {
+	SampleRate      int
+	SamplesPerFrame int
+	FrameSize       int // 包括帧头的帧长度
+	Channels        int
+}
+
+var (
+	// mp3Bitrates 码率（kbps），[MPEG1、MPEG2和2.5][Layer1、2、3][码率索引]
+	mp3Bitrates = [2][3][16]int{
+		{
+			{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+			{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+		},
+		{
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		},
+	}
+	// mp3SampleRates 采样率，[版本：MPEG2.5、保留、MPEG2、MPEG1][采样率索引]
+	mp3SampleRates = [4][3]int{
+		{11025, 12000, 8000},
+		{},
+		{22050, 24000, 16000},
+		{44100, 48000, 32000},
+	}
+)
+
+// parseMP3FrameHeader 解析4字节的MP3帧头，不支持自由码率
+func parseMP3FrameHeader(b []byte) (h MP3FrameHeader, ok bool) {
+	if len(b) < 4 || b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+		return
+	}
+	version, layer := b[1]>>3&0x03, 4-int(b[1]>>1&0x03)
+	bitrateIndex, rateIndex := b[2]>>4, b[2]>>2&0x03
+	if version == 1 || layer == 4 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return
+	}
+	mpeg1 := version == 3
+	row := 1
+	if mpeg1 {
+		row = 0
+	}
+	bitrate := mp3Bitrates[row][layer-1][bitrateIndex] * 1000
+	h.SampleRate = mp3SampleRates[version][rateIndex]
+	h.Channels = 2
+	if b[3]>>6 == 3 {
+		h.Channels = 1
+	}
+	padding := int(b[2] >> 1 & 0x01)
+	switch {
+	case layer == 1:
+		h.SamplesPerFrame = 384
+		h.FrameSize = (12*bitrate/h.SampleRate + padding) * 4
+	case layer == 3 && !mpeg1:
+		h.SamplesPerFrame = 576
+		h.FrameSize = 72*bitrate/h.SampleRate + padding
+	default:
+		h.SamplesPerFrame = 1152
+		h.FrameSize = 144*bitrate/h.SampleRate + padding
+	}
+	return h, true
+}
+
+// mp3Samples 统计一个音频消息中所有MP3帧的采样数
+func mp3Samples(payload []byte) (samples int, sampleRate int) {
+	for len(payload) >= 4 {
+		h, ok := parseMP3FrameHeader(payload)
+		if !ok || h.FrameSize <= 0 || sampleRate != 0 && h.SampleRate != sampleRate {
+			break
+		}
+		samples, sampleRate = samples+h.SamplesPerFrame, h.SampleRate
+		if h.FrameSize >= len(payload) {
+			break
+		}
+		payload = payload[h.FrameSize:]
+	}
+	return
+}
+
+// mp3Clock 根据MP3帧的采样数计算时间戳，Flash编码器和shoutcast转接的源时间戳常有抖动或者精度只有整数毫秒的累计误差
+type mp3Clock struct {
+	mp3Started bool
+	mp3Base    uint32 // 对齐时的时间戳
+	mp3Samples uint64 // 对齐之后的采样数
+	mp3Rate    int
+}
+
+// retimeMP3 用MP3帧头推算的时间戳替换源时间戳，首次、采样率变化或者相差超过1秒（断流、跳变）时重新对齐到源时间戳
+func (r *RTMPReceiver) retimeMP3(msg *Chunk) {
+	data := msg.AVData.ToBytes()
+	if len(data) < 5 || codec.AudioCodecID(data[0]>>4) != CodecID_MP3 {
+		return
+	}
+	samples, rate := mp3Samples(data[1:])
+	if samples == 0 {
+		return
+	}
+	c := &r.mp3Clock
+	ts := msg.ExtendTimestamp
+	if c.mp3Started && rate == c.mp3Rate {
+		expected := c.mp3Base + uint32(c.mp3Samples*1000/uint64(c.mp3Rate))
+		if diff := int64(expected) - int64(ts); diff < 1000 && diff > -1000 {
+			msg.ExtendTimestamp = expected
+			c.mp3Samples += uint64(samples)
+			return
+		}
+	}
+	c.mp3Started, c.mp3Base, c.mp3Samples, c.mp3Rate = true, ts, uint64(samples), rate
+}
+
+// forwardMP3 传统格式的MP3（包括由.mp3转换的）以.mp3写入数据轨道并原样转发给rtmp播放者和推流目标，返回false代表不是MP3
+func (r *RTMPReceiver) forwardMP3(msg *Chunk) bool {
+	b0, err := msg.AVData.NewReader().ReadByte()
+	if err != nil || !isMP3(codec.AudioCodecID(b0>>4)) {
+		return false
+	}
+	r.passthroughAudio(FourCC_MP3, msg.AVData.ToBytes(), msg.ExtendTimestamp, false)
+	return true
+}
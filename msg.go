@@ -42,14 +42,16 @@ const (
 	RTMP_MAX_CHUNK_HEADER   = 18
 
 	// User Control Event
-	RTMP_USER_STREAM_BEGIN       = 0
-	RTMP_USER_STREAM_EOF         = 1
-	RTMP_USER_STREAM_DRY         = 2
-	RTMP_USER_SET_BUFFLEN        = 3
-	RTMP_USER_STREAM_IS_RECORDED = 4
-	RTMP_USER_PING_REQUEST       = 6
-	RTMP_USER_PING_RESPONSE      = 7
-	RTMP_USER_EMPTY              = 31
+	RTMP_USER_STREAM_BEGIN        = 0
+	RTMP_USER_STREAM_EOF          = 1
+	RTMP_USER_STREAM_DRY          = 2
+	RTMP_USER_SET_BUFFLEN         = 3
+	RTMP_USER_STREAM_IS_RECORDED  = 4
+	RTMP_USER_PING_REQUEST        = 6
+	RTMP_USER_PING_RESPONSE       = 7
+	RTMP_USER_SWF_VERIFY_REQUEST  = 26
+	RTMP_USER_SWF_VERIFY_RESPONSE = 27
+	RTMP_USER_EMPTY               = 31
 
 	// StreamID == (ChannelID-4)/5+1
 	// ChannelID == Chunk Stream ID
@@ -68,7 +70,7 @@ const (
 func newChunkHeader(messageType byte) *ChunkHeader {
 	head := new(ChunkHeader)
 	head.ChunkStreamID = RTMP_CSID_CONTROL
-	if messageType == RTMP_MSG_AMF0_COMMAND {
+	if messageType == RTMP_MSG_AMF0_COMMAND || messageType == RTMP_MSG_AMF0_METADATA {
 		head.ChunkStreamID = RTMP_CSID_COMMAND
 	}
 	head.MessageTypeID = messageType
@@ -156,6 +158,7 @@ func GetRtmpMessage(chunk *Chunk, body util.Buffer) error {
 	case RTMP_MSG_AMF3_COMMAND: // RTMP消息类型ID=17, 命令消息.用AMF3编码.
 		decodeCommandAMF0(chunk, body[1:])
 	case RTMP_MSG_AMF0_METADATA: // RTMP消息类型ID=18, 数据消息.用AMF0编码.
+		decodeDataAMF0(chunk, body)
 	case RTMP_MSG_AMF0_SHARED: // RTMP消息类型ID=19, 共享对象消息.用AMF0编码.
 	case RTMP_MSG_AMF0_COMMAND: // RTMP消息类型ID=20, 命令消息.用AMF0编码.
 		decodeCommandAMF0(chunk, body) // 解析具体的命令消息
@@ -165,6 +168,26 @@ func GetRtmpMessage(chunk *Chunk, body util.Buffer) error {
 	return nil
 }
 
+// decodeDataAMF0 解析AMF0编码的数据消息，去掉推流端添加的@setDataFrame
+func decodeDataAMF0(chunk *Chunk, body []byte) {
+	amf := util.AMF{body}
+	m := &DataMessage{
+		Name:     amf.ReadShortString(),
+		StreamID: chunk.MessageStreamID,
+	}
+	if m.Name == "@setDataFrame" {
+		m.Name = amf.ReadShortString()
+	}
+	for amf.Len() > 0 {
+		v, err := amf.Unmarshal()
+		if err != nil {
+			break
+		}
+		m.Values = append(m.Values, v)
+	}
+	chunk.MsgData = m
+}
+
 // 03 00 00 00 00 01 02 14 00 00 00 00 02 00 07 63 6F 6E 6E 65 63 74 00 3F F0 00 00 00 00 00 00 08
 //
 // 这个函数解析的是从02(第13个字节)开始,前面12个字节是Header,后面的是Payload,即解析Payload.
@@ -318,6 +341,13 @@ func decodeCommandAMF0(chunk *Chunk, body []byte) {
 		} else {
 			chunk.MsgData = response
 		}
+	case CommandSetEncryption:
+		amf.Unmarshal()
+		chunk.MsgData = &EncryptionMessage{
+			cmdMsg,
+			amf.ReadObject(),
+			chunk.MessageStreamID,
+		}
 	case "FCPublish", "FCUnpublish":
 		fallthrough
 	default:
@@ -386,6 +416,21 @@ type MetadataMessage struct {
 	Proterties map[string]interface{} `json:",omitempty"`
 }
 
+// DataMessage AMF0编码的数据消息，例如onMetaData或者自定义的数据消息
+type DataMessage struct {
+	Name     string
+	Values   []any `json:",omitempty"`
+	StreamID uint32
+}
+
+func (msg *DataMessage) GetStreamID() uint32 {
+	return msg.StreamID
+}
+
+func (msg *DataMessage) Encode(buf *util.Buffer) {
+	buf.MarshalAMFs(append([]any{msg.Name}, msg.Values...)...)
+}
+
 // Object 可选值:
 // App 				客户端要连接到的服务应用名 												Testapp
 // Flashver			Flash播放器版本.和应用文档中getversion()函数返回的字符串相同.			FMSc/1.0
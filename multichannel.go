@@ -0,0 +1,129 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+// 增强rtmp MultichannelConfig中的AudioChannelOrder
+const (
+	AudioChannelOrderUnspecified = 0 // 只有声道数
+	AudioChannelOrderNative      = 1 // 以位掩码表示存在的声道，按AudioChannel的顺序排列
+	AudioChannelOrderCustom      = 2 // 逐个列出每个声道的位置
+)
+
+// audioChannelNames AudioChannel的取值对应的声道位置
+var audioChannelNames = []string{
+	"FL", "FR", "FC", "LFE", "BL", "BR", "FLC", "FRC", "BC", "SL", "SR", "TC",
+	"TFL", "TFC", "TFR", "TBL", "TBC", "TBR", "LFE2", "TSL", "TSR", "BFC", "BFL", "BFR",
+}
+
+func audioChannelName(c byte) string {
+	switch {
+	case int(c) < len(audioChannelNames):
+		return audioChannelNames[c]
+	case c == 0xfe:
+		return "unused"
+	case c == 0xff:
+		return "unknown"
+	}
+	return strconv.Itoa(int(c))
+}
+
+// MultichannelConfig 增强rtmp AudioPacketType为MultichannelConfig的声道布局，用于5.1、7.1等多声道音频
+type MultichannelConfig struct {
+	FourCC       string
+	ChannelOrder byte
+	ChannelCount byte
+	Layout       string   `json:",omitempty"` // 常见布局的名称，例如5.1、7.1
+	Channels     []string `json:",omitempty"` // 各声道的位置，ChannelOrder为0时没有
+}
+
+// parseMultichannelConfig 解析MultichannelConfig的负载：audioChannelOrder(1) channelCount(1)，
+// 之后Custom为channelCount个字节的audioChannelMapping，Native为4字节的audioChannelFlags
+func parseMultichannelConfig(fourCc string, b []byte) (*MultichannelConfig, error) {
+	if len(b) < 2 {
+		return nil, errors.New("multichannel config too short")
+	}
+	c := &MultichannelConfig{FourCC: fourCc, ChannelOrder: b[0], ChannelCount: b[1]}
+	switch c.ChannelOrder {
+	case AudioChannelOrderUnspecified:
+	case AudioChannelOrderCustom:
+		if len(b) < 2+int(c.ChannelCount) {
+			return nil, errors.New("multichannel mapping too short")
+		}
+		for _, ch := range b[2 : 2+int(c.ChannelCount)] {
+			c.Channels = append(c.Channels, audioChannelName(ch))
+		}
+	case AudioChannelOrderNative:
+		if len(b) < 6 {
+			return nil, errors.New("multichannel flags too short")
+		}
+		flags := binary.BigEndian.Uint32(b[2:6])
+		for i := range audioChannelNames {
+			if flags&(1<<i) != 0 {
+				c.Channels = append(c.Channels, audioChannelNames[i])
+			}
+		}
+	default:
+		return nil, errors.New("unknown audio channel order")
+	}
+	switch c.ChannelCount {
+	case 1:
+		c.Layout = "mono"
+	case 2:
+		c.Layout = "stereo"
+	case 6:
+		c.Layout = "5.1"
+	case 8:
+		c.Layout = "7.1"
+	}
+	return c, nil
+}
+
+// multichannelCache 缓存发布者最新的声道布局
+type multichannelCache struct {
+	multichannel atomic.Pointer[MultichannelConfig]
+}
+
+// receiveMultichannel 记录发布者发送的声道布局
+func (r *RTMPReceiver) receiveMultichannel(fourCc string, payload []byte) {
+	c, err := parseMultichannelConfig(fourCc, payload)
+	if err != nil {
+		r.Warn("invalid multichannel config", zap.String("fourCC", fourCc), zap.Error(err))
+		return
+	}
+	if prev := r.multichannel.Swap(c); prev == nil || prev.ChannelCount != c.ChannelCount {
+		r.Info("multichannel config", zap.String("fourCC", fourCc), zap.Uint8("channels", c.ChannelCount), zap.String("layout", c.Layout), zap.Strings("mapping", c.Channels))
+	}
+}
+
+// Multichannel 发布者最新的声道布局，没有收到时返回nil
+func (r *RTMPReceiver) Multichannel() *MultichannelConfig {
+	return r.multichannel.Load()
+}
+
+func (*RTMPConfig) API_multichannel(w http.ResponseWriter, r *http.Request) {
+	streamPath := r.URL.Query().Get("streamPath")
+	util.ReturnJson(func() map[string]*MultichannelConfig {
+		m := make(map[string]*MultichannelConfig)
+		for _, s := range filterStreams() {
+			if streamPath != "" && s.Path != streamPath {
+				continue
+			}
+			if p, ok := s.Publisher.(IRTMPReceiver); ok {
+				if c := p.GetReceiver().Multichannel(); c != nil {
+					m[s.Path] = c
+				}
+			}
+		}
+		return m
+	}, time.Second, w, r)
+}
@@ -0,0 +1,609 @@
+package rtmp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/track"
+	"m7s.live/engine/v4/util"
+)
+
+// 增强rtmp v2多轨道消息的AvMultitrackType
+const (
+	MultitrackOneTrack             = 0
+	MultitrackManyTracks           = 1
+	MultitrackManyTracksManyCodecs = 2
+)
+
+// RTMP_CSID_MULTITRACK 推流时发送其他视频轨道使用的块流，与主视频轨道分开，避免打乱主视频轨道的块头压缩
+const RTMP_CSID_MULTITRACK = 0x07
+
+// exTrack 多轨道视频消息中一个轨道的数据
+type exTrack struct {
+	ID      byte
+	FourCc  string
+	Payload []byte
+}
+
+// parseMultitrack 解析PacketType为Multitrack的扩展音视频消息体（不含第一个字节），音视频的格式相同
+func parseMultitrack(b []byte) (packetType byte, tracks []exTrack, err error) {
+	if len(b) < 1 {
+		return 0, nil, errors.New("multitrack too short")
+	}
+	mtType := b[0] >> 4
+	packetType, b = b[0]&0x0f, b[1:]
+	var fourCc string
+	if mtType != MultitrackManyTracksManyCodecs {
+		if len(b) < 4 {
+			return 0, nil, errors.New("multitrack fourCC too short")
+		}
+		fourCc, b = string(b[:4]), b[4:]
+	}
+	for len(b) > 0 {
+		t := exTrack{FourCc: fourCc}
+		if mtType == MultitrackManyTracksManyCodecs {
+			if len(b) < 4 {
+				return 0, nil, errors.New("multitrack fourCC too short")
+			}
+			t.FourCc, b = string(b[:4]), b[4:]
+		}
+		if len(b) < 1 {
+			return 0, nil, errors.New("multitrack trackId missing")
+		}
+		t.ID, b = b[0], b[1:]
+		size := len(b)
+		if mtType != MultitrackOneTrack {
+			if len(b) < 3 {
+				return 0, nil, errors.New("multitrack track size missing")
+			}
+			size, b = int(b[0])<<16|int(b[1])<<8|int(b[2]), b[3:]
+			if size > len(b) {
+				return 0, nil, fmt.Errorf("multitrack track %d size %d exceeds %d", t.ID, size, len(b))
+			}
+		}
+		t.Payload, b = b[:size], b[size:]
+		tracks = append(tracks, t)
+		if mtType == MultitrackOneTrack {
+			break
+		}
+	}
+	return
+}
+
+// multitrackFrame 绕过引擎转发的视频数据，其他视频轨道已经封装成单轨道的多轨道消息，TrackID为0时是引擎不支持的主视频轨道（AV1、VP9、VVC）的扩展视频消息
+type multitrackFrame struct {
+	Timestamp uint32 // 发布者的时间戳
+	TrackID   byte
+	KeyFrame  bool
+	SeqHead   bool
+	Data      []byte
+	Audio     bool // 引擎不支持的音频（Opus）的扩展音频消息
+}
+
+type multitrackSink struct {
+	frames  chan multitrackFrame
+	dropped atomic.Bool // 因为来不及发送丢弃过数据
+	extra   bool        // 是否接收其他视频轨道，播放者只接收主视频轨道
+	aux     bool        // 是否接收透明通道等辅助视频层，支持多轨道的播放者接收
+}
+
+// multitrackState 发布者多轨道音视频中trackId不为0的轨道，trackId为0的轨道作为主音视频轨道
+type multitrackState struct {
+	extraVideo map[byte]common.VideoTrack // 以trackId为key，不支持的编码为nil
+	extraAudio map[byte]common.AudioTrack // 以trackId为key，不支持的编码为nil
+	mtLock     sync.Mutex
+	mtSeqHeads map[byte]multitrackFrame // 各视频轨道最近的序列头，新的推流先发送
+	mtSinks    map[*multitrackSink]struct{}
+	auxVideo   map[byte]bool // 发布者onMetaData中标记为辅助视频层的trackId
+
+	exMain        *track.Data[ExFrame] // 主视频轨道是引擎不支持的编码时注册的引擎数据轨道
+	exMainFourCc  string               // 绕过引擎转发的主视频轨道的编码，只在接收协程中写入
+	exAudio       *track.Data[ExFrame] // 音频是引擎不支持的编码时注册的引擎数据轨道
+	exAudioFourCc string               // 绕过引擎转发的音频的编码，只在接收协程中写入
+	mtAudioHead   *multitrackFrame     // 绕过引擎转发的音频最近的序列头
+	mtActive      bool                 // 发布者发送过需要绕过引擎转发的音视频，之后加入的播放和推流立即开始转发
+	mtPending     map[*RTMPSender]bool // 等待发布者发送需要绕过引擎转发的音视频的播放和推流，value为extra
+	exBlackedOut  bool                 // 屏蔽期间丢弃过绕过引擎转发的主视频，恢复时从关键帧开始，只在接收协程中读写
+}
+
+// ExFrame 引擎没有AV1、VP9、VVC（H.266）的视频轨道和Opus、AC-3、E-AC-3、FLAC、MP3的音频轨道，发布者的扩展音视频消息原样写入以FourCC命名的数据轨道，供录像等其他插件订阅
+type ExFrame struct {
+	FourCC    string
+	Timestamp uint32
+	KeyFrame  bool
+	SeqHead   bool
+	Data      []byte // 扩展音视频消息体，包括FourCC；MP3为传统格式的音频消息
+}
+
+// exPassthrough 引擎没有轨道的视频编码，保留扩展视频头绕过引擎转发
+var exPassthrough = map[string]bool{
+	FourCC_AV1: true,
+	FourCC_VP9: true,
+	FourCC_VVC: true,
+}
+
+// exAudioPassthrough 引擎没有轨道的音频编码，保留扩展音频头和序列头（例如OpusHead、FLAC的STREAMINFO）绕过引擎转发
+var exAudioPassthrough = map[string]bool{
+	FourCC_OPUS: true,
+	FourCC_AC3:  true,
+	FourCC_EAC3: true,
+	FourCC_FLAC: true,
+}
+
+// convertMultitrack 处理多轨道视频消息，其他轨道写入各自的引擎视频轨道，0号轨道转换成传统格式继续处理
+func (r *RTMPReceiver) convertMultitrack(msg *Chunk, data []byte) bool {
+	packetType, tracks, err := parseMultitrack(data[1:])
+	if err != nil {
+		r.Warn("invalid multitrack", zap.Error(err))
+		return false
+	}
+	var main *exTrack
+	for i := range tracks {
+		if tracks[i].ID == 0 {
+			main = &tracks[i]
+			continue
+		}
+		r.forwardExtraVideo(data[0], packetType, tracks[i], msg.ExtendTimestamp)
+		r.writeExtraVideo(data[0], packetType, tracks[i], msg.ExtendTimestamp)
+	}
+	if main == nil {
+		return false
+	}
+	if packetType == PacketTypeMetadata {
+		r.receiveColorInfo(main.FourCc, main.Payload)
+		return false
+	}
+	if exPassthrough[main.FourCc] {
+		// 还原成单轨道的扩展视频消息
+		single := make([]byte, 5+len(main.Payload))
+		single[0] = data[0]&0xf0 | packetType
+		copy(single[1:], main.FourCc)
+		copy(single[5:], main.Payload)
+		r.forwardExVideo(main.FourCc, single, msg.ExtendTimestamp)
+		return false
+	}
+	header, payload, ok := r.legacyVideo(data[0], packetType, main.FourCc, main.Payload)
+	if _, supported := exVideoCodecID(main.FourCc); !supported {
+		// 还原成单轨道的扩展视频头，交给checkCodec处理不支持的编码
+		header[0] = data[0]&0xf0 | packetType
+		copy(header[1:], main.FourCc)
+		payload, ok = main.Payload, true
+	}
+	if !ok {
+		return false
+	}
+	mem := r.bytePool.Get(len(header) + len(payload))
+	copy(mem.Value, header[:])
+	copy(mem.Value[len(header):], payload)
+	msg.AVData.Recycle()
+	msg.AVData.Push(mem)
+	return true
+}
+
+// writeExtraVideo 将其他轨道写入单独的引擎视频轨道，轨道名称为编码加trackId，例如h264_1
+func (r *RTMPReceiver) writeExtraVideo(b0, packetType byte, t exTrack, ts uint32) {
+	if r.Stream == nil {
+		return
+	}
+	vt, created := r.extraVideo[t.ID]
+	if !created {
+		if packetType != PacketTypeSequenceStart {
+			// 等待该轨道的序列头
+			return
+		}
+		codecID, _ := exVideoCodecID(t.FourCc)
+		switch codecID {
+		case codec.CodecID_H264:
+			vt = track.NewH264(r.Stream, fmt.Sprintf("h264_%d", t.ID))
+		case codec.CodecID_H265:
+			vt = track.NewH265(r.Stream, fmt.Sprintf("h265_%d", t.ID))
+		}
+		if vt != nil {
+			vt.SetStuff(r.bytePool)
+			r.Info("multitrack video", zap.Uint8("trackId", t.ID), zap.String("fourCC", t.FourCc), zap.String("track", vt.GetName()))
+		} else {
+			r.Warn("unsupported multitrack codec", zap.Uint8("trackId", t.ID), zap.String("fourCC", t.FourCc))
+		}
+		if r.extraVideo == nil {
+			r.extraVideo = make(map[byte]common.VideoTrack)
+		}
+		r.extraVideo[t.ID] = vt
+	}
+	if vt == nil {
+		return
+	}
+	header, payload, ok := r.legacyVideo(b0, packetType, t.FourCc, t.Payload)
+	if !ok {
+		return
+	}
+	mem := r.bytePool.Get(len(header) + len(payload))
+	copy(mem.Value, header[:])
+	copy(mem.Value[len(header):], payload)
+	var frame util.BLL
+	frame.Push(mem)
+	vt.WriteAVCC(ts, &frame)
+}
+
+// forwardExtraVideo 将其他轨道封装成单轨道的多轨道消息，交给正在推流的RTMPSender
+func (r *RTMPReceiver) forwardExtraVideo(b0, packetType byte, t exTrack, ts uint32) {
+	seqHead := packetType == PacketTypeSequenceStart
+	r.mtLock.Lock()
+	defer r.mtLock.Unlock()
+	r.activateMultitrack()
+	if len(r.mtSinks) == 0 && !seqHead {
+		return
+	}
+	data := make([]byte, 7+len(t.Payload))
+	data[0] = 0x80 | b0&0x70 | PacketTypeMultitrack
+	data[1] = MultitrackOneTrack<<4 | packetType
+	copy(data[2:6], t.FourCc)
+	data[6] = t.ID
+	copy(data[7:], t.Payload)
+	r.dispatchMultitrack(multitrackFrame{ts, t.ID, b0&0x70 == 0x10, seqHead, data, false})
+}
+
+// dispatchMultitrack 缓存序列头并交给各RTMPSender，调用时持有mtLock
+func (r *RTMPReceiver) dispatchMultitrack(f multitrackFrame) {
+	if f.Audio && f.SeqHead {
+		r.mtAudioHead = &f
+	} else if f.SeqHead {
+		if r.mtSeqHeads == nil {
+			r.mtSeqHeads = make(map[byte]multitrackFrame)
+		}
+		r.mtSeqHeads[f.TrackID] = f
+	}
+	for sink := range r.mtSinks {
+		if !r.acceptTrack(sink, f.TrackID) {
+			continue
+		}
+		select {
+		case sink.frames <- f:
+		default:
+			sink.dropped.Store(true)
+		}
+	}
+}
+
+// activateMultitrack 发布者第一次发送需要绕过引擎转发的视频时开始转发给等待的播放和推流，调用时持有mtLock
+func (r *RTMPReceiver) activateMultitrack() {
+	if r.mtActive {
+		return
+	}
+	r.mtActive = true
+	for sender, extra := range r.mtPending {
+		if !sender.IsClosed() {
+			go sender.forwardMultitrack(r, extra)
+		}
+	}
+	r.mtPending = nil
+}
+
+// startMultitrack 发布者有其他视频轨道或者引擎不支持的主视频轨道时才开始转发，否则等待发布者第一次发送
+func (rtmp *RTMPSender) startMultitrack(extra bool) {
+	if rtmp.Stream == nil {
+		return
+	}
+	p, ok := rtmp.Stream.Publisher.(IRTMPReceiver)
+	if !ok {
+		return
+	}
+	r := p.GetReceiver()
+	r.mtLock.Lock()
+	defer r.mtLock.Unlock()
+	if r.mtActive {
+		go rtmp.forwardMultitrack(r, extra)
+		return
+	}
+	if r.mtPending == nil {
+		r.mtPending = make(map[*RTMPSender]bool)
+	}
+	for sender := range r.mtPending {
+		if sender.IsClosed() {
+			delete(r.mtPending, sender)
+		}
+	}
+	r.mtPending[rtmp] = extra
+}
+
+// passthroughFourCc 绕过引擎转发的主视频轨道的编码，没有时为空
+func (r *RTMPReceiver) passthroughFourCc() string {
+	r.mtLock.Lock()
+	defer r.mtLock.Unlock()
+	return r.exMainFourCc
+}
+
+func (r *RTMPReceiver) addMultitrackSink(extra, aux bool) *multitrackSink {
+	r.mtLock.Lock()
+	defer r.mtLock.Unlock()
+	sink := &multitrackSink{frames: make(chan multitrackFrame, 65+len(r.mtSeqHeads)), extra: extra, aux: aux}
+	if r.mtAudioHead != nil {
+		sink.frames <- *r.mtAudioHead
+	}
+	for _, f := range r.mtSeqHeads {
+		if r.acceptTrack(sink, f.TrackID) {
+			sink.frames <- f
+		}
+	}
+	if r.mtSinks == nil {
+		r.mtSinks = make(map[*multitrackSink]struct{})
+	}
+	r.mtSinks[sink] = struct{}{}
+	return sink
+}
+
+func (r *RTMPReceiver) removeMultitrackSink(sink *multitrackSink) {
+	r.mtLock.Lock()
+	delete(r.mtSinks, sink)
+	r.mtLock.Unlock()
+}
+
+// multitrackSender 记录主视频轨道和音频发送的时间戳，用于对齐绕过引擎转发的视频
+type multitrackSender struct {
+	videoSent atomic.Bool
+	videoTime atomic.Uint32
+	audioSent atomic.Bool
+	audioTime atomic.Uint32
+}
+
+// forwardMultitrack 发送绕过引擎转发的视频直到播放或推流结束：extra为true时（推流）以增强rtmp v2多轨道消息发送发布者的其他视频轨道，
+// 播放者在connect中通告支持多轨道时只接收透明通道等辅助视频层，引擎不支持的主视频轨道（AV1、VP9、VVC）总是发送
+func (rtmp *RTMPSender) forwardMultitrack(r *RTMPReceiver, extra bool) {
+	sink := r.addMultitrackSink(extra, !extra && rtmp.caps.Multitrack())
+	defer r.removeMultitrackSink(sink)
+	var mt AVSender
+	mt.RTMPSender = rtmp
+	mt.ChunkStreamID = RTMP_CSID_MULTITRACK
+	mt.MessageTypeID = RTMP_MSG_VIDEO
+	mt.MessageStreamID = rtmp.StreamID
+	started := make(map[byte]bool)
+	var offset, mainOffset int64
+	hasOffset, hasMainOffset := false, false
+	for {
+		select {
+		case <-rtmp.Subscriber.Done():
+			return
+		case f := <-sink.frames:
+			if sink.dropped.Swap(false) {
+				// 丢弃过数据，各轨道需要重新从关键帧开始
+				started = make(map[byte]bool)
+			}
+			if f.TrackID == 0 && !hasMainOffset {
+				// 以已经发送的引擎音视频的时间戳为准，都没有时从0开始
+				mainOffset, hasMainOffset = -int64(f.Timestamp), true
+				if rtmp.audioSent.Load() {
+					mainOffset += int64(rtmp.audioTime.Load())
+				} else if rtmp.videoSent.Load() {
+					mainOffset += int64(rtmp.videoTime.Load())
+				}
+			}
+			if f.Audio {
+				rtmp.sendMainAudio(f, uint32(int64(f.Timestamp)+mainOffset))
+				continue
+			}
+			if f.TrackID == 0 {
+				if !f.SeqHead && !started[0] && !f.KeyFrame {
+					continue
+				}
+				if !f.SeqHead {
+					started[0] = true
+				}
+				rtmp.sendMainVideo(f, uint32(int64(f.Timestamp)+mainOffset))
+				continue
+			}
+			var ts uint32
+			if !f.SeqHead {
+				if !started[f.TrackID] && !f.KeyFrame {
+					continue
+				}
+				if !hasOffset {
+					// 以主视频轨道的时间戳为准，主视频轨道还没有发送时等待
+					if !rtmp.videoSent.Load() {
+						continue
+					}
+					offset, hasOffset = int64(rtmp.videoTime.Load())-int64(f.Timestamp), true
+				}
+				started[f.TrackID] = true
+				ts = uint32(int64(f.Timestamp) + offset)
+			}
+			if rtmp.quota != nil {
+				rtmp.quota.egressBytes.Add(int64(len(f.Data)))
+			}
+			rtmp.egressBytes.Add(int64(len(f.Data)))
+			mt.sendData(f.Data, ts)
+		}
+	}
+}
+
+// sendMainVideo 在主视频块流上发送引擎不支持的主视频轨道
+func (rtmp *RTMPSender) sendMainVideo(f multitrackFrame, ts uint32) {
+	if rtmp.DataOnly {
+		return
+	}
+	if rtmp.quota != nil {
+		rtmp.quota.egressBytes.Add(int64(len(f.Data)))
+	}
+	rtmp.egressBytes.Add(int64(len(f.Data)))
+	rtmp.video.sendData(f.Data, ts)
+}
+
+// sendMainAudio 在音频块流上发送引擎不支持的音频
+func (rtmp *RTMPSender) sendMainAudio(f multitrackFrame, ts uint32) {
+	if rtmp.DataOnly {
+		return
+	}
+	if rtmp.quota != nil {
+		rtmp.quota.egressBytes.Add(int64(len(f.Data)))
+	}
+	rtmp.egressBytes.Add(int64(len(f.Data)))
+	rtmp.audio.sendData(f.Data, ts)
+}
+
+// convertAudioMultitrack 处理多轨道音频消息（例如多语种、解说），其他轨道写入各自的引擎音频轨道，0号轨道转换成传统格式继续处理
+func (r *RTMPReceiver) convertAudioMultitrack(msg *Chunk, data []byte) bool {
+	packetType, tracks, err := parseMultitrack(data[1:])
+	if err != nil {
+		r.Warn("invalid audio multitrack", zap.Error(err))
+		return false
+	}
+	var main *exTrack
+	for i := range tracks {
+		if tracks[i].ID == 0 {
+			main = &tracks[i]
+			continue
+		}
+		r.writeExtraAudio(packetType, tracks[i], msg.ExtendTimestamp)
+	}
+	if main == nil {
+		return false
+	}
+	if exAudioPassthrough[main.FourCc] {
+		// 还原成单轨道的扩展音频消息
+		single := make([]byte, 5+len(main.Payload))
+		single[0] = SoundFormatExHeader<<4 | packetType
+		copy(single[1:], main.FourCc)
+		copy(single[5:], main.Payload)
+		if packetType == AudioPacketTypeMultichannelConfig {
+			r.receiveMultichannel(main.FourCc, main.Payload)
+		}
+		r.forwardExAudio(main.FourCc, single, msg.ExtendTimestamp)
+		return false
+	}
+	if packetType == AudioPacketTypeMultichannelConfig {
+		r.receiveMultichannel(main.FourCc, main.Payload)
+		return false
+	}
+	header, ok := legacyAudio(packetType, main.FourCc, main.Payload)
+	if _, supported := exAudioCodecID(main.FourCc); !supported {
+		// 还原成单轨道的扩展音频头，交给checkCodec处理不支持的编码
+		header = append([]byte{SoundFormatExHeader<<4 | packetType}, main.FourCc...)
+		ok = true
+	}
+	if !ok {
+		return false
+	}
+	mem := r.bytePool.Get(len(header) + len(main.Payload))
+	copy(mem.Value, header)
+	copy(mem.Value[len(header):], main.Payload)
+	msg.AVData.Recycle()
+	msg.AVData.Push(mem)
+	return true
+}
+
+// writeExtraAudio 将其他轨道写入单独的引擎音频轨道，轨道名称为编码加trackId，例如aac_1
+func (r *RTMPReceiver) writeExtraAudio(packetType byte, t exTrack, ts uint32) {
+	if r.Stream == nil {
+		return
+	}
+	at, created := r.extraAudio[t.ID]
+	if !created {
+		if packetType != AudioPacketTypeSequenceStart {
+			// 等待该轨道的序列头
+			return
+		}
+		if codecID, _ := exAudioCodecID(t.FourCc); codecID == codec.CodecID_AAC {
+			at = track.NewAAC(r.Stream, fmt.Sprintf("aac_%d", t.ID))
+			at.SetStuff(r.bytePool)
+			r.Info("multitrack audio", zap.Uint8("trackId", t.ID), zap.String("fourCC", t.FourCc), zap.String("track", at.GetName()))
+		} else {
+			r.Warn("unsupported multitrack codec", zap.Uint8("trackId", t.ID), zap.String("fourCC", t.FourCc))
+		}
+		if r.extraAudio == nil {
+			r.extraAudio = make(map[byte]common.AudioTrack)
+		}
+		r.extraAudio[t.ID] = at
+	}
+	if at == nil {
+		return
+	}
+	header, ok := legacyAudio(packetType, t.FourCc, t.Payload)
+	if !ok {
+		return
+	}
+	mem := r.bytePool.Get(len(header) + len(t.Payload))
+	copy(mem.Value, header)
+	copy(mem.Value[len(header):], t.Payload)
+	var frame util.BLL
+	frame.Push(mem)
+	at.WriteAVCC(ts, &frame)
+}
+
+// forwardExVideo 引擎没有AV1、VP9和VVC（H.266）的视频轨道，扩展视频消息保留FourCC写入数据轨道，
+// 同时绕过引擎原样转发给rtmp播放者和推流，序列头缓存给之后加入的播放者
+func (r *RTMPReceiver) forwardExVideo(fourCc string, data []byte, ts uint32) {
+	packetType := data[0] & 0x0f
+	seqHead := packetType == PacketTypeSequenceStart
+	if seqHead {
+		if err := r.checkExSequenceStart(fourCc, data[5:]); err != nil {
+			r.Warn("invalid sequence start", zap.String("fourCC", fourCc), zap.Error(err))
+			return
+		}
+		// 引擎的轨道和数据轨道都不能更换编码
+		if prev := r.exMainFourCc; prev != fourCc && (prev != "" || len(r.seqHead) > 0) {
+			if prev == "" {
+				prev = videoCodec(r.seqHead)
+			}
+			r.endCodecChange(prev, fourCc)
+			return
+		}
+	} else if r.exMainFourCc != fourCc {
+		// 等待该编码的序列头
+		return
+	}
+	r.mtLock.Lock()
+	defer r.mtLock.Unlock()
+	r.activateMultitrack()
+	if r.exMain == nil && r.Stream != nil {
+		r.exMain = track.NewDataTrack[ExFrame](fourCc)
+		r.Stream.AddTrack(r.exMain)
+		r.Info("video passthrough", zap.String("fourCC", fourCc))
+	}
+	r.exMainFourCc = fourCc
+	keyFrame := data[0]&0x70 == 0x10
+	data = append([]byte(nil), data...)
+	if r.exMain != nil {
+		r.exMain.Push(ExFrame{fourCc, ts, keyFrame, seqHead, data})
+	}
+	if len(r.mtSinks) == 0 && !seqHead || r.blackoutPassthrough(false, seqHead, keyFrame) {
+		return
+	}
+	r.dispatchMultitrack(multitrackFrame{ts, 0, keyFrame, seqHead, data, false})
+}
+
+// forwardExAudio 引擎没有Opus的音频轨道，扩展音频消息保留FourCC写入数据轨道，
+// 同时绕过引擎原样转发给rtmp播放者和推流，序列头（OpusHead）缓存给之后加入的播放者
+func (r *RTMPReceiver) forwardExAudio(fourCc string, data []byte, ts uint32) {
+	r.passthroughAudio(fourCc, data, ts, data[0]&0x0f == AudioPacketTypeSequenceStart)
+}
+
+// passthroughAudio 将引擎没有轨道的音频写入数据轨道并交给各RTMPSender，data为原样发送的音频消息
+func (r *RTMPReceiver) passthroughAudio(fourCc string, data []byte, ts uint32, seqHead bool) {
+	if prev := r.exAudioFourCc; prev != "" && prev != fourCc || r.AudioTrack != nil {
+		// 引擎的轨道和数据轨道都不能更换编码
+		if seqHead {
+			r.Warn("audio codec changed, dropped", zap.String("from", prev), zap.String("to", fourCc))
+		}
+		return
+	}
+	r.mtLock.Lock()
+	defer r.mtLock.Unlock()
+	r.activateMultitrack()
+	if r.exAudio == nil && r.Stream != nil {
+		r.exAudio = track.NewDataTrack[ExFrame](fourCc)
+		r.Stream.AddTrack(r.exAudio)
+		r.Info("audio passthrough", zap.String("fourCC", fourCc))
+	}
+	r.exAudioFourCc = fourCc
+	data = append([]byte(nil), data...)
+	if r.exAudio != nil {
+		r.exAudio.Push(ExFrame{fourCc, ts, false, seqHead, data})
+	}
+	if len(r.mtSinks) == 0 && !seqHead || r.blackoutPassthrough(true, seqHead, false) {
+		return
+	}
+	r.dispatchMultitrack(multitrackFrame{ts, 0, false, seqHead, data, true})
+}
@@ -0,0 +1,112 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+// newTestPlayer 以net.Pipe的一端作为播放连接，返回另一端用于读取播放者收到的消息
+func newTestPlayer(t *testing.T) (*RTMPSender, *NetConnection) {
+	client, server := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		client.Close()
+		server.Close()
+	})
+	player := &RTMPSender{}
+	player.NetStream = NetStream{NetConnection: NewNetConnection(server), StreamID: 1}
+	player.Subscriber.Context = ctx
+	player.Subscriber.Logger = zap.NewNop()
+	player.audio.RTMPSender = player
+	player.audio.ChunkStreamID = RTMP_CSID_AUDIO
+	player.audio.MessageTypeID = RTMP_MSG_AUDIO
+	player.audio.MessageStreamID = player.StreamID
+	return player, NewNetConnection(client)
+}
+
+// recvAudio 读取对端收到的音频消息
+func recvAudio(t *testing.T, peer *NetConnection) []byte {
+	t.Helper()
+	done := make(chan []byte, 1)
+	go func() {
+		for {
+			msg, err := peer.RecvMessage()
+			if err != nil {
+				close(done)
+				return
+			}
+			if msg.MessageTypeID == RTMP_MSG_AUDIO {
+				done <- msg.AVData.ToBytes()
+				return
+			}
+		}
+	}()
+	select {
+	case data, ok := <-done:
+		if !ok {
+			t.Fatal("connection closed before audio")
+		}
+		return data
+	case <-time.After(time.Second):
+		t.Fatal("no audio received")
+	}
+	return nil
+}
+
+// exAudioMessage 生成单轨道的扩展音频消息
+func exAudioMessage(packetType byte, fourCc string, payload []byte, ts uint32) *Chunk {
+	data := append([]byte{SoundFormatExHeader<<4 | packetType}, fourCc...)
+	data = append(data, payload...)
+	msg := &Chunk{}
+	msg.MessageTypeID = RTMP_MSG_AUDIO
+	msg.ExtendTimestamp = ts
+	msg.AVData.Push(&util.ListItem[util.Buffer]{Value: data})
+	return msg
+}
+
+// waitSinks 等待forwardMultitrack注册到发布者
+func waitSinks(t *testing.T, r *RTMPReceiver, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		r.mtLock.Lock()
+		count := len(r.mtSinks)
+		r.mtLock.Unlock()
+		if count >= n {
+			return
+		}
+	}
+	t.Fatal("player not registered")
+}
+
+func TestExAudioPassthrough(t *testing.T) {
+	for _, fourCc := range []string{FourCC_AC3, FourCC_EAC3, FourCC_FLAC} {
+		t.Run(fourCc, func(t *testing.T) {
+			r := &RTMPReceiver{}
+			r.Logger = zap.NewNop()
+			seqStart := []byte{0x0b, 0x77, 0x01}
+			if r.convertExAudio(exAudioMessage(AudioPacketTypeSequenceStart, fourCc, seqStart, 0)) {
+				t.Fatal("passthrough audio written to engine")
+			}
+			player, peer := newTestPlayer(t)
+			go player.forwardMultitrack(r, false)
+			waitSinks(t, r, 1)
+			frame := []byte{0x0b, 0x77, 0x12, 0x34}
+			r.convertExAudio(exAudioMessage(AudioPacketTypeCodedFrames, fourCc, frame, 40))
+			// 之后加入的播放者先收到缓存的序列头
+			if got := recvAudio(t, peer); !bytes.Equal(got[5:], seqStart) || string(got[1:5]) != fourCc {
+				t.Fatalf("sequence start %x", got)
+			}
+			got := recvAudio(t, peer)
+			if got[0] != SoundFormatExHeader<<4|AudioPacketTypeCodedFrames || string(got[1:5]) != fourCc || !bytes.Equal(got[5:], frame) {
+				t.Fatalf("frame %x", got)
+			}
+		})
+	}
+}
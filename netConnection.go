@@ -2,13 +2,17 @@ package rtmp
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"errors"
 	"io"
 	"net"
 	"runtime"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"go.uber.org/zap"
 	"m7s.live/engine/v4/util"
 )
 
@@ -48,19 +52,95 @@ type NetConnection struct {
 	*bufio.Reader   `json:"-"`
 	net.Conn        `json:"-"`
 	bandwidth       uint32
-	readSeqNum      uint32 // 当前读的字节
-	writeSeqNum     uint32 // 当前写的字节
-	totalWrite      uint32 // 总共写了多少字节
-	totalRead       uint32 // 总共读了多少字节
-	writeChunkSize  int
-	readChunkSize   int
-	incommingChunks map[uint32]*Chunk
+	readSeqNum      uint32            // 当前读的字节
+	writeSeqNum     uint32            // 当前写的字节
+	totalWrite      uint32            // 总共写了多少字节
+	totalRead       uint32            // 总共读了多少字节
+	writeChunkSize  int               // 发送的块大小，只在写锁内读写
+	readChunkSize   int               // 接收的块大小，只在读取的协程中读写
+	incommingChunks map[uint32]*Chunk // 每个块流ID上一个块的消息头，只在读取的协程中使用
 	objectEncoding  float64
 	appName         string
-	tmpBuf          util.Buffer //用来接收/发送小数据，复用内存
+	caps            Capabilities // 对端在connect中通告的增强rtmp能力
+	software        string       // 根据flashVer识别出的客户端软件
+	geo             *GeoInfo     // 客户端的地理位置，没有配置GeoIP数据库时为nil
+	tmpBuf          util.Buffer  // 发送时在写锁内编码消息，复用内存
+	readBuf         util.Buffer  // 读取块消息头，与发送分开，读写在不同的协程中进行
 	chunkHeader     util.Buffer
 	bytePool        util.BytesPool
 	writing         atomic.Bool // false 可写，true 不可写
+	ConnectTime     time.Time
+	lastStreamID    uint32
+	mu              sync.RWMutex
+	streamIDs       map[uint32]string // 消息流ID对应的streamPath
+	ctx             context.Context
+	tcpStats        atomic.Pointer[TCPStats]
+	badStreamIDs    atomic.Uint32                // 消息流ID不符的音视频消息数
+	labels          map[uint32]map[string]string // 消息流ID对应的会话标签
+	readChecker
+	memoryAccount
+	sessionLog
+	writeCoalescer
+	serverSig []byte // 握手时服务端S1的最后32字节，用于SWF校验
+
+	ctxStop chan struct{} // 关闭后结束SetContext启动的监听协程
+}
+
+// ConnectionInfo 连接的诊断信息
+type ConnectionInfo struct {
+	RemoteAddr  string
+	AppName     string
+	ConnectTime time.Time
+	StreamIDs   map[uint32]string
+	TCP         *TCPStats                    `json:",omitempty"`
+	BadMessages uint32                       // 消息流ID不符的音视频消息数
+	Labels      map[uint32]map[string]string `json:",omitempty"` // 消息流ID对应的会话标签
+	FourCcList  []string                     `json:",omitempty"` // 对端通告的增强rtmp视频编码
+	CapsEx      int                          `json:",omitempty"` // 对端通告的增强rtmp扩展能力
+	Anomalies   *ReadAnomalies               `json:",omitempty"` // 读取时发现的消息连续性异常，开启ReadCheck时统计
+	Geo         *GeoInfo                     `json:",omitempty"` // 客户端的地理位置
+	Memory      *MemoryStats                 `json:",omitempty"` // 连接缓冲中的字节数，配置了MaxConnMemory时统计
+}
+
+// Capabilities 对端在connect中通告的增强rtmp能力，推流时据此决定打包格式
+func (nc *NetConnection) Capabilities() Capabilities {
+	return nc.caps
+}
+
+func (nc *NetConnection) GetInfo() (info ConnectionInfo) {
+	nc.mu.RLock()
+	defer nc.mu.RUnlock()
+	info.RemoteAddr = nc.RemoteAddr().String()
+	info.AppName = nc.appName
+	info.ConnectTime = nc.ConnectTime
+	info.TCP = nc.tcpStats.Load()
+	info.BadMessages = nc.badStreamIDs.Load()
+	info.FourCcList = nc.caps.FourCcList
+	info.CapsEx = nc.caps.CapsEx
+	info.Geo = nc.geo
+	if conf.MaxConnMemory > 0 {
+		info.Memory = nc.memoryStats()
+	}
+	if conf.ReadCheck {
+		info.Anomalies = nc.anomalies()
+	}
+	info.StreamIDs = make(map[uint32]string, len(nc.streamIDs))
+	for id, streamPath := range nc.streamIDs {
+		info.StreamIDs[id] = streamPath
+	}
+	for id, labels := range nc.labels {
+		if len(labels) == 0 {
+			continue
+		}
+		if info.Labels == nil {
+			info.Labels = make(map[uint32]map[string]string)
+		}
+		info.Labels[id] = make(map[string]string, len(labels))
+		for k, v := range labels {
+			info.Labels[id][k] = v
+		}
+	}
+	return
 }
 
 func NewNetConnection(conn net.Conn) *NetConnection {
@@ -72,10 +152,52 @@ func NewNetConnection(conn net.Conn) *NetConnection {
 		incommingChunks: make(map[uint32]*Chunk),
 		bandwidth:       RTMP_MAX_CHUNK_SIZE << 3,
 		tmpBuf:          make(util.Buffer, 4),
+		readBuf:         make(util.Buffer, 4),
 		chunkHeader:     make(util.Buffer, 0, 16),
 		bytePool:        make(util.BytesPool, 17),
+		ConnectTime:     time.Now(),
 	}
 }
+
+// SetContext 绑定连接的生命周期，ctx结束时通过设置截止时间中断阻塞的读写，ctx带有截止时间时同时作为读写的截止时间
+func (conn *NetConnection) SetContext(ctx context.Context) {
+	if ctx == nil {
+		return
+	}
+	// 先结束上一次的监听，避免每次调用都留下一个协程
+	conn.releaseContext()
+	conn.ctx = ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	conn.ctxStop = stop
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+}
+
+// releaseContext 结束SetContext启动的监听协程，连接不再使用时调用；
+// 推拉流重连时ctx在多个连接间复用，不调用的话旧连接的协程要等到ctx结束才退出
+func (conn *NetConnection) releaseContext() {
+	if conn.ctxStop != nil {
+		close(conn.ctxStop)
+		conn.ctxStop = nil
+	}
+}
+
+// ConnContext 返回连接绑定的ctx，可以用来获取链路追踪等信息
+func (conn *NetConnection) ConnContext() context.Context {
+	if conn.ctx == nil {
+		return context.Background()
+	}
+	return conn.ctx
+}
+
 func (conn *NetConnection) ReadFull(buf []byte) (n int, err error) {
 	n, err = io.ReadFull(conn.Reader, buf)
 	if err == nil {
@@ -131,9 +253,13 @@ func (conn *NetConnection) readChunk() (msg *Chunk, err error) {
 
 	if ChunkType != 3 && ok && chunk.AVData.Length > 0 {
 		// 如果块类型不为3,那么这个rtmp的body应该为空.
+		conn.anomaly(&conn.incomplete, &totalAnomalies.incomplete, "incomplete message", ChunkStreamID)
 		return nil, errors.New("incompleteRtmpBody error")
 	}
 	if !ok {
+		if ChunkType != 0 {
+			conn.anomaly(&conn.missingHeader, &totalAnomalies.missingHeader, "missing previous header", ChunkStreamID)
+		}
 		chunk = &Chunk{}
 		conn.incommingChunks[ChunkStreamID] = chunk
 	}
@@ -141,20 +267,38 @@ func (conn *NetConnection) readChunk() (msg *Chunk, err error) {
 	if err = conn.readChunkType(&chunk.ChunkHeader, ChunkType); err != nil {
 		return nil, errors.New("get chunk type error :" + err.Error())
 	}
+	if ChunkType < 2 && !knownMessageType(chunk.MessageTypeID) {
+		conn.anomaly(&conn.unknownType, &totalAnomalies.unknownType, "unknown message type", ChunkStreamID)
+	}
 	msgLen := int(chunk.MessageLength)
 
 	needRead := conn.readChunkSize
 	if unRead := msgLen - chunk.AVData.ByteLength; unRead < needRead {
 		needRead = unRead
 	}
-	mem := conn.bytePool.Get(needRead)
-	if n, err := conn.ReadFull(mem.Value); err != nil {
-		mem.Recycle()
-		return nil, err
-	} else {
-		conn.readSeqNum += uint32(n)
+	// 对端的块大小可能远大于本地（例如60000或者不分块），按内存池最大的块分段读取，缓冲随着数据到达增长
+	for needRead > 0 {
+		size := needRead
+		if size > RTMP_MAX_CHUNK_SIZE {
+			size = RTMP_MAX_CHUNK_SIZE
+		}
+		mem := conn.bytePool.Get(size)
+		if n, err := conn.ReadFull(mem.Value); err != nil {
+			mem.Recycle()
+			return nil, err
+		} else {
+			conn.readSeqNum += uint32(n)
+		}
+		if err = conn.holdMemory(size); err != nil {
+			mem.Recycle()
+			conn.exceedMemory("chunk")
+			return nil, err
+		}
+		chunk.AVData.Push(mem)
+		needRead -= size
 	}
-	if chunk.AVData.Push(mem); chunk.AVData.ByteLength == msgLen {
+	if chunk.AVData.ByteLength == msgLen {
+		conn.releaseMemory(msgLen)
 		chunk.ChunkHeader.ExtendTimestamp += chunk.ChunkHeader.Timestamp
 		msg = chunk
 		switch chunk.MessageTypeID {
@@ -203,8 +347,8 @@ func (conn *NetConnection) readChunkStreamID(csid uint32) (chunkStreamID uint32,
 }
 
 func (conn *NetConnection) readChunkType(h *ChunkHeader, chunkType byte) (err error) {
-	conn.tmpBuf.Reset()
-	b4 := conn.tmpBuf.Malloc(4)
+	conn.readBuf.Reset()
+	b4 := conn.readBuf.Malloc(4)
 	b3 := b4[:3]
 	if chunkType == 3 {
 		// 3个字节的时间戳
@@ -255,23 +399,47 @@ func (conn *NetConnection) RecvMessage() (msg *Chunk, err error) {
 		err = conn.SendMessage(RTMP_MSG_ACK, Uint32Message(conn.totalRead))
 	}
 	for msg == nil && err == nil {
+		if conn.ctx != nil && conn.ctx.Err() != nil {
+			return nil, conn.ctx.Err()
+		}
 		if msg, err = conn.readChunk(); msg != nil {
+			conn.logMessage(false, msg.MessageTypeID, msg.MessageStreamID, msg.MsgData)
 			switch msg.MessageTypeID {
 			case RTMP_MSG_CHUNK_SIZE:
-				conn.readChunkSize = int(msg.MsgData.(Uint32Message))
-				println("read chunk size", conn.readChunkSize)
+				// 只影响接收，发送的块大小由SetChunkSize单独协商
+				size := uint32(msg.MsgData.(Uint32Message))
+				if size < 1 || size > 0x7fffffff {
+					return nil, errors.New("invalid chunk size")
+				}
+				if size > 0xffffff {
+					// 消息长度最大为0xffffff，更大的块大小等同于不分块
+					size = 0xffffff
+				}
+				conn.readChunkSize = int(size)
+				conn.peerChunkSize.Store(int64(size))
+				RTMPPlugin.Debug("peer chunk size", zap.String("remote", conn.RemoteAddr().String()), zap.Uint32("size", size))
 			case RTMP_MSG_ABORT:
-				delete(conn.incommingChunks, uint32(msg.MsgData.(Uint32Message)))
+				// 丢弃未完成的消息，保留该块流的消息头，之后的块仍然可以省略消息头
+				csid := uint32(msg.MsgData.(Uint32Message))
+				if chunk, ok := conn.incommingChunks[csid]; ok {
+					conn.releaseMemory(chunk.AVData.ByteLength)
+					chunk.AVData.Recycle()
+					conn.incommingChunks[csid] = &Chunk{ChunkHeader: chunk.ChunkHeader}
+				}
 			case RTMP_MSG_ACK, RTMP_MSG_EDGE:
 			case RTMP_MSG_USER_CONTROL:
 				if _, ok := msg.MsgData.(*PingRequestMessage); ok {
 					conn.SendUserControl(RTMP_USER_PING_RESPONSE)
+				} else if m, ok := msg.MsgData.(*UserControlMessage); ok {
+					if err = conn.handleSWFVerify(m); err != nil {
+						return nil, err
+					}
 				}
 			case RTMP_MSG_ACK_SIZE:
 				conn.bandwidth = uint32(msg.MsgData.(Uint32Message))
 			case RTMP_MSG_BANDWIDTH:
 				conn.bandwidth = msg.MsgData.(*SetPeerBandwidthMessage).AcknowledgementWindowsize
-			case RTMP_MSG_AMF0_COMMAND, RTMP_MSG_AUDIO, RTMP_MSG_VIDEO:
+			case RTMP_MSG_AMF0_COMMAND, RTMP_MSG_AMF0_METADATA, RTMP_MSG_AUDIO, RTMP_MSG_VIDEO:
 				return msg, err
 			}
 		}
@@ -282,16 +450,30 @@ func (conn *NetConnection) SendMessage(t byte, msg RtmpMessage) (err error) {
 	if conn == nil {
 		return errors.New("connection is nil")
 	}
-	if conn.writeSeqNum > conn.bandwidth {
-		conn.totalWrite += conn.writeSeqNum
-		conn.writeSeqNum = 0
-		err = conn.SendMessage(RTMP_MSG_ACK, Uint32Message(conn.totalWrite))
-		err = conn.SendStreamID(RTMP_USER_PING_REQUEST, 0)
+	if conn.ctx != nil && conn.ctx.Err() != nil {
+		return conn.ctx.Err()
 	}
 	for !conn.writing.CompareAndSwap(false, true) {
 		runtime.Gosched()
 	}
 	defer conn.writing.Store(false)
+	conn.sendAck()
+	return conn.writeMessage(t, msg)
+}
+
+// sendAck 发送的字节超过窗口大小时发送确认和ping，调用时持有写锁
+func (conn *NetConnection) sendAck() {
+	if conn.writeSeqNum <= conn.bandwidth {
+		return
+	}
+	conn.totalWrite += conn.writeSeqNum
+	conn.writeSeqNum = 0
+	conn.writeMessage(RTMP_MSG_ACK, Uint32Message(conn.totalWrite))
+	conn.writeMessage(RTMP_MSG_USER_CONTROL, &StreamIDMessage{UserControlMessage{EventType: RTMP_USER_PING_REQUEST}, 0})
+}
+
+// writeMessage 编码并分块发送消息，调用时持有写锁
+func (conn *NetConnection) writeMessage(t byte, msg RtmpMessage) error {
 	conn.tmpBuf.Reset()
 	msg.Encode(&conn.tmpBuf)
 	head := newChunkHeader(t)
@@ -303,10 +485,38 @@ func (conn *NetConnection) SendMessage(t byte, msg RtmpMessage) (err error) {
 	for _, chunk := range conn.tmpBuf.Split(conn.writeChunkSize) {
 		conn.sendChunk(chunk)
 	}
+	// 之后的消息按照新的块大小分块，和SetChunkSize消息在同一次写操作中切换，不会与其他写操作交错
+	if t == RTMP_MSG_CHUNK_SIZE {
+		conn.writeChunkSize = int(msg.(Uint32Message))
+	}
+	conn.logMessage(true, t, head.MessageStreamID, msg)
 	return nil
 }
 
+// SetChunkSize 在会话中途修改发送的块大小
+func (conn *NetConnection) SetChunkSize(size int) error {
+	// 块大小在协议中为31位，但是消息长度只有24位，超过0xFFFFFF没有意义
+	if size < 1 || size > 0xFFFFFF {
+		return errors.New("invalid chunk size")
+	}
+	return conn.SendMessage(RTMP_MSG_CHUNK_SIZE, Uint32Message(size))
+}
+
 func (conn *NetConnection) sendChunk(writeBuffer ...[]byte) error {
+	if conn.coalesce {
+		conn.pending = append(conn.pending, conn.chunkHeader...)
+		n := len(conn.chunkHeader)
+		for _, b := range writeBuffer {
+			conn.pending = append(conn.pending, b...)
+			n += len(b)
+		}
+		conn.writeSeqNum += uint32(n)
+		return nil
+	}
+	// 先发送合并的缓冲，保持发送顺序
+	if err := conn.sendPending(); err != nil {
+		return err
+	}
 	if n, err := conn.Write(conn.chunkHeader); err != nil {
 		return err
 	} else {
@@ -0,0 +1,136 @@
+package rtmp
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"m7s.live/engine/v4/util"
+)
+
+// PeerStats 按客户端软件统计的连接数和失败次数，用于决定优先兼容哪些推流软件
+type PeerStats struct {
+	Software    string
+	Connections uint64
+	Publishes   uint64
+	Plays       uint64
+	Failures    uint64            // 发布、播放失败或者连接异常断开的次数
+	FailureRate float64           // Failures / Connections
+	FlashVers   map[string]uint64 // 原始的flashVer及其连接数
+}
+
+// 每个客户端软件最多记录的flashVer数量，避免任意的flashVer占用过多内存
+const maxFlashVers = 100
+
+var peers struct {
+	sync.Mutex
+	m map[string]*PeerStats
+}
+
+// fingerprints flashVer中的特征字符串对应的客户端软件，按顺序匹配
+var fingerprints = []struct {
+	pattern  string
+	software string
+}{
+	{"obs-studio", "OBS Studio"},
+	{"Lavf", "FFmpeg"},
+	{"LNX 9,0,124,2", "FFmpeg"}, // ffmpeg播放时的默认flashVer
+	{"Wirecast", "Wirecast"},
+	{"vMix", "vMix"},
+	{"XSplit", "XSplit"},
+	{"Larix", "Larix"},
+	{"monibuca", "Monibuca"},
+	{"FMLE", "Flash Media Live Encoder"},
+	{"LNX", "Flash Player"},
+	{"WIN", "Flash Player"},
+	{"MAC", "Flash Player"},
+}
+
+func fingerprint(flashVer string) string {
+	if flashVer == "" {
+		return "unknown"
+	}
+	for _, f := range fingerprints {
+		if strings.Contains(flashVer, f.pattern) {
+			return f.software
+		}
+	}
+	return "other"
+}
+
+func peerStats(software string) *PeerStats {
+	if peers.m == nil {
+		peers.m = make(map[string]*PeerStats)
+	}
+	s, ok := peers.m[software]
+	if !ok {
+		s = &PeerStats{Software: software, FlashVers: make(map[string]uint64)}
+		peers.m[software] = s
+	}
+	return s
+}
+
+// recordPeer 记录一次connect，返回识别出的客户端软件
+func recordPeer(flashVer string) string {
+	software := fingerprint(flashVer)
+	peers.Lock()
+	defer peers.Unlock()
+	s := peerStats(software)
+	s.Connections++
+	if _, ok := s.FlashVers[flashVer]; ok || len(s.FlashVers) < maxFlashVers {
+		s.FlashVers[flashVer]++
+	}
+	return software
+}
+
+// recordPeerResult 记录一次发布或者播放的结果
+func recordPeerResult(software string, publish bool, failed bool) {
+	if software == "" {
+		return
+	}
+	peers.Lock()
+	defer peers.Unlock()
+	s := peerStats(software)
+	if publish {
+		s.Publishes++
+	} else {
+		s.Plays++
+	}
+	if failed {
+		s.Failures++
+	}
+}
+
+// recordPeerFailure 记录连接异常断开
+func recordPeerFailure(software string) {
+	if software == "" {
+		return
+	}
+	peers.Lock()
+	defer peers.Unlock()
+	peerStats(software).Failures++
+}
+
+func (*RTMPConfig) API_peers(w http.ResponseWriter, r *http.Request) {
+	util.ReturnJson(func() (list []PeerStats) {
+		peers.Lock()
+		defer peers.Unlock()
+		for _, s := range peers.m {
+			stats := *s
+			stats.FlashVers = make(map[string]uint64, len(s.FlashVers))
+			for k, v := range s.FlashVers {
+				stats.FlashVers[k] = v
+			}
+			if stats.Connections > 0 {
+				stats.FailureRate = float64(stats.Failures) / float64(stats.Connections)
+			}
+			list = append(list, stats)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Connections > list[j].Connections
+		})
+		return
+	}, time.Second, w, r)
+}
@@ -0,0 +1,296 @@
+package rtmp
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// NetStream_Publish_Preflight 只校验的推流结束时发送的onStatus，信息对象的report为校验报告
+const NetStream_Publish_Preflight = "NetStream.Publish.Preflight"
+
+// 只校验的推流的默认和最长的检查时长
+const (
+	preflightDefault = 5 * time.Second
+	preflightMax     = 60 * time.Second
+	preflightMaxGOP  = 10 * time.Second // 关键帧间隔超过该时长时报告问题
+)
+
+// PreflightReport 只校验的推流（推流地址带?validate=5s）的检查报告，用于编码器接入前的自检
+type PreflightReport struct {
+	StreamPath   string
+	Duration     time.Duration // 检查的墙上时长
+	AudioCodec   string        `json:",omitempty"`
+	VideoCodec   string        `json:",omitempty"`
+	AudioBitrate int           // kbps，按时间戳计算
+	VideoBitrate int           // kbps，按时间戳计算
+	FrameRate    float64
+	KeyFrames    int
+	GOP          time.Duration     // 平均关键帧间隔
+	MaxGOP       time.Duration     // 最大关键帧间隔
+	Width        int               `json:",omitempty"` // 来自onMetaData
+	Height       int               `json:",omitempty"` // 来自onMetaData
+	Encoder      string            `json:",omitempty"` // 来自onMetaData
+	Problems     []string          `json:",omitempty"` // 发现的问题，为空代表通过
+	Labels       map[string]string `json:",omitempty"`
+}
+
+// preflight 只校验的推流，不发布到引擎，检查时长结束后回复报告并断开连接
+type preflight struct {
+	sync.Mutex
+	nc         *NetConnection
+	streamID   uint32
+	report     PreflightReport
+	start      time.Time
+	done       bool
+	audioSeq   bool
+	videoSeq   bool
+	audioBytes int
+	videoBytes int
+	audioTime  [2]uint32 // 第一个和最后一个音频帧的时间戳
+	videoTime  [2]uint32
+	videoCount int
+	keyTimes   []uint32
+	timer      *time.Timer
+}
+
+// preflightDuration 推流地址中validate参数指定的检查时长，validate=1使用默认时长，没有该参数时返回false
+func preflightDuration(args url.Values) (time.Duration, bool) {
+	v := args.Get("validate")
+	switch v {
+	case "", "0":
+		return 0, false
+	case "1", "true":
+		return preflightDefault, true
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return preflightDefault, true
+	}
+	if d > preflightMax {
+		d = preflightMax
+	}
+	return d, true
+}
+
+// startPreflight 开始只校验的推流，检查时长之后在定时器的协程中结束
+func startPreflight(nc *NetConnection, streamID uint32, streamPath string, d time.Duration, labels map[string]string) *preflight {
+	p := &preflight{nc: nc, streamID: streamID, start: time.Now()}
+	p.report.StreamPath = streamPath
+	p.report.Labels = labels
+	p.timer = time.AfterFunc(d, p.finish)
+	RTMPPlugin.Info("publish preflight", zap.String("streamPath", streamPath), zap.Duration("duration", d))
+	return p
+}
+
+// legacyCodecName 传统FLV的CodecID对应的编码名称
+func legacyCodecName(isAudio bool, codecID byte) string {
+	if isAudio {
+		switch codecID {
+		case 2, 14:
+			return "mp3"
+		case 7:
+			return "pcma"
+		case 8:
+			return "pcmu"
+		case 10:
+			return "aac"
+		case 11:
+			return "speex"
+		case 4, 5, 6:
+			return "nellymoser"
+		}
+	} else {
+		switch codecID {
+		case 2:
+			return "h263"
+		case 7:
+			return "h264"
+		case 12:
+			return "h265"
+		}
+	}
+	return strconv.Itoa(int(codecID))
+}
+
+// receive 统计推流的音视频消息，不写入引擎
+func (p *preflight) receive(msg *Chunk) {
+	defer msg.AVData.Recycle()
+	p.Lock()
+	defer p.Unlock()
+	if p.done || msg.AVData.ByteLength < 2 {
+		return
+	}
+	codecID, fourCc, isExt := parseCodec(msg)
+	isAudio := msg.MessageTypeID == RTMP_MSG_AUDIO
+	name := fourCc
+	if !isExt {
+		name = legacyCodecName(isAudio, codecID)
+	}
+	if !codecSupported(isAudio, codecID, fourCc, isExt) {
+		name += "(unsupported)"
+	}
+	reader := msg.AVData.NewReader()
+	b0, _ := reader.ReadByte()
+	b1, _ := reader.ReadByte()
+	ts := msg.ExtendTimestamp
+	if isAudio {
+		p.report.AudioCodec = name
+		// 扩展音频头的AudioPacketType为0，AAC的AACPacketType为0时是序列头
+		if isExt && b0&0x0f == AudioPacketTypeSequenceStart || !isExt && codecID == 10 && b1 == 0 {
+			p.audioSeq = true
+			return
+		}
+		if p.audioBytes == 0 {
+			p.audioTime[0] = ts
+		}
+		p.audioTime[1] = ts
+		p.audioBytes += msg.AVData.ByteLength
+		return
+	}
+	p.report.VideoCodec = name
+	keyFrame, seqHead := b0>>4 == 1 && b1 != 0, b1 == 0
+	if isExt {
+		packetType := b0 & 0x0f
+		keyFrame = b0>>4&0x07 == 1 && (packetType == PacketTypeCodedFrames || packetType == PacketTypeCodedFramesX || packetType == PacketTypeMultitrack)
+		seqHead = packetType == PacketTypeSequenceStart
+	}
+	if seqHead {
+		p.videoSeq = true
+		return
+	}
+	if p.videoCount == 0 {
+		p.videoTime[0] = ts
+	}
+	p.videoTime[1] = ts
+	p.videoCount++
+	p.videoBytes += msg.AVData.ByteLength
+	if keyFrame {
+		p.keyTimes = append(p.keyTimes, ts)
+	}
+}
+
+// receiveMetaData 记录onMetaData中的分辨率和编码器
+func (p *preflight) receiveMetaData(msg *Chunk) {
+	m, ok := msg.MsgData.(*DataMessage)
+	if !ok || m.Name != "onMetaData" {
+		return
+	}
+	meta, _, _ := singleTrackMeta(m.Values)
+	if meta == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.report.Width = int(amfNumber(meta, "width"))
+	p.report.Height = int(amfNumber(meta, "height"))
+	p.report.Encoder, _ = meta["encoder"].(string)
+}
+
+// finish 生成报告，以onPreflight数据消息和onStatus发送给推流端后断开连接
+func (p *preflight) finish() {
+	p.Lock()
+	if p.done {
+		p.Unlock()
+		return
+	}
+	p.done = true
+	r := &p.report
+	r.Duration = time.Since(p.start)
+	if span := p.audioTime[1] - p.audioTime[0]; span > 0 {
+		r.AudioBitrate = int(int64(p.audioBytes) * 8 / int64(span))
+	}
+	if span := p.videoTime[1] - p.videoTime[0]; span > 0 {
+		r.VideoBitrate = int(int64(p.videoBytes) * 8 / int64(span))
+		r.FrameRate = float64(p.videoCount-1) * 1000 / float64(span)
+	}
+	r.KeyFrames = len(p.keyTimes)
+	if n := len(p.keyTimes); n > 1 {
+		for i := 1; i < n; i++ {
+			if gop := time.Duration(p.keyTimes[i]-p.keyTimes[i-1]) * time.Millisecond; gop > r.MaxGOP {
+				r.MaxGOP = gop
+			}
+		}
+		r.GOP = time.Duration(p.keyTimes[n-1]-p.keyTimes[0]) * time.Millisecond / time.Duration(n-1)
+	}
+	switch {
+	case r.AudioCodec == "" && r.VideoCodec == "":
+		r.Problems = append(r.Problems, "no audio or video")
+	case r.VideoCodec == "":
+		r.Problems = append(r.Problems, "no video")
+	case r.AudioCodec == "":
+		r.Problems = append(r.Problems, "no audio")
+	}
+	for _, codec := range []string{r.AudioCodec, r.VideoCodec} {
+		if strings.HasSuffix(codec, "(unsupported)") {
+			r.Problems = append(r.Problems, "unsupported codec "+strings.TrimSuffix(codec, "(unsupported)"))
+		}
+	}
+	if r.AudioCodec == "aac" && !p.audioSeq {
+		r.Problems = append(r.Problems, "no audio sequence header")
+	}
+	if r.VideoCodec != "" && !p.videoSeq {
+		r.Problems = append(r.Problems, "no video sequence header")
+	}
+	if r.VideoCodec != "" && r.KeyFrames == 0 {
+		r.Problems = append(r.Problems, "no keyframe")
+	} else if r.KeyFrames > 0 && (r.MaxGOP > preflightMaxGOP || time.Duration(p.videoTime[1]-p.keyTimes[r.KeyFrames-1])*time.Millisecond > preflightMaxGOP) {
+		r.Problems = append(r.Problems, "keyframe interval over "+preflightMaxGOP.String())
+	}
+	p.Unlock()
+
+	level, code := Level_Status, NetStream_Publish_Preflight
+	if len(r.Problems) > 0 {
+		level = Level_Warning
+		RTMPPlugin.Warn("publish preflight failed", zap.String("streamPath", r.StreamPath), zap.Strings("problems", r.Problems))
+	} else {
+		RTMPPlugin.Info("publish preflight passed", zap.String("streamPath", r.StreamPath))
+	}
+	emitEvent(*r)
+	obj := r.amf()
+	p.nc.SendMessage(RTMP_MSG_AMF0_METADATA, &DataMessage{"onPreflight", []any{obj}, p.streamID})
+	m := new(ResponsePublishMessage)
+	m.CommandName = Response_OnStatus
+	m.Infomation = map[string]any{
+		"code":        code,
+		"level":       level,
+		"description": strings.Join(r.Problems, "; "),
+		"report":      obj,
+	}
+	m.StreamID = p.streamID
+	p.nc.SendMessage(RTMP_MSG_AMF0_COMMAND, m)
+	p.nc.Close()
+}
+
+// amf 报告的AMF对象，时长以毫秒表示，问题以分号连接
+func (r *PreflightReport) amf() map[string]any {
+	return map[string]any{
+		"streamPath":   r.StreamPath,
+		"duration":     float64(r.Duration.Milliseconds()),
+		"audioCodec":   r.AudioCodec,
+		"videoCodec":   r.VideoCodec,
+		"audioBitrate": float64(r.AudioBitrate),
+		"videoBitrate": float64(r.VideoBitrate),
+		"frameRate":    r.FrameRate,
+		"keyFrames":    float64(r.KeyFrames),
+		"gop":          float64(r.GOP.Milliseconds()),
+		"maxGop":       float64(r.MaxGOP.Milliseconds()),
+		"width":        float64(r.Width),
+		"height":       float64(r.Height),
+		"encoder":      r.Encoder,
+		"passed":       len(r.Problems) == 0,
+		"problems":     strings.Join(r.Problems, "; "),
+	}
+}
+
+// stop 推流端提前断开或者删除流时停止检查
+func (p *preflight) stop() {
+	p.timer.Stop()
+	p.Lock()
+	p.done = true
+	p.Unlock()
+}
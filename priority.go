@@ -0,0 +1,215 @@
+package rtmp
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4"
+	"m7s.live/engine/v4/util"
+)
+
+// 超过推流出口带宽上限时对低优先级推流的处理方式
+const (
+	PushPressureThrottle = "throttle" // 停止发送视频只发送音频，压力缓解后从关键帧恢复
+	PushPressureSuspend  = "suspend"  // 暂停推流，压力缓解后自动恢复
+)
+
+// pushThrottle 记录推流的出口字节数，以及带宽压力下的限流状态
+type pushThrottle struct {
+	egressBytes atomic.Int64 // 上次统计之后发送的音视频字节数
+	egressKbps  atomic.Int64
+	throttled   atomic.Bool
+	videoPaused bool // 当前因为限流没有发送视频
+}
+
+// throttleVideo 判断当前视频帧是否因为限流而不发送，解除限流后从关键帧恢复
+func (rtmp *RTMPSender) throttleVideo(v engine.VideoFrame) bool {
+	t := &rtmp.pushThrottle
+	if t.throttled.Load() {
+		t.videoPaused = true
+		return true
+	}
+	if !t.videoPaused {
+		return false
+	}
+	if !v.IFrame {
+		return true
+	}
+	t.videoPaused = false
+	// 跳过了中间的视频帧，需要重新发送绝对时间戳
+	rtmp.video.firstSent.Store(false)
+	return false
+}
+
+// pushPriority 通过接口设置的推流优先级覆盖配置
+func pushPriority(streamPath string) int {
+	if v, ok := paths.Load(streamPath); ok {
+		if n := v.(*pathEntry).priority.Load(); n != nil {
+			return *n
+		}
+	}
+	return conf.PushPriority[streamPath]
+}
+
+// shedPush 因为带宽压力被限流或暂停的推流
+type shedPush struct {
+	priority  int
+	kbps      int // 限流或暂停之前的出口带宽，用于判断是否可以恢复
+	suspended bool
+}
+
+// pressureShed 因为带宽压力被限流或暂停的推流，以streamPath为key
+var (
+	pressureLock sync.Mutex
+	pressureShed = make(map[string]shedPush)
+)
+
+type pushLoad struct {
+	pusher   *RTMPPusher
+	priority int
+	kbps     int
+}
+
+// runPushPressure 每秒统计推流的出口带宽，超过上限时从优先级最低的推流开始限流或暂停，带宽低于上限的80%时逐个恢复
+func runPushPressure() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		var loads []pushLoad
+		total := 0
+		rangePaths(func(_ string, e *pathEntry) bool {
+			p := e.pusher.Load()
+			if p == nil {
+				return true
+			}
+			kbps := int(p.egressBytes.Swap(0) * 8 / 1000)
+			p.egressKbps.Store(int64(kbps))
+			loads = append(loads, pushLoad{p, pushPriority(p.StreamPath), kbps})
+			total += kbps
+			return true
+		})
+		pressureLock.Lock()
+		if max := conf.MaxPushEgress; max > 0 && total > max {
+			shedPushes(loads, total-max)
+		} else if max <= 0 || total < max*8/10 {
+			restorePush(max*8/10 - total)
+		}
+		pressureLock.Unlock()
+	}
+}
+
+// shedPushes 从优先级最低的推流开始处理，相同优先级先处理最新开始的推流，直到覆盖超出的带宽。
+// 最高优先级的推流不受影响，所有推流优先级相同时只保留最早开始的推流
+func shedPushes(loads []pushLoad, excess int) {
+	sort.Slice(loads, func(i, j int) bool {
+		if loads[i].priority != loads[j].priority {
+			return loads[i].priority < loads[j].priority
+		}
+		return loads[i].pusher.StartTime.After(loads[j].pusher.StartTime)
+	})
+	top := loads[len(loads)-1].priority
+	allEqual := loads[0].priority == top
+	for i, l := range loads {
+		if excess <= 0 || allEqual && i == len(loads)-1 || !allEqual && l.priority >= top {
+			return
+		}
+		if l.pusher.throttled.Load() {
+			if conf.PushPressureAction != PushPressureSuspend {
+				continue
+			}
+			// 改为暂停之后，已经限流的推流也需要暂停
+			l.kbps = pressureShed[l.pusher.StreamPath].kbps
+		}
+		RTMPPlugin.Warn("push egress pressure", zap.String("streamPath", l.pusher.StreamPath), zap.Int("priority", l.priority), zap.Int("kbps", l.kbps), zap.String("action", conf.PushPressureAction))
+		shed := shedPush{priority: l.priority, kbps: l.kbps}
+		if conf.PushPressureAction == PushPressureSuspend {
+			if !suspendPush(l.pusher) {
+				continue
+			}
+			shed.suspended = true
+		} else {
+			l.pusher.throttled.Store(true)
+		}
+		pressureShed[l.pusher.StreamPath] = shed
+		excess -= l.kbps
+	}
+}
+
+// restorePush 恢复优先级最高的一个推流，每次只恢复一个，避免带宽反复震荡
+func restorePush(headroom int) {
+	var streamPath string
+	var best shedPush
+	for path, s := range pressureShed {
+		if streamPath == "" || s.priority > best.priority {
+			streamPath, best = path, s
+		}
+	}
+	if streamPath == "" || (conf.MaxPushEgress > 0 && best.kbps > headroom) {
+		return
+	}
+	if best.suspended {
+		if s := suspendedPushOf(streamPath); s != nil {
+			if runningPusher(streamPath) != nil {
+				// 暂停的推流还没有完全退出
+				return
+			}
+			if err := resumePush(streamPath, s); err != nil {
+				RTMPPlugin.Error("resume push", zap.String("streamPath", streamPath), zap.Error(err))
+				return
+			}
+		}
+	} else if p := runningPusher(streamPath); p != nil {
+		RTMPPlugin.Info("push egress restored", zap.String("streamPath", streamPath))
+		p.throttled.Store(false)
+	}
+	delete(pressureShed, streamPath)
+}
+
+type PushPriorityInfo struct {
+	StreamPath string
+	Priority   int
+	EgressKbps int
+	State      string // normal、throttled、suspended
+}
+
+// API_priority 设置推流的优先级，不带priority时返回推流的优先级和带宽压力下的状态
+func (*RTMPConfig) API_priority(rw http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if priority := q.Get("priority"); priority != "" {
+		n, err := strconv.Atoi(priority)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pathEntryOf(q.Get("streamPath")).priority.Store(&n)
+		rw.Write([]byte("ok"))
+		return
+	}
+	util.ReturnJson(func() (list []PushPriorityInfo) {
+		rangePaths(func(_ string, e *pathEntry) bool {
+			p := e.pusher.Load()
+			if p == nil {
+				return true
+			}
+			info := PushPriorityInfo{p.StreamPath, pushPriority(p.StreamPath), int(p.egressKbps.Load()), "normal"}
+			if p.throttled.Load() {
+				info.State = "throttled"
+			}
+			list = append(list, info)
+			return true
+		})
+		pressureLock.Lock()
+		defer pressureLock.Unlock()
+		for streamPath, s := range pressureShed {
+			if s.suspended {
+				list = append(list, PushPriorityInfo{streamPath, s.priority, 0, "suspended"})
+			}
+		}
+		return
+	}, time.Second, rw, r)
+}
@@ -0,0 +1,162 @@
+package rtmp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+// ProbeStats rtmp端口上收到的非rtmp连接（端口探测、crossdomain策略请求等）和握手失败的次数
+type ProbeStats struct {
+	HTTP              uint64            // http请求，例如端口存活检测
+	Crossdomain       uint64            // Flash的crossdomain策略请求，包括<policy-file-request/>和http的/crossdomain.xml
+	TLS               uint64            // 没有开启rtmps时的TLS连接
+	HandshakeFailures map[string]uint64 // 其他握手失败的连接，以失败原因为key
+}
+
+var probeStats struct {
+	http, crossdomain, tls atomic.Uint64
+}
+
+// 握手失败的原因
+const (
+	HandshakeBadVersion = "bad_version" // C0不是rtmp的版本号，通常是扫描器
+	HandshakeShortRead  = "short_read"  // 没有收到完整的C0C1或C2就断开
+	HandshakeTimeout    = "timeout"     // 超过handshaketimeout没有完成握手
+	HandshakeTLS        = "tls"         // rtmps的TLS握手失败
+	HandshakeDigest     = "digest"      // 复杂握手的digest校验失败或者简单握手的C2不匹配
+	HandshakeOther      = "other"
+)
+
+// handshakeError 带有失败原因的握手错误
+type handshakeError struct {
+	reason string
+	err    error
+}
+
+func (e *handshakeError) Error() string {
+	return e.reason + ": " + e.err.Error()
+}
+
+func (e *handshakeError) Unwrap() error {
+	return e.err
+}
+
+type failureCounter struct {
+	sync.Mutex
+	m map[string]uint64
+}
+
+func (c *failureCounter) add(reason string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]uint64)
+	}
+	c.m[reason]++
+}
+
+func (c *failureCounter) snapshot() map[string]uint64 {
+	c.Lock()
+	defer c.Unlock()
+	m := make(map[string]uint64, len(c.m))
+	for reason, n := range c.m {
+		m[reason] = n
+	}
+	return m
+}
+
+var handshakeFailures failureCounter
+
+// handshakeFailed 对握手失败分类并计数，返回失败原因
+func handshakeFailed(err error) string {
+	reason := HandshakeOther
+	var he *handshakeError
+	var ne net.Error
+	switch {
+	case errors.As(err, &ne) && ne.Timeout():
+		reason = HandshakeTimeout
+	case errors.As(err, &he):
+		reason = he.reason
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		reason = HandshakeShortRead
+	}
+	handshakeFailures.add(reason)
+	return reason
+}
+
+const (
+	policyFileRequest = "<policy-file-request/>"
+	crossdomainPolicy = `<?xml version="1.0"?><cross-domain-policy><allow-access-from domain="*" to-ports="*"/></cross-domain-policy>`
+	probeTimeout      = 5 * time.Second
+)
+
+// dropProbe 快速应答或者关闭rtmp端口上常见的非rtmp连接，避免它们作为握手失败记录错误日志，返回true代表已经处理
+func (nc *NetConnection) dropProbe() bool {
+	first, err := nc.Reader.Peek(1)
+	if err != nil || first[0] == RTMP_HANDSHAKE_VERSION {
+		return false
+	}
+	// 探测连接可能只发送部分数据，避免长时间占用连接
+	nc.Conn.SetReadDeadline(time.Now().Add(probeTimeout))
+	defer nc.Conn.SetReadDeadline(time.Time{})
+	remote := nc.RemoteAddr().String()
+	switch {
+	case isTLS(first):
+		// 开启rtmps时已经由sniff处理
+		probeStats.tls.Add(1)
+		RTMPPlugin.Debug("tls on plain rtmp port", zap.String("remote", remote))
+		return true
+	case first[0] == '<':
+		if head, _ := nc.Reader.Peek(len(policyFileRequest)); string(head) != policyFileRequest {
+			return false
+		}
+		probeStats.crossdomain.Add(1)
+		RTMPPlugin.Debug("policy file request", zap.String("remote", remote))
+		nc.Conn.Write(append([]byte(crossdomainPolicy), 0))
+		return true
+	}
+	if !strings.ContainsRune("GPHDO", rune(first[0])) {
+		return false
+	}
+	if head, _ := nc.Reader.Peek(HTTPHeadLen); !IsHTTP(head) {
+		return false
+	}
+	line, _ := nc.Reader.ReadSlice('\n')
+	fields := strings.Fields(string(line))
+	if len(fields) > 1 && fields[1] == "/crossdomain.xml" {
+		probeStats.crossdomain.Add(1)
+		RTMPPlugin.Debug("crossdomain.xml request", zap.String("remote", remote))
+		nc.Conn.Write(httpResponse("200 OK", "text/x-cross-domain-policy", crossdomainPolicy))
+		return true
+	}
+	probeStats.http.Add(1)
+	RTMPPlugin.Debug("http request on rtmp port", zap.String("remote", remote), zap.String("request", string(bytes.TrimSpace(line))))
+	nc.Conn.Write(httpResponse("404 Not Found", "text/plain", "rtmp server\n"))
+	return true
+}
+
+func httpResponse(status, contentType, body string) []byte {
+	return []byte(fmt.Sprintf("HTTP/1.1 %s\r\nContent-Type: %s\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", status, contentType, len(body), body))
+}
+
+func (*RTMPConfig) API_probes(w http.ResponseWriter, r *http.Request) {
+	util.ReturnJson(func() ProbeStats {
+		return ProbeStats{
+			HTTP:              probeStats.http.Load(),
+			Crossdomain:       probeStats.crossdomain.Load(),
+			TLS:               probeStats.tls.Load(),
+			HandshakeFailures: handshakeFailures.snapshot(),
+		}
+	}, time.Second, w, r)
+}
@@ -0,0 +1,180 @@
+package rtmp
+
+import (
+	"runtime"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4"
+)
+
+// 播放落后超过阈值时的队列策略
+const (
+	QueueDropVideo = "drop-video" // 只发送音频，追上后在关键帧恢复视频
+	QueueSkipGOP   = "skip-gop"   // 丢弃当前GOP剩余的视频帧，从下一个关键帧继续
+	QueueBlock     = "block"      // 不丢帧
+)
+
+// coalesceMax 合并发送的缓冲上限，超过后立即发送
+const coalesceMax = 64 * 1024
+
+// PlayProfile 播放的传输调优方案，把块大小、合并发送的间隔、关键帧行为和拥塞时的处理打包成一个名称
+type PlayProfile struct {
+	ChunkSize     int           // 连接上只有这一个播放时修改连接的发送块大小，0为不修改
+	FlushInterval time.Duration // 音视频帧合并发送的间隔，0为每帧立即发送
+	SubMode       int           // 引擎的订阅模式：0追赶到最新的关键帧，1首屏后不追赶，2从缓冲中最早的关键帧开始
+	QueuePolicy   string        // 落后超过QueueLag时的处理：drop-video、skip-gop、block
+	QueueLag      time.Duration // 落后超过该时长时执行队列策略，0为使用DegradeLag
+	IdleTimeout   time.Duration // 写操作阻塞超过该时长时关闭会话，0为使用PlayIdleTimeout
+}
+
+// playProfiles 内置的调优方案
+var playProfiles = map[string]PlayProfile{
+	// 低延迟：小块、立即发送、追赶到最新的关键帧，拥塞时先丢视频，播放端不读取时尽快关闭
+	"low-latency": {ChunkSize: 4096, SubMode: 0, QueuePolicy: QueueDropVideo, QueueLag: time.Second, IdleTimeout: 5 * time.Second},
+	// 可靠：不跳帧不降级，容忍较长时间的阻塞
+	"reliable": {ChunkSize: 16384, SubMode: 1, QueuePolicy: QueueBlock, IdleTimeout: 30 * time.Second},
+	// 大吞吐：大块、每50毫秒合并发送、从最早的关键帧开始，落后时跳过GOP，用于转码、录制等下游
+	"bulk": {ChunkSize: 65536, FlushInterval: 50 * time.Millisecond, SubMode: 2, QueuePolicy: QueueSkipGOP, QueueLag: 10 * time.Second},
+}
+
+// writeCoalescer 合并发送的播放的音视频帧先写入缓冲，到达合并间隔、缓冲超过coalesceMax
+// 或者连接上有其他不合并的写操作时一起发送，只影响该播放的帧。所有字段只在写锁内读写
+type writeCoalescer struct {
+	coalesce       bool // 当前写操作的块写入缓冲
+	pending        []byte
+	flushTimer     *time.Timer
+	flushScheduled bool
+}
+
+// gopSkipper 队列策略为skip-gop时的状态
+type gopSkipper struct {
+	gopSkipping bool
+	SkippedGOPs int
+}
+
+// applyProfile 在订阅之前应用调优方案中的订阅模式和降级设置，此时还没有订阅者的日志
+func (rtmp *RTMPSender) applyProfile(name string, sub *RTMPConfig) {
+	p, ok := playProfiles[name]
+	if !ok {
+		RTMPPlugin.Warn("unknown play profile", zap.String("profile", name))
+		return
+	}
+	rtmp.profile = &p
+	// 复制插件共享的订阅配置再修改
+	config := sub.Subscribe
+	config.SubMode = p.SubMode
+	rtmp.Config = &config
+	rtmp.DegradeEnabled.Store(p.QueuePolicy == QueueDropVideo)
+}
+
+// applyConnProfile 订阅成功之后修改连接的块大小。块大小是整个连接的参数，连接上还有其他播放时不修改，以免影响其他播放
+func (rtmp *RTMPSender) applyConnProfile() error {
+	if rtmp.profile == nil || rtmp.profile.ChunkSize <= 0 {
+		return nil
+	}
+	shared := false
+	subscribers.Range(func(_, v any) bool {
+		sub := v.(*RTMPSubscriber)
+		shared = sub.NetConnection == rtmp.NetConnection && &sub.RTMPSender != rtmp
+		return !shared
+	})
+	if shared {
+		rtmp.Info("connection shared by other players, keep chunk size", zap.Int("chunkSize", rtmp.profile.ChunkSize))
+		return nil
+	}
+	return rtmp.SetChunkSize(rtmp.profile.ChunkSize)
+}
+
+// flushInterval 合并发送的间隔，0为立即发送，纯音频的发布不超过AudioFlushInterval
+func (rtmp *RTMPSender) flushInterval() time.Duration {
+	interval := conf.FlushInterval
+	if rtmp.profile != nil {
+		interval = rtmp.profile.FlushInterval
+	}
+	if interval > conf.AudioFlushInterval && rtmp.Stream != nil {
+		if p, ok := rtmp.Stream.Publisher.(IRTMPReceiver); ok && p.GetReceiver().audioOnly.Load() {
+			return conf.AudioFlushInterval
+		}
+	}
+	return interval
+}
+
+// sendPending 在写锁内发送合并的缓冲
+func (conn *NetConnection) sendPending() error {
+	if len(conn.pending) == 0 {
+		return nil
+	}
+	_, err := conn.Write(conn.pending)
+	conn.pending = conn.pending[:0]
+	return err
+}
+
+// endCoalesce 在写锁内结束合并，缓冲超过上限时立即发送，否则在间隔之后发送
+func (conn *NetConnection) endCoalesce(interval time.Duration) {
+	conn.coalesce = false
+	if len(conn.pending) >= coalesceMax {
+		conn.sendPending()
+		return
+	}
+	if len(conn.pending) == 0 || conn.flushScheduled {
+		return
+	}
+	conn.flushScheduled = true
+	if conn.flushTimer == nil {
+		conn.flushTimer = time.AfterFunc(interval, conn.flushLater)
+	} else {
+		conn.flushTimer.Reset(interval)
+	}
+}
+
+func (conn *NetConnection) flushLater() {
+	for !conn.writing.CompareAndSwap(false, true) {
+		runtime.Gosched()
+	}
+	defer conn.writing.Store(false)
+	conn.flushScheduled = false
+	conn.sendPending()
+}
+
+// skipGOP 队列策略为skip-gop时，落后超过阈值后丢弃当前GOP剩余的视频帧，从下一个关键帧继续
+func (rtmp *RTMPSender) skipGOP(v engine.VideoFrame) bool {
+	if rtmp.profile == nil || rtmp.profile.QueuePolicy != QueueSkipGOP {
+		return false
+	}
+	if v.IFrame {
+		if rtmp.gopSkipping {
+			rtmp.gopSkipping = false
+			// 跳过了中间的视频帧，需要重新发送绝对时间戳
+			rtmp.video.firstSent.Store(false)
+		}
+		return false
+	}
+	if rtmp.gopSkipping {
+		return true
+	}
+	if lag := rtmp.insufficientBW.lag(v.AbsTime); lag > rtmp.degradeLag() {
+		rtmp.gopSkipping = true
+		rtmp.SkippedGOPs++
+		rtmp.Info("skip gop", zap.Duration("lag", lag))
+		rtmp.waitKeyFrame()
+		return true
+	}
+	return false
+}
+
+// degradeLag 执行队列策略的落后阈值，调优方案优先
+func (rtmp *RTMPSender) degradeLag() time.Duration {
+	if rtmp.profile != nil && rtmp.profile.QueueLag > 0 {
+		return rtmp.profile.QueueLag
+	}
+	return conf.DegradeLag
+}
+
+// idleTimeout 写操作阻塞的超时，调优方案优先
+func (rtmp *RTMPSender) idleTimeout() time.Duration {
+	if rtmp.profile != nil && rtmp.profile.IdleTimeout > 0 {
+		return rtmp.profile.IdleTimeout
+	}
+	return conf.PlayIdleTimeout
+}
@@ -0,0 +1,88 @@
+package rtmp
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// createStreamTimeout 等待createStream的_result的时间，部分源站（例如某些配置的SRS）不回复，超时后在默认的消息流上play
+const createStreamTimeout = 3 * time.Second
+
+// defaultPlayStreamID 没有收到createStream的_result时play使用的消息流ID，与大多数服务端分配的第一个消息流ID相同
+const defaultPlayStreamID = 1
+
+// playState 拉流的play进度，源站可能只回复onStatus NetStream.Play.Start
+type playState struct {
+	playSent    atomic.Bool // 已经发送过play，createStream的_result和超时只有一个生效
+	playStarted bool        // 收到了NetStream.Play.Start
+}
+
+// sendPlay 在消息流streamID上play，只发送一次，可能在超时的协程中调用
+func (puller *RTMPPuller) sendPlay(streamID uint32) error {
+	if !puller.playSent.CompareAndSwap(false, true) {
+		return nil
+	}
+	m := &PlayMessage{}
+	m.StreamId = streamID
+	m.TransactionId = 1
+	m.CommandMessage.CommandName = "play"
+	URL, _ := url.Parse(puller.RemoteURL)
+	ps := strings.Split(URL.Path, "/")
+	args := URL.Query()
+	m.StreamName = ps[len(ps)-1]
+	if len(args) > 0 {
+		m.StreamName += "?" + args.Encode()
+	}
+	if err := puller.SendMessage(RTMP_MSG_AMF0_COMMAND, m); err != nil {
+		return err
+	}
+	if conf.PullBufferLength > 0 {
+		// 部分源站根据缓冲长度决定突发和发送的节奏
+		return puller.SendMessage(RTMP_MSG_USER_CONTROL, &SetBufferMessage{
+			StreamIDMessage{UserControlMessage{EventType: RTMP_USER_SET_BUFFLEN}, streamID},
+			uint32(conf.PullBufferLength / time.Millisecond),
+		})
+	}
+	return nil
+}
+
+// playAfter 超过d没有收到createStream的_result时在默认的消息流上play
+func (puller *RTMPPuller) playAfter(d time.Duration) *time.Timer {
+	return time.AfterFunc(d, func() {
+		if !puller.playSent.Load() {
+			puller.Warn("no createStream result, play on default stream")
+			puller.sendPlay(defaultPlayStreamID)
+		}
+	})
+}
+
+// playStatus 处理play的onStatus，NetStream.Play.Start即视为成功，以其消息流ID为准；错误级别的状态结束拉流
+func (puller *RTMPPuller) playStatus(m *ResponsePlayMessage) error {
+	code, _ := m.Infomation["code"].(string)
+	if m.Infomation["level"] == Level_Error {
+		return errors.New(code)
+	}
+	if code != NetStream_Play_Start || puller.playStarted {
+		return nil
+	}
+	puller.playStarted = true
+	if m.StreamID != 0 {
+		puller.StreamID = m.StreamID
+	} else if puller.StreamID == 0 {
+		// 没有收到createStream的_result，已经在默认的消息流上play
+		puller.StreamID = defaultPlayStreamID
+	}
+	puller.Info("play start", zap.Uint32("streamID", puller.StreamID))
+	return nil
+}
+
+// resetPlay 在新的连接上重新createStream和play之前调用
+func (puller *RTMPPuller) resetPlay() {
+	puller.playSent.Store(false)
+	puller.playStarted = false
+}
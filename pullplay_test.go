@@ -0,0 +1,130 @@
+package rtmp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// newTestPuller 以net.Pipe的一端作为拉流连接，返回另一端用于读取拉流发出的消息
+func newTestPuller(t *testing.T, remoteURL string) (*RTMPPuller, *NetConnection) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	puller := &RTMPPuller{}
+	puller.NetConnection = NewNetConnection(client)
+	puller.Logger = zap.NewNop()
+	puller.RemoteURL = remoteURL
+	return puller, NewNetConnection(server)
+}
+
+// recvPlay 读取对端收到的play命令
+func recvPlay(t *testing.T, peer *NetConnection) *PlayMessage {
+	t.Helper()
+	done := make(chan *PlayMessage, 1)
+	go func() {
+		for {
+			msg, err := peer.RecvMessage()
+			if err != nil {
+				close(done)
+				return
+			}
+			if m, ok := msg.MsgData.(*PlayMessage); ok {
+				done <- m
+				return
+			}
+		}
+	}()
+	select {
+	case m, ok := <-done:
+		if !ok {
+			t.Fatal("connection closed before play")
+		}
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("no play received")
+	}
+	return nil
+}
+
+func TestPullPlay(t *testing.T) {
+	tests := []struct {
+		name           string
+		createStreamID uint32 // createStream的_result分配的消息流ID，0代表源站不回复
+		wantStreamID   uint32
+	}{
+		{"createStream timeout", 0, defaultPlayStreamID},
+		{"play on stream 1", 1, 1},
+		{"play on allocated stream", 5, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			puller, peer := newTestPuller(t, "rtmp://localhost/live/test?token=abc")
+			wait := 10 * time.Millisecond
+			if tt.createStreamID != 0 {
+				// 有_result时定时器不能先触发，负载高的机器上10ms可能早于协程执行
+				wait = time.Minute
+				go puller.sendPlay(tt.createStreamID)
+			}
+			timer := puller.playAfter(wait)
+			defer timer.Stop()
+			m := recvPlay(t, peer)
+			if m.StreamId != tt.wantStreamID {
+				t.Errorf("play on stream %d, want %d", m.StreamId, tt.wantStreamID)
+			}
+			if m.StreamName != "test?token=abc" {
+				t.Errorf("stream name %q", m.StreamName)
+			}
+			// 超时和_result只有一个生效
+			time.Sleep(20 * time.Millisecond)
+			if err := puller.sendPlay(tt.wantStreamID); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestPullPlayStatus(t *testing.T) {
+	tests := []struct {
+		name         string
+		streamID     uint32 // 拉流当前的消息流ID
+		level, code  string
+		msgStreamID  uint32 // onStatus的消息流ID
+		wantErr      bool
+		wantStreamID uint32
+		wantStarted  bool
+	}{
+		{"play start on default stream", 0, Level_Status, NetStream_Play_Start, 0, false, defaultPlayStreamID, true},
+		{"play start uses message stream id", 1, Level_Status, NetStream_Play_Start, 3, false, 3, true},
+		{"play reset ignored", 1, Level_Status, NetStream_Play_Reset, 0, false, 1, false},
+		{"stream not found", 1, Level_Error, NetStream_Play_StreamNotFound, 1, true, 1, false},
+		{"play failed", 0, Level_Error, NetStream_Play_Failed, 0, true, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			puller, _ := newTestPuller(t, "rtmp://localhost/live/test")
+			puller.StreamID = tt.streamID
+			m := &ResponsePlayMessage{}
+			m.CommandName = Response_OnStatus
+			m.StreamID = tt.msgStreamID
+			m.Infomation = map[string]any{"level": tt.level, "code": tt.code}
+			err := puller.playStatus(m)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && err.Error() != tt.code {
+				t.Errorf("err = %q, want %q", err, tt.code)
+			}
+			if puller.StreamID != tt.wantStreamID {
+				t.Errorf("stream id %d, want %d", puller.StreamID, tt.wantStreamID)
+			}
+			if puller.playStarted != tt.wantStarted {
+				t.Errorf("started %v, want %v", puller.playStarted, tt.wantStarted)
+			}
+		})
+	}
+}
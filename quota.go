@@ -0,0 +1,182 @@
+package rtmp
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4"
+	"m7s.live/engine/v4/util"
+)
+
+// AppUsage 每个应用（appName）当前的资源使用情况
+type AppUsage struct {
+	AppName    string
+	Publishers int // 包括引擎中其他协议的发布者
+	Players    int // 包括引擎中其他协议的订阅者
+	EgressKbps int // 最近一秒的rtmp播放出口带宽
+}
+
+type appQuota struct {
+	AppUsage
+	egressBytes     atomic.Int64 // 上次统计之后发送的音视频字节数
+	rtmpPublishers  int          // rtmp会话占用的配额，实时计数
+	rtmpPlayers     int
+	otherPublishers int // 上次统计时引擎中其他协议的发布者和订阅者
+	otherPlayers    int
+}
+
+// sum 汇总rtmp会话和其他协议的使用数量
+func (q *appQuota) sum() {
+	q.Publishers = q.rtmpPublishers + q.otherPublishers
+	q.Players = q.rtmpPlayers + q.otherPlayers
+}
+
+var (
+	quotaLock sync.Mutex
+	appQuotas = make(map[string]*appQuota)
+)
+
+// acquireQuota 检查并占用应用的发布者或播放者配额，成功后需要在会话结束时释放
+func acquireQuota(appName string, publish bool) (*appQuota, error) {
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+	q, ok := appQuotas[appName]
+	if !ok {
+		q = &appQuota{AppUsage: AppUsage{AppName: appName}}
+		appQuotas[appName] = q
+	}
+	if publish {
+		if max := conf.MaxAppPublishers[appName]; max > 0 && q.Publishers >= max {
+			return nil, fmt.Errorf("app %s exceeds max publishers %d", appName, max)
+		}
+		q.rtmpPublishers++
+		q.sum()
+		return q, nil
+	}
+	if max := conf.MaxAppPlayers[appName]; max > 0 && q.Players >= max {
+		return nil, fmt.Errorf("app %s exceeds max players %d", appName, max)
+	}
+	if max := conf.MaxAppEgress[appName]; max > 0 && q.EgressKbps >= max {
+		return nil, fmt.Errorf("app %s exceeds max egress %dkbps", appName, max)
+	}
+	q.rtmpPlayers++
+	q.sum()
+	return q, nil
+}
+
+func (q *appQuota) release(publish bool) {
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+	if publish {
+		q.rtmpPublishers--
+	} else {
+		q.rtmpPlayers--
+	}
+	q.sum()
+}
+
+// holdUntil 会话结束时释放配额
+func (q *appQuota) holdUntil(done <-chan struct{}, publish bool) {
+	go func() {
+		<-done
+		q.release(publish)
+	}()
+}
+
+// engineUsage 统计引擎中各应用的发布者和订阅者数量，包括其他协议（插件）的会话
+func engineUsage() (publishers, players map[string]int) {
+	publishers, players = make(map[string]int), make(map[string]int)
+	engine.Streams.RLock()
+	defer engine.Streams.RUnlock()
+	for _, s := range engine.Streams.Map {
+		if s.Publisher != nil {
+			publishers[s.AppName]++
+		}
+		if n := s.Subscribers.Len(); n > 0 {
+			players[s.AppName] += n
+		}
+	}
+	return
+}
+
+type playerLoad struct {
+	player *RTMPSubscriber
+	kbps   int
+}
+
+// shedPlayers 应用的出口带宽超过上限时，从最新开始的播放者开始断开，直到覆盖超出的带宽，最早开始的播放者不受影响
+func shedPlayers(appName string, loads []playerLoad, excess int) {
+	sort.Slice(loads, func(i, j int) bool {
+		return loads[i].player.StartTime.After(loads[j].player.StartTime)
+	})
+	for _, l := range loads[:len(loads)-1] {
+		if excess <= 0 {
+			return
+		}
+		RTMPPlugin.Warn("app egress quota exceeded", zap.String("appName", appName), zap.String("streamPath", l.player.Stream.Path), zap.Int("kbps", l.kbps))
+		l.player.Stop(zap.String("reason", "app egress quota"))
+		excess -= l.kbps
+	}
+}
+
+// runQuotaMeter 每秒统计各应用的出口带宽和引擎中其他协议的会话数，出口带宽超过上限时断开部分播放者，并清理已经没有会话的应用
+func runQuotaMeter() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		loads := make(map[*appQuota][]playerLoad)
+		subscribers.Range(func(_, v any) bool {
+			s := v.(*RTMPSubscriber)
+			kbps := int(s.egressBytes.Swap(0) * 8 / 1000)
+			if s.quota != nil && !s.IsClosed() {
+				loads[s.quota] = append(loads[s.quota], playerLoad{s, kbps})
+			}
+			return true
+		})
+		publishers, players := engineUsage()
+		quotaLock.Lock()
+		for _, m := range []map[string]int{publishers, players} {
+			for appName := range m {
+				if _, ok := appQuotas[appName]; !ok {
+					appQuotas[appName] = &appQuota{AppUsage: AppUsage{AppName: appName}}
+				}
+			}
+		}
+		for appName, q := range appQuotas {
+			q.EgressKbps = int(q.egressBytes.Swap(0) * 8 / 1000)
+			// 引擎中的数量包括已经开始的rtmp会话
+			q.otherPublishers = publishers[appName] - q.rtmpPublishers
+			if q.otherPublishers < 0 {
+				q.otherPublishers = 0
+			}
+			q.otherPlayers = players[appName] - q.rtmpPlayers
+			if q.otherPlayers < 0 {
+				q.otherPlayers = 0
+			}
+			q.sum()
+			if max := conf.MaxAppEgress[appName]; max > 0 && q.EgressKbps > max && len(loads[q]) > 0 {
+				shedPlayers(appName, loads[q], q.EgressKbps-max)
+			}
+			if q.Publishers == 0 && q.Players == 0 && q.EgressKbps == 0 {
+				delete(appQuotas, appName)
+			}
+		}
+		quotaLock.Unlock()
+	}
+}
+
+func (*RTMPConfig) API_quota(w http.ResponseWriter, r *http.Request) {
+	util.ReturnJson(func() (list []AppUsage) {
+		quotaLock.Lock()
+		defer quotaLock.Unlock()
+		for _, q := range appQuotas {
+			list = append(list, q.AppUsage)
+		}
+		return
+	}, time.Second, w, r)
+}
@@ -0,0 +1,68 @@
+package rtmp
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+// ReadAnomalies 读取时发现的消息连续性异常次数，持续增长说明网络路径不稳定或者中间设备破坏了数据
+type ReadAnomalies struct {
+	MissingHeader uint32 // 块流之前没有消息头却收到了类型1、2、3的块
+	Incomplete    uint32 // 消息还没有接收完整（实际长度小于声明的长度）就收到了新的消息头
+	UnknownType   uint32 // 未知的消息类型
+}
+
+// readChecker 异常次数只增不减，推流切换连接时累加新连接上的次数
+type readChecker struct {
+	missingHeader atomic.Uint32
+	incomplete    atomic.Uint32
+	unknownType   atomic.Uint32
+}
+
+// totalAnomalies 所有连接累计的异常次数，连接关闭后仍然保留
+var totalAnomalies readChecker
+
+func (c *readChecker) anomalies() *ReadAnomalies {
+	return &ReadAnomalies{
+		MissingHeader: c.missingHeader.Load(),
+		Incomplete:    c.incomplete.Load(),
+		UnknownType:   c.unknownType.Load(),
+	}
+}
+
+// merge 累加另一个连接上的异常次数
+func (c *readChecker) merge(other *readChecker) {
+	c.missingHeader.Add(other.missingHeader.Load())
+	c.incomplete.Add(other.incomplete.Load())
+	c.unknownType.Add(other.unknownType.Load())
+}
+
+// knownMessageType 协议中定义的消息类型
+func knownMessageType(t byte) bool {
+	switch t {
+	case RTMP_MSG_CHUNK_SIZE, RTMP_MSG_ABORT, RTMP_MSG_ACK, RTMP_MSG_USER_CONTROL, RTMP_MSG_ACK_SIZE, RTMP_MSG_BANDWIDTH, RTMP_MSG_EDGE,
+		RTMP_MSG_AUDIO, RTMP_MSG_VIDEO, RTMP_MSG_AMF3_METADATA, RTMP_MSG_AMF3_SHARED, RTMP_MSG_AMF3_COMMAND,
+		RTMP_MSG_AMF0_METADATA, RTMP_MSG_AMF0_SHARED, RTMP_MSG_AMF0_COMMAND, RTMP_MSG_AGGREGATE:
+		return true
+	}
+	return false
+}
+
+// anomaly 开启ReadCheck时记录一次读取异常，counter为连接上的计数，total为所有连接累计的计数
+func (conn *NetConnection) anomaly(counter, total *atomic.Uint32, reason string, csid uint32) {
+	if !conf.ReadCheck {
+		return
+	}
+	total.Add(1)
+	n := counter.Add(1)
+	RTMPPlugin.Debug("read anomaly", zap.String("reason", reason), zap.String("remote", conn.RemoteAddr().String()), zap.Uint32("csid", csid), zap.Uint32("count", n))
+}
+
+// API_readcheck 所有连接累计的读取异常次数
+func (*RTMPConfig) API_readcheck(w http.ResponseWriter, r *http.Request) {
+	util.ReturnJson(totalAnomalies.anomalies, time.Second, w, r)
+}
@@ -0,0 +1,287 @@
+package rtmp
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// NetConnection_Connect_ReconnectRequest 增强rtmp：服务端请求客户端重新连接，信息对象中的tcUrl为新的地址（可选，没有则重连原地址）
+const NetConnection_Connect_ReconnectRequest = "NetConnection.Connect.ReconnectRequest"
+
+// reconnectTimeout 在新连接上完成createStream和publish的超时时间
+const reconnectTimeout = 10 * time.Second
+
+// ReconnectEvent 推流或拉流按照远端的ReconnectRequest切换到新的地址
+type ReconnectEvent struct {
+	Kind       string // pull 或 push
+	StreamPath string
+	From       string
+	To         string
+	Error      string `json:",omitempty"` // 切换失败的原因，失败时继续使用原来的连接
+}
+
+// clientCapabilityProps 推拉流在connect中通告的增强rtmp能力，客户端支持ReconnectRequest
+func clientCapabilityProps(list []string) map[string]any {
+	props := capabilityProps(list)
+	props["capsEx"] = localCapsEx | CapsExReconnect
+	return props
+}
+
+// reconnectURL 以ReconnectRequest中的tcUrl替换远端地址中的应用部分，保留流名称和参数
+func reconnectURL(remoteURL string, tcUrl string) (string, error) {
+	if tcUrl == "" {
+		return remoteURL, nil
+	}
+	from, err := url.Parse(remoteURL)
+	if err != nil {
+		return "", err
+	}
+	to, err := url.Parse(tcUrl)
+	if err != nil {
+		return "", err
+	}
+	if to.Scheme != "rtmp" && to.Scheme != "rtmps" || to.Host == "" {
+		return "", errors.New("invalid tcUrl")
+	}
+	ps := strings.Split(from.Path, "/")
+	if len(ps) < 3 {
+		return "", errors.New("illegal rtmp url")
+	}
+	to.Path = strings.TrimSuffix(to.Path, "/") + "/" + strings.Join(ps[2:], "/")
+	if to.RawQuery == "" {
+		to.RawQuery = from.RawQuery
+	}
+	return to.String(), nil
+}
+
+// publishName 推流地址中publish使用的流名称，包括参数
+func publishName(remoteURL string) string {
+	URL, _ := url.Parse(remoteURL)
+	_, streamPath, _ := strings.Cut(URL.Path, "/")
+	_, streamPath, _ = strings.Cut(streamPath, "/")
+	if args := URL.Query(); len(args) > 0 {
+		streamPath += "?" + args.Encode()
+	}
+	return streamPath
+}
+
+// publishStream 在新连接上完成createStream和publish，返回消息流ID
+func (nc *NetConnection) publishStream(streamName string) (uint32, error) {
+	nc.SetReadDeadline(time.Now().Add(reconnectTimeout))
+	defer nc.SetReadDeadline(time.Time{})
+	if err := nc.SendMessage(RTMP_MSG_AMF0_COMMAND, &CommandMessage{"createStream", 2}); err != nil {
+		return 0, err
+	}
+	var streamID uint32
+	for {
+		msg, err := nc.RecvMessage()
+		if err != nil {
+			return 0, err
+		}
+		switch m := msg.MsgData.(type) {
+		case *ResponseCreateStreamMessage:
+			streamID = m.StreamId
+			if err = nc.SendMessage(RTMP_MSG_AMF0_COMMAND, &PublishMessage{
+				CURDStreamMessage{CommandMessage{"publish", 1}, streamID},
+				streamName,
+				"live",
+			}); err != nil {
+				return 0, err
+			}
+		case *ResponsePublishMessage:
+			if code, _ := m.Infomation["code"].(string); code != NetStream_Publish_Start {
+				return 0, errors.New(code)
+			}
+			return streamID, nil
+		}
+	}
+}
+
+// takeOver 在写锁内换成next的底层连接和读写状态，之后的读写都使用新的连接，旧的连接关闭，只能在读取的协程中调用。
+// locked在持有写锁时调用，用于修改发送时在写锁内读取的状态
+func (nc *NetConnection) takeOver(next *NetConnection, locked func()) {
+	old := nc.takeOverWrite(next, locked)
+	nc.takeOverRead(next)
+	old.Close()
+}
+
+// takeOverWrite 在写锁内换成next的底层连接和发送状态，返回旧的连接。读取状态由读取的协程调用takeOverRead切换
+func (nc *NetConnection) takeOverWrite(next *NetConnection, locked func()) net.Conn {
+	for !nc.writing.CompareAndSwap(false, true) {
+		runtime.Gosched()
+	}
+	old := nc.Conn
+	nc.Conn = next.Conn
+	nc.writeChunkSize = next.writeChunkSize
+	nc.bandwidth = next.bandwidth
+	nc.writeSeqNum, nc.totalWrite = next.writeSeqNum, next.totalWrite
+	nc.caps, nc.appName, nc.serverSig = next.caps, next.appName, next.serverSig
+	if locked != nil {
+		locked()
+	}
+	nc.writing.Store(false)
+	if nc.ctx != nil {
+		if deadline, ok := nc.ctx.Deadline(); ok {
+			nc.SetDeadline(deadline)
+		}
+	}
+	return old
+}
+
+// takeOverRead 换成next的读取状态，只能在读取的协程中调用
+func (nc *NetConnection) takeOverRead(next *NetConnection) {
+	nc.Reader = next.Reader
+	nc.incommingChunks = next.incommingChunks
+	nc.readChunkSize = next.readChunkSize
+	nc.readSeqNum, nc.totalRead = next.readSeqNum, next.totalRead
+	nc.readChecker.merge(&next.readChecker)
+}
+
+// handoverState 推流切换到新连接后，由发送音视频的协程补发序列头并从关键帧开始发送
+type handoverState struct {
+	handedOver       atomic.Bool
+	handingOver      atomic.Bool                   // 正在连接新的地址
+	handoverConn     atomic.Pointer[NetConnection] // 已经换成新连接发送，读取的协程在旧连接关闭后切换读取
+	handoverExVideo  bool                          // 新连接上是否以扩展视频头发送HEVC，在handedOver之前写入
+	handoverKeyFrame bool                          // 正在等待关键帧
+}
+
+// handoverRead 读取旧连接出错时，如果已经切换到新连接则改为从新连接读取，返回true代表继续读取
+func (pusher *RTMPPusher) handoverRead() bool {
+	next := pusher.handoverConn.Swap(nil)
+	if next == nil {
+		return false
+	}
+	pusher.NetConnection.takeOverRead(next)
+	return true
+}
+
+// handoverRebase 拉流切换到新的源站后，以新源站的第一帧为基准，使时间戳从切换前最后的时间戳继续
+type handoverRebase struct {
+	rebasing      bool
+	rebaseOffset  uint32 // 加到新源站时间戳上的偏移量，回绕相当于负数
+	lastTimestamp uint32
+}
+
+// rebaseTimestamp 在归一化之后调整时间戳
+func (r *RTMPReceiver) rebaseTimestamp(msg *Chunk) {
+	if r.rebasing {
+		r.rebasing = false
+		r.rebaseOffset = r.lastTimestamp + 1 - msg.ExtendTimestamp
+	}
+	msg.ExtendTimestamp += r.rebaseOffset
+	r.lastTimestamp = msg.ExtendTimestamp
+}
+
+// resumeHandover 切换连接后在发送下一帧之前补发onMetaData和序列头
+func (rtmp *RTMPSender) resumeHandover() {
+	if !rtmp.handedOver.Swap(false) {
+		return
+	}
+	rtmp.exVideo = rtmp.handoverExVideo
+	rtmp.sentMetaVersion.Store(0)
+	rtmp.sentColorInfoVersion = 0
+	for _, av := range []*AVSender{&rtmp.audio, &rtmp.video} {
+		if av.seqHead != nil {
+			av.sendSequenceHead(av.seqHead)
+		}
+	}
+	rtmp.handoverKeyFrame = rtmp.video.seqHead != nil
+}
+
+// skipUntilKeyFrame 切换连接后跳过关键帧之前的视频帧
+func (rtmp *RTMPSender) skipUntilKeyFrame(iframe bool) bool {
+	if rtmp.handoverKeyFrame && !iframe {
+		return true
+	}
+	rtmp.handoverKeyFrame = false
+	return false
+}
+
+func reconnected(kind, streamPath, from, to string, err error) {
+	from, to = redactURL(from), redactURL(to)
+	event := ReconnectEvent{Kind: kind, StreamPath: streamPath, From: from, To: to}
+	if err != nil {
+		event.Error = err.Error()
+		RTMPPlugin.Warn(kind+" reconnect request failed", zap.String("streamPath", streamPath), zap.String("to", to), zap.Error(err))
+	} else {
+		RTMPPlugin.Info(kind+" reconnected", zap.String("streamPath", streamPath), zap.String("from", from), zap.String("to", to))
+	}
+	emitEvent(event)
+}
+
+// handover 按照ReconnectRequest在新的地址上完成connect、createStream和publish后再切换，切换前旧连接继续推流。
+// 在单独的协程中运行，连接新地址时不阻塞读取旧连接
+func (pusher *RTMPPusher) handover(info map[string]any) {
+	if !pusher.handingOver.CompareAndSwap(false, true) {
+		return
+	}
+	defer pusher.handingOver.Store(false)
+	from := pusher.RemoteURL
+	tcUrl, _ := info["tcUrl"].(string)
+	to, err := reconnectURL(from, tcUrl)
+	if err == nil && pusher.encrypter != nil {
+		// 新连接需要重新协商密钥流
+		err = errors.New("encrypted push")
+	}
+	var nc *NetConnection
+	if err == nil {
+		nc, err = newRTMPClient(to, clientCapabilityProps(pusher.localFourCcList()))
+	}
+	var streamID uint32
+	if err == nil {
+		if streamID, err = nc.publishStream(publishName(to)); err != nil {
+			nc.Close()
+		} else if err = pusher.Err(); err != nil {
+			// 连接新地址期间推流已经结束
+			nc.Close()
+		}
+	}
+	if err == nil {
+		pusher.handoverExVideo = (conf.PushEnhancedRTMP || nc.caps.Supports(FourCC_HEVC)) && !legacyHEVCTarget(to)
+		// 先交给读取的协程，关闭旧连接使其读取出错后切换到新连接
+		pusher.handoverConn.Store(nc)
+		old := pusher.NetConnection.takeOverWrite(nc, func() {
+			pusher.StreamID = streamID
+			pusher.audio.MessageStreamID = streamID
+			pusher.video.MessageStreamID = streamID
+			pusher.audio.firstSent.Store(false)
+			pusher.video.firstSent.Store(false)
+			pusher.handedOver.Store(true)
+		})
+		pusher.SetIO(nc.Conn)
+		pusher.RemoteURL = to
+		old.Close()
+	}
+	reconnected("push", pusher.StreamPath, from, to, err)
+}
+
+// handover 按照ReconnectRequest连接新的地址后切换，在新连接上重新play，引擎中的流不会中断
+func (puller *RTMPPuller) handover(info map[string]any) error {
+	from := puller.RemoteURL
+	tcUrl, _ := info["tcUrl"].(string)
+	to, err := reconnectURL(from, tcUrl)
+	var nc *NetConnection
+	if err == nil {
+		nc, err = newRTMPClient(to, clientCapabilityProps(conf.FourCcList))
+	}
+	reconnected("pull", puller.StreamPath, from, to, err)
+	if err != nil {
+		return err
+	}
+	puller.NetConnection.takeOver(nc, nil)
+	puller.SetIO(puller.NetConnection.Conn)
+	puller.RemoteURL = to
+	// 新的源站重新协商负载加密，时间戳从切换前最后的时间戳继续
+	puller.decrypter = nil
+	puller.rebasing = true
+	puller.resetPlay()
+	return puller.SendMessage(RTMP_MSG_AMF0_COMMAND, &CommandMessage{"createStream", 2})
+}
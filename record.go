@@ -0,0 +1,110 @@
+package rtmp
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var recordClient = &http.Client{Timeout: time.Second * 3}
+
+// recordRule 预先编译的自动录像规则
+type recordRule struct {
+	re *regexp.Regexp
+	t  string
+}
+
+var recordRules atomic.Pointer[[]recordRule]
+
+// loadRecordRules 加载配置时编译RecordRules，无效的正则表达式只告警并忽略
+func (c *RTMPConfig) loadRecordRules() {
+	rules := make([]recordRule, 0, len(c.RecordRules))
+	for pattern, t := range c.RecordRules {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			RTMPPlugin.Warn("invalid record rule", zap.String("pattern", pattern), zap.Error(err))
+			continue
+		}
+		rules = append(rules, recordRule{re, t})
+	}
+	recordRules.Store(&rules)
+}
+
+// recordType 根据配置规则和?record参数决定是否录制以及录制类型，返回空字符串代表不录制
+func recordType(streamPath string, args url.Values) string {
+	switch t := args.Get("record"); t {
+	case "", "0":
+	case "1":
+		return "flv"
+	default:
+		return t
+	}
+	if rules := recordRules.Load(); rules != nil {
+		for _, rule := range *rules {
+			if rule.re.MatchString(streamPath) {
+				return rule.t
+			}
+		}
+	}
+	return ""
+}
+
+// startRecord 在单独的协程中调用录像插件的API开始录制，不阻塞读取；
+// 协程等到stopRecord后再停止录制，保证停止在开始之后
+func (r *RTMPReceiver) startRecord(streamPath string, args url.Values) {
+	t := recordType(streamPath, args)
+	if t == "" || conf.RecordAPI == "" {
+		return
+	}
+	stop := make(chan struct{})
+	r.recordStop = stop
+	go func() {
+		id := requestRecordStart(streamPath, t)
+		if id == "" {
+			return
+		}
+		r.RecordID = id
+		<-stop
+		r.RecordID = ""
+		requestRecordStop(id)
+	}()
+}
+
+// stopRecord 发布结束时停止自动开启的录制
+func (r *RTMPReceiver) stopRecord() {
+	if r.recordStop != nil {
+		close(r.recordStop)
+		r.recordStop = nil
+	}
+}
+
+func requestRecordStart(streamPath, t string) string {
+	res, err := recordClient.Get(conf.RecordAPI + "/start?type=" + url.QueryEscape(t) + "&streamPath=" + url.QueryEscape(streamPath))
+	if err != nil {
+		RTMPPlugin.Error("start record", zap.String("streamPath", streamPath), zap.Error(err))
+		return ""
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		RTMPPlugin.Error("start record", zap.String("streamPath", streamPath), zap.String("response", string(body)))
+		return ""
+	}
+	RTMPPlugin.Info("start record", zap.String("streamPath", streamPath), zap.String("id", string(body)))
+	return string(body)
+}
+
+func requestRecordStop(id string) {
+	res, err := recordClient.Get(conf.RecordAPI + "/stop?id=" + url.QueryEscape(id))
+	if err != nil {
+		RTMPPlugin.Error("stop record", zap.String("id", id), zap.Error(err))
+		return
+	}
+	res.Body.Close()
+	RTMPPlugin.Info("stop record", zap.String("id", id))
+}
@@ -0,0 +1,50 @@
+package rtmp
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// pathEntry 一个streamPath上由接口或者推流任务设置的状态：运行中的推流、推流优先级、推流时间窗口、暂停信息和画面屏蔽
+type pathEntry struct {
+	pusher    atomic.Pointer[RTMPPusher]
+	priority  atomic.Pointer[int] // 通过接口设置的优先级，覆盖配置
+	schedule  atomic.Pointer[PushSchedule]
+	suspended atomic.Pointer[suspendedPush]
+	blackout  atomic.Pointer[Blackout]
+}
+
+// paths 以streamPath为key的注册表，条目创建后不删除
+var paths sync.Map
+
+// pathEntryOf 获取streamPath的条目，没有时创建
+func pathEntryOf(streamPath string) *pathEntry {
+	if v, ok := paths.Load(streamPath); ok {
+		return v.(*pathEntry)
+	}
+	v, _ := paths.LoadOrStore(streamPath, new(pathEntry))
+	return v.(*pathEntry)
+}
+
+// rangePaths 遍历所有条目
+func rangePaths(f func(streamPath string, e *pathEntry) bool) {
+	paths.Range(func(key, value any) bool {
+		return f(key.(string), value.(*pathEntry))
+	})
+}
+
+// runningPusher streamPath上正在运行的rtmp推流
+func runningPusher(streamPath string) *RTMPPusher {
+	if v, ok := paths.Load(streamPath); ok {
+		return v.(*pathEntry).pusher.Load()
+	}
+	return nil
+}
+
+// suspendedPushOf streamPath上暂停的推流
+func suspendedPushOf(streamPath string) *suspendedPush {
+	if v, ok := paths.Load(streamPath); ok {
+		return v.(*pathEntry).suspended.Load()
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package rtmp
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"m7s.live/engine/v4"
+	"m7s.live/engine/v4/util"
+)
+
+// 未指定streamPath的中转任务使用的内部streamPath前缀，rtmp播放者不能播放
+const relayPrefix = "__relay/"
+
+// Relay 从Source拉流并推送到Target的中转任务
+type Relay struct {
+	ID         string
+	Source     string
+	Target     string
+	StreamPath string
+	StartTime  time.Time
+	puller     *RTMPPuller
+	pusher     *RTMPPusher
+}
+
+type RelayStatus struct {
+	*Relay
+	Pulling bool
+	Pushing bool
+}
+
+var relays sync.Map
+var relayID uint32
+
+var errRelayStream = errors.New("relay stream")
+
+// guardRelayStreams 在引擎订阅鉴权时拒绝除推流以外的订阅者订阅中转任务的内部流，
+// 包括其他协议的播放；保留原有的OnAuthSub，在其之前检查
+func guardRelayStreams() {
+	next := engine.OnAuthSub
+	engine.OnAuthSub = func(p *util.Promise[engine.ISubscriber]) error {
+		if _, ok := p.Value.(*RTMPPusher); !ok {
+			if s := p.Value.GetSubscriber().Stream; s != nil && strings.HasPrefix(s.Path, relayPrefix) {
+				return errRelayStream
+			}
+		}
+		if next != nil {
+			return next(p)
+		}
+		return nil
+	}
+}
+
+func isRunning(io interface{ IsClosed() bool }, started bool) bool {
+	return started && !io.IsClosed()
+}
+
+func (relay *Relay) Status() RelayStatus {
+	return RelayStatus{
+		relay,
+		isRunning(relay.puller, relay.puller.Context != nil),
+		isRunning(relay.pusher, relay.pusher.Context != nil),
+	}
+}
+
+func (relay *Relay) Stop() {
+	if relay.puller.Context != nil {
+		relay.puller.Stop()
+	}
+	if relay.pusher.Context != nil {
+		relay.pusher.Stop()
+	}
+	relays.Delete(relay.ID)
+}
+
+// StartRelay 同时创建拉流和推流，任意一个失败则都不创建
+func StartRelay(source, target, streamPath string) (*Relay, error) {
+	id := strconv.FormatUint(uint64(atomic.AddUint32(&relayID, 1)), 10)
+	if streamPath == "" {
+		streamPath = relayPrefix + id
+	}
+	relay := &Relay{
+		ID:         id,
+		Source:     source,
+		Target:     target,
+		StreamPath: streamPath,
+		StartTime:  time.Now(),
+		puller:     new(RTMPPuller),
+		pusher:     newRTMPPusher(),
+	}
+	if err := RTMPPlugin.Pull(streamPath, source, relay.puller, 0); err != nil {
+		return nil, err
+	}
+	if err := RTMPPlugin.Push(streamPath, target, relay.pusher, false); err != nil {
+		relay.Stop()
+		return nil, err
+	}
+	relays.Store(id, relay)
+	return relay, nil
+}
+
+func (*RTMPConfig) API_relay(rw http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if id := q.Get("stop"); id != "" {
+		if relay, ok := relays.Load(id); ok {
+			relay.(*Relay).Stop()
+			rw.Write([]byte("ok"))
+		} else {
+			http.Error(rw, "relay not found", http.StatusNotFound)
+		}
+		return
+	}
+	if strings.HasPrefix(q.Get("streamPath"), relayPrefix) {
+		http.Error(rw, "illegal streamPath", http.StatusBadRequest)
+		return
+	}
+	relay, err := StartRelay(q.Get("source"), q.Get("target"), q.Get("streamPath"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+	} else {
+		rw.Write([]byte(relay.ID))
+	}
+}
+
+func (*RTMPConfig) API_relays(rw http.ResponseWriter, r *http.Request) {
+	util.ReturnJson(func() (list []RelayStatus) {
+		relays.Range(func(key, value any) bool {
+			list = append(list, value.(*Relay).Status())
+			return true
+		})
+		return
+	}, time.Second, rw, r)
+}
@@ -0,0 +1,41 @@
+package rtmp
+
+import (
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// 推流重连后发送的时间戳
+const (
+	PushTimestampAbsolute = "absolute" // 使用流的时间戳（默认）
+	PushTimestampContinue = "continue" // 从上一次连接最后发送的时间戳继续
+	PushTimestampZero     = "zero"     // 每次连接都从0开始
+)
+
+// resyncState 发布者断开后重新发布（时间戳可能重新从0开始）时，订阅者的时间戳从之前发送的时间戳继续，而不是断开或者发送不连续的数据
+type resyncState struct {
+	resyncing   bool
+	resyncZero  bool // 从0开始而不是从之前的时间戳继续
+	ResyncCount int
+}
+
+// resync 在重新发布后的第一帧计算时间戳偏移量，并重新发送完整的消息头
+func (rtmp *RTMPSender) resync(absTime uint32) {
+	if !rtmp.resyncing {
+		return
+	}
+	rtmp.resyncing = false
+	if rtmp.resyncZero {
+		rtmp.resyncZero = false
+		atomic.StoreUint32(&rtmp.timestampOffset, -absTime)
+	} else if rtmp.lastAbsTime == 0 {
+		return
+	} else {
+		atomic.StoreUint32(&rtmp.timestampOffset, rtmp.lastAbsTime+1-absTime)
+	}
+	rtmp.audio.firstSent.Store(false)
+	rtmp.video.firstSent.Store(false)
+	rtmp.ResyncCount++
+	rtmp.Info("resync", zap.Uint32("lastTimestamp", rtmp.lastAbsTime), zap.Uint32("timestamp", absTime))
+}
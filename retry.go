@@ -0,0 +1,86 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TaskFailedEvent 拉流或推流任务重试次数用尽，最终失败
+type TaskFailedEvent struct {
+	Kind       string // pull 或 push
+	StreamPath string
+	RemoteURL  string
+	Attempts   int
+	LastError  string
+	StartTime  time.Time     // 第一次尝试的时间
+	Duration   time.Duration // 从第一次尝试到最终失败的时长
+	Uptime     time.Duration // 累计连接成功的时长
+}
+
+// taskRetry 记录拉流推流任务的尝试次数和时长
+type taskRetry struct {
+	Attempts     int
+	firstAttempt time.Time
+	connectedAt  time.Time
+	Uptime       time.Duration
+}
+
+func (t *taskRetry) attempt() {
+	if t.firstAttempt.IsZero() {
+		t.firstAttempt = time.Now()
+	}
+	t.Attempts++
+}
+
+func (t *taskRetry) connected() {
+	t.connectedAt = time.Now()
+}
+
+func (t *taskRetry) disconnected() {
+	if !t.connectedAt.IsZero() {
+		t.Uptime += time.Since(t.connectedAt)
+		t.connectedAt = time.Time{}
+	}
+}
+
+// failed 在重试次数用尽时产生TaskFailedEvent，并通知TaskFailWebhook
+func (t *taskRetry) failed(kind, streamPath, remoteURL string, exhausted bool, err error) {
+	t.disconnected()
+	if !exhausted || err == nil {
+		return
+	}
+	event := TaskFailedEvent{
+		Kind:       kind,
+		StreamPath: streamPath,
+		RemoteURL:  redactURL(remoteURL),
+		Attempts:   t.Attempts,
+		LastError:  err.Error(),
+		StartTime:  t.firstAttempt,
+		Duration:   time.Since(t.firstAttempt),
+		Uptime:     t.Uptime,
+	}
+	RTMPPlugin.Error(kind+" failed", zap.String("streamPath", streamPath), zap.String("remoteURL", event.RemoteURL), zap.Int("attempts", t.Attempts), zap.Error(err))
+	emitEvent(event)
+	if conf.TaskFailWebhook != "" {
+		go postWebhook(conf.TaskFailWebhook, event)
+	}
+}
+
+var webhookClient = &http.Client{Timeout: time.Second * 5}
+
+func postWebhook(url string, event any) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		RTMPPlugin.Error("webhook", zap.String("url", url), zap.Error(err))
+		return
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,213 @@
+package rtmp
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4"
+	"m7s.live/engine/v4/util"
+)
+
+// PushSchedule 推流时间窗口，格式为 "分 时 日 月 周|时长"，例如 "0 20 * * 1-5|2h" 代表工作日20点开始推流2小时
+type PushSchedule struct {
+	Expr     string
+	fields   [5][]bool
+	duration time.Duration
+
+	domStar, dowStar bool // 日、周字段是否以*开头，都不是时按照cron的规则任一满足即可
+}
+
+var cronRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+func parseCronField(field string, min, max int) ([]bool, error) {
+	set := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if p, s, ok := strings.Cut(part, "/"); ok {
+			var err error
+			if step, err = strconv.Atoi(s); err != nil || step <= 0 {
+				return nil, errors.New("invalid cron step: " + part)
+			}
+			part = p
+		}
+		from, to := min, max
+		if part != "*" {
+			a, b, isRange := strings.Cut(part, "-")
+			var err error
+			if from, err = strconv.Atoi(a); err != nil {
+				return nil, errors.New("invalid cron field: " + part)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(b); err != nil {
+					return nil, errors.New("invalid cron field: " + part)
+				}
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, errors.New("cron field out of range: " + part)
+		}
+		for i := from; i <= to; i += step {
+			set[i] = true
+		}
+	}
+	return set, nil
+}
+
+func ParsePushSchedule(expr string) (*PushSchedule, error) {
+	cron, d, ok := strings.Cut(expr, "|")
+	if !ok {
+		return nil, errors.New("schedule must be \"cron|duration\"")
+	}
+	s := &PushSchedule{Expr: expr}
+	var err error
+	if s.duration, err = time.ParseDuration(strings.TrimSpace(d)); err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(cron)
+	if len(fields) != 5 {
+		return nil, errors.New("cron must have 5 fields")
+	}
+	for i, f := range fields {
+		if s.fields[i], err = parseCronField(f, cronRanges[i][0], cronRanges[i][1]); err != nil {
+			return nil, err
+		}
+	}
+	s.domStar, s.dowStar = strings.HasPrefix(fields[2], "*"), strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+// matchDay 判断某天是否有窗口开始，日和周都受限时任一满足即可
+func (s *PushSchedule) matchDay(day time.Time) bool {
+	if !s.fields[3][int(day.Month())] {
+		return false
+	}
+	dom, dow := s.fields[2][day.Day()], s.fields[4][int(day.Weekday())]
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Active 判断t是否处于某个时间窗口内：按天向前找到不晚于t的最近一次开始时间，再比较时长
+func (s *PushSchedule) Active(t time.Time) bool {
+	t = t.Truncate(time.Minute)
+	year, month, date := t.Date()
+	for d := 0; ; d++ {
+		// 这一天结束时已经超过时长，更早的开始时间都不在窗口内
+		if d > 0 && t.Sub(time.Date(year, month, date-d+1, 0, 0, 0, 0, t.Location())) >= s.duration {
+			return false
+		}
+		day := time.Date(year, month, date-d, 0, 0, 0, 0, t.Location())
+		if !s.matchDay(day) {
+			continue
+		}
+		lastHour := 23
+		if d == 0 {
+			lastHour = t.Hour()
+		}
+		for h := lastHour; h >= 0; h-- {
+			if !s.fields[1][h] {
+				continue
+			}
+			lastMinute := 59
+			if d == 0 && h == t.Hour() {
+				lastMinute = t.Minute()
+			}
+			for m := lastMinute; m >= 0; m-- {
+				if s.fields[0][m] {
+					return t.Sub(time.Date(year, month, date-d, h, m, 0, 0, t.Location())) < s.duration
+				}
+			}
+		}
+	}
+}
+
+func inPushWindow(streamPath string) bool {
+	if v, ok := paths.Load(streamPath); ok {
+		if s := v.(*pathEntry).schedule.Load(); s != nil {
+			return s.Active(time.Now())
+		}
+	}
+	return true
+}
+
+func (c *RTMPConfig) loadPushSchedules() {
+	for streamPath, expr := range c.PushSchedule {
+		if s, err := ParsePushSchedule(expr); err == nil {
+			pathEntryOf(streamPath).schedule.Store(s)
+		} else {
+			RTMPPlugin.Error("push schedule", zap.String("streamPath", streamPath), zap.Error(err))
+		}
+	}
+}
+
+// runPushSchedule 每分钟检查一次推流时间窗口，进入窗口时开始推流，离开窗口时停止推流
+func (c *RTMPConfig) runPushSchedule() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		rangePaths(func(streamPath string, e *pathEntry) bool {
+			s := e.schedule.Load()
+			if s == nil {
+				return true
+			}
+			active := s.Active(time.Now())
+			if p := e.pusher.Load(); p != nil {
+				if !active {
+					RTMPPlugin.Info("leave push window", zap.String("streamPath", streamPath))
+					p.Stop()
+				}
+			} else if url, ok := c.PushList[streamPath]; ok && active && !pushSuspended(streamPath) && engine.Streams.Get(streamPath) != nil {
+				RTMPPlugin.Info("enter push window", zap.String("streamPath", streamPath))
+				if err := RTMPPlugin.Push(streamPath, url, newRTMPPusher(), false); err != nil {
+					RTMPPlugin.Error("push", zap.String("streamPath", streamPath), zap.String("url", redactURL(url)), zap.Error(err))
+				}
+			}
+			return true
+		})
+	}
+}
+
+type PushScheduleInfo struct {
+	StreamPath string
+	Schedule   string
+	Active     bool
+	Pushing    bool
+}
+
+func (*RTMPConfig) API_schedule(rw http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if streamPath := q.Get("streamPath"); streamPath != "" {
+		if expr := q.Get("schedule"); expr == "" {
+			pathEntryOf(streamPath).schedule.Store(nil)
+		} else if s, err := ParsePushSchedule(expr); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		} else {
+			pathEntryOf(streamPath).schedule.Store(s)
+		}
+		rw.Write([]byte("ok"))
+		return
+	}
+	util.ReturnJson(func() (list []PushScheduleInfo) {
+		rangePaths(func(streamPath string, e *pathEntry) bool {
+			s := e.schedule.Load()
+			if s == nil {
+				return true
+			}
+			list = append(list, PushScheduleInfo{
+				StreamPath: streamPath,
+				Schedule:   s.Expr,
+				Active:     s.Active(time.Now()),
+				Pushing:    e.pusher.Load() != nil,
+			})
+			return true
+		})
+		return
+	}, time.Second, rw, r)
+}
@@ -0,0 +1,85 @@
+package rtmp
+
+import (
+	"bytes"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// SequenceHeadChangeEvent 发布者在推流中途发送了不同的视频序列头（分辨率、profile等参数变化，或者更换编码）
+type SequenceHeadChangeEvent struct {
+	StreamPath string
+	CodecID    byte              // FLV视频CodecID，增强rtmp的视频已经转换成传统的CodecID
+	Codec      string            `json:",omitempty"` // 更换编码时新的编码（FourCC，传统格式没有FourCC时为CodecID）
+	FromCodec  string            `json:",omitempty"` // 更换编码时之前的编码，此时发布被结束
+	Changes    int               // 本次发布中序列头变化的次数
+	Labels     map[string]string `json:",omitempty"`
+}
+
+// seqHeadMonitor 记录发布者视频序列头的变化
+type seqHeadMonitor struct {
+	SequenceHeadChanges int // 序列头变化的次数
+}
+
+// checkSeqHead 在缓存关键帧之前比较新的视频序列头与之前的序列头，返回false代表该消息不写入引擎。
+// 相同编码的新序列头由引擎的视频轨道重新解析，订阅者随后收到新的VideoDeConf；引擎的轨道不能更换编码，
+// 收到不同编码的序列头时以NetStream.Publish.Rejected结束发布，推流端重新发布后以新的编码创建轨道
+func (r *RTMPReceiver) checkSeqHead(msg *Chunk) bool {
+	_, seqHead := parseVideoHeader(msg)
+	if len(r.seqHead) == 0 {
+		if fourCc := r.passthroughFourCc(); fourCc != "" {
+			// 主视频轨道已经绕过引擎转发
+			if seqHead {
+				r.endCodecChange(fourCc, videoCodec(msg.AVData.ToBytes()))
+			}
+			return false
+		}
+		return true
+	}
+	prev := r.seqHead[0] & 0x0f
+	data := msg.AVData.ToBytes()
+	if from, to := videoCodec(r.seqHead), videoCodec(data); from != to {
+		if seqHead {
+			r.endCodecChange(from, to)
+		}
+		return false
+	}
+	if !seqHead {
+		return true
+	}
+	if bytes.Equal(data, r.seqHead) {
+		return true
+	}
+	r.SequenceHeadChanges++
+	// 之前的关键帧与新的参数不匹配，避免中途开始的推流补发旧的序列头和关键帧
+	r.snapshot.Store(nil)
+	r.Info("video sequence header changed", zap.Uint8("codecID", prev), zap.Int("changes", r.SequenceHeadChanges))
+	event := SequenceHeadChangeEvent{CodecID: prev, Changes: r.SequenceHeadChanges, Labels: r.Labels()}
+	if r.Stream != nil {
+		event.StreamPath = r.Stream.Path
+	}
+	emitEvent(event)
+	return true
+}
+
+// videoCodec 比较编码时使用的标识：FourCC，传统格式没有对应的FourCC时为CodecID
+func videoCodec(data []byte) string {
+	if fourCc := videoFourCc(data); fourCc != "" || len(data) == 0 {
+		return fourCc
+	}
+	return strconv.Itoa(int(data[0] & 0x0f))
+}
+
+// endCodecChange 发布者中途更换了视频编码，结束发布，避免订阅者一直收不到视频
+func (r *RTMPReceiver) endCodecChange(from, to string) {
+	r.SequenceHeadChanges++
+	r.Warn("video codec changed, publish ended", zap.String("from", from), zap.String("to", to))
+	event := SequenceHeadChangeEvent{Codec: to, FromCodec: from, Changes: r.SequenceHeadChanges, Labels: r.Labels()}
+	if r.Stream != nil {
+		event.StreamPath = r.Stream.Path
+	}
+	emitEvent(event)
+	r.ResponseReason(0, NetStream_Publish_Rejected, Level_Error, event.StreamPath, "video codec changed from "+from+" to "+to)
+	r.Stop()
+}
@@ -2,10 +2,15 @@ package rtmp
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/url"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 	"m7s.live/engine/v4"
@@ -22,6 +27,12 @@ func (ns *NetStream) Begin() {
 
 var gstreamid uint32
 
+// subscribers 当前所有的rtmp播放会话，以ID为key
+var subscribers sync.Map
+
+// connections 当前所有的服务端rtmp连接，以远端地址为key
+var connections sync.Map
+
 type RTMPSubscriber struct {
 	RTMPSender
 }
@@ -35,16 +46,58 @@ func (s *RTMPSubscriber) OnEvent(event any) {
 }
 func (config *RTMPConfig) ServeTCP(conn *net.TCPConn) {
 	defer conn.Close()
+	nc := NewNetConnection(conn)
+	if nc.sniff() || nc.dropProbe() {
+		return
+	}
+	config.serve(nc, conn)
+}
+
+// serve 处理一个rtmp连接，tcpConn为底层的tcp连接（rtmps时nc.Conn为tls连接），用于读取TCP_INFO
+func (config *RTMPConfig) serve(nc *NetConnection, tcpConn net.Conn) {
+	conn := nc.Conn
 	senders := make(map[uint32]*RTMPSubscriber)
 	receivers := make(map[uint32]*RTMPReceiver)
-	nc := NewNetConnection(conn)
+	preflights := make(map[uint32]*preflight)
+	defer func() {
+		for _, sender := range senders {
+			subscribers.Delete(sender.ID)
+		}
+		for _, receiver := range receivers {
+			receiver.stopRecord()
+		}
+		for _, p := range preflights {
+			p.stop()
+		}
+	}()
+	connections.Store(conn.RemoteAddr().String(), nc)
+	defer connections.Delete(conn.RemoteAddr().String())
+	// 关闭时保存最后的快照，连接断开后仍然可以查询
+	defer func() { keepSnapshot(nc.Snapshot()) }()
 	ctx, cancel := context.WithCancel(engine.Engine)
 	defer cancel()
+	nc.SetContext(ctx)
+	go nc.pollTCPInfo(ctx, tcpConn)
+	var expired atomic.Bool
+	if config.MaxLifetime > 0 {
+		// 连接存活超过上限后关闭其上的所有发布和播放，迫使客户端重连并重新鉴权
+		lifetime := time.AfterFunc(config.MaxLifetime, func() {
+			expired.Store(true)
+			// 中断阻塞的读操作，由读取协程通知客户端后关闭
+			conn.SetReadDeadline(time.Now())
+		})
+		defer lifetime.Stop()
+	}
 	/* Handshake */
+	if config.HandshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(config.HandshakeTimeout))
+	}
 	if err := nc.Handshake(); err != nil {
-		RTMPPlugin.Error("handshake", zap.Error(err))
+		reason := handshakeFailed(err)
+		RTMPPlugin.Error("handshake", zap.String("reason", reason), zap.String("remote", conn.RemoteAddr().String()), zap.Error(err))
 		return
 	}
+	conn.SetReadDeadline(time.Time{})
 	for {
 		if msg, err := nc.RecvMessage(); err == nil {
 			if msg.MessageLength <= 0 {
@@ -61,17 +114,39 @@ func (config *RTMPConfig) ServeTCP(conn *net.TCPConn) {
 				case *CallMessage: //connect
 					app := cmd.Object["app"]                       // 客户端要连接到的服务应用名
 					objectEncoding := cmd.Object["objectEncoding"] // AMF编码方法
-					switch v := objectEncoding.(type) {
-					case float64:
-						nc.objectEncoding = v
-					default:
-						nc.objectEncoding = 0
-					}
+					encoding, _ := objectEncoding.(float64)
 					nc.appName = app.(string)
-					RTMPPlugin.Info("connect", zap.String("appName", nc.appName), zap.Float64("objectEncoding", nc.objectEncoding))
+					if len(conf.AdobeAuth) > 0 {
+						// 认证参数附加在app之后，只在开启认证时从app中去掉
+						appName, rawQuery, _ := strings.Cut(nc.appName, "?")
+						nc.appName = appName
+						ip, _ := remoteIP(nc.RemoteAddr())
+						user, reject := checkAdobeAuth(ip.String(), rawQuery)
+						if reject != "" {
+							// 推流端收到质询后在新的连接上带着用户名和应答重新connect
+							RTMPPlugin.Info("connect rejected", zap.String("user", user), zap.String("description", reject))
+							nc.audit(cmd.CommandName, 0, cmd, NetConnection_Connect_Rejected)
+							nc.rejectConnect(reject)
+							return
+						}
+						RTMPPlugin.Info("adobe auth passed", zap.String("user", user))
+					}
+					nc.caps = parseCapabilities(cmd.Object)
+					flashVer, _ := cmd.Object["flashVer"].(string)
+					software := recordPeer(flashVer)
+					// 会话快照在其他协程中读取
+					nc.logMu.Lock()
+					nc.objectEncoding, nc.software = encoding, software
+					nc.logMu.Unlock()
+					nc.geo = lookupGeo(nc.RemoteAddr())
+					RTMPPlugin.Info("connect", zap.String("appName", nc.appName), zap.Float64("objectEncoding", nc.objectEncoding), zap.Strings("fourCcList", nc.caps.FourCcList), zap.Int("capsEx", nc.caps.CapsEx))
+					if hookErr := nc.checkHook(HookConnect, app.(string), 0); hookErr != nil {
+						nc.audit(cmd.CommandName, 0, cmd, NetConnection_Connect_Rejected+": "+hookErr.Error())
+						nc.rejectConnect(hookErr.Error())
+						return
+					}
 					err = nc.SendMessage(RTMP_MSG_ACK_SIZE, Uint32Message(512<<10))
-					nc.writeChunkSize = config.ChunkSize
-					err = nc.SendMessage(RTMP_MSG_CHUNK_SIZE, Uint32Message(config.ChunkSize))
+					err = nc.SetChunkSize(config.ChunkSize)
 					err = nc.SendMessage(RTMP_MSG_BANDWIDTH, &SetPeerBandwidthMessage{
 						AcknowledgementWindowsize: uint32(512 << 10),
 						LimitType:                 byte(2),
@@ -86,21 +161,44 @@ func (config *RTMPConfig) ServeTCP(conn *net.TCPConn) {
 						"mode":         1,
 						"Author":       "dexter",
 					}
+					// 增强rtmp：通告可以接收的编码和扩展能力，推流端据此决定是否使用HEVC、AV1等编码以及多轨道
+					for k, v := range capabilityProps(config.FourCcList) {
+						m.Properties[k] = v
+					}
 					m.Infomation = map[string]any{
 						"level":          Level_Status,
 						"code":           NetConnection_Connect_Success,
 						"objectEncoding": nc.objectEncoding,
 					}
 					err = nc.SendMessage(RTMP_MSG_AMF0_COMMAND, m)
+					nc.audit(cmd.CommandName, 0, cmd, NetConnection_Connect_Success)
+					if config.SWFVerify {
+						err = nc.SendUserControl(RTMP_USER_SWF_VERIFY_REQUEST)
+					}
 				case *CommandMessage: // "createStream"
-					streamId := atomic.AddUint32(&gstreamid, 1)
+					streamId := nc.allocStreamID()
 					RTMPPlugin.Info("createStream:", zap.Uint32("streamId", streamId))
 					nc.ResponseCreateStream(cmd.TransactionId, streamId)
 				case *CURDStreamMessage:
+					outcome := "stream not found"
 					if stream, ok := receivers[cmd.StreamId]; ok {
+						stream.stopRecord()
 						stream.Stop()
+						delete(receivers, cmd.StreamId)
+						outcome = "stream closed"
+					} else if sender, ok := senders[cmd.StreamId]; ok {
+						sender.Stop()
+						subscribers.Delete(sender.ID)
 						delete(senders, cmd.StreamId)
+						outcome = "stream closed"
+					} else if p, ok := preflights[cmd.StreamId]; ok {
+						// 提前结束只校验的推流，以已经收到的数据生成报告
+						delete(preflights, cmd.StreamId)
+						p.finish()
+						outcome = "preflight finished"
 					}
+					nc.unbindStreamID(cmd.StreamId)
+					nc.audit(cmd.CommandName, cmd.StreamId, cmd, outcome)
 				case *ReleaseStreamMessage:
 					m := &CommandMessage{
 						CommandName:   "releaseStream_error",
@@ -110,28 +208,111 @@ func (config *RTMPConfig) ServeTCP(conn *net.TCPConn) {
 					if s != nil && s.Publisher != nil {
 						if p, ok := s.Publisher.(*RTMPReceiver); ok {
 							m.CommandName = "releaseStream_result"
+							p.stopRecord()
 							p.Stop()
 							delete(receivers, p.StreamID)
 						}
 					}
 					err = nc.SendMessage(RTMP_MSG_AMF0_COMMAND, m)
 				case *PublishMessage:
+					if streamPath, rawQuery, _ := strings.Cut(nc.appName+"/"+cmd.PublishingName, "?"); rawQuery != "" {
+						args, _ := url.ParseQuery(rawQuery)
+						if d, ok := preflightDuration(args); ok {
+							// 只校验不发布，同样需要通过鉴权，不占用流和配额
+							pubErr := checkIP(nc.RemoteAddr(), nc.appName, true)
+							if pubErr == nil {
+								pubErr = checkGeo(nc.geo, nc.appName, true)
+							}
+							if pubErr == nil {
+								pubErr = checkAuth(nc.appName+"/"+cmd.PublishingName, true)
+							}
+							if pubErr == nil {
+								pubErr = nc.checkHook(HookPublish, nc.appName+"/"+cmd.PublishingName, cmd.StreamId)
+							}
+							ns := NetStream{NetConnection: nc, StreamID: cmd.StreamId}
+							ns.parseLabels(args)
+							receiver := &RTMPReceiver{NetStream: ns}
+							if pubErr != nil {
+								err = receiver.ResponseReason(cmd.TransactionId, NetStream_Publish_BadName, Level_Error, streamPath, pubErr.Error())
+								nc.audit(cmd.CommandName, cmd.StreamId, cmd, NetStream_Publish_BadName+": "+pubErr.Error())
+							} else {
+								preflights[cmd.StreamId] = startPreflight(nc, cmd.StreamId, streamPath, d, ns.Labels())
+								err = receiver.ResponseReason(cmd.TransactionId, NetStream_Publish_Start, Level_Status, streamPath, "")
+								nc.audit(cmd.CommandName, cmd.StreamId, cmd, NetStream_Publish_Preflight)
+							}
+							break
+						}
+					}
 					receiver := &RTMPReceiver{
 						NetStream: NetStream{
 							NetConnection: nc,
 							StreamID:      cmd.StreamId,
 						},
 					}
+					receiver.NormalizeTimestamp = config.NormalizeTimestamp
+					// 发布之后其他协程会读取，在发布之前设置
+					receiver.Delay = conf.PublishDelay
+					if _, rawQuery, ok := strings.Cut(cmd.PublishingName, "?"); ok {
+						args, _ := url.ParseQuery(rawQuery)
+						if d, err := time.ParseDuration(args.Get("delay")); err == nil {
+							receiver.Delay = d
+						}
+					}
 					receiver.SetParentCtx(ctx)
 					if !config.KeepAlive {
 						receiver.SetIO(conn)
 					}
-					if RTMPPlugin.Publish(nc.appName+"/"+cmd.PublishingName, receiver) == nil {
+					pubErr := errors.New("server draining")
+					var quota *appQuota
+					if !drainRejects(true) {
+						if pubErr = checkIP(nc.RemoteAddr(), nc.appName, true); pubErr == nil {
+							pubErr = checkGeo(nc.geo, nc.appName, true)
+						}
+						if pubErr == nil {
+							pubErr = checkAuth(nc.appName+"/"+cmd.PublishingName, true)
+						}
+						if pubErr == nil {
+							pubErr = nc.checkHook(HookPublish, nc.appName+"/"+cmd.PublishingName, cmd.StreamId)
+						}
+						if pubErr == nil {
+							if quota, pubErr = acquireQuota(nc.appName, true); pubErr == nil {
+								if pubErr = RTMPPlugin.Publish(nc.appName+"/"+cmd.PublishingName, receiver); pubErr == nil {
+									if pubErr = burnToken(nc.appName + "/" + cmd.PublishingName); pubErr == nil {
+										pubErr = consumeNonce(nc.appName+"/"+cmd.PublishingName, true)
+									}
+									if pubErr != nil {
+										receiver.Stop()
+									}
+								}
+								if pubErr != nil {
+									quota.release(true)
+								}
+							}
+						}
+					}
+					if pubErr == nil {
+						quota.holdUntil(receiver.Done(), true)
 						receivers[cmd.StreamId] = receiver
+						nc.bindStreamID(cmd.StreamId, receiver.Stream.Path)
 						receiver.Begin()
 						err = receiver.Response(cmd.TransactionId, NetStream_Publish_Start, Level_Status)
+						nc.audit(cmd.CommandName, cmd.StreamId, cmd, NetStream_Publish_Start)
+						recordPeerResult(nc.software, true, false)
+						streamPath, rawQuery, _ := strings.Cut(nc.appName+"/"+cmd.PublishingName, "?")
+						args, _ := url.ParseQuery(rawQuery)
+						receiver.parseLabels(args)
+						receiver.Logger = receiver.Logger.With(receiver.labelFields()...)
+						receiver.startRecord(streamPath, args)
+						receiver.startShadow()
+						go nc.hookDone(HookPublish, nc.appName+"/"+cmd.PublishingName, cmd.StreamId, receiver.Done())
 					} else {
-						err = receiver.Response(cmd.TransactionId, NetStream_Publish_BadName, Level_Error)
+						err = receiver.ResponseReason(cmd.TransactionId, NetStream_Publish_BadName, Level_Error, nc.appName+"/"+cmd.PublishingName, pubErr.Error())
+						nc.audit(cmd.CommandName, cmd.StreamId, cmd, NetStream_Publish_BadName+": "+pubErr.Error())
+						recordPeerResult(nc.software, true, true)
+					}
+				case *EncryptionMessage:
+					if r, ok := receivers[msg.MessageStreamID]; ok {
+						r.setDecryption(cmd)
 					}
 				case *PlayMessage:
 					streamPath := nc.appName + "/" + cmd.StreamName
@@ -144,35 +325,139 @@ func (config *RTMPConfig) ServeTCP(conn *net.TCPConn) {
 					if !config.KeepAlive {
 						sender.SetIO(conn)
 					}
+					encrypt := false
 					sender.ID = fmt.Sprintf("%s|%d", conn.RemoteAddr().String(), sender.StreamID)
-					if RTMPPlugin.Subscribe(streamPath, sender) != nil {
-						sender.Response(cmd.TransactionId, NetStream_Play_Failed, Level_Error)
+					streamName, rawQuery, hasArgs := strings.Cut(cmd.StreamName, "?")
+					args, _ := url.ParseQuery(rawQuery)
+					// 调优方案先于地址中单独指定的参数生效
+					profile := config.PlayProfile[nc.appName]
+					if p := args.Get("profile"); p != "" {
+						profile = p
+					}
+					if profile != "" {
+						sender.applyProfile(profile, config)
+					}
+					if hasArgs {
+						if args.Has("degrade") {
+							sender.DegradeEnabled.Store(args.Get("degrade") == "1")
+						}
+						sender.NoData = args.Get("data") == "0"
+						sender.DataOnly = args.Get("data") == "only"
+						encrypt = args.Get("encrypt") == "1"
+						sender.parseLabels(args)
+						// ?audio=track2 选择打包进rtmp音频消息的音频轨道，转换成引擎的订阅音频轨道参数
+						if audio := args.Get("audio"); audio != "" && config.SubAudioArgName != "" && config.SubAudioArgName != "audio" {
+							args.Set(config.SubAudioArgName, audio)
+							streamPath = nc.appName + "/" + streamName + "?" + args.Encode()
+						}
+					}
+					streamPath = aliasStreamPath(streamPath)
+					subErr := errRelayStream
+					if drainRejects(false) {
+						subErr = errors.New("server draining")
+					} else if !strings.HasPrefix(streamPath, relayPrefix) {
+						if subErr = checkIP(nc.RemoteAddr(), nc.appName, false); subErr == nil {
+							subErr = checkGeo(nc.geo, nc.appName, false)
+						}
+						if subErr == nil {
+							subErr = checkAuth(nc.appName+"/"+cmd.StreamName, false)
+						}
+						if subErr == nil {
+							subErr = nc.checkHook(HookPlay, nc.appName+"/"+cmd.StreamName, cmd.StreamId)
+						}
+						if subErr == nil {
+							if sender.quota, subErr = acquireQuota(nc.appName, false); subErr == nil {
+								if subErr = RTMPPlugin.Subscribe(streamPath, sender); subErr == nil {
+									if subErr = consumeNonce(nc.appName+"/"+cmd.StreamName, false); subErr != nil {
+										sender.Stop()
+									}
+								}
+								if subErr != nil {
+									sender.quota.release(false)
+								}
+							}
+						}
+					}
+					if subErr != nil {
+						nc.unbindStreamID(sender.StreamID)
+						sender.ResponseReason(cmd.TransactionId, NetStream_Play_Failed, Level_Error, streamPath, subErr.Error())
+						nc.audit(cmd.CommandName, cmd.StreamId, cmd, NetStream_Play_Failed+": "+subErr.Error())
+						recordPeerResult(nc.software, false, true)
 					} else {
+						sender.quota.holdUntil(sender.Done(), false)
 						senders[sender.StreamID] = sender
+						subscribers.Store(sender.ID, sender)
+						sender.Logger = sender.Logger.With(sender.labelFields()...)
+						nc.bindStreamID(sender.StreamID, sender.Stream.Path)
+						if err := sender.applyConnProfile(); err != nil {
+							sender.Warn("apply play profile", zap.Error(err))
+						}
 						sender.Begin()
 						sender.Response(cmd.TransactionId, NetStream_Play_Reset, Level_Status)
 						sender.Response(cmd.TransactionId, NetStream_Play_Start, Level_Status)
+						nc.audit(cmd.CommandName, cmd.StreamId, cmd, NetStream_Play_Start)
+						recordPeerResult(nc.software, false, false)
+						if encrypt {
+							if err := sender.startEncryption(); err != nil {
+								// 已经登记的播放会话需要移除，否则会留在统计和排空计数中
+								sender.Error("start encryption", zap.Error(err))
+								delete(senders, sender.StreamID)
+								subscribers.Delete(sender.ID)
+								nc.unbindStreamID(sender.StreamID)
+								sender.ResponseReason(cmd.TransactionId, NetStream_Play_Failed, Level_Error, streamPath, "start encryption: "+err.Error())
+								nc.audit(cmd.CommandName, cmd.StreamId, cmd, NetStream_Play_Failed+": start encryption: "+err.Error())
+								sender.Stop()
+								continue
+							}
+						}
+						go sender.watchIdle()
+						go nc.hookDone(HookPlay, nc.appName+"/"+cmd.StreamName, cmd.StreamId, sender.Done())
+						sender.startMultitrack(false)
 						go sender.PlayRaw()
 					}
 				}
+			case RTMP_MSG_AMF0_METADATA:
+				if r, ok := receivers[msg.MessageStreamID]; ok {
+					r.receiveMetaData(msg)
+				} else if p, ok := preflights[msg.MessageStreamID]; ok {
+					p.receiveMetaData(msg)
+				}
 			case RTMP_MSG_AUDIO:
 				if r, ok := receivers[msg.MessageStreamID]; ok {
 					r.ReceiveAudio(msg)
-				} else {
-					RTMPPlugin.Warn("ReceiveAudio", zap.Uint32("MessageStreamID", msg.MessageStreamID))
+				} else if p, ok := preflights[msg.MessageStreamID]; ok {
+					p.receive(msg)
+				} else if !nc.badStreamID(msg, publishingStreamID(receivers, preflights)) {
+					return
 				}
 			case RTMP_MSG_VIDEO:
 				if r, ok := receivers[msg.MessageStreamID]; ok {
 					r.ReceiveVideo(msg)
-				} else {
-					RTMPPlugin.Warn("ReceiveVideo", zap.Uint32("MessageStreamID", msg.MessageStreamID))
+				} else if p, ok := preflights[msg.MessageStreamID]; ok {
+					p.receive(msg)
+				} else if !nc.badStreamID(msg, publishingStreamID(receivers, preflights)) {
+					return
 				}
 			}
 		} else if err == io.EOF {
 			RTMPPlugin.Info("rtmp client closed", zap.String("remote", conn.RemoteAddr().String()))
 			return
+		} else if expired.Load() {
+			RTMPPlugin.Info("max lifetime reached", zap.String("remote", conn.RemoteAddr().String()), zap.Duration("lifetime", config.MaxLifetime))
+			// 先发送onStatus，客户端据此区分正常结束和网络断开
+			for _, r := range receivers {
+				r.Response(0, NetStream_Unpublish_Success, Level_Status)
+			}
+			for _, s := range senders {
+				s.Response(0, NetStream_Play_Stop, Level_Status)
+			}
+			return
+		} else if ctx.Err() != nil {
+			RTMPPlugin.Info("rtmp connection canceled", zap.String("remote", conn.RemoteAddr().String()), zap.Error(ctx.Err()))
+			return
 		} else {
 			RTMPPlugin.Warn("ReadMessage", zap.Error(err))
+			recordPeerFailure(nc.software)
 			return
 		}
 	}
@@ -0,0 +1,125 @@
+package rtmp
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// adobeChallengeTTL 质询的有效期，推流端需要在此期间带上应答重新connect
+const adobeChallengeTTL = 30 * time.Second
+
+// 未应答的质询数量上限，超过后拒绝发出新的质询，避免不断connect占满内存
+const (
+	adobeChallengeMax      = 10000
+	adobeChallengeMaxPerIP = 16
+)
+
+// adobeChallenges 已经发给推流端的adobe认证质询，以opaque为key，每个质询只能使用一次，perIP为每个IP未应答的质询数量
+var adobeChallenges struct {
+	sync.Mutex
+	m     map[string]adobeChallenge
+	perIP map[string]int
+}
+
+type adobeChallenge struct {
+	user, salt, challenge string
+	ip                    string
+	expire                time.Time
+}
+
+// removeAdobeChallenge 调用者需要持有adobeChallenges的锁
+func removeAdobeChallenge(opaque string, c adobeChallenge) {
+	delete(adobeChallenges.m, opaque)
+	if adobeChallenges.perIP[c.ip]--; adobeChallenges.perIP[c.ip] <= 0 {
+		delete(adobeChallenges.perIP, c.ip)
+	}
+}
+
+// runAdobeChallengeSweep 定时清理过期的质询
+func runAdobeChallengeSweep() {
+	ticker := time.NewTicker(adobeChallengeTTL)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		adobeChallenges.Lock()
+		for opaque, c := range adobeChallenges.m {
+			if now.After(c.expire) {
+				removeAdobeChallenge(opaque, c)
+			}
+		}
+		adobeChallenges.Unlock()
+	}
+}
+
+// adobeAuthResponse 计算adobe认证的应答：base64(md5(base64(md5(user + salt + password)) + key + 客户端的challenge))
+func adobeAuthResponse(user, salt, password, key, challenge string) string {
+	h := md5.Sum([]byte(user + salt + password))
+	h = md5.Sum([]byte(base64.StdEncoding.EncodeToString(h[:]) + key + challenge))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// checkAdobeAuth 校验connect的app中带的authmod=adobe认证参数，未配置AdobeAuth时不校验。
+// 返回拒绝connect的description，推流端据此依次带上用户名和应答重新connect，为空表示通过
+func checkAdobeAuth(ip string, rawQuery string) (user string, reject string) {
+	if len(conf.AdobeAuth) == 0 {
+		return "", ""
+	}
+	args, _ := url.ParseQuery(rawQuery)
+	if args.Get("authmod") != AuthModAdobe {
+		return "", "[ AccessManager.Reject ] : [ code=403 need auth; authmod=adobe ]"
+	}
+	user = args.Get("user")
+	const rejected = "[ AccessManager.Reject ] : [ authmod=adobe ] : ?reason="
+	password, ok := conf.AdobeAuth[user]
+	if !ok {
+		return user, rejected + "nosuchuser"
+	}
+	// 推流端不转义base64的应答，其中的+被解析成了空格
+	response := strings.ReplaceAll(args.Get("response"), " ", "+")
+	adobeChallenges.Lock()
+	defer adobeChallenges.Unlock()
+	now := time.Now()
+	if response == "" {
+		// 第一次带用户名connect，发出质询
+		if len(adobeChallenges.m) >= adobeChallengeMax || adobeChallenges.perIP[ip] >= adobeChallengeMaxPerIP {
+			return user, rejected + "authfailed"
+		}
+		if adobeChallenges.m == nil {
+			adobeChallenges.m = make(map[string]adobeChallenge)
+			adobeChallenges.perIP = make(map[string]int)
+		}
+		c := adobeChallenge{user, randomHex(8), randomHex(8), ip, now.Add(adobeChallengeTTL)}
+		opaque := randomHex(8)
+		adobeChallenges.m[opaque] = c
+		adobeChallenges.perIP[ip]++
+		return user, rejected + "needauth&user=" + url.QueryEscape(user) + "&salt=" + c.salt + "&challenge=" + c.challenge + "&opaque=" + opaque
+	}
+	// 收到opaque的客户端以opaque计算应答
+	opaque := args.Get("opaque")
+	c, ok := adobeChallenges.m[opaque]
+	if !ok || c.user != user || now.After(c.expire) {
+		return user, rejected + "authfailed&opaque=" + url.QueryEscape(opaque)
+	}
+	removeAdobeChallenge(opaque, c)
+	if !hmac.Equal([]byte(response), []byte(adobeAuthResponse(user, c.salt, password, opaque, args.Get("challenge")))) {
+		return user, rejected + "authfailed&opaque=" + url.QueryEscape(opaque)
+	}
+	return user, ""
+}
+
+// rejectConnect 以_error拒绝connect，description中带有认证的质询或者失败原因
+func (nc *NetConnection) rejectConnect(description string) error {
+	m := new(ResponseConnectMessage)
+	m.CommandName = Response_Error
+	m.TransactionId = 1
+	m.Infomation = map[string]any{
+		"level":       Level_Error,
+		"code":        NetConnection_Connect_Rejected,
+		"description": description,
+	}
+	return nc.SendMessage(RTMP_MSG_AMF0_COMMAND, m)
+}
@@ -0,0 +1,288 @@
+package rtmp
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"m7s.live/engine/v4/util"
+)
+
+// sessionLogSize 每个连接记录的最近的命令和控制消息数量
+const sessionLogSize = 64
+
+// sessionKeep 保留的已关闭连接的快照数量
+const sessionKeep = 64
+
+// closedSessions 已关闭连接的最后一个快照以及导入的快照，按保存顺序排列
+var closedSessions struct {
+	sync.Mutex
+	list []*SessionSnapshot
+}
+
+// CommandRecord 收发的一条命令或者协议控制消息
+type CommandRecord struct {
+	Time     time.Time
+	Out      bool   // true为发送，false为接收
+	Name     string // 命令名称，控制消息为setChunkSize、abort、windowAckSize、setPeerBandwidth
+	StreamID uint32 `json:",omitempty"`
+	Detail   string `json:",omitempty"` // onStatus和_result的code、play和publish的流名称（不含参数）、控制消息的值
+}
+
+// sessionLog 连接最近的命令，总是记录，不依赖调试日志
+type sessionLog struct {
+	logMu         sync.Mutex
+	records       [sessionLogSize]CommandRecord
+	recordCount   int
+	peerChunkSize atomic.Int64 // 对端的发送块大小
+}
+
+// commandDetail 命令中用于诊断的信息，流名称去掉参数以免带出鉴权信息
+func commandDetail(msg RtmpMessage) string {
+	var info map[string]any
+	switch m := msg.(type) {
+	case *PlayMessage:
+		name, _, _ := strings.Cut(m.StreamName, "?")
+		return name
+	case *PublishMessage:
+		name, _, _ := strings.Cut(m.PublishingName, "?")
+		return name
+	case *ResponseConnectMessage:
+		info = m.Infomation
+	case *ResponsePlayMessage:
+		info = m.Infomation
+	case *ResponsePublishMessage:
+		info = m.Infomation
+	case *ResponseMessage:
+		info = m.Infomation
+	}
+	code, _ := info["code"].(string)
+	return code
+}
+
+// logMessage 记录命令和协议控制消息，音视频、数据消息和确认不记录
+func (nc *NetConnection) logMessage(out bool, t byte, streamID uint32, msg RtmpMessage) {
+	r := CommandRecord{Time: time.Now(), Out: out, StreamID: streamID}
+	switch t {
+	case RTMP_MSG_AMF0_COMMAND:
+		c, ok := msg.(Commander)
+		if !ok {
+			return
+		}
+		r.Name = c.GetCommand().CommandName
+		r.Detail = commandDetail(msg)
+	case RTMP_MSG_CHUNK_SIZE:
+		r.Name = "setChunkSize"
+	case RTMP_MSG_ABORT:
+		r.Name = "abort"
+	case RTMP_MSG_ACK_SIZE:
+		r.Name = "windowAckSize"
+	case RTMP_MSG_BANDWIDTH:
+		r.Name = "setPeerBandwidth"
+		if m, ok := msg.(*SetPeerBandwidthMessage); ok {
+			r.Detail = strconv.FormatUint(uint64(m.AcknowledgementWindowsize), 10)
+		}
+	default:
+		return
+	}
+	if v, ok := msg.(Uint32Message); ok {
+		r.Detail = strconv.FormatUint(uint64(v), 10)
+	}
+	nc.logMu.Lock()
+	nc.records[nc.recordCount%sessionLogSize] = r
+	nc.recordCount++
+	nc.logMu.Unlock()
+}
+
+// commandLog 按时间顺序返回记录的命令
+func (nc *NetConnection) commandLog() []CommandRecord {
+	nc.logMu.Lock()
+	defer nc.logMu.Unlock()
+	n := nc.recordCount
+	if n > sessionLogSize {
+		n = sessionLogSize
+	}
+	list := make([]CommandRecord, 0, n)
+	for i := nc.recordCount - n; i < nc.recordCount; i++ {
+		list = append(list, nc.records[i%sessionLogSize])
+	}
+	return list
+}
+
+// sendChunkSize 本端的发送块大小，在写锁内读取
+func (nc *NetConnection) sendChunkSize() int {
+	for !nc.writing.CompareAndSwap(false, true) {
+		runtime.Gosched()
+	}
+	defer nc.writing.Store(false)
+	return nc.writeChunkSize
+}
+
+// PublisherSnapshot 连接上的发布者的时间戳和缓冲状态
+type PublisherSnapshot struct {
+	StreamID       uint32
+	StreamPath     string
+	FirstFrameTime time.Time
+	FirstTimestamp uint32
+	StreamTime     uint32
+	TimestampBase  uint32 `json:",omitempty"`
+	Delay          time.Duration
+	BufferedBytes  int64
+	Dropped        int64
+}
+
+// PlayerSnapshot 连接上的播放者的发送进度和拥塞状态
+type PlayerSnapshot struct {
+	ID              string
+	StreamID        uint32
+	StreamPath      string
+	LastTimestamp   uint32
+	TimestampOffset uint32
+	Behind          time.Duration `json:",omitempty"` // 落后于发布者最新一帧的时长
+	Blocked         time.Duration `json:",omitempty"` // 当前写操作已经阻塞的时长
+	WaitingKeyFrame bool
+	AudioOnly       bool // 处于降级的纯音频状态
+	DegradeCount    int32
+	InsufficientBW  int32
+}
+
+// SessionSnapshot 会话的诊断快照，用于附在问题报告中
+type SessionSnapshot struct {
+	Time           time.Time
+	Connection     ConnectionInfo
+	Software       string `json:",omitempty"`
+	ObjectEncoding float64
+	ChunkSize      int          // 本端的发送块大小
+	PeerChunkSize  int          // 对端的发送块大小
+	Memory         *MemoryStats // 连接缓冲中的字节数
+	Commands       []CommandRecord
+	Publishers     []PublisherSnapshot `json:",omitempty"`
+	Players        []PlayerSnapshot    `json:",omitempty"`
+}
+
+// Snapshot 采集会话的诊断快照，其他协程修改的状态通过锁或者原子操作读取
+func (nc *NetConnection) Snapshot() *SessionSnapshot {
+	s := &SessionSnapshot{
+		Time:          time.Now(),
+		Connection:    nc.GetInfo(),
+		ChunkSize:     nc.sendChunkSize(),
+		PeerChunkSize: RTMP_DEFAULT_CHUNK_SIZE,
+		Memory:        nc.memoryStats(),
+		Commands:      nc.commandLog(),
+	}
+	nc.logMu.Lock()
+	s.Software, s.ObjectEncoding = nc.software, nc.objectEncoding
+	nc.logMu.Unlock()
+	if size := nc.peerChunkSize.Load(); size > 0 {
+		s.PeerChunkSize = int(size)
+	}
+	for _, stream := range filterStreams() {
+		p, ok := stream.Publisher.(IRTMPReceiver)
+		if !ok || p.GetReceiver().NetConnection != nc {
+			continue
+		}
+		r := p.GetReceiver()
+		s.Publishers = append(s.Publishers, PublisherSnapshot{
+			StreamID:       r.StreamID,
+			StreamPath:     stream.Path,
+			FirstFrameTime: r.FirstFrameTime(),
+			FirstTimestamp: r.FirstTimestamp(),
+			StreamTime:     r.StreamTime(),
+			TimestampBase:  atomic.LoadUint32(&r.TimestampBase),
+			Delay:          r.Delay,
+			BufferedBytes:  atomic.LoadInt64(&r.BufferedBytes),
+			Dropped:        atomic.LoadInt64(&r.Dropped),
+		})
+	}
+	subscribers.Range(func(_, v any) bool {
+		sub := v.(*RTMPSubscriber)
+		if sub.NetConnection != nc {
+			return true
+		}
+		player := PlayerSnapshot{
+			ID:              sub.ID,
+			StreamID:        sub.StreamID,
+			LastTimestamp:   atomic.LoadUint32(&sub.lastAbsTime),
+			TimestampOffset: atomic.LoadUint32(&sub.timestampOffset),
+			WaitingKeyFrame: sub.waitingKeyFrame.Load(),
+			AudioOnly:       sub.audioOnly.Load(),
+			DegradeCount:    atomic.LoadInt32(&sub.DegradeCount),
+			InsufficientBW:  atomic.LoadInt32(&sub.InsufficientBWCount),
+		}
+		if start := sub.writeStart.Load(); start != 0 {
+			player.Blocked = time.Since(time.Unix(0, start))
+		}
+		if sub.Stream != nil {
+			player.StreamPath = sub.Stream.Path
+			if p, ok := sub.Stream.Publisher.(IRTMPReceiver); ok {
+				player.Behind = time.Duration(int64(p.GetReceiver().StreamTime())-int64(player.LastTimestamp-player.TimestampOffset)) * time.Millisecond
+			}
+		}
+		s.Players = append(s.Players, player)
+		return true
+	})
+	return s
+}
+
+// keepSnapshot 保存快照，同一个远端地址只保留最新的，超过sessionKeep时丢弃最早的
+func keepSnapshot(s *SessionSnapshot) {
+	closedSessions.Lock()
+	defer closedSessions.Unlock()
+	for i, old := range closedSessions.list {
+		if old.Connection.RemoteAddr == s.Connection.RemoteAddr {
+			closedSessions.list = append(closedSessions.list[:i], closedSessions.list[i+1:]...)
+			break
+		}
+	}
+	if len(closedSessions.list) >= sessionKeep {
+		closedSessions.list = closedSessions.list[1:]
+	}
+	closedSessions.list = append(closedSessions.list, s)
+}
+
+// keptSnapshot 查找保存的快照
+func keptSnapshot(id string) *SessionSnapshot {
+	closedSessions.Lock()
+	defer closedSessions.Unlock()
+	for _, s := range closedSessions.list {
+		if s.Connection.RemoteAddr == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// API_session 获取会话的诊断快照，id为rtmp/api/connections中的远端地址，连接关闭后返回关闭时保存的快照。
+// 以POST提交快照（例如问题报告中附带的）时恢复到保存的快照中，之后可以用其中的远端地址查询
+func (*RTMPConfig) API_session(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var s SessionSnapshot
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "invalid snapshot: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.Connection.RemoteAddr == "" {
+			http.Error(w, "snapshot without Connection.RemoteAddr", http.StatusBadRequest)
+			return
+		}
+		keepSnapshot(&s)
+		w.Write([]byte("ok"))
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if v, ok := connections.Load(id); ok {
+		util.ReturnJson(v.(*NetConnection).Snapshot, time.Second, w, r)
+		return
+	}
+	s := keptSnapshot(id)
+	if s == nil {
+		http.Error(w, "connection not found", http.StatusNotFound)
+		return
+	}
+	util.ReturnJson(func() *SessionSnapshot { return s }, time.Second, w, r)
+}
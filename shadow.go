@@ -0,0 +1,46 @@
+package rtmp
+
+import (
+	"go.uber.org/zap"
+)
+
+// startShadow 按配置将发布者的音视频消息镜像到另一个streamPath（影子流），用于监控和分析，不影响原始流的分发
+func (r *RTMPReceiver) startShadow() {
+	if r.Stream == nil {
+		return
+	}
+	shadowPath, ok := conf.Shadow[r.Stream.Path]
+	if !ok {
+		return
+	}
+	shadow := &RTMPReceiver{
+		NetStream: r.NetStream,
+	}
+	shadow.SetParentCtx(r.Context)
+	if err := RTMPPlugin.Publish(shadowPath, shadow); err != nil {
+		r.Error("shadow publish", zap.String("streamPath", shadowPath), zap.Error(err))
+		return
+	}
+	r.Info("shadow publish", zap.String("streamPath", shadowPath))
+	r.shadow = shadow
+}
+
+// mirror 复制一份消息写入影子流，需要在原始消息交给引擎之前调用
+func (r *RTMPReceiver) mirror(msg *Chunk) {
+	if r.shadow == nil {
+		return
+	}
+	if r.shadow.IsClosed() {
+		r.shadow = nil
+		return
+	}
+	clone := &Chunk{ChunkHeader: msg.ChunkHeader}
+	mem := r.bytePool.Get(msg.AVData.ByteLength)
+	copy(mem.Value, msg.AVData.ToBytes())
+	clone.AVData.Push(mem)
+	if msg.MessageTypeID == RTMP_MSG_AUDIO {
+		r.shadow.writeAudioTrack(clone)
+	} else {
+		r.shadow.writeVideoTrack(clone)
+	}
+}
@@ -0,0 +1,60 @@
+package rtmp
+
+import "sync/atomic"
+
+// singleTrackPublish 纯音频（例如电台）或者纯视频（例如监控画面）的发布，跳过等待另一种序列头和关键帧的逻辑，避免等待永远不会到来的数据带来的延迟
+type singleTrackPublish struct {
+	AudioOnlyPublish bool `json:",omitempty"` // 发布者的onMetaData声明没有视频
+	VideoOnlyPublish bool `json:",omitempty"` // 发布者的onMetaData声明没有音频
+
+	audioOnly atomic.Bool // 与AudioOnlyPublish相同，供播放者的协程读取
+}
+
+// singleTrackMeta 根据onMetaData中的hasAudio、hasVideo判断，没有时根据是否只有audiocodecid或者videocodecid判断
+func singleTrackMeta(values []any) (meta map[string]any, audioOnly, videoOnly bool) {
+	for _, v := range values {
+		m, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+		_, audio := m["audiocodecid"]
+		_, video := m["videocodecid"]
+		if hasAudio, ok := m["hasAudio"].(bool); ok {
+			audio = hasAudio
+		}
+		if hasVideo, ok := m["hasVideo"].(bool); ok {
+			video = hasVideo
+		}
+		return m, audio && !video, video && !audio
+	}
+	return nil, false, false
+}
+
+// checkSingleTrack 根据onMetaData切换到纯音频或纯视频的处理，告诉引擎不需要等待另一种轨道，
+// 并在转发的onMetaData中明确hasAudio、hasVideo，避免播放器（例如flv.js）等待不存在的轨道
+func (r *RTMPReceiver) checkSingleTrack(values []any) {
+	if r.AudioOnlyPublish || r.VideoOnlyPublish {
+		return
+	}
+	meta, audioOnly, videoOnly := singleTrackMeta(values)
+	switch {
+	case audioOnly && r.VideoTrack == nil:
+		r.AudioOnlyPublish = true
+		r.audioOnly.Store(true)
+		meta["hasVideo"] = false
+		r.Info("audio only publish")
+	case videoOnly && r.AudioTrack == nil:
+		r.VideoOnlyPublish = true
+		meta["hasAudio"] = false
+		r.Info("video only publish")
+	default:
+		return
+	}
+	if r.Config != nil {
+		// Config是插件共享的发布配置，复制一份再修改
+		config := *r.Config
+		config.PubAudio = config.PubAudio && !r.VideoOnlyPublish
+		config.PubVideo = config.PubVideo && !r.AudioOnlyPublish
+		r.Config = &config
+	}
+}
@@ -0,0 +1,80 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"net/http"
+	"sync/atomic"
+
+	"m7s.live/engine/v4"
+)
+
+// KeyFrameSnapshot 最近一个视频关键帧，payload为rtmp视频消息体(AVCC)
+type KeyFrameSnapshot struct {
+	SequenceHead []byte
+	Payload      []byte
+	Timestamp    uint32
+}
+
+type keyFrameCache struct {
+	seqHead      []byte
+	snapshot     atomic.Pointer[KeyFrameSnapshot]
+	audioSeqHead atomic.Pointer[[]byte]
+}
+
+// cacheKeyFrame 缓存关键帧和序列头，在数据交给引擎之前调用
+func (c *keyFrameCache) cacheKeyFrame(msg *Chunk) {
+	keyFrame, seqHead := parseVideoHeader(msg)
+	if seqHead {
+		c.seqHead = msg.AVData.ToBytes()
+		return
+	}
+	if !keyFrame {
+		return
+	}
+	c.snapshot.Store(&KeyFrameSnapshot{
+		SequenceHead: c.seqHead,
+		Payload:      msg.AVData.ToBytes(),
+		Timestamp:    msg.ExtendTimestamp,
+	})
+}
+
+// writeFLVTag 写入一个flv tag及其后的PreviousTagSize
+func writeFLVTag(w http.ResponseWriter, t byte, ts uint32, data []byte) {
+	head := make([]byte, 11)
+	head[0] = t
+	head[1], head[2], head[3] = byte(len(data)>>16), byte(len(data)>>8), byte(len(data))
+	head[4], head[5], head[6], head[7] = byte(ts>>16), byte(ts>>8), byte(ts), byte(ts>>24)
+	w.Write(head)
+	w.Write(data)
+	binary.BigEndian.PutUint32(head, uint32(len(data)+11))
+	w.Write(head[:4])
+}
+
+func (*RTMPConfig) API_snapshot(rw http.ResponseWriter, r *http.Request) {
+	s := engine.Streams.Get(r.URL.Query().Get("streamPath"))
+	if s == nil {
+		http.Error(rw, "stream not found", http.StatusNotFound)
+		return
+	}
+	p, ok := s.Publisher.(IRTMPReceiver)
+	if !ok {
+		http.Error(rw, "not rtmp publisher", http.StatusBadRequest)
+		return
+	}
+	snapshot := p.GetReceiver().snapshot.Load()
+	if snapshot == nil {
+		http.Error(rw, "no keyframe", http.StatusNotFound)
+		return
+	}
+	if r.URL.Query().Get("format") == "raw" {
+		rw.Header().Set("Content-Type", "application/octet-stream")
+		rw.Write(snapshot.Payload)
+		return
+	}
+	rw.Header().Set("Content-Type", "video/x-flv")
+	rw.Write([]byte{'F', 'L', 'V', 0x01, 0x01, 0, 0, 0, 9, 0, 0, 0, 0})
+	if snapshot.SequenceHead != nil {
+		writeFLVTag(rw, RTMP_MSG_VIDEO, 0, snapshot.SequenceHead)
+	}
+	writeFLVTag(rw, RTMP_MSG_VIDEO, 0, snapshot.Payload)
+}
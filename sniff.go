@@ -0,0 +1,134 @@
+package rtmp
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ProtocolHandler 处理rtmp端口上的非rtmp连接，用于单端口部署
+type ProtocolHandler struct {
+	Name   string
+	Match  func(head []byte) bool // head为连接最开始已经收到的数据，至少1个字节
+	Handle func(conn net.Conn)    // 返回后连接会被关闭
+
+	HeadLen int // Match需要的字节数，嗅探时在超时之前等待收到这么多数据，0为1个字节
+}
+
+// HTTPHeadLen IsHTTP需要的字节数，即最长的请求方法"OPTIONS "的长度
+const HTTPHeadLen = 8
+
+var protocolHandlers struct {
+	sync.RWMutex
+	list []ProtocolHandler
+}
+
+// RegisterProtocol 注册rtmp端口上的其他协议，连接的第一个字节不是rtmp的版本号时依次匹配
+func RegisterProtocol(handler ProtocolHandler) {
+	protocolHandlers.Lock()
+	defer protocolHandlers.Unlock()
+	protocolHandlers.list = append(protocolHandlers.list, handler)
+}
+
+// sniffedConn 先读取嗅探时缓存的数据，再读取原始连接
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// sniff 根据第一个字节判断是否是rtmp连接，不是则交给匹配的ProtocolHandler处理，返回true代表已经处理
+func (nc *NetConnection) sniff() bool {
+	protocolHandlers.RLock()
+	handlers := protocolHandlers.list
+	protocolHandlers.RUnlock()
+	if len(handlers) == 0 {
+		return false
+	}
+	headLen := 1
+	for _, handler := range handlers {
+		if handler.HeadLen > headLen {
+			headLen = handler.HeadLen
+		}
+	}
+	// 对端可能只发送部分数据，等待匹配需要的数据时不能一直占用连接
+	nc.Conn.SetReadDeadline(time.Now().Add(probeTimeout))
+	first, err := nc.Reader.Peek(1)
+	if err != nil || first[0] == RTMP_HANDSHAKE_VERSION {
+		nc.Conn.SetReadDeadline(time.Time{})
+		return false
+	}
+	// 数据不足时Peek返回已经收到的部分
+	head, _ := nc.Reader.Peek(headLen)
+	// 处理器和之后的rtmp握手自己设置超时
+	nc.Conn.SetReadDeadline(time.Time{})
+	for _, handler := range handlers {
+		if handler.Match(head) {
+			RTMPPlugin.Debug("sniff", zap.String("protocol", handler.Name), zap.String("remote", nc.RemoteAddr().String()))
+			handler.Handle(&sniffedConn{nc.Conn, nc.Reader})
+			return true
+		}
+	}
+	return false
+}
+
+// IsHTTP 判断连接开头是否是http请求，注册时HeadLen使用HTTPHeadLen
+func IsHTTP(head []byte) bool {
+	for _, method := range []string{"GET ", "POST ", "PUT ", "HEAD ", "DELETE ", "OPTIONS ", "PATCH "} {
+		if len(head) >= len(method) && string(head[:len(method)]) == method {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTPHandler 把单个连接交给http.Handler处理，配合RegisterProtocol在rtmp端口上提供状态页等http服务
+func HTTPHandler(h http.Handler) func(net.Conn) {
+	return func(conn net.Conn) {
+		l := &oneConnListener{conn: &notifyCloseConn{Conn: conn, closed: make(chan struct{})}}
+		http.Serve(l, h)
+		<-l.conn.closed
+	}
+}
+
+type notifyCloseConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *notifyCloseConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// oneConnListener 只Accept一次的Listener
+type oneConnListener struct {
+	conn     *notifyCloseConn
+	accepted bool
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	if l.accepted {
+		<-l.conn.closed
+		return nil, io.EOF
+	}
+	l.accepted = true
+	return l.conn, nil
+}
+
+func (l *oneConnListener) Close() error {
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,130 @@
+package rtmp
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4"
+)
+
+// standby 预先建立好握手和connect（但没有play）的拉流连接，取走之前由读取协程处理远端的控制消息
+type standby struct {
+	nc     *NetConnection
+	mu     sync.Mutex // 读取协程处理一个消息时持有，取走时等待消息处理完
+	taken  bool
+	closed bool
+	done   chan struct{} // 读取协程退出后关闭
+}
+
+// standbys 预备连接，以远端地址为key
+var standbys struct {
+	sync.Mutex
+	m map[string]*standby
+}
+
+// takeStandby 取出预备连接，停止其读取协程后交给拉流使用，keepStandby随后建立新的预备连接
+func takeStandby(remoteURL string) *NetConnection {
+	standbys.Lock()
+	s, ok := standbys.m[remoteURL]
+	delete(standbys.m, remoteURL)
+	standbys.Unlock()
+	if !ok {
+		return nil
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.taken = true
+	s.mu.Unlock()
+	// 读取协程只在等待新消息时被打断，不会读到一半
+	s.nc.SetReadDeadline(time.Now())
+	<-s.done
+	s.nc.SetReadDeadline(time.Time{})
+	return s.nc
+}
+
+// serve 读取并处理预备连接上的控制消息（ack、ping、块大小），定时发送ping保持连接，直到被取走或者断开
+func (s *standby) serve(remoteURL string) {
+	defer close(s.done)
+	stopPing := make(chan struct{})
+	defer close(stopPing)
+	go func() {
+		ticker := time.NewTicker(conf.WarmStandbyRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopPing:
+				return
+			case <-ticker.C:
+				s.nc.SendMessage(RTMP_MSG_USER_CONTROL, &StreamIDMessage{UserControlMessage{EventType: RTMP_USER_PING_REQUEST}, uint32(time.Now().UnixMilli())})
+			}
+		}
+	}()
+	for {
+		_, err := s.nc.Reader.Peek(1)
+		s.mu.Lock()
+		if s.taken {
+			s.mu.Unlock()
+			return
+		}
+		if err == nil {
+			// play之前远端只会发送控制消息和命令（例如onBWDone），命令直接丢弃
+			_, err = s.nc.RecvMessage()
+		}
+		if err != nil {
+			s.closed = true
+			s.mu.Unlock()
+			RTMPPlugin.Warn("warm standby closed", zap.String("url", redactURL(remoteURL)), zap.Error(err))
+			standbys.Lock()
+			if standbys.m[remoteURL] == s {
+				delete(standbys.m, remoteURL)
+			}
+			standbys.Unlock()
+			s.nc.Close()
+			return
+		}
+		s.mu.Unlock()
+	}
+}
+
+// keepStandby 保持一个预备连接，被取走或者断开后重新建立，建立失败时间隔WarmStandbyRefresh重试
+func keepStandby(remoteURL string) {
+	for engine.Engine.Err() == nil {
+		nc, err := NewRTMPClient(remoteURL)
+		if err != nil {
+			RTMPPlugin.Warn("warm standby", zap.String("url", redactURL(remoteURL)), zap.Error(err))
+			select {
+			case <-engine.Engine.Done():
+				return
+			case <-time.After(conf.WarmStandbyRefresh):
+			}
+			continue
+		}
+		s := &standby{nc: nc, done: make(chan struct{})}
+		standbys.Lock()
+		if standbys.m == nil {
+			standbys.m = make(map[string]*standby)
+		}
+		standbys.m[remoteURL] = s
+		standbys.Unlock()
+		s.serve(remoteURL)
+	}
+}
+
+func (c *RTMPConfig) runWarmStandby() {
+	if c.WarmStandbyRefresh <= 0 {
+		return
+	}
+	// 多个流使用同一个远端地址时只保持一个预备连接
+	started := make(map[string]bool, len(c.WarmStandby))
+	for streamPath, remoteURL := range c.WarmStandby {
+		RTMPPlugin.Info("warm standby", zap.String("streamPath", streamPath), zap.String("url", redactURL(remoteURL)))
+		if !started[remoteURL] {
+			started[remoteURL] = true
+			go keepStandby(remoteURL)
+		}
+	}
+}
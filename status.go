@@ -0,0 +1,57 @@
+package rtmp
+
+import (
+	"strings"
+	"sync/atomic"
+	"text/template"
+
+	"go.uber.org/zap"
+)
+
+// StatusData onStatus描述模板中可以使用的字段
+type StatusData struct {
+	Code       string // 例如 NetStream.Play.Start
+	Level      string
+	StreamPath string // 不含参数的streamPath
+	AppName    string
+	StreamName string
+	Reason     string // 失败原因，没有时为空
+}
+
+// statusTemplates 加载配置时解析好的StatusDescription模板，以code为key
+var statusTemplates atomic.Pointer[map[string]*template.Template]
+
+// loadStatusTemplates 加载配置时解析StatusDescription，无效的模板只告警并忽略
+func (c *RTMPConfig) loadStatusTemplates() {
+	templates := make(map[string]*template.Template, len(c.StatusDescription))
+	for code, text := range c.StatusDescription {
+		t, err := template.New(code).Parse(text)
+		if err != nil {
+			RTMPPlugin.Warn("status description", zap.String("code", code), zap.Error(err))
+			continue
+		}
+		templates[code] = t
+	}
+	statusTemplates.Store(&templates)
+}
+
+// statusDescription 按StatusDescription中code对应的模板生成onStatus的description，没有配置时为空
+func statusDescription(code, level, streamPath, reason string) string {
+	templates := statusTemplates.Load()
+	if templates == nil {
+		return ""
+	}
+	t, ok := (*templates)[code]
+	if !ok {
+		return ""
+	}
+	data := StatusData{Code: code, Level: level, Reason: reason}
+	data.StreamPath, _, _ = strings.Cut(streamPath, "?")
+	data.AppName, data.StreamName, _ = strings.Cut(data.StreamPath, "/")
+	var sb strings.Builder
+	if err := t.Execute(&sb, data); err != nil {
+		RTMPPlugin.Warn("status description", zap.String("code", code), zap.Error(err))
+		return ""
+	}
+	return sb.String()
+}
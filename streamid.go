@@ -0,0 +1,101 @@
+package rtmp
+
+import (
+	"math/rand"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// createStream 时分配消息流ID的方式
+const (
+	StreamIDGlobal     = "global"     // 全局递增（默认）
+	StreamIDSequential = "sequential" // 每个连接从1开始递增
+	StreamIDFixed      = "fixed"      // 固定为StreamIDFixed
+	StreamIDRandom     = "random"     // 在[StreamIDMin, StreamIDMax]中随机
+)
+
+// 音视频消息的消息流ID与publish/play的消息流ID不一致时的处理方式
+const (
+	StreamIDCheckOff    = "off"    // 不校验（默认），拉流时不区分消息流ID
+	StreamIDCheckLog    = "log"    // 记录日志
+	StreamIDCheckReject = "reject" // 记录日志并断开连接
+)
+
+// allocStreamID 分配消息流ID并记录为已分配（streamPath为空），fixed和random分配的ID在连接上仍在使用时，
+// 改为在连接上分配过的最大ID之后递增，不会与正在使用的消息流冲突
+func (nc *NetConnection) allocStreamID() uint32 {
+	id := nc.nextStreamID()
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if nc.streamIDs == nil {
+		nc.streamIDs = make(map[uint32]string)
+	}
+	for {
+		if _, used := nc.streamIDs[id]; !used {
+			break
+		}
+		nc.lastStreamID++
+		id = nc.lastStreamID
+	}
+	if id > nc.lastStreamID {
+		nc.lastStreamID = id
+	}
+	nc.streamIDs[id] = ""
+	return id
+}
+
+func (nc *NetConnection) nextStreamID() uint32 {
+	switch conf.StreamIDMode {
+	case StreamIDSequential:
+		return nc.lastStreamID + 1
+	case StreamIDFixed:
+		return conf.StreamIDFixed
+	case StreamIDRandom:
+		if conf.StreamIDMax > conf.StreamIDMin {
+			return conf.StreamIDMin + uint32(rand.Int63n(int64(conf.StreamIDMax-conf.StreamIDMin)+1))
+		}
+		return conf.StreamIDMin
+	default:
+		return atomic.AddUint32(&gstreamid, 1)
+	}
+}
+
+// bindStreamID 记录消息流ID对应的streamPath，用于诊断
+func (nc *NetConnection) bindStreamID(streamID uint32, streamPath string) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if nc.streamIDs == nil {
+		nc.streamIDs = make(map[uint32]string)
+	}
+	nc.streamIDs[streamID] = streamPath
+}
+
+func (nc *NetConnection) unbindStreamID(streamID uint32) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	delete(nc.streamIDs, streamID)
+	delete(nc.labels, streamID)
+}
+
+// publishingStreamID 连接上正在发布（包括预检）的消息流ID，用于记录不符的消息；有多个时取最小的，没有时为0
+func publishingStreamID(receivers map[uint32]*RTMPReceiver, preflights map[uint32]*preflight) (expected uint32) {
+	for id := range receivers {
+		if expected == 0 || id < expected {
+			expected = id
+		}
+	}
+	for id := range preflights {
+		if expected == 0 || id < expected {
+			expected = id
+		}
+	}
+	return
+}
+
+// badStreamID 收到消息流ID不符的音视频消息，返回false时应断开连接
+func (nc *NetConnection) badStreamID(msg *Chunk, expected uint32) bool {
+	nc.badStreamIDs.Add(1)
+	RTMPPlugin.Warn("unexpected message stream id", zap.String("remote", nc.RemoteAddr().String()), zap.Uint8("type", msg.MessageTypeID), zap.Uint32("MessageStreamID", msg.MessageStreamID), zap.Uint32("expected", expected))
+	return conf.StreamIDCheck != StreamIDCheckReject
+}
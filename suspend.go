@@ -0,0 +1,120 @@
+package rtmp
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+// suspendedPush 暂停的推流任务，保留远端地址和重试统计，恢复时继续累计
+type suspendedPush struct {
+	sync.Mutex
+	RemoteURL   string
+	SuspendedAt time.Time
+	retry       taskRetry
+}
+
+type SuspendedPushInfo struct {
+	StreamPath  string
+	RemoteURL   string
+	SuspendedAt time.Time
+	Attempts    int
+	Uptime      time.Duration // 暂停前累计连接成功的时长
+}
+
+var errPushSuspended = errors.New("push suspended")
+
+func pushSuspended(streamPath string) bool {
+	return suspendedPushOf(streamPath) != nil
+}
+
+// saveSuspended 推流结束时如果是被暂停的，保存重试统计
+func (pusher *RTMPPusher) saveSuspended() {
+	if s := suspendedPushOf(pusher.StreamPath); s != nil {
+		s.Lock()
+		s.retry = pusher.taskRetry
+		s.Unlock()
+	}
+}
+
+// API_suspend 暂停推流：断开连接但保留任务，不带streamPath时返回暂停中的推流列表
+func (*RTMPConfig) API_suspend(rw http.ResponseWriter, r *http.Request) {
+	streamPath := r.URL.Query().Get("streamPath")
+	if streamPath == "" {
+		util.ReturnJson(func() (list []SuspendedPushInfo) {
+			rangePaths(func(streamPath string, e *pathEntry) bool {
+				s := e.suspended.Load()
+				if s == nil {
+					return true
+				}
+				s.Lock()
+				list = append(list, SuspendedPushInfo{streamPath, redactURL(s.RemoteURL), s.SuspendedAt, s.retry.Attempts, s.retry.Uptime})
+				s.Unlock()
+				return true
+			})
+			return
+		}, time.Second, rw, r)
+		return
+	}
+	p := runningPusher(streamPath)
+	if p == nil {
+		http.Error(rw, "push not found", http.StatusNotFound)
+		return
+	}
+	if !suspendPush(p) {
+		http.Error(rw, "push already suspended", http.StatusConflict)
+		return
+	}
+	rw.Write([]byte("ok"))
+}
+
+// suspendPush 暂停正在运行的推流，返回false代表已经暂停
+func suspendPush(pusher *RTMPPusher) bool {
+	if !pathEntryOf(pusher.StreamPath).suspended.CompareAndSwap(nil, &suspendedPush{RemoteURL: pusher.originURL, SuspendedAt: time.Now()}) {
+		return false
+	}
+	RTMPPlugin.Info("suspend push", zap.String("streamPath", pusher.StreamPath), zap.String("remoteURL", redactURL(pusher.originURL)))
+	pusher.Stop()
+	return true
+}
+
+// API_resume 恢复暂停的推流，沿用原来的远端地址和重试统计
+func (*RTMPConfig) API_resume(rw http.ResponseWriter, r *http.Request) {
+	streamPath := r.URL.Query().Get("streamPath")
+	s := suspendedPushOf(streamPath)
+	if s == nil {
+		http.Error(rw, "push not suspended", http.StatusNotFound)
+		return
+	}
+	if runningPusher(streamPath) != nil {
+		// 暂停的推流还没有完全退出
+		http.Error(rw, "push is stopping", http.StatusConflict)
+		return
+	}
+	if err := resumePush(streamPath, s); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rw.Write([]byte("ok"))
+}
+
+func resumePush(streamPath string, s *suspendedPush) error {
+	e := pathEntryOf(streamPath)
+	if !e.suspended.CompareAndSwap(s, nil) {
+		return errors.New("push already resumed")
+	}
+	s.Lock()
+	pusher := newRTMPPusher()
+	pusher.taskRetry = s.retry
+	s.Unlock()
+	RTMPPlugin.Info("resume push", zap.String("streamPath", streamPath), zap.String("remoteURL", redactURL(s.RemoteURL)))
+	if err := RTMPPlugin.Push(streamPath, s.RemoteURL, pusher, false); err != nil {
+		e.suspended.CompareAndSwap(nil, s)
+		return err
+	}
+	return nil
+}
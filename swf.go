@@ -0,0 +1,86 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+// SWFVerifyMessage SWF校验响应（=27）
+// 事件数据为42字节：0x01 0x01 + SWF解压后的大小（4字节，重复两次）+ HMAC-SHA256(握手时服务端S1的最后32字节, SWF哈希)
+type SWFVerifyMessage struct {
+	UserControlMessage
+}
+
+func (msg *SWFVerifyMessage) Encode(buf *util.Buffer) {
+	buf.WriteUint16(msg.EventType)
+	buf.Write(msg.EventData)
+}
+
+// checkSWFHash 加载配置时检查SWF哈希：开启SWFVerify却没有有效的SWFHash时无法校验任何客户端，
+// 报错并关闭SWFVerify，而不是发送校验请求却接受所有响应
+func (c *RTMPConfig) checkSWFHash() {
+	if c.SWFHash == "" && !c.SWFVerify {
+		return
+	}
+	if hash, err := hex.DecodeString(c.SWFHash); err != nil || len(hash) != 32 {
+		RTMPPlugin.Error("swfhash must be 64 hex characters", zap.Bool("swfVerify", c.SWFVerify))
+		if c.SWFVerify {
+			RTMPPlugin.Error("swfverify disabled: no valid swfhash")
+			c.SWFVerify = false
+		}
+	}
+}
+
+// swfVerifyResponse 根据配置的SWF哈希和大小计算校验响应
+func swfVerifyResponse(serverSig []byte) ([]byte, error) {
+	hash, err := hex.DecodeString(conf.SWFHash)
+	if err != nil || len(hash) != 32 {
+		return nil, errors.New("invalid swf hash")
+	}
+	if len(serverSig) != 32 {
+		return nil, errors.New("no handshake signature")
+	}
+	digest, err := HMAC_SHA256(hash, serverSig)
+	if err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 10, 42)
+	resp[0], resp[1] = 1, 1
+	binary.BigEndian.PutUint32(resp[2:], conf.SWFSize)
+	binary.BigEndian.PutUint32(resp[6:], conf.SWFSize)
+	return append(resp, digest...), nil
+}
+
+// handleSWFVerify 客户端收到校验请求时回复，服务端收到校验响应时与配置的SWF哈希比较
+func (conn *NetConnection) handleSWFVerify(m *UserControlMessage) error {
+	switch m.EventType {
+	case RTMP_USER_SWF_VERIFY_REQUEST:
+		if conf.SWFHash == "" {
+			return nil
+		}
+		resp, err := swfVerifyResponse(conn.serverSig)
+		if err != nil {
+			RTMPPlugin.Warn("swf verify", zap.Error(err))
+			return nil
+		}
+		return conn.SendMessage(RTMP_MSG_USER_CONTROL, &SWFVerifyMessage{UserControlMessage{RTMP_USER_SWF_VERIFY_RESPONSE, resp}})
+	case RTMP_USER_SWF_VERIFY_RESPONSE:
+		if !conf.SWFVerify {
+			return nil
+		}
+		expected, err := swfVerifyResponse(conn.serverSig)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(m.EventData, expected) {
+			RTMPPlugin.Warn("swf verification failed", zap.String("remote", conn.RemoteAddr().String()))
+			return errors.New("swf verification failed")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package rtmp
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// TCPStats 从内核读取的TCP连接统计信息，用于区分网络问题和编码器问题
+type TCPStats struct {
+	RTT         time.Duration
+	RTTVar      time.Duration
+	Retransmits uint32 // 累计重传的报文数
+	Lost        uint32
+	Cwnd        uint32 // 拥塞窗口(报文数)
+	SendMSS     uint32
+	UpdateTime  time.Time
+}
+
+// pollTCPInfo 定期读取连接的TCP_INFO，直到ctx结束
+func (nc *NetConnection) pollTCPInfo(ctx context.Context, conn net.Conn) {
+	if conf.TCPInfoInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(conf.TCPInfoInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stats, err := readTCPInfo(conn)
+			if err != nil {
+				return
+			}
+			nc.tcpStats.Store(stats)
+		}
+	}
+}
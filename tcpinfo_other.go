@@ -0,0 +1,12 @@
+//go:build !linux || 386
+
+package rtmp
+
+import (
+	"errors"
+	"net"
+)
+
+func readTCPInfo(conn net.Conn) (*TCPStats, error) {
+	return nil, errors.New("TCP_INFO not supported")
+}
@@ -0,0 +1,121 @@
+package rtmp
+
+import (
+	"sync/atomic"
+)
+
+// 携带时间码的数据消息
+const (
+	DataTimeCoordinates = "onTimeCoordinates"
+	DataFI              = "onFI" // Adobe编码器发送的时间码和日期，tc字段为hh:mm:ss:ff
+)
+
+// timecodeKeys 数据消息的对象中可能表示SMPTE时间码的字段
+var timecodeKeys = []string{"timecode", "timeCode", "smpteTimecode", "smpte", "tc"}
+
+// Timecode 发布者提供的时间码，用于下游逐帧对齐
+type Timecode struct {
+	Source    string // 数据消息名称，来自onMetaData中的字段时为onMetaData
+	Timecode  string `json:",omitempty"` // SMPTE时间码，例如01:00:00:00
+	Timestamp uint32 // 数据消息的时间戳
+	values    []any  // 原始的数据，转发时原样发送
+	version   uint32 // 在发布者时间码中的序号，用于在队列中确认没有被覆盖
+}
+
+// TimecodeEvent 收到发布者提供的时间码
+type TimecodeEvent struct {
+	StreamPath string
+	Timecode
+	Labels map[string]string `json:",omitempty"`
+}
+
+// timecodeQueueSize 两帧之间可以逐个转发的时间码数量，订阅者落后更多时丢弃最早的
+const timecodeQueueSize = 64
+
+// timecodeCache 缓存发布者最新的时间码，版本号用于让订阅者发现更新
+type timecodeCache struct {
+	timecode        atomic.Pointer[Timecode]
+	timecodeVersion atomic.Uint32
+	timecodeQueue   [timecodeQueueSize]atomic.Pointer[Timecode] // 以版本号取模保存最近的时间码，订阅者按顺序全部转发
+}
+
+// timecodeSender 已经转发的发布者时间码版本
+type timecodeSender struct {
+	sentTimecodeVersion uint32
+}
+
+// timecodeOf 在数据消息的对象中查找时间码字段
+func timecodeOf(values []any) string {
+	for _, v := range values {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+		for _, key := range timecodeKeys {
+			if tc, ok := obj[key].(string); ok && tc != "" {
+				return tc
+			}
+		}
+	}
+	return ""
+}
+
+// receiveTimecode 记录onTimeCoordinates、onFI以及onMetaData中的时间码
+func (r *RTMPReceiver) receiveTimecode(m *DataMessage, timestamp uint32) {
+	tc := timecodeOf(m.Values)
+	switch m.Name {
+	case DataTimeCoordinates, DataFI:
+	case "onMetaData":
+		if tc == "" {
+			return
+		}
+	default:
+		return
+	}
+	version := r.timecodeVersion.Load() + 1
+	timecode := &Timecode{Source: m.Name, Timecode: tc, Timestamp: timestamp, values: m.Values, version: version}
+	r.timecode.Store(timecode)
+	// 先放入队列再更新版本号，订阅者看到新版本时一定能取到
+	r.timecodeQueue[version%timecodeQueueSize].Store(timecode)
+	r.timecodeVersion.Store(version)
+	event := TimecodeEvent{Timecode: *timecode, Labels: r.Labels()}
+	if r.Stream != nil {
+		event.StreamPath = r.Stream.Path
+	}
+	emitEvent(event)
+}
+
+// Timecode 发布者最新的时间码，没有收到时返回nil
+func (r *RTMPReceiver) Timecode() *Timecode {
+	return r.timecode.Load()
+}
+
+// forwardTimecode 发布者的时间码数据消息有更新时在下一帧之前按顺序原样转发（两帧之间有多个时也逐个转发），onMetaData中的时间码随onMetaData转发
+func (rtmp *RTMPSender) forwardTimecode() {
+	if rtmp.Stream == nil {
+		return
+	}
+	p, ok := rtmp.Stream.Publisher.(IRTMPReceiver)
+	if !ok {
+		return
+	}
+	receiver := p.GetReceiver()
+	version := receiver.timecodeVersion.Load()
+	if version == rtmp.sentTimecodeVersion {
+		return
+	}
+	// 刚开始播放时不转发之前的时间码，避免与之后的帧错位
+	sent := rtmp.sentTimecodeVersion
+	rtmp.sentTimecodeVersion = version
+	if sent == 0 {
+		return
+	}
+	if version-sent > timecodeQueueSize {
+		sent = version - timecodeQueueSize
+	}
+	for v := sent + 1; v != version+1; v++ {
+		if timecode := receiver.timecodeQueue[v%timecodeQueueSize].Load(); timecode != nil && timecode.version == v && timecode.Source != "onMetaData" {
+			rtmp.sendDataMessage(timecode.Source, timecode.values...)
+		}
+	}
+}
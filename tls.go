@@ -0,0 +1,68 @@
+package rtmp
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// isTLS 判断连接开头是否是TLS握手记录（ClientHello）
+func isTLS(head []byte) bool {
+	return head[0] == 0x16 && (len(head) < 2 || head[1] == 0x03)
+}
+
+// tlsCert 当前的证书，配置热更新时替换，只影响之后的TLS握手
+var tlsCert atomic.Pointer[tls.Certificate]
+
+var tlsOnce sync.Once
+
+// enableTLS 加载证书并在rtmp端口上识别TLS连接，使rtmp://和rtmps://可以共用同一个端口
+func (config *RTMPConfig) enableTLS() {
+	if config.TLSCertFile == "" || config.TLSKeyFile == "" {
+		return
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		RTMPPlugin.Error("load tls certificate", zap.Error(err))
+		return
+	}
+	if tlsCert.Swap(&cert) != nil {
+		RTMPPlugin.Info("tls certificate reloaded")
+	}
+	tlsOnce.Do(config.registerTLS)
+}
+
+func (config *RTMPConfig) registerTLS() {
+	tlsConfig := &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return tlsCert.Load(), nil
+		},
+	}
+	RegisterProtocol(ProtocolHandler{
+		Name:    "rtmps",
+		Match:   isTLS,
+		HeadLen: 2,
+		Handle: func(conn net.Conn) {
+			tlsConn := tls.Server(conn, tlsConfig)
+			defer tlsConn.Close()
+			if config.HandshakeTimeout > 0 {
+				conn.SetReadDeadline(time.Now().Add(config.HandshakeTimeout))
+			}
+			if err := tlsConn.Handshake(); err != nil {
+				handshakeFailures.add(HandshakeTLS)
+				RTMPPlugin.Warn("tls handshake", zap.String("remote", conn.RemoteAddr().String()), zap.Error(err))
+				return
+			}
+			tcpConn := conn
+			if c, ok := conn.(*sniffedConn); ok {
+				tcpConn = c.Conn
+			}
+			config.serve(NewNetConnection(tlsConn), tcpConn)
+		},
+	})
+	RTMPPlugin.Info("rtmps enabled on rtmp port")
+}
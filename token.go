@@ -0,0 +1,104 @@
+package rtmp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 一次性推流令牌：通过接口为某个流生成令牌，推流地址带上?token=，校验通过后令牌立即作废，泄露的推流地址无法再次使用
+type publishToken struct {
+	StreamPath string
+	Expire     time.Time
+}
+
+var publishTokens struct {
+	sync.Mutex
+	m map[string]publishToken // token -> 绑定的流和过期时间
+}
+
+// checkPublishToken 校验推流地址中的一次性令牌，未开启PublishToken时不校验。
+// 校验失败时令牌作废，避免被用来猜测绑定的流；校验通过的令牌在发布成功之后由burnToken作废
+func checkPublishToken(fullPath string) error {
+	if !conf.PublishToken {
+		return nil
+	}
+	streamPath, rawQuery, _ := strings.Cut(fullPath, "?")
+	args, _ := url.ParseQuery(rawQuery)
+	token := args.Get("token")
+	if token == "" {
+		return errors.New("missing token")
+	}
+	publishTokens.Lock()
+	defer publishTokens.Unlock()
+	t, ok := publishTokens.m[token]
+	if !ok {
+		return errors.New("invalid token")
+	}
+	if time.Now().After(t.Expire) {
+		delete(publishTokens.m, token)
+		return errors.New("token expired")
+	}
+	if t.StreamPath != streamPath {
+		delete(publishTokens.m, token)
+		return errors.New("token not for this stream")
+	}
+	return nil
+}
+
+// burnToken 发布成功之后作废推流地址中的一次性令牌，令牌已经被同时进行的其他推流使用时返回错误
+func burnToken(fullPath string) error {
+	if !conf.PublishToken {
+		return nil
+	}
+	_, rawQuery, _ := strings.Cut(fullPath, "?")
+	args, _ := url.ParseQuery(rawQuery)
+	token := args.Get("token")
+	publishTokens.Lock()
+	defer publishTokens.Unlock()
+	if _, ok := publishTokens.m[token]; !ok {
+		return errors.New("token already used")
+	}
+	delete(publishTokens.m, token)
+	return nil
+}
+
+// API_token 生成绑定到streamPath的一次性推流令牌，带revoke参数时作废该令牌
+func (*RTMPConfig) API_token(rw http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	publishTokens.Lock()
+	defer publishTokens.Unlock()
+	if token := q.Get("revoke"); token != "" {
+		delete(publishTokens.m, token)
+		rw.Write([]byte("ok"))
+		return
+	}
+	streamPath := q.Get("streamPath")
+	if streamPath == "" {
+		http.Error(rw, "streamPath required", http.StatusBadRequest)
+		return
+	}
+	ttl, err := time.ParseDuration(q.Get("ttl"))
+	if err != nil {
+		ttl = time.Minute * 5
+	}
+	now := time.Now()
+	if publishTokens.m == nil {
+		publishTokens.m = make(map[string]publishToken)
+	}
+	for token, t := range publishTokens.m {
+		if now.After(t.Expire) {
+			delete(publishTokens.m, token)
+		}
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	publishTokens.m[token] = publishToken{streamPath, now.Add(ttl)}
+	rw.Write([]byte(token))
+}
@@ -0,0 +1,61 @@
+package rtmp
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// PushURLData 推流地址模板中可以使用的字段
+type PushURLData struct {
+	StreamPath string // 本地的streamPath，例如 live/test
+	AppName    string // streamPath中第一个/之前的部分
+	StreamName string // streamPath中第一个/之后的部分
+}
+
+// PushURLTransform 推流前对远端地址进行转换，例如修改appName、追加token等，为nil时不转换
+var PushURLTransform func(streamPath string, remoteURL string) (string, error)
+
+var pushURLFuncs = template.FuncMap{
+	"md5": func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	},
+	"sha256": func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	},
+	"hmac": func(key, s string) string {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(s))
+		return hex.EncodeToString(mac.Sum(nil))
+	},
+	"unix": func() int64 {
+		return time.Now().Unix()
+	},
+}
+
+// transformPushURL 远端地址中包含{{时作为模板渲染，之后再交给PushURLTransform处理
+func transformPushURL(streamPath, remoteURL string) (string, error) {
+	if strings.Contains(remoteURL, "{{") {
+		t, err := template.New("push").Funcs(pushURLFuncs).Parse(remoteURL)
+		if err != nil {
+			return "", err
+		}
+		data := PushURLData{StreamPath: streamPath}
+		data.AppName, data.StreamName, _ = strings.Cut(streamPath, "/")
+		var sb strings.Builder
+		if err = t.Execute(&sb, data); err != nil {
+			return "", err
+		}
+		remoteURL = sb.String()
+	}
+	if PushURLTransform != nil {
+		return PushURLTransform(streamPath, remoteURL)
+	}
+	return remoteURL, nil
+}